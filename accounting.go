@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// pmonDeviceFields are the device-wide readings standing in for each
+// per-process utilization value on GPUs without accounting mode, with
+// -onNoAccounting aggressive.
+var pmonDeviceFields = map[string]string{
+	"sm_util":  "utilization.gpu",
+	"mem_util": "utilization.memory",
+	"enc_util": "utilization.encoder",
+	"dec_util": "utilization.decoder",
+}
+
+// gpuAccounting is a GPU's accounting mode along with its device-wide
+// utilization readings, by per-process field name.
+type gpuAccounting struct {
+	Enabled bool
+	Device  map[string]float64
+}
+
+// queryAccounting returns the accounting mode of each GPU by UUID, leaving out
+// GPUs that don't report one, such as MIG devices.
+func queryAccounting() (map[string]gpuAccounting, error) {
+	fields := []string{"uuid", "accounting.mode"}
+	var names []string
+	for _, f := range pmonFields {
+		if field := pmonDeviceFields[f.Name]; smiCaps.supports(queryField{Field: field, GPU: true}) {
+			fields, names = append(fields, field), append(names, f.Name)
+		}
+	}
+	out, err := runSMI("--query-gpu="+strings.Join(fields, ","), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseSMICSV(out, len(fields))
+	if err != nil {
+		return nil, err
+	}
+
+	gpus := make(map[string]gpuAccounting, len(records))
+	for _, record := range records {
+		var gpu gpuAccounting
+		switch record[1] {
+		case "Enabled":
+			gpu.Enabled = true
+		case "Disabled":
+		default:
+			continue
+		}
+		gpu.Device = make(map[string]float64, len(names))
+		for i, name := range names {
+			if v, err := strconv.ParseFloat(record[i+2], 64); err == nil {
+				gpu.Device[name] = v
+			}
+		}
+		gpus[record[0]] = gpu
+	}
+	return gpus, nil
+}
+
+// handleNoAccounting applies -onNoAccounting to the processes on GPUs with
+// accounting mode disabled, whose per-process utilization can't be told apart
+// from an idle process holding memory. Conservatively their utilization values
+// are dropped, so utilization based rules can't judge them idle; aggressively
+// they're replaced with the GPU's device-wide utilization. The behaviour is
+// logged for each GPU as its accounting mode is first seen disabled.
+func (m *monitor) handleNoAccounting(processes []gpuProcess) {
+	if !smiCaps.supports(queryField{Field: "accounting.mode", GPU: true}) {
+		return
+	}
+	gpus, err := queryAccounting()
+	if err != nil {
+		if !m.accountingFailed {
+			m.logger.Printf("Failed to query the GPUs' accounting mode, using per-process utilization as reported: %v\n", err)
+			m.accountingFailed = true
+		}
+		return
+	}
+	m.accountingFailed = false
+
+	for uuid, gpu := range gpus {
+		switch {
+		case !gpu.Enabled && !m.noAccounting[uuid] && m.cfg.OnNoAccounting == "aggressive":
+			m.logger.Printf("GPU %s has accounting mode disabled, so its per-process utilization is replaced with device-wide utilization (-onNoAccounting aggressive).\n", uuid)
+		case !gpu.Enabled && !m.noAccounting[uuid]:
+			m.logger.Printf("GPU %s has accounting mode disabled, so its per-process utilization is ignored and utilization can't mark its processes idle (-onNoAccounting conservative).\n", uuid)
+		case gpu.Enabled && m.noAccounting[uuid]:
+			m.logger.Printf("GPU %s has accounting mode enabled again, using its per-process utilization.\n", uuid)
+		}
+		m.noAccounting[uuid] = !gpu.Enabled
+	}
+
+	for _, p := range processes {
+		gpu, ok := gpus[p.GPUUUID]
+		if !ok || gpu.Enabled {
+			continue
+		}
+		for _, f := range pmonFields {
+			delete(p.Values, f.Name)
+			if v, ok := gpu.Device[f.Name]; ok && m.cfg.OnNoAccounting == "aggressive" {
+				p.Values[f.Name] = v
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// activityPath is an -activityPaths entry: a glob of checkpoint or output files
+// whose modification shows a process is still working, for the processes of
+// one target workload or, without a target, all of them.
+type activityPath struct {
+	Target string
+	Glob   string
+}
+
+// parseActivityPaths parses the -activityPaths flag, comma-separated
+// [<target>=]<glob> entries, e.g. python=/data/checkpoints/*.
+func parseActivityPaths(spec string) ([]activityPath, error) {
+	var paths []activityPath
+	for _, entry := range splitList(spec) {
+		var p activityPath
+		if target, glob, ok := strings.Cut(entry, "="); ok {
+			p.Target, p.Glob = strings.TrimSpace(target), strings.TrimSpace(glob)
+		} else {
+			p.Glob = entry
+		}
+		if p.Glob == "" {
+			return nil, fmt.Errorf("missing glob in %q", entry)
+		}
+		if _, err := filepath.Match(p.Glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob in %q: %v", entry, err)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// activityClassifier judges a process active while any file matching its
+// -activityPaths has been modified recently, so a job that's idle on the GPU
+// while writing a checkpoint isn't killed mid-write. Matching directories count
+// by the newest file within them. The glob's {pid} is replaced by the
+// process's PID.
+type activityClassifier struct {
+	paths  []activityPath
+	maxAge time.Duration
+	clock  clock
+}
+
+func (a activityClassifier) name() string {
+	return "activity"
+}
+
+func (a activityClassifier) classify(p gpuProcess) (idleVerdict, string, error) {
+	comm, err := processComm(p.PID)
+	if err != nil {
+		return verdictUnknown, "", fmt.Errorf("failed to get the process name: %v", err)
+	}
+	name := fullProcessName(p.PID, comm)
+
+	var newest time.Time
+	var newestPath string
+	var globs []string
+	for _, path := range a.paths {
+		if path.Target != "" && !matchesName([]string{path.Target}, name) {
+			continue
+		}
+		pattern := strings.ReplaceAll(path.Glob, "{pid}", strconv.Itoa(p.PID))
+		globs = append(globs, pattern)
+		for _, match := range globProcess(p.PID, pattern) {
+			filepath.WalkDir(match, func(file string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return nil
+				}
+				if info, err := d.Info(); err == nil && info.ModTime().After(newest) {
+					newest, newestPath = info.ModTime(), file
+				}
+				return nil
+			})
+		}
+	}
+
+	switch {
+	case len(globs) == 0:
+		return verdictUnknown, fmt.Sprintf("No -activityPaths apply to %s.", name), nil
+	case newestPath == "":
+		return verdictUnknown, fmt.Sprintf("No files match %s.", strings.Join(globs, ", ")), nil
+	}
+	age := a.clock.Now().Sub(newest).Truncate(time.Second)
+	if age > a.maxAge {
+		return verdictUnknown, fmt.Sprintf("The most recent activity was %s, modified at %s, %v ago, over %v.", newestPath, newest.Format(time.RFC3339), age, a.maxAge), nil
+	}
+	return verdictActive, fmt.Sprintf("The most recent activity was %s, modified at %s, %v ago.", newestPath, newest.Format(time.RFC3339), age), nil
+}
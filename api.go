@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// runtimeConfig is the part of the configuration that can be read and changed
+// through the API while running: the thresholds and what's targeted. Fields
+// left out of a PUT are unchanged.
+type runtimeConfig struct {
+	IdleTimeThreshold      *int      `json:"idleTimeThreshold,omitempty"`
+	MaxRuntime             *int      `json:"maxRuntime,omitempty"`
+	ConfirmCycles          *int      `json:"confirmCycles,omitempty"`
+	MaxPeakMB              *int      `json:"maxPeakMB,omitempty"`
+	MinReclaimableMB       *int      `json:"minReclaimableMB,omitempty"`
+	TempThreshold          *int      `json:"tempThreshold,omitempty"`
+	LeakedContextThreshold *int      `json:"leakedContextThreshold,omitempty"`
+	WarningOnly            *bool     `json:"warningOnly,omitempty"`
+	TargetWorkloads        *[]string `json:"targetWorkloads,omitempty"`
+	Whitelist              *[]string `json:"whitelist,omitempty"`
+}
+
+func runtimeConfigOf(cfg Config) runtimeConfig {
+	return runtimeConfig{
+		IdleTimeThreshold:      &cfg.IdleTimeThreshold,
+		MaxRuntime:             &cfg.MaxRuntime,
+		ConfirmCycles:          &cfg.ConfirmCycles,
+		MaxPeakMB:              &cfg.MaxPeakMB,
+		MinReclaimableMB:       &cfg.MinReclaimableMB,
+		TempThreshold:          &cfg.TempThreshold,
+		LeakedContextThreshold: &cfg.LeakedContextThreshold,
+		WarningOnly:            &cfg.WarningOnly,
+		TargetWorkloads:        &cfg.TargetWorkloads,
+		Whitelist:              &cfg.Whitelist,
+	}
+}
+
+// over returns cfg with the fields set in the update applied over it.
+func (u runtimeConfig) over(cfg Config) Config {
+	setInt := func(field *int, value *int) {
+		if value != nil {
+			*field = *value
+		}
+	}
+	setInt(&cfg.IdleTimeThreshold, u.IdleTimeThreshold)
+	setInt(&cfg.MaxRuntime, u.MaxRuntime)
+	setInt(&cfg.ConfirmCycles, u.ConfirmCycles)
+	setInt(&cfg.MaxPeakMB, u.MaxPeakMB)
+	setInt(&cfg.MinReclaimableMB, u.MinReclaimableMB)
+	setInt(&cfg.TempThreshold, u.TempThreshold)
+	setInt(&cfg.LeakedContextThreshold, u.LeakedContextThreshold)
+	if u.WarningOnly != nil {
+		cfg.WarningOnly = *u.WarningOnly
+	}
+	if u.TargetWorkloads != nil {
+		cfg.TargetWorkloads = *u.TargetWorkloads
+	}
+	if u.Whitelist != nil {
+		cfg.Whitelist = *u.Whitelist
+	}
+	return cfg
+}
+
+// merge adds the fields set in a later update, which take precedence.
+func (u runtimeConfig) merge(later runtimeConfig) runtimeConfig {
+	setInt := func(field **int, value *int) {
+		if value != nil {
+			*field = value
+		}
+	}
+	setInt(&u.IdleTimeThreshold, later.IdleTimeThreshold)
+	setInt(&u.MaxRuntime, later.MaxRuntime)
+	setInt(&u.ConfirmCycles, later.ConfirmCycles)
+	setInt(&u.MaxPeakMB, later.MaxPeakMB)
+	setInt(&u.MinReclaimableMB, later.MinReclaimableMB)
+	setInt(&u.TempThreshold, later.TempThreshold)
+	setInt(&u.LeakedContextThreshold, later.LeakedContextThreshold)
+	if later.WarningOnly != nil {
+		u.WarningOnly = later.WarningOnly
+	}
+	if later.TargetWorkloads != nil {
+		u.TargetWorkloads = later.TargetWorkloads
+	}
+	if later.Whitelist != nil {
+		u.Whitelist = later.Whitelist
+	}
+	return u
+}
+
+// persist writes the fields set in the update to the config file at path for
+// -apiPersist, keeping the file's other settings and its permissions.
+func (u runtimeConfig) persist(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	changed, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(changed, &settings); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFileMode(path, append(data, '\n'), info.Mode().Perm())
+}
+
+// apiServer serves the HTTP API for a monitor.
+type apiServer struct {
+	m     *monitor
+	token string
+}
+
+// startAPI listens on addr and serves the API in the background. Without a
+// token the configuration can be read but not changed.
+func startAPI(addr, token string, m *monitor) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	a := &apiServer{m: m, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", a.handleConfig)
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/preview", a.handlePreview)
+	mux.HandleFunc("/whatif", a.handleWhatIf)
+	mux.HandleFunc("/events", a.handleEvents)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			m.logger.Printf("API server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+func (a *apiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.m.mu.Lock()
+		cfg := a.m.cfg
+		a.m.mu.Unlock()
+		writeJSON(w, http.StatusOK, runtimeConfigOf(cfg))
+
+	case http.MethodPut:
+		if !a.authorized(r) {
+			writeError(w, http.StatusUnauthorized, "a valid bearer token is required to change the configuration")
+			return
+		}
+		var update runtimeConfig
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+
+		a.m.mu.Lock()
+		cfg := update.over(a.m.cfg)
+		err := a.m.apply(cfg)
+		var persistErr error
+		if err == nil {
+			// Kept so that reloading the config file doesn't undo the change,
+			// and with -apiPersist restarting doesn't either
+			a.m.apiOverrides = a.m.apiOverrides.merge(update)
+			if cfg.APIPersist {
+				persistErr = a.m.apiOverrides.persist(cfg.ConfigFile)
+			}
+		}
+		a.m.mu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		changes, _ := json.Marshal(update)
+		a.m.logger.Printf("Configuration changed via the API from %s: %s\n", r.RemoteAddr, changes)
+		if persistErr != nil {
+			a.m.logger.Printf("Failed to write the configuration changed via the API to %s, it will be lost on restart: %v\n", cfg.ConfigFile, persistErr)
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("the change was applied, but couldn't be written to %s: %v", cfg.ConfigFile, persistErr))
+			return
+		}
+		writeJSON(w, http.StatusOK, runtimeConfigOf(cfg))
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// status is the monitor's current state, as returned by GET /status.
+type status struct {
+	Degraded         bool             `json:"degraded"` // only warning after failed scans
+	Processes        []processMemory  `json:"processes"`
+	Temperatures     []gpuTemperature `json:"temperatures,omitempty"`
+	Clocks           []gpuClockState  `json:"clocks,omitempty"` // with -monitorGpuHealth
+	Whitelist        map[string]int   `json:"whitelist"`        // matches of each -whitelist entry
+	ScanLatency      latencyStats     `json:"scanLatency"`
+	PermissionErrors int              `json:"permissionErrors"`         // signals nvidler wasn't permitted to send since startup
+	Quarantined      []int            `json:"quarantined"`              // PIDs quarantined by -quarantineAction
+	LeakedContexts   []leakedContext  `json:"leakedContexts,omitempty"` // with -leakedContextThreshold
+	Shadow           *shadowStats     `json:"shadow,omitempty"`         // with -shadowConfig
+	Self             selfStats        `json:"self"`
+}
+
+func (a *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	a.m.mu.Lock()
+	s := status{Degraded: a.m.failSafe.Degraded, Processes: a.m.peaks.list(), Whitelist: a.m.whitelistUsage.counts(a.m.cfg.Whitelist), ScanLatency: a.m.latency.stats(), PermissionErrors: a.m.permissionErrors, Quarantined: a.m.quarantined.list(), Self: a.m.readSelfStats()}
+	if a.m.cfg.TempThreshold > 0 {
+		s.Temperatures = a.m.thermal.readings()
+	}
+	if a.m.cfg.MonitorGPUHealth {
+		s.Clocks = a.m.health.clockStates()
+	}
+	if a.m.cfg.LeakedContextThreshold > 0 {
+		s.LeakedContexts = a.m.leakedContexts()
+	}
+	if a.m.shadow != nil {
+		stats := a.m.shadow.stats
+		s.Shadow = &stats
+	}
+	a.m.mu.Unlock()
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *apiServer) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	a.m.mu.Lock()
+	entries, err := a.m.preview()
+	a.m.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleWhatIf reports which processes would be acted on at each of the
+// thresholds in seconds given by the thresholds query parameter, the same as
+// -whatIf.
+func (a *apiServer) handleWhatIf(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	thresholds, err := parseThresholds(r.URL.Query().Get("thresholds"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid thresholds: "+err.Error())
+		return
+	}
+
+	a.m.mu.Lock()
+	results, err := a.m.whatIf(thresholds)
+	a.m.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handleEvents streams events as they're emitted, as JSON one per line, until
+// the client disconnects. A client that doesn't keep up loses events by
+// -eventOverflow rather than holding up the monitor. As events name users and
+// processes, the stream needs the API token when there is one, and without one
+// leaves out the details, such as captured command lines.
+func (a *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if a.token != "" && !a.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "a valid bearer token is required to stream events")
+		return
+	}
+	withDetails := a.token != ""
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+
+	a.m.mu.Lock()
+	buffer, overflow := a.m.cfg.EventBuffer, a.m.cfg.EventOverflow
+	a.m.mu.Unlock()
+	sub := a.m.events.subscribe(buffer, overflow)
+	defer a.m.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			if dropped := sub.droppedEvents(); dropped > 0 {
+				a.m.logger.Printf("API: %s dropped %d events from GET /events, by -eventOverflow %s.\n", r.RemoteAddr, dropped, overflow)
+			}
+			return
+		case e := <-sub.events:
+			if !withDetails {
+				e.Details = nil
+			}
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// authorized reports whether a request carries the API token.
+func (a *apiServer) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
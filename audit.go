@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	auditBatchSize     = 100             // rows written to the audit database at once
+	auditFlushInterval = 5 * time.Second // longest a row waits before being written
+	auditQueueSize     = 10000           // rows held while the database is slow
+)
+
+// auditSchema creates the audit table, indexed for looking up actions by time
+// and by user.
+const auditSchema = `CREATE TABLE IF NOT EXISTS actions (
+	id INTEGER PRIMARY KEY,
+	timestamp TEXT NOT NULL,
+	host TEXT NOT NULL,
+	pid INTEGER,
+	user TEXT,
+	container TEXT,
+	gpu TEXT,
+	memory INTEGER,
+	idle_seconds INTEGER,
+	action TEXT NOT NULL,
+	result TEXT NOT NULL,
+	message TEXT
+);
+CREATE INDEX IF NOT EXISTS actions_timestamp ON actions (timestamp);
+CREATE INDEX IF NOT EXISTS actions_user ON actions (user, timestamp);
+`
+
+// auditSink records every warning, termination and error, and whether each
+// termination took effect, as a row of a SQLite database for -auditDb, giving a
+// queryable history of who was acted on, why and with what result. Rows are
+// written in batches in the background by the sqlite3 command, so a slow disk
+// never holds up a scan, and flushed before nvidler exits.
+type auditSink struct {
+	path    string
+	host    string
+	rows    chan event
+	flushes chan chan struct{} // closed once everything queued is written
+	logger  *log.Logger
+}
+
+// newAuditSink creates the database at path if needed and starts writing rows
+// to it.
+func newAuditSink(path string, logger *log.Logger) (*auditSink, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, errors.New("the sqlite3 command is required")
+	}
+	host, _ := os.Hostname()
+	a := &auditSink{path: path, host: host, rows: make(chan event, auditQueueSize), flushes: make(chan chan struct{}), logger: logger}
+	if err := a.exec(auditSchema); err != nil {
+		return nil, err
+	}
+	go a.run()
+	return a, nil
+}
+
+func (a *auditSink) send(e event) error {
+	switch e.Action {
+	case actionWarn, actionTerminate, actionQuarantine, actionRelease, actionError:
+	case actionReport:
+		if e.Report == nil || len(e.Report.Verified) == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	select {
+	case a.rows <- e:
+		return nil
+	default:
+		return errors.New("audit queue is full, dropping the row")
+	}
+}
+
+// run writes queued rows in batches, once enough have built up, they've
+// waited for the flush interval or they're flushed.
+func (a *auditSink) run() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	var batch []event
+	for {
+		var flushed chan struct{}
+		select {
+		case e := <-a.rows:
+			if batch = append(batch, e); len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case flushed = <-a.flushes:
+			for len(a.rows) > 0 {
+				batch = append(batch, <-a.rows)
+			}
+		}
+		if len(batch) > 0 {
+			if err := a.write(batch); err != nil {
+				a.logger.Printf("Failed to write %d row(s) to the audit database %s: %v\n", len(batch), a.path, err)
+			}
+		}
+		batch = nil
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+// flush writes every row queued so far and waits until they're written, for
+// when nvidler is about to exit. Rows can still be sent afterwards.
+func (a *auditSink) flush() {
+	flushed := make(chan struct{})
+	a.flushes <- flushed
+	<-flushed
+}
+
+// auditActionVerify is the action of a row recording whether a process
+// terminated on the scan before is gone.
+const auditActionVerify = "verify"
+
+// write inserts a batch of rows in a single transaction. A report adds a
+// verify row for each process it checked on.
+func (a *auditSink) write(batch []event) error {
+	var sql strings.Builder
+	sql.WriteString("BEGIN;\n")
+	insert := func(e event, action, result string) {
+		fmt.Fprintf(&sql, "INSERT INTO actions (timestamp, host, pid, user, container, gpu, memory, idle_seconds, action, result, message) VALUES (%s, %s, %d, %s, %s, %s, %d, %d, %s, %s, %s);\n",
+			sqlText(e.Time.UTC().Format(time.RFC3339)), sqlText(a.host), e.PID, sqlText(e.User), sqlText(e.Container), sqlText(e.GPU), e.Memory, e.IdleSeconds, sqlText(action), sqlText(result), sqlText(e.Message))
+	}
+	for _, e := range batch {
+		if e.Action != actionReport {
+			insert(e, e.Action, auditResult(e))
+			continue
+		}
+		for _, o := range e.Report.Verified {
+			message := fmt.Sprintf("Verified: PID %d (%s) is gone since it was terminated.", o.PID, o.Process)
+			if o.Outcome != outcomeGone {
+				message = fmt.Sprintf("Verification failed: PID %d (%s) is still running a scan after it was terminated.", o.PID, o.Process)
+			}
+			insert(event{Time: e.Time, PID: o.PID, Container: o.Container, GPU: o.GPU, Message: message}, auditActionVerify, o.Outcome)
+		}
+	}
+	sql.WriteString("COMMIT;\n")
+	return a.exec(sql.String())
+}
+
+// auditResult is what came of an action, for the result column: the outcome of
+// a termination or failure to terminate as in termination reports, or what was
+// done otherwise.
+func auditResult(e event) string {
+	if e.Outcome != "" {
+		return e.Outcome
+	}
+	switch e.Action {
+	case actionWarn:
+		return "warned"
+	case actionTerminate:
+		return outcomeSent
+	case actionQuarantine:
+		return "quarantined"
+	case actionRelease:
+		return "released"
+	default:
+		return outcomeFailed
+	}
+}
+
+// exec runs SQL against the database with the sqlite3 command, waiting a while
+// for any reader holding a lock.
+func (a *auditSink) exec(sql string) error {
+	cmd := exec.Command("sqlite3", "-bail", "-cmd", ".timeout 5000", a.path)
+	cmd.Stdin = strings.NewReader(sql)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sqlText quotes a string as an SQL literal.
+func sqlText(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
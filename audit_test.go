@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditRecordsOutcomes(t *testing.T) {
+	e := newTestEnv(t)
+	// sqlite3 records the SQL it's given instead of running it
+	e.writeScript(filepath.Join(e.dir, "bin", "sqlite3"), `cat >> `+filepath.Join(e.dir, "sql"))
+	a := &auditSink{path: filepath.Join(e.dir, "audit.db"), host: "node1"}
+
+	batch := []event{
+		{Time: testEpoch, Action: actionWarn, PID: 1001, Message: "WARNING: idle"},
+		{Time: testEpoch, Action: actionTerminate, PID: 1002, Outcome: outcomeEscalated, Message: "Terminated: it's idle"},
+		{Time: testEpoch, Action: actionError, PID: 1003, Outcome: outcomeNotPermitted, Message: "Not permitted"},
+		{Time: testEpoch, Action: actionReport, Report: &sweepReport{Verified: []killOutcome{
+			{PID: 1004, Process: "python", Outcome: outcomeGone},
+			{PID: 1005, Process: "python", Outcome: outcomeStillRunning},
+		}}},
+	}
+	if err := a.write(batch); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var rows []string
+	for _, line := range e.readLines("sql") {
+		if strings.HasPrefix(line, "INSERT") {
+			rows = append(rows, line)
+		}
+	}
+	want := []string{
+		"1001, '', '', '', 0, 0, 'warn', 'warned', 'WARNING: idle'",
+		"1002, '', '', '', 0, 0, 'terminate', 'escalated', 'Terminated: it''s idle'",
+		"1003, '', '', '', 0, 0, 'error', 'notPermitted', 'Not permitted'",
+		"1004, '', '', '', 0, 0, 'verify', 'gone', 'Verified: PID 1004 (python) is gone",
+		"1005, '', '', '', 0, 0, 'verify', 'stillRunning', 'Verification failed: PID 1005 (python)",
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("inserted %d rows, want %d:\n%s", len(rows), len(want), strings.Join(rows, "\n"))
+	}
+	for i := range want {
+		if !strings.Contains(rows[i], want[i]) {
+			t.Errorf("row %d = %s, want values %s", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestTerminationEventsCarryOutcome(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.SignalLadder = "USR1@0s,TERM@30s"
+	m := e.monitor(cfg)
+
+	m.scan()
+	e.clock.Sleep(30 * time.Second)
+	m.scan()
+	var outcomes []string
+	for _, ev := range e.events {
+		if ev.Action == actionTerminate {
+			outcomes = append(outcomes, ev.Outcome)
+		}
+	}
+	if want := []string{outcomeSent, outcomeEscalated}; !equalStrings(outcomes, want) {
+		t.Fatalf("termination outcomes = %v, want %v", outcomes, want)
+	}
+}
+
+func TestOnceFlushesAuditDB(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("the sqlite3 command isn't installed")
+	}
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.Once = true
+	cfg.AuditDB = filepath.Join(e.dir, "audit.db")
+	m := e.monitor(cfg)
+	audit, err := newAuditSink(cfg.AuditDB, m.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.events.sinks = append(m.events.sinks, audit)
+
+	// As main does for -once, well before a batch fills or the flush interval
+	// passes
+	m.runOnce("")
+	flushSinks(nil, audit)
+	out, err := exec.Command("sqlite3", cfg.AuditDB, "SELECT pid, action, result FROM actions").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(out)), "1001|terminate|sent"; got != want {
+		t.Fatalf("audit rows after -once = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// secretFlags are the flags whose values are left out of the startup banner.
+var secretFlags = []string{"apiToken", "webhookURL", "telemetryEndpoint"}
+
+// modeFlags are the flags that run something other than the monitor, which
+// are left out of the startup banner as they're never set when it's logged.
+var modeFlags = []string{"validateConfig", "explain", "preview", "describePolicy"}
+
+// startupBanner records exactly how an instance was configured, logged as
+// JSON at startup so it can be machine-parsed.
+type startupBanner struct {
+	Settings map[string]interface{} `json:"settings"` // by flag name, after merging the config file, environment and flags
+	Binaries map[string]string      `json:"binaries"` // resolved paths of the commands run, empty if not found
+	Backend  string                 `json:"backend"`
+	GPUs     int                    `json:"gpus"`
+	GPUError string                 `json:"gpuError,omitempty"` // why the GPUs couldn't be counted
+	Runtime  bannerRuntime          `json:"runtime"`
+}
+
+type bannerRuntime struct {
+	Executable string `json:"executable"`
+	PID        int    `json:"pid"`
+	UID        int    `json:"uid"`
+	Hostname   string `json:"hostname"`
+	GoVersion  string `json:"goVersion"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+}
+
+// newStartupBanner describes the running instance, given the GPUs found at
+// startup or why they couldn't be.
+func newStartupBanner(cfg Config, gpus []gpuInfo, gpuErr error) startupBanner {
+	b := startupBanner{
+		Settings: effectiveSettings(),
+		Binaries: make(map[string]string),
+		Backend:  cfg.Backend,
+		GPUs:     len(gpus),
+		Runtime: bannerRuntime{
+			PID:       os.Getpid(),
+			UID:       os.Getuid(),
+			GoVersion: runtime.Version(),
+			OS:        runtime.GOOS,
+			Arch:      runtime.GOARCH,
+		},
+	}
+	if gpuErr != nil {
+		b.GPUError = gpuErr.Error()
+	}
+	b.Runtime.Executable, _ = os.Executable()
+	b.Runtime.Hostname, _ = os.Hostname()
+
+	commands := []string{"nvidia-smi", "kill", "ps"}
+	if cfg.SlurmCancel {
+		commands = append(commands, "scancel")
+	}
+	if cfg.AuditDB != "" {
+		commands = append(commands, "sqlite3")
+	}
+	if cfg.MonitorGPUHealth {
+		commands = append(commands, "dmesg")
+	}
+	for _, command := range commands {
+		b.Binaries[command], _ = exec.LookPath(command)
+	}
+	return b
+}
+
+// effectiveSettings returns the value of every flag, typed as in a config
+// file, with secrets redacted.
+func effectiveSettings() map[string]interface{} {
+	settings := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if contains(modeFlags, f.Name) {
+			return
+		}
+		var value interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		switch {
+		case contains(secretFlags, f.Name):
+			if value != "" {
+				value = "[redacted]"
+			}
+		case contains(objectFlags, f.Name):
+			if s, _ := value.(string); json.Valid([]byte(s)) {
+				value = json.RawMessage(s)
+			}
+		}
+		settings[f.Name] = value
+	})
+	return settings
+}
+
+func (b startupBanner) String() string {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
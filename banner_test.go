@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStartupBannerRoundTrips(t *testing.T) {
+	resetFlags(t)
+	for name, value := range map[string]string{
+		"idleTimeThreshold": "900",
+		"warningOnly":       "false",
+		"whitelist":         "jupyter,tensorboard",
+		"massIdleGuard":     "0.5",
+		"idlePolicy":        `{"memoryBelowMB":5}`,
+		"apiToken":          "s3cret",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	banner := newStartupBanner(bound.config(), []gpuInfo{{Index: 0}, {Index: 1}}, nil)
+	logged := banner.String()
+	if strings.Contains(logged, "s3cret") {
+		t.Fatalf("banner contains the API token: %s", logged)
+	}
+
+	var decoded startupBanner
+	if err := json.Unmarshal([]byte(logged), &decoded); err != nil {
+		t.Fatalf("banner isn't valid JSON: %v\n%s", err, logged)
+	}
+	if decoded.GPUs != 2 || decoded.Backend != banner.Backend || decoded.Runtime != banner.Runtime || !reflect.DeepEqual(decoded.Binaries, banner.Binaries) {
+		t.Errorf("decoded banner = %+v, want %+v", decoded, banner)
+	}
+
+	// The settings are typed as in a config file, so they can be used as one to
+	// configure another instance the same way
+	settings := make(map[string]interface{})
+	for name, value := range decoded.Settings {
+		if !strings.HasPrefix(name, "test.") && !contains(commandLineOnly, name) && !contains(secretFlags, name) {
+			settings[name] = value
+		}
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "nvidler.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := bound.config()
+	flag.VisitAll(func(f *flag.Flag) {
+		if !bound.onCommandLine[f.Name] && !contains(commandLineOnly, f.Name) {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	if err := loadConfigFile(path, bound.onCommandLine); err != nil {
+		t.Fatalf("banner settings as a config file: %v", err)
+	}
+	got := bound.config()
+	got.APIToken, want.APIToken = "", ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("configuration from the banner's settings = %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// processCgroup returns the cgroup a process is in: its cgroup v2 path, or
+// under cgroup v1 the hierarchy and path of the first controller listed, such
+// as cpu,cpuacct:/slurm/uid_1000/job_1234.
+func processCgroup(pid int) (string, error) {
+	data, err := os.ReadFile(procPath(pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, line := range lines {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return path, nil
+		}
+	}
+	for _, line := range lines {
+		if _, group, ok := strings.Cut(line, ":"); ok {
+			return group, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup in %s", procPath(pid, "cgroup"))
+}
+
+// reapableCgroup reports whether a cgroup is narrow enough to act on as a
+// whole with -reapGranularity cgroup. The root cgroup and systemd slices hold
+// unrelated units, so their processes are only ever acted on one by one.
+func reapableCgroup(group string) bool {
+	path := group
+	if i := strings.Index(group, ":"); i >= 0 {
+		path = group[i+1:]
+	}
+	return path != "" && path != "/" && !strings.HasSuffix(path, ".slice")
+}
+
+// cgroupMembers returns every process in a cgroup, found by reading the cgroup
+// of each process under -procRoot, which works the same under either cgroup
+// version and wherever the cgroup filesystem is mounted.
+func cgroupMembers(group string) ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	var members []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if g, err := processCgroup(pid); err == nil && g == group {
+			members = append(members, pid)
+		}
+	}
+	sort.Ints(members)
+	return members, nil
+}
+
+// planCgroupReaps groups candidates by cgroup for -reapGranularity cgroup. A
+// cgroup is returned to be reaped when every one of its GPU processes is idle
+// and due to be terminated; otherwise none of its processes are terminated.
+// Candidates in cgroups too broad to act on as a whole are unaffected.
+func planCgroupReaps(candidates []candidate, terminate map[int]bool, gpuPIDsByCgroup map[string][]int, logger *log.Logger) map[string][]candidate {
+	idle := make(map[string][]candidate)
+	for _, c := range candidates {
+		if c.Cgroup != "" && reapableCgroup(c.Cgroup) {
+			idle[c.Cgroup] = append(idle[c.Cgroup], c)
+		}
+	}
+
+	reap := make(map[string][]candidate)
+	for group, members := range idle {
+		total := len(gpuPIDsByCgroup[group])
+
+		eligible := 0
+		for _, c := range members {
+			if terminate[c.PID] {
+				eligible++
+			}
+			delete(terminate, c.PID)
+		}
+
+		switch {
+		case len(members) < total:
+			logger.Printf("Cgroup %s: %d of %d GPU processes idle, leaving it running.\n", group, len(members), total)
+		case eligible < total:
+			logger.Printf("Cgroup %s: all %d GPU processes idle, but only %d due for termination, leaving it running.\n", group, total, eligible)
+		default:
+			reap[group] = members
+		}
+	}
+	return reap
+}
+
+// reapCgroup sends SIGTERM to every process in a cgroup whose GPU processes are
+// all idle, including those not using the GPU themselves, such as a training
+// job's data loader workers. A cgroup holding nvidler itself is left alone.
+func (m *monitor) reapCgroup(group string, gpuMembers []candidate, state *scanState) error {
+	members, err := cgroupMembers(group)
+	if err != nil {
+		return fmt.Errorf("Failed to list the processes in cgroup %s: %v", group, err)
+	}
+	for _, pid := range members {
+		if reason, ok := state.protected[pid]; ok {
+			return fmt.Errorf("Not reaping cgroup %s, its PID %d %s.", group, pid, reason)
+		}
+	}
+
+	m.logger.Printf("Cgroup %s: all %d GPU processes idle, sending SIGTERM to its %d processes %v.\n", group, len(gpuMembers), len(members), members)
+	var failed []string
+	for _, pid := range members {
+		c := gpuMembers[0]
+		c.PID = pid
+		if err := m.kill(c, "TERM"); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to signal every process in cgroup %s: %s", group, strings.Join(failed, " "))
+	}
+	return nil
+}
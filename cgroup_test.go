@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessCgroup(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 200, PPID: 1, Comm: "python", Cgroup: "0::/slurm/uid_1000/job_1234\n"})
+	e.addProcess(fakeProcess{PID: 201, PPID: 1, Comm: "python", Cgroup: "12:cpu,cpuacct:/slurm/uid_1000/job_5678\n11:memory:/slurm/uid_1000/job_5678\n"})
+
+	for pid, want := range map[int]string{200: "/slurm/uid_1000/job_1234", 201: "cpu,cpuacct:/slurm/uid_1000/job_5678"} {
+		if got, err := processCgroup(pid); err != nil || got != want {
+			t.Errorf("processCgroup(%d) = %q, %v, want %q", pid, got, err, want)
+		}
+	}
+
+	for group, want := range map[string]bool{
+		"/slurm/uid_1000/job_1234":             true,
+		"cpu,cpuacct:/slurm/uid_1000/job_5678": true,
+		"/system.slice/train.service":          true,
+		"/":                                    false,
+		"/user.slice":                          false,
+		"cpu,cpuacct:/":                        false,
+	} {
+		if got := reapableCgroup(group); got != want {
+			t.Errorf("reapableCgroup(%q) = %v, want %v", group, got, want)
+		}
+	}
+}
+
+func TestScanReapsWholeCgroup(t *testing.T) {
+	e := newTestEnv(t)
+	job := "0::/slurm/uid_1000/job_1234\n"
+	// Two GPU workers and a data loader not using the GPU in one job, and
+	// another job's GPU process
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: job})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1001, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: job})
+	e.addProcess(fakeProcess{PID: 1003, PPID: 1001, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: job})
+	e.addProcess(fakeProcess{PID: 1004, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: "0::/slurm/uid_1001/job_5678\n"})
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.ReapGranularity = "cgroup"
+	m := e.monitor(cfg)
+
+	// While one of the job's GPU processes is busy, none of them are touched
+	e.gpuProcesses("1001, 0", "1002, 2048", "1004, 2048")
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v while the job was partly busy, want nothing", got)
+	}
+	if want := "Cgroup /slurm/uid_1000/job_1234: 1 of 2 GPU processes idle, leaving it running."; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+
+	e.gpuProcesses("1001, 0", "1002, 0", "1004, 2048")
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001", "-s TERM 1002", "-s TERM 1003"}; !equalStrings(got, want) {
+		t.Fatalf("signals once the job was idle = %v, want %v, every member of its cgroup", got, want)
+	}
+	if want := "sending SIGTERM to its 3 processes [1001 1002 1003]"; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't list the cgroup's members as %q:\n%s", want, e.log.String())
+	}
+	var terminated []string
+	for _, ev := range e.events {
+		if ev.Action == actionTerminate {
+			terminated = append(terminated, ev.Message)
+		}
+	}
+	if len(terminated) != 1 || !strings.Contains(terminated[0], "cgroup /slurm/uid_1000/job_1234") {
+		t.Errorf("termination events = %q, want one for the cgroup", terminated)
+	}
+}
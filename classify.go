@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idleVerdict is an idle classifier's judgement of a process.
+type idleVerdict int
+
+const (
+	verdictUnknown idleVerdict = iota // no opinion, leaving it to the others
+	verdictIdle
+	verdictActive
+)
+
+func (v idleVerdict) String() string {
+	switch v {
+	case verdictIdle:
+		return "idle"
+	case verdictActive:
+		return "active"
+	default:
+		return "unknown"
+	}
+}
+
+// idleClassifier judges whether a GPU process is idle, returning the reason for
+// its verdict. Site-specific classifiers, such as one asking a scheduler whether
+// the job is still running, are run by -idleClassifierCommand and held in
+// monitor.classifiers alongside the built-in ones.
+type idleClassifier interface {
+	name() string // identifies the classifier in logs and explanations
+	classify(p gpuProcess) (verdict idleVerdict, reason string, err error)
+}
+
+// readingsClassifier judges a process from the nvidia-smi readings by
+// -idleExpr. Without one the built-in classifier is a policyClassifier.
+type readingsClassifier struct {
+	expr   expr
+	source string
+}
+
+func (r readingsClassifier) name() string {
+	return "readings"
+}
+
+func (r readingsClassifier) classify(p gpuProcess) (idleVerdict, string, error) {
+	result, err := r.expr.eval(p.Values)
+	if err != nil {
+		return verdictUnknown, "", fmt.Errorf("failed to evaluate -idleExpr: %v", err)
+	}
+	if result != 0 {
+		return verdictIdle, fmt.Sprintf("-idleExpr %q evaluates to %v.", r.source, result), nil
+	}
+	return verdictActive, fmt.Sprintf("-idleExpr %q evaluates to %v.", r.source, result), nil
+}
+
+// classifyIdle combines the verdicts of the classifiers, noting each of them. A
+// process is idle only if at least one classifier judges it idle and none
+// judge it active; an error from any classifier leaves it alone.
+func (m *monitor) classifyIdle(p gpuProcess, state *scanState) bool {
+	classifiers := []idleClassifier{m.readings}
+	if m.cfg.BusyFileGlob != "" {
+		classifiers = append(classifiers, busyFileClassifier{glob: m.cfg.BusyFileGlob, maxAge: m.threshold(), clock: m.clock})
+	}
+	if len(m.activityPaths) > 0 {
+		classifiers = append(classifiers, activityClassifier{paths: m.activityPaths, maxAge: m.threshold(), clock: m.clock})
+	}
+
+	var idleBy idleClassifier
+	for _, c := range append(classifiers, m.classifiers...) {
+		verdict, reason, err := c.classify(p)
+		if err != nil {
+			state.log(p.PID).Printf("The %s idle classifier failed for PID %d: %v\n", c.name(), p.PID, err)
+			state.note(p.PID, "The %s idle classifier failed: %v", c.name(), err)
+			return false
+		}
+		state.note(p.PID, "The %s idle classifier judges it %v: %s", c.name(), verdict, reason)
+		if _, ok := c.(policyClassifier); ok && m.cfg.IdlePolicy != "" {
+			state.log(p.PID).Printf("PID %d judged %v by -idlePolicy: %s\n", p.PID, verdict, reason)
+		}
+		if _, ok := c.(activityClassifier); ok && verdict != verdictActive {
+			state.log(p.PID).Printf("PID %d -activityPaths: %s\n", p.PID, reason)
+		}
+		switch verdict {
+		case verdictActive:
+			if idleBy != nil {
+				state.log(p.PID).Printf("PID %d was judged idle by the %s idle classifier, overridden by the %s idle classifier: %s\n", p.PID, idleBy.name(), c.name(), reason)
+			}
+			return false
+		case verdictIdle:
+			if idleBy == nil {
+				idleBy = c
+			}
+		}
+	}
+	return idleBy != nil
+}
+
+// busyFileClassifier judges a process active while it keeps a busy file fresh,
+// letting cooperative jobs protect themselves through phases where they hold
+// the GPU without using it. The glob's {pid} is replaced by the process's PID.
+type busyFileClassifier struct {
+	glob   string
+	maxAge time.Duration
+	clock  clock
+}
+
+func (b busyFileClassifier) name() string {
+	return "busy file"
+}
+
+func (b busyFileClassifier) classify(p gpuProcess) (idleVerdict, string, error) {
+	pattern := strings.ReplaceAll(b.glob, "{pid}", strconv.Itoa(p.PID))
+	matches := globProcess(p.PID, pattern)
+
+	var newest time.Time
+	var newestPath string
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newest) {
+			newest, newestPath = info.ModTime(), path
+		}
+	}
+	if newestPath == "" {
+		return verdictUnknown, fmt.Sprintf("No busy file matches %s.", pattern), nil
+	}
+	age := b.clock.Now().Sub(newest).Truncate(time.Second)
+	if age > b.maxAge {
+		return verdictUnknown, fmt.Sprintf("Busy file %s was last modified %v ago, over %v.", newestPath, age, b.maxAge), nil
+	}
+	return verdictActive, fmt.Sprintf("Busy file %s was modified %v ago.", newestPath, age), nil
+}
+
+// globProcess finds the files matching a glob as a process sees them, looking
+// in its own filesystem first, so files written in a container or private /tmp
+// are found, then on the host.
+func globProcess(pid int, pattern string) []string {
+	for _, root := range []string{procPath(pid, "root"), "/"} {
+		if matches, _ := filepath.Glob(filepath.Join(root, pattern)); len(matches) > 0 {
+			return matches
+		}
+	}
+	return nil
+}
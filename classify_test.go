@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandClassifier(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python"})
+	script := filepath.Join(e.dir, "classifier")
+	e.writeScript(script, `echo "$NVIDLER_PROCESS $1" >> `+filepath.Join(e.dir, "classified")+`
+case "$1" in
+1001) echo "idle Job finished at 10:00." ;;
+1002) echo active ;;
+1003) echo unknown ;;
+1004) echo maybe ;;
+*) echo "no such job" >&2; exit 1 ;;
+esac`)
+	cmd, err := parseKillCommand(script + " {{.PID}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := commandClassifier{cmd: cmd}
+
+	tests := []struct {
+		pid     int
+		verdict idleVerdict
+		reason  string
+		err     string
+	}{
+		{1001, verdictIdle, "Job finished at 10:00.", ""},
+		{1002, verdictActive, script + " answered active.", ""},
+		{1003, verdictUnknown, script + " answered unknown.", ""},
+		{1004, verdictUnknown, "", `answered "maybe"`},
+		{1005, verdictUnknown, "", "no such job"},
+	}
+	for _, tt := range tests {
+		verdict, reason, err := c.classify(gpuProcess{PID: tt.pid, GPUUUID: testGPU})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("PID %d: error %v, want one mentioning %q", tt.pid, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || verdict != tt.verdict || reason != tt.reason {
+			t.Errorf("PID %d: %v %q %v, want %v %q", tt.pid, verdict, reason, err, tt.verdict, tt.reason)
+		}
+	}
+	if got := e.readLines("classified"); len(got) == 0 || got[0] != "python 1001" {
+		t.Errorf("classifier was run with %q, want the process name in NVIDLER_PROCESS", got)
+	}
+}
+
+func TestScanConsultsIdleClassifierCommand(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0", "1002, 0")
+	script := filepath.Join(e.dir, "classifier")
+	e.writeScript(script, `[ "$1" = 1002 ] && echo "active Its job is still running." || echo unknown`)
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.IdleClassifierCommand = script + " {{.PID}}"
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v, with 1002 held active by the command", got, want)
+	}
+}
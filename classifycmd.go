@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// classifierCommandTimeout is how long an -idleClassifierCommand is given to
+// answer for a process before it's treated as having failed.
+const classifierCommandTimeout = 10 * time.Second
+
+// commandClassifier is a site-specific idle classifier run as an external
+// command, for -idleClassifierCommand, so sites can judge processes by their
+// own signals, such as a scheduler API or a job database, without rebuilding
+// nvidler. Its arguments are templates of the process's event, parsed and
+// rendered as for -killCommand. The first word of its output is its verdict,
+// idle, active or unknown, and the rest of the line is the reason. A non-zero
+// exit is a failure, which leaves the process alone.
+type commandClassifier struct {
+	cmd *killCommand
+}
+
+func (c commandClassifier) name() string {
+	return "command"
+}
+
+func (c commandClassifier) classify(p gpuProcess) (idleVerdict, string, error) {
+	e := event{PID: p.PID, GPU: p.GPUUUID, Memory: p.UsedMemory, Job: slurmJob(p.PID)}
+	if comm, err := processComm(p.PID); err == nil {
+		e.Process = fullProcessName(p.PID, comm)
+	}
+	args, err := c.cmd.render(e)
+	if err != nil {
+		return verdictUnknown, "", fmt.Errorf("failed to render -idleClassifierCommand: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), classifierCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NVIDLER_PID="+strconv.Itoa(e.PID),
+		"NVIDLER_PROCESS="+e.Process,
+		"NVIDLER_GPU="+e.GPU,
+		"NVIDLER_JOB="+e.Job,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return verdictUnknown, "", fmt.Errorf("%s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	answer, reason, _ := strings.Cut(line, " ")
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = fmt.Sprintf("%s answered %s.", args[0], answer)
+	}
+	switch answer {
+	case "idle":
+		return verdictIdle, reason, nil
+	case "active":
+		return verdictActive, reason, nil
+	case "unknown":
+		return verdictUnknown, reason, nil
+	}
+	return verdictUnknown, "", fmt.Errorf("%s answered %q, want idle, active or unknown", strings.Join(args, " "), line)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// clock is the monitor's source of time. Everything that depends on the
+// current time or waits goes through it, so that it can be replaced to advance
+// time virtually rather than waiting in real time.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
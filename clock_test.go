@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when it's advanced, or when it's
+// slept on or waited for, which advance it by the duration rather than
+// blocking.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.advance(d)
+}
+
+// After advances the clock by d and returns a channel that already holds the
+// new time.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.advance(d)
+	return ch
+}
+
+// advance moves the clock forward by d, returning the new time.
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	return c.now
+}
+
+func TestFakeClockAdvancesVirtually(t *testing.T) {
+	c := newFakeClock(testEpoch)
+	c.Sleep(time.Minute)
+	if got, want := c.Now(), testEpoch.Add(time.Minute); !got.Equal(want) {
+		t.Fatalf("Now after Sleep = %v, want %v", got, want)
+	}
+	select {
+	case got := <-c.After(time.Hour):
+		if want := testEpoch.Add(time.Hour + time.Minute); !got.Equal(want) {
+			t.Fatalf("After delivered %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("After didn't deliver without waiting")
+	}
+}
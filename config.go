@@ -0,0 +1,677 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/docker/docker/client"
+)
+
+// Config holds nvidler's settings.
+type Config struct {
+	IdleTimeThreshold        int
+	MaxRuntime               int
+	MaxRuntimeAction         string
+	WarningOnly              bool
+	TargetWorkloads          []string
+	Whitelist                []string
+	WarnUnusedWhitelist      int
+	OnlyUsers                []string
+	ConfirmCycles            int
+	WarnRepeatInterval       int
+	WhitelistGPUs            []string
+	GPUDisableMarkerDir      string
+	CaptureProcDetails       bool
+	LogMemoryPercent         bool
+	SnapshotBeforeKill       bool
+	SnapshotDir              string
+	SnapshotMaxMB            int
+	DiagBufferSize           int
+	DiagDumpDir              string
+	DiagDumpMaxMB            int
+	ShadowConfig             string
+	ShadowLogFile            string
+	ContainerIdlePolicy      string
+	ReapGranularity          string
+	BusinessHours            string
+	BusinessHoursMultiplier  float64
+	QuarantineAction         string
+	SkipPrivilegedContainers bool
+	ContainerOnly            bool
+	RequireFreshAttribution  int
+	TargetImages             []string
+	WhitelistImages          []string
+	Slurm                    bool
+	SlurmCancel              bool
+	K8sEvict                 bool
+	K8sNode                  string
+	KillCommand              string
+	SignalLadder             string
+	ProbeBeforeKill          bool
+	LogFile                  string
+	MirrorStdout             bool
+	RotateOnStart            bool
+	RotateMinMB              int
+	SplitStreams             string
+	MaxLoggedProcesses       int
+	SleepInterval            int
+	DockerEnabled            bool
+	DockerHost               string
+	DockerHosts              []string
+	DockerTLSCACert          string
+	DockerTLSCert            string
+	DockerTLSKey             string
+	Backend                  string
+	ExtraQueryFields         string
+	Pmon                     bool
+	OnNoAccounting           string
+	IdleExpr                 string
+	IdlePolicy               string
+	ProcRoot                 string
+	SMITimeout               int
+	MonitorGPUHealth         bool
+	DetectGPUResets          bool
+	ReclaimTargetMB          string
+	ReclaimOrder             string
+	Journal                  bool
+	LockFile                 string
+	OnConflict               string
+	WebhookURL               string
+	WebhookTemplate          string
+	BatchTerminations        bool
+	AuditDB                  string
+	SummaryInterval          int
+	SelfStatsInterval        int
+	StateFile                string
+	TelemetryEndpoint        string
+	TelemetryInterval        int
+	TelemetryIdentify        bool
+	SelfMemoryLimitMB        int
+	SelfMaxProcs             int
+	DStateAlertAfter         int
+	RespectActiveTty         bool
+	RespectOomScore          bool
+	OomProtectedAdj          int
+	RespectMemTransfers      bool
+	WallNotify               int
+	BusyFileGlob             string
+	IdleClassifierCommand    string
+	ActivityPaths            string
+	TempThreshold            int
+	TempSustain              int
+	TempPause                bool
+	MinNodeUptime            int
+	LeakedContextThreshold   int
+	MaxPeakMB                int
+	MinReclaimableMB         int
+	SeedIdleFromStartTime    bool
+	Drain                    bool
+	DrainTimeout             int
+	DrainGPUs                []string
+	BatchPs                  bool
+	FailSafeAfter            int
+	FailSafeRecovery         int
+	LatencyWarnFraction      float64
+	LatencyWindow            int
+	DemandSignal             string
+	MassIdleGuard            float64
+	MassIdleMinProcesses     int
+	APIAddr                  string
+	APIToken                 string
+	APIPersist               bool
+	EventBuffer              int
+	EventOverflow            string
+	ConfigFile               string
+	Once                     bool
+	OnceSummary              string
+	ConfigCache              string
+	ConfigRefresh            int
+	ConfigPublicKey          string
+	WatchConfig              bool
+	ValidateConfig           bool
+	ExplainPID               int
+	Preview                  string
+	WhatIf                   string
+	WhatIfFormat             string
+	DescribePolicy           string
+}
+
+// listFlags are the flags holding comma-separated lists, which may be given as
+// arrays of strings in the config file.
+var listFlags = []string{"targetWorkloads", "whitelist", "onlyUsers", "whitelistGPUs", "targetImages", "whitelistImages", "drainGPUs", "dockerHosts"}
+
+// objectFlags are the flags holding JSON objects, which may be given as objects
+// in the config file as well as strings.
+var objectFlags = []string{"idlePolicy"}
+
+// commandLineOnly are the flags that can't be set from the config file.
+var commandLineOnly = []string{"config", "configCache", "configRefresh", "configPublicKey", "validateConfig", "explain", "preview", "whatIf", "whatIfFormat", "describePolicy", "once", "onceSummary"}
+
+// parseFlags reads the configuration from the command line, NVIDLER_*
+// environment variables and, if -config is given, the config file. Flags take
+// precedence over environment variables, which take precedence over the file,
+// which takes precedence over the defaults. Any problems with the environment
+// or file are reported together.
+func parseFlags() (Config, error) {
+	cfg := &bound.cfg
+	targetWorkloads, whitelist, onlyUsers := &bound.targetWorkloads, &bound.whitelist, &bound.onlyUsers
+	whitelistGPUs, targetImages, whitelistImages := &bound.whitelistGPUs, &bound.targetImages, &bound.whitelistImages
+	drainGPUs, dockerHosts := &bound.drainGPUs, &bound.dockerHosts
+
+	flag.IntVar(&cfg.IdleTimeThreshold, "idleTimeThreshold", 300, "Time threshold for idle GPUs in seconds")
+	flag.StringVar(&cfg.BusinessHours, "businessHours", "", "Windows when the idle threshold is multiplied by -businessHoursMultiplier, as days, a time of day and optionally a time zone, separated by semicolons, e.g. \"Mon-Fri 09:00-18:00 Europe/London\" (empty to always use the base threshold)")
+	flag.Float64Var(&cfg.BusinessHoursMultiplier, "businessHoursMultiplier", 3, "Multiplier for the idle threshold during -businessHours")
+	flag.IntVar(&cfg.MaxRuntime, "maxRuntime", 0, "Act on target processes that have been running for longer than this many seconds, whether idle or not (0 to disable)")
+	flag.StringVar(&cfg.MaxRuntimeAction, "maxRuntimeAction", "warn", "What to do about processes over -maxRuntime: warn or terminate (terminate is subject to -warningOnly)")
+	flag.BoolVar(&cfg.WarningOnly, "warningOnly", true, "Warning only mode")
+	flag.StringVar(targetWorkloads, "targetWorkloads", "python,tensorflow,cuda,pytorch", "List of target workload process names, or executable paths such as /opt/conda/envs/bad/bin/python (comma-separated)")
+	flag.StringVar(whitelist, "whitelist", "whitelisted_process,whitelisted_container,nvidia-smi,nvidler.sh", "Whitelisted processes, by name or executable path, and Docker containers (comma-separated)")
+	flag.IntVar(&cfg.WarnUnusedWhitelist, "warnUnusedWhitelist", 0, "Every this many seconds, warn about -whitelist entries that haven't matched any process or container since startup (0 to disable)")
+	flag.StringVar(onlyUsers, "onlyUsers", "", "Only act on processes owned by these users (comma-separated, empty for all users)")
+	flag.IntVar(&cfg.ConfirmCycles, "confirmCycles", 1, "Number of consecutive scans a process must be judged eligible for termination before it is terminated")
+	flag.IntVar(&cfg.WarnRepeatInterval, "warnRepeatInterval", 600, "Seconds before warning again about an idle process that isn't terminated, rather than every scan (0 to warn every scan)")
+	flag.StringVar(whitelistGPUs, "whitelistGPUs", "", "GPUs whose processes are never acted on, by index or UUID (comma-separated)")
+	flag.BoolVar(&cfg.Drain, "drain", false, "Drain GPUs for maintenance: warn every target process on them at once, whether idle or not, and terminate any still running after -drainTimeout, even with -warningOnly")
+	flag.IntVar(&cfg.DrainTimeout, "drainTimeout", 600, "Seconds a process being drained is given after its warning before it's terminated")
+	flag.StringVar(drainGPUs, "drainGPUs", "", "With -drain, only drain these GPUs, by index or UUID (comma-separated, empty for all GPUs)")
+	flag.StringVar(&cfg.GPUDisableMarkerDir, "gpuDisableMarkerDir", "", "Directory checked each scan for marker files named after a GPU index or UUID, whose processes aren't acted on while the marker exists (empty to disable)")
+	flag.BoolVar(&cfg.CaptureProcDetails, "captureProcDetails", false, "Capture the command line, working directory and job identifiers of processes when terminating them")
+	flag.BoolVar(&cfg.LogMemoryPercent, "logMemoryPercent", false, "Include the share of its GPU's total memory a process held in warnings and terminations")
+	flag.BoolVar(&cfg.SnapshotBeforeKill, "snapshotBeforeKill", false, "Save a GPU state dump and the process's memory map to -snapshotDir before terminating it")
+	flag.StringVar(&cfg.SnapshotDir, "snapshotDir", "/var/lib/nvidler/snapshots", "Directory for snapshots taken with -snapshotBeforeKill")
+	flag.IntVar(&cfg.SnapshotMaxMB, "snapshotMaxMB", 100, "Maximum total size of -snapshotDir in MB, the oldest snapshots are removed beyond this")
+	flag.IntVar(&cfg.DiagBufferSize, "diagBufferSize", 0, "Keep the raw nvidia-smi output, containers, idle processes and events of this many of the latest scans in memory, dumped to -diagDumpDir on SIGUSR2 or a panic (0 to disable)")
+	flag.StringVar(&cfg.DiagDumpDir, "diagDumpDir", "/var/lib/nvidler/diag", "Directory for dumps of -diagBufferSize")
+	flag.IntVar(&cfg.DiagDumpMaxMB, "diagDumpMaxMB", 50, "Maximum total size of -diagDumpDir in MB, the oldest dumps are removed beyond this")
+	flag.StringVar(&cfg.ShadowConfig, "shadowConfig", "", "JSON file or http(s) URL of candidate settings keyed by flag name, evaluated alongside the live settings each scan without acting, logging only where their decisions differ; a URL is checked against -configPublicKey only when -config is also a URL, and is never cached (empty to disable)")
+	flag.StringVar(&cfg.ShadowLogFile, "shadowLogFile", "", "With -shadowConfig, log where the candidate settings differ to this file rather than the main log")
+	flag.StringVar(&cfg.ContainerIdlePolicy, "containerIdlePolicy", "any", "With Docker tracking, act on any idle process in a container (any), or stop the container only once all of its GPU processes are idle (all)")
+	flag.StringVar(&cfg.ReapGranularity, "reapGranularity", "process", "Act on each idle process by itself (process), or send SIGTERM to every process in a cgroup, such as a systemd unit or batch job, only once all of its GPU processes are idle (cgroup)")
+	flag.StringVar(&cfg.QuarantineAction, "quarantineAction", "", "Quarantine idle processes rather than terminating them, restoring them once they're active again: lower their CPU priority (renice) or limit their cgroup's CPU (cgroup-limit) (empty to terminate)")
+	flag.BoolVar(&cfg.ContainerOnly, "containerOnly", false, "With Docker tracking, only ever act on processes in Docker containers, skipping all host processes")
+	flag.IntVar(&cfg.RequireFreshAttribution, "requireFreshAttribution", 0, "Only warn, rather than act, on any scan whose Docker containers couldn't all be listed, or were listed more than this many seconds before acting (0 to disable)")
+	flag.BoolVar(&cfg.SkipPrivilegedContainers, "skipPrivilegedContainers", true, "With Docker tracking, never act on processes in privileged or host networked containers, which are usually infrastructure such as monitoring agents or drivers")
+	flag.StringVar(targetImages, "targetImages", "", "With Docker tracking, also target processes in containers whose image matches one of these globs, e.g. internal/batch:*, or is pinned by one of these digests (comma-separated)")
+	flag.StringVar(whitelistImages, "whitelistImages", "", "With Docker tracking, never act on processes in containers whose image matches one of these globs, e.g. jupyter/*, or is pinned by one of these digests, e.g. jupyter/scipy-notebook@sha256:<digest> (comma-separated)")
+	flag.BoolVar(&cfg.Slurm, "slurm", false, "Attribute processes to SLURM jobs, from their cgroup or SLURM_JOB_ID, and include the job ID in warnings and terminations")
+	flag.BoolVar(&cfg.SlurmCancel, "slurmCancel", false, "With -slurm, terminate processes in a SLURM job by cancelling the job with scancel rather than signalling the process")
+	flag.BoolVar(&cfg.K8sEvict, "k8sEvict", false, "When running in Kubernetes, evict the pods of idle processes in GPU-requesting pods through the API, respecting PodDisruptionBudgets, rather than signalling the processes")
+	flag.StringVar(&cfg.K8sNode, "k8sNode", os.Getenv("NODE_NAME"), "Node whose pods -k8sEvict evicts (default: the NODE_NAME environment variable)")
+	flag.StringVar(&cfg.KillCommand, "killCommand", "", "Command run to terminate a process instead of signalling it, each argument a template of the event such as {{.PID}}, {{.Container}} or {{.User}}, e.g. mycluster-reclaim {{.PID}} (empty to signal directly)")
+	flag.StringVar(&cfg.SignalLadder, "signalLadder", "", "Escalate the signals sent to a process over successive scans, as comma-separated <signal>@<delay> rungs, e.g. USR1@0s,TERM@30s,KILL@120s (empty to send SIGTERM)")
+	flag.BoolVar(&cfg.ProbeBeforeKill, "probeBeforeKill", false, "With -signalLadder, only send a KILL rung once the process has shown no sign of shutting down since the previous rung (releasing GPU memory or ending threads), holding it off while it does")
+	flag.StringVar(&cfg.LogFile, "logFile", "/var/log/gpu_idle_monitor.log", "Log file (- to log to stdout only)")
+	flag.BoolVar(&cfg.RotateOnStart, "rotateOnStart", true, "Rotate -logFile at startup once it has grown to -rotateMinMB, keeping rotated logs for 7 days")
+	flag.IntVar(&cfg.RotateMinMB, "rotateMinMB", 10, "Size in MB -logFile must reach before it's rotated at startup (0 to rotate it on every start)")
+	flag.BoolVar(&cfg.MirrorStdout, "mirrorStdout", true, "Also write the log to stdout when writing it to -logFile")
+	flag.StringVar(&cfg.SplitStreams, "splitStreams", "", "Write events as JSON lines to one stream and the log to the other: stdout for events on stdout and the log on stderr, or stderr for the reverse (empty to log to stdout only)")
+	flag.IntVar(&cfg.MaxLoggedProcesses, "maxLoggedProcesses", 0, "Only log the GPU processes and evaluation of this many processes each scan, plus any acted on (0 for all)")
+	flag.IntVar(&cfg.SleepInterval, "sleepInterval", 60, "Sleep interval in seconds")
+	flag.BoolVar(&cfg.DockerEnabled, "docker", true, "Enable Docker container tracking")
+	flag.StringVar(&cfg.DockerHost, "dockerHost", "", "Docker daemon to connect to, e.g. unix:///run/docker.sock or tcp://[fd00::1]:2376, overriding DOCKER_HOST (empty to use the environment)")
+	flag.StringVar(dockerHosts, "dockerHosts", "", "Docker daemons to attribute containers from, such as the system daemon and each user's rootless daemon, e.g. unix:///run/docker.sock,unix:///run/user/1000/docker.sock, in place of -dockerHost (comma-separated)")
+	flag.StringVar(&cfg.DockerTLSCACert, "dockerTLSCACert", "", "CA certificate to verify the Docker daemon with over TLS, overriding DOCKER_CERT_PATH")
+	flag.StringVar(&cfg.DockerTLSCert, "dockerTLSCert", "", "Client certificate to authenticate to the Docker daemon with over TLS, with -dockerTLSKey")
+	flag.StringVar(&cfg.DockerTLSKey, "dockerTLSKey", "", "Private key of -dockerTLSCert")
+	flag.StringVar(&cfg.Backend, "backend", "csv", "How nvidia-smi is queried: csv for a --query-* call per reading, or xml to take every reading from a single nvidia-smi -q -x call per scan")
+	flag.StringVar(&cfg.ExtraQueryFields, "extraQueryFields", "", "Additional nvidia-smi fields to collect for -idleExpr (comma-separated, [name=][gpu:]field)")
+	flag.BoolVar(&cfg.Pmon, "pmon", false, "Sample per-process SM, memory, encoder and decoder utilization with nvidia-smi pmon each scan, exposed to -idleExpr as sm_util, mem_util, enc_util and dec_util")
+	flag.StringVar(&cfg.IdleExpr, "idleExpr", "", "Expression over collected fields deciding whether a process is idle (default: used_memory==0)")
+	flag.StringVar(&cfg.OnNoAccounting, "onNoAccounting", "conservative", "With -pmon, on GPUs with accounting mode disabled, ignore per-process utilization so it can't mark processes idle (conservative), or use the GPU's device-wide utilization in its place (aggressive)")
+	flag.StringVar(&cfg.IdlePolicy, "idlePolicy", "", `Idle policy as a JSON object combining conditions with "match": "all" or "any": memoryBelowMB, utilizationBelow (of utilizationField, default sm_util) for utilizationWindow seconds, noDeviceFds and minAge in seconds (default: {"memoryBelowMB": 1})`)
+	flag.BoolVar(&cfg.SeedIdleFromStartTime, "seedIdleFromStartTime", false, "With an -idlePolicy utilizationWindow, count a process first seen below the utilization threshold holding no GPU memory as below it since it started, rather than since it was first seen, so a restart of nvidler doesn't give every idle process a fresh window")
+	flag.IntVar(&cfg.SMITimeout, "smiTimeout", 30, "Seconds nvidia-smi is given to answer before it's killed and the scan fails, as it can hang on a wedged driver (0 to wait indefinitely)")
+	flag.StringVar(&cfg.ProcRoot, "procRoot", defaultProcRoot, "Path to the host's /proc, e.g. when mounted into a container without host PID namespace")
+	flag.BoolVar(&cfg.MonitorGPUHealth, "monitorGpuHealth", false, "Alert on GPU hardware errors (uncorrected ECC errors and Xid events); reading Xid events requires access to the kernel log")
+	flag.BoolVar(&cfg.DetectGPUResets, "detectGpuResets", true, "Detect GPUs that were reset or whose driver restarted, by a GPU dropping out of nvidia-smi and coming back or all of its processes losing their memory at once, and count their processes as idle only from the reset")
+	flag.StringVar(&cfg.ReclaimTargetMB, "reclaimTargetMB", "", "Only terminate enough idle processes to free this much GPU memory in MB, either for all GPUs or per GPU as <index>=<MB> (comma-separated)")
+	flag.StringVar(&cfg.ReclaimOrder, "reclaimOrder", "largest", "Order idle processes are chosen in to meet -reclaimTargetMB: largest, smallest, oldest or newest")
+	flag.BoolVar(&cfg.Journal, "journal", false, "Also write events to the systemd journal with structured fields (no-op when not running under systemd)")
+	flag.StringVar(&cfg.LockFile, "lockFile", "/run/nvidler.lock", "Lock file ensuring only one instance runs at a time, which must be writable, e.g. under $XDG_RUNTIME_DIR when not running as root (empty to disable)")
+	flag.StringVar(&cfg.OnConflict, "onConflict", "exit", "What to do when another instance holds the lock: exit or wait")
+	flag.StringVar(&cfg.WebhookURL, "webhookURL", "", "URL to POST events to as JSON (empty to disable)")
+	flag.StringVar(&cfg.WebhookTemplate, "webhookTemplate", "generic", "Webhook payload template: generic, slack, or the path to a Go text/template file")
+	flag.BoolVar(&cfg.BatchTerminations, "batchTerminations", false, "Report each scan's terminations together as a single report event in the log, journal and webhook, rather than an event for each, which only -splitStreams, GET /events and -auditDb are then sent")
+	flag.StringVar(&cfg.AuditDB, "auditDb", "", "SQLite database to record every warning, termination and error in, using the sqlite3 command (empty to disable)")
+	flag.IntVar(&cfg.SummaryInterval, "summaryInterval", 0, "Interval in seconds between summary reports of actions taken (0 to disable)")
+	flag.StringVar(&cfg.StateFile, "stateFile", "", "File to write the state as of each scan to as JSON, replacing it atomically: GPU utilization, tracked processes and recent actions (empty to disable)")
+	flag.StringVar(&cfg.TelemetryEndpoint, "telemetryEndpoint", "", "URL of a self-hosted endpoint to POST an anonymized usage summary to every -telemetryInterval: the number of GPUs, warnings, terminations and idle GPU-hours reclaimed (empty to disable, the default)")
+	flag.IntVar(&cfg.TelemetryInterval, "telemetryInterval", 86400, "Interval in seconds between -telemetryEndpoint reports")
+	flag.BoolVar(&cfg.TelemetryIdentify, "telemetryIdentify", false, "Include the hostname and the number of warnings and terminations by user in -telemetryEndpoint reports")
+	flag.IntVar(&cfg.SelfStatsInterval, "selfStatsInterval", 3600, "Interval in seconds between logging nvidler's own memory use and goroutine count, warning if they've grown well beyond their size at startup (0 to disable)")
+	flag.IntVar(&cfg.SelfMemoryLimitMB, "selfMemoryLimitMB", 0, "Soft limit on nvidler's own memory in MB, making the garbage collector work harder to stay under it (0 for no limit)")
+	flag.IntVar(&cfg.SelfMaxProcs, "selfMaxProcs", 0, "Maximum number of CPUs nvidler runs Go code on at once (0 for all of them)")
+	flag.IntVar(&cfg.DStateAlertAfter, "dStateAlertAfter", 0, "Raise a critical alert once an idle process has been stuck in uninterruptible sleep (D state) for this many seconds (0 to disable)")
+	flag.BoolVar(&cfg.RespectActiveTty, "respectActiveTty", false, "Spare idle processes whose controlling terminal (e.g. an SSH or tmux session) has had input within -idleTimeThreshold")
+	flag.BoolVar(&cfg.RespectOomScore, "respectOomScore", false, "Never act on processes whose oom_score_adj is at or below -oomProtectedAdj, as they've been shielded from the kernel's OOM killer")
+	flag.IntVar(&cfg.OomProtectedAdj, "oomProtectedAdj", -500, "With -respectOomScore, the oom_score_adj at or below which a process is never acted on, from -1000 to 1000")
+	flag.BoolVar(&cfg.RespectMemTransfers, "respectMemTransfers", false, "With -pmon, spare idle processes with any memory controller utilization, as they're copying data to or from the GPU, e.g. loading a model, even with no SM utilization")
+	flag.IntVar(&cfg.WallNotify, "wallNotify", 0, "Write a notice to the terminals the owner of an idle process is logged in on this many seconds before terminating it, as wall(1) does (0 to disable)")
+	flag.StringVar(&cfg.BusyFileGlob, "busyFileGlob", "", "Treat a process as active while a file matching this glob, with {pid} replaced by its PID, has been modified within -idleTimeThreshold, e.g. /tmp/nvidler-busy-{pid} (empty to disable)")
+	flag.StringVar(&cfg.IdleClassifierCommand, "idleClassifierCommand", "", "Command run for each process to judge it by site-specific signals, each argument a template such as {{.PID}}, {{.Process}}, {{.GPU}} or {{.Job}}, answering idle, active or unknown and a reason on its first line, e.g. is-job-idle {{.Job}} (empty to disable)")
+	flag.StringVar(&cfg.ActivityPaths, "activityPaths", "", "Treat a process as active while a checkpoint or output file matching one of these globs has been modified within -idleTimeThreshold, as comma-separated [<target>=]<glob> entries, e.g. python=/data/checkpoints/* (empty to disable)")
+	flag.IntVar(&cfg.TempThreshold, "tempThreshold", 0, "Alert when a GPU's temperature stays above this many °C for -tempSustain (0 to disable)")
+	flag.IntVar(&cfg.TempSustain, "tempSustain", 300, "How long in seconds a GPU must stay above -tempThreshold before alerting")
+	flag.IntVar(&cfg.MinNodeUptime, "minNodeUptime", 0, "Only warn rather than terminate until the node has been up for this many seconds, as jobs are still starting and nvidia-smi and Docker may be unsettled after a boot (0 to disable)")
+	flag.BoolVar(&cfg.TempPause, "tempPauseEnforcement", false, "Only warn rather than terminate while a GPU is alerting for over-temperature, so schedulers don't restart jobs onto a hot node")
+	flag.IntVar(&cfg.LeakedContextThreshold, "leakedContextThreshold", 0, "With -pmon, act on processes that have held GPU memory unchanged with no SM utilization for this many seconds as leaked CUDA contexts, even if not judged idle (0 to disable)")
+	flag.IntVar(&cfg.MaxPeakMB, "maxPeakMB", 0, "Only act on idle processes whose peak GPU memory use seen was below this many MB, e.g. jobs that grabbed a GPU but never really used it (0 for any)")
+	flag.IntVar(&cfg.MinReclaimableMB, "minReclaimableMB", 0, "Only act on idle processes holding at least this many MB of GPU memory, as terminating smaller ones frees too little to be worth the disruption (0 for any)")
+	flag.BoolVar(&cfg.BatchPs, "batchPs", false, "Look up the names, start times and owners of all GPU processes with a single ps call per scan, rather than several per process")
+	flag.IntVar(&cfg.FailSafeAfter, "failSafeAfter", 0, "Only warn, and raise a critical alert, after this many consecutive scans fail to query nvidia-smi or Docker (0 to disable)")
+	flag.IntVar(&cfg.FailSafeRecovery, "failSafeRecovery", 3, "Number of consecutive clean scans before enforcement resumes after -failSafeAfter")
+	flag.Float64Var(&cfg.LatencyWarnFraction, "latencyWarnFraction", 0.5, "Warn when the p95 scan duration is more than this fraction of -sleepInterval, as the monitor is falling behind (0 to disable)")
+	flag.IntVar(&cfg.LatencyWindow, "latencyWindow", 3600, "How many seconds of scans the p50 and p95 scan durations are taken over before starting afresh")
+	flag.StringVar(&cfg.DemandSignal, "demandSignal", "", "File or http(s) URL polled each scan for the number of GPU jobs waiting to run (a number, true/false or {\"pending\": N}); idle processes are only terminated while there are any, and otherwise only warned about (empty to always enforce)")
+	flag.Float64Var(&cfg.MassIdleGuard, "massIdleGuard", 0, "Don't terminate anything in a scan where more than this fraction of GPU processes appear idle at once, e.g. 0.9, as it most likely means bad data (0 to disable)")
+	flag.IntVar(&cfg.MassIdleMinProcesses, "massIdleMinProcesses", 3, "Minimum number of GPU processes for -massIdleGuard to apply, so a node with one or two idle processes can still be reclaimed")
+	flag.StringVar(&cfg.APIAddr, "apiAddr", "", "Address to serve the HTTP API on, e.g. 127.0.0.1:9400 (empty to disable)")
+	flag.StringVar(&cfg.APIToken, "apiToken", "", "Bearer token required to change the configuration and stream events through the API (empty to make it read-only, streaming events without their details)")
+	flag.BoolVar(&cfg.APIPersist, "apiPersist", false, "Write settings changed through the API back to the -config file, which must be a local file, so they're kept when nvidler restarts")
+	flag.IntVar(&cfg.EventBuffer, "eventBuffer", 100, "Number of events buffered for each GET /events client that hasn't received them yet")
+	flag.StringVar(&cfg.EventOverflow, "eventOverflow", overflowDropOldest, "Which events are lost when a GET /events client's buffer is full: dropOldest or dropNewest")
+
+	flag.StringVar(&cfg.ConfigFile, "config", "", "JSON file of settings keyed by flag name, overridden by any flags given on the command line")
+	flag.BoolVar(&cfg.WatchConfig, "watchConfig", false, "Reload the -config file automatically when it changes, as well as on SIGHUP")
+	flag.StringVar(&cfg.ConfigCache, "configCache", "/var/lib/nvidler/config-cache.json", "When -config is an http(s) URL, keep the last config fetched in this file and fall back on it if the URL can't be reached at startup (empty to disable)")
+	flag.IntVar(&cfg.ConfigRefresh, "configRefresh", 300, "When -config is an http(s) URL, check it for changes every this many seconds and reload it when it has, as well as on SIGHUP (0 to only reload on SIGHUP)")
+	flag.StringVar(&cfg.ConfigPublicKey, "configPublicKey", "", "When -config is an http(s) URL, only accept configs signed with this base64 Ed25519 public key, with the base64 signature served at the same URL with .sig appended (empty to accept unsigned configs)")
+	flag.BoolVar(&cfg.ValidateConfig, "validateConfig", false, "Check the configuration, including any -config file, and exit")
+	flag.IntVar(&cfg.ExplainPID, "explain", 0, "Evaluate this PID once, print each step of the decision about it and exit, without acting on it")
+	flag.StringVar(&cfg.WhatIf, "whatIf", "", "Print which GPU processes would be acted on at each of these idle thresholds in seconds (comma-separated, e.g. 300,600,1800) and exit, without acting on any")
+	flag.StringVar(&cfg.WhatIfFormat, "whatIfFormat", "table", "Format of the -whatIf report: table or json")
+	flag.StringVar(&cfg.Preview, "preview", "", "Print every GPU process ranked by waste (idle time × the fraction of a GPU held) as a table or json and exit, without acting on any")
+	flag.StringVar(&cfg.DescribePolicy, "describePolicy", "", "Print the policy the configuration enforces, generated from it, as text or markdown and exit: what's targeted and acted on, how idleness is defined, the thresholds, what's exempt and what holds enforcement off")
+	flag.BoolVar(&cfg.Once, "once", false, "Scan once, acting as configured, and exit with 0 if nothing was idle, 2 if idle processes were only warned about, 3 if any were terminated, stopped or quarantined, or 1 on an error, e.g. for cron")
+	flag.StringVar(&cfg.OnceSummary, "onceSummary", "", "With -once, also write what the scan found and did to this file as JSON")
+
+	flag.Parse()
+
+	bound.onCommandLine = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { bound.onCommandLine[f.Name] = true })
+
+	var fileErr error
+	if cfg.ConfigFile != "" && isURL(cfg.ConfigFile) {
+		remote, fileErr = newRemoteConfig(*cfg)
+	}
+	if cfg.ConfigFile != "" && fileErr == nil {
+		fileErr = loadConfigFile(cfg.ConfigFile, bound.onCommandLine)
+	}
+	err := errors.Join(fileErr, loadEnv(bound.onCommandLine))
+	return bound.config(), err
+}
+
+// boundFlags holds what the flags are bound to, so that the configuration can
+// be read from them again when the config file is reloaded.
+type boundFlags struct {
+	cfg                                          Config
+	targetWorkloads, whitelist, onlyUsers        string
+	whitelistGPUs, targetImages, whitelistImages string
+	drainGPUs, dockerHosts                       string
+	onCommandLine                                map[string]bool
+}
+
+var bound boundFlags
+
+// config returns the configuration currently held by the flags, converting
+// comma-separated strings to slices.
+func (b *boundFlags) config() Config {
+	cfg := b.cfg
+	cfg.TargetWorkloads = strings.Split(b.targetWorkloads, ",")
+	cfg.Whitelist = strings.Split(b.whitelist, ",")
+	cfg.OnlyUsers = splitList(b.onlyUsers)
+	cfg.WhitelistGPUs = splitList(b.whitelistGPUs)
+	cfg.TargetImages = splitList(b.targetImages)
+	cfg.WhitelistImages = splitList(b.whitelistImages)
+	cfg.DrainGPUs = splitList(b.drainGPUs)
+	cfg.DockerHosts = splitList(b.dockerHosts)
+	return cfg
+}
+
+// reloadConfigFile reads the config file again, returning the resulting
+// configuration. Settings no longer in the file revert to their defaults,
+// while those on the command line or in the environment still take precedence.
+func reloadConfigFile() (Config, error) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !bound.onCommandLine[f.Name] && !contains(commandLineOnly, f.Name) {
+			f.Value.Set(f.DefValue)
+		}
+	})
+	err := errors.Join(loadConfigFile(bound.cfg.ConfigFile, bound.onCommandLine), loadEnv(bound.onCommandLine))
+	return bound.config(), err
+}
+
+// loadConfigFile sets each flag in a JSON config file that wasn't already set
+// on the command line. Unknown settings and values of the wrong type are
+// reported together, naming the setting at fault.
+func loadConfigFile(path string, onCommandLine map[string]bool) error {
+	data, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	// Go through the settings in a stable order so errors are too
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f == nil || contains(commandLineOnly, name) {
+			errs = append(errs, fmt.Errorf("%s: unknown setting", name))
+			continue
+		}
+		value, err := configValue(name, f, settings[name])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s:\n%w", path, errors.Join(errs...))
+	}
+	return nil
+}
+
+// overlayConfigFile returns the configuration held by the flags with the
+// settings in a JSON config file applied over it, whether or not they were set
+// on the command line, for -shadowConfig. The flags are left as they were.
+func overlayConfigFile(path string) (Config, error) {
+	saved := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	defer flag.VisitAll(func(f *flag.Flag) { f.Value.Set(saved[f.Name]) })
+
+	err := loadConfigFile(path, nil)
+	return bound.config(), err
+}
+
+// envAliases are alternative environment variable names for some flags.
+var envAliases = map[string]string{
+	"NVIDLER_IDLE_THRESHOLD": "idleTimeThreshold",
+}
+
+// envName returns the environment variable for a flag, its name in upper snake
+// case prefixed with NVIDLER_, e.g. NVIDLER_IDLE_TIME_THRESHOLD for
+// -idleTimeThreshold.
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString("NVIDLER_")
+	for i, r := range flagName {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(rune(flagName[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// loadEnv sets each flag that has an NVIDLER_* environment variable and wasn't
+// set on the command line, overriding the config file.
+func loadEnv(onCommandLine map[string]bool) error {
+	names := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !contains(commandLineOnly, f.Name) {
+			names[envName(f.Name)] = f.Name
+		}
+	})
+	for alias, name := range envAliases {
+		names[alias] = name
+	}
+
+	var vars []string
+	for env := range names {
+		vars = append(vars, env)
+	}
+	sort.Strings(vars)
+
+	var errs []error
+	for _, env := range vars {
+		value, ok := os.LookupEnv(env)
+		name := names[env]
+		if !ok || onCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", env, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("environment:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// configValue checks that a config file value has the JSON type of its flag
+// and returns it in the form the flag parses.
+func configValue(name string, f *flag.Flag, raw json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+
+	switch f.Value.(flag.Getter).Get().(type) {
+	case bool:
+		if b, ok := value.(bool); ok {
+			return fmt.Sprint(b), nil
+		}
+		return "", fmt.Errorf("%s: expected true or false, got %s", name, raw)
+	case int:
+		if n, ok := value.(float64); ok && n == math.Trunc(n) {
+			return fmt.Sprint(int64(n)), nil
+		}
+		return "", fmt.Errorf("%s: expected a whole number, got %s", name, raw)
+	case float64:
+		if n, ok := value.(float64); ok {
+			return fmt.Sprint(n), nil
+		}
+		return "", fmt.Errorf("%s: expected a number, got %s", name, raw)
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	if _, ok := value.(map[string]interface{}); ok && contains(objectFlags, name) {
+		return string(raw), nil
+	}
+	items, ok := value.([]interface{})
+	if !ok || !contains(listFlags, name) {
+		return "", fmt.Errorf("%s: expected a string, got %s", name, raw)
+	}
+	var list []string
+	var errs []error
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s[%d]: expected a string, got %v", name, i, item))
+			continue
+		}
+		list = append(list, s)
+	}
+	return strings.Join(list, ","), errors.Join(errs...)
+}
+
+// validate checks that the settings are consistent and within range, reporting
+// every problem rather than just the first.
+func (cfg Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.IdleTimeThreshold >= 0, "invalid -idleTimeThreshold %d: must not be negative", cfg.IdleTimeThreshold)
+	check(cfg.MaxRuntime >= 0, "invalid -maxRuntime %d: must not be negative", cfg.MaxRuntime)
+	check(cfg.MaxRuntimeAction == "warn" || cfg.MaxRuntimeAction == "terminate", "invalid -maxRuntimeAction %q: must be warn or terminate", cfg.MaxRuntimeAction)
+	check(cfg.BusinessHoursMultiplier >= 1, "invalid -businessHoursMultiplier %v: must be at least 1", cfg.BusinessHoursMultiplier)
+	if cfg.BusinessHours != "" {
+		_, err := parseBusinessHours(cfg.BusinessHours)
+		check(err == nil, "invalid -businessHours: %v", err)
+	}
+	check(cfg.SleepInterval >= 1, "invalid -sleepInterval %d: must be at least 1", cfg.SleepInterval)
+	check(cfg.LatencyWarnFraction >= 0, "invalid -latencyWarnFraction %v: must not be negative", cfg.LatencyWarnFraction)
+	check(cfg.LatencyWindow >= 1, "invalid -latencyWindow %d: must be at least 1", cfg.LatencyWindow)
+	check(cfg.SMITimeout >= 0, "invalid -smiTimeout %d: must not be negative", cfg.SMITimeout)
+	check(cfg.SummaryInterval >= 0, "invalid -summaryInterval %d: must not be negative", cfg.SummaryInterval)
+	check(cfg.SelfStatsInterval >= 0, "invalid -selfStatsInterval %d: must not be negative", cfg.SelfStatsInterval)
+	check(cfg.TelemetryInterval >= 1, "invalid -telemetryInterval %d: must be at least 1", cfg.TelemetryInterval)
+	if cfg.TelemetryEndpoint != "" {
+		u, err := url.Parse(cfg.TelemetryEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "invalid -telemetryEndpoint: must be an http or https URL")
+	}
+	check(cfg.SelfMemoryLimitMB >= 0, "invalid -selfMemoryLimitMB %d: must not be negative", cfg.SelfMemoryLimitMB)
+	check(cfg.SelfMaxProcs >= 0, "invalid -selfMaxProcs %d: must not be negative", cfg.SelfMaxProcs)
+	check(cfg.WarnRepeatInterval >= 0, "invalid -warnRepeatInterval %d: must not be negative", cfg.WarnRepeatInterval)
+	check(cfg.ConfirmCycles >= 1, "invalid -confirmCycles %d: must be at least 1", cfg.ConfirmCycles)
+	check(cfg.MaxLoggedProcesses >= 0, "invalid -maxLoggedProcesses %d: must not be negative", cfg.MaxLoggedProcesses)
+	check(cfg.RotateMinMB >= 0, "invalid -rotateMinMB %d: must not be negative", cfg.RotateMinMB)
+	check(cfg.WarnUnusedWhitelist >= 0, "invalid -warnUnusedWhitelist %d: must not be negative", cfg.WarnUnusedWhitelist)
+	check(cfg.LeakedContextThreshold >= 0, "invalid -leakedContextThreshold %d: must not be negative", cfg.LeakedContextThreshold)
+	check(cfg.LeakedContextThreshold == 0 || cfg.Pmon, "invalid -leakedContextThreshold: requires -pmon")
+	check(cfg.OomProtectedAdj >= -1000 && cfg.OomProtectedAdj <= 1000, "invalid -oomProtectedAdj %d: must be from -1000 to 1000", cfg.OomProtectedAdj)
+	check(!cfg.RespectMemTransfers || cfg.Pmon, "invalid -respectMemTransfers: requires -pmon")
+	check(cfg.MaxPeakMB >= 0, "invalid -maxPeakMB %d: must not be negative", cfg.MaxPeakMB)
+	check(!cfg.SeedIdleFromStartTime || cfg.IdlePolicy != "", "invalid -seedIdleFromStartTime: requires -idlePolicy")
+	check(cfg.MinReclaimableMB >= 0, "invalid -minReclaimableMB %d: must not be negative", cfg.MinReclaimableMB)
+	check(cfg.FailSafeAfter >= 0, "invalid -failSafeAfter %d: must not be negative", cfg.FailSafeAfter)
+	check(cfg.FailSafeRecovery >= 1, "invalid -failSafeRecovery %d: must be at least 1", cfg.FailSafeRecovery)
+	check(cfg.MassIdleGuard >= 0 && cfg.MassIdleGuard < 1, "invalid -massIdleGuard %v: must be at least 0 and below 1", cfg.MassIdleGuard)
+	check(cfg.MassIdleMinProcesses >= 1, "invalid -massIdleMinProcesses %d: must be at least 1", cfg.MassIdleMinProcesses)
+	check(cfg.EventBuffer >= 1, "invalid -eventBuffer %d: must be at least 1", cfg.EventBuffer)
+	check(cfg.EventOverflow == overflowDropOldest || cfg.EventOverflow == overflowDropNewest, "invalid -eventOverflow %q: must be %s or %s", cfg.EventOverflow, overflowDropOldest, overflowDropNewest)
+	check(cfg.TempThreshold >= 0, "invalid -tempThreshold %d: must not be negative", cfg.TempThreshold)
+	check(cfg.TempSustain >= 0, "invalid -tempSustain %d: must not be negative", cfg.TempSustain)
+	check(cfg.MinNodeUptime >= 0, "invalid -minNodeUptime %d: must not be negative", cfg.MinNodeUptime)
+	check(cfg.DStateAlertAfter >= 0, "invalid -dStateAlertAfter %d: must not be negative", cfg.DStateAlertAfter)
+	check(!cfg.SnapshotBeforeKill || cfg.SnapshotMaxMB >= 1, "invalid -snapshotMaxMB %d: must be at least 1", cfg.SnapshotMaxMB)
+	check(cfg.DiagBufferSize >= 0, "invalid -diagBufferSize %d: must not be negative", cfg.DiagBufferSize)
+	check(cfg.DiagBufferSize == 0 || cfg.DiagDumpDir != "", "invalid -diagDumpDir: required with -diagBufferSize")
+	check(cfg.DiagBufferSize == 0 || cfg.DiagDumpMaxMB >= 1, "invalid -diagDumpMaxMB %d: must be at least 1", cfg.DiagDumpMaxMB)
+	check(cfg.ShadowLogFile == "" || cfg.ShadowConfig != "", "invalid -shadowLogFile: requires -shadowConfig")
+	check(cfg.ContainerIdlePolicy == "any" || cfg.ContainerIdlePolicy == "all", "invalid -containerIdlePolicy %q: must be any or all", cfg.ContainerIdlePolicy)
+	check(cfg.ReapGranularity == "process" || cfg.ReapGranularity == "cgroup", "invalid -reapGranularity %q: must be process or cgroup", cfg.ReapGranularity)
+	check(cfg.QuarantineAction == "" || cfg.QuarantineAction == quarantineRenice || cfg.QuarantineAction == quarantineCgroupLimit, "invalid -quarantineAction %q: must be %s or %s", cfg.QuarantineAction, quarantineRenice, quarantineCgroupLimit)
+	check(cfg.QuarantineAction == "" || (cfg.ContainerIdlePolicy == "any" && cfg.ReapGranularity == "process"), "invalid -quarantineAction: can't be used with -containerIdlePolicy all or -reapGranularity cgroup")
+	check(contains(reclaimOrders, cfg.ReclaimOrder), "invalid -reclaimOrder %q: must be one of %s", cfg.ReclaimOrder, strings.Join(reclaimOrders, ", "))
+	check(!cfg.ContainerOnly || cfg.DockerEnabled, "invalid -containerOnly: requires -docker")
+	check(cfg.RequireFreshAttribution >= 0, "invalid -requireFreshAttribution %d: must not be negative", cfg.RequireFreshAttribution)
+	check(cfg.RequireFreshAttribution == 0 || cfg.DockerEnabled, "invalid -requireFreshAttribution: requires -docker")
+	if cfg.DockerHost != "" {
+		_, err := client.ParseHostURL(cfg.DockerHost)
+		check(err == nil, "invalid -dockerHost %q: %v", cfg.DockerHost, err)
+	}
+	check(len(cfg.DockerHosts) == 0 || cfg.DockerHost == "", "invalid -dockerHosts: can't be used with -dockerHost")
+	for i, host := range cfg.DockerHosts {
+		_, err := client.ParseHostURL(host)
+		check(err == nil, "invalid -dockerHosts[%d] %q: %v", i, host, err)
+	}
+	check((cfg.DockerTLSCert == "") == (cfg.DockerTLSKey == ""), "invalid -dockerTLSCert/-dockerTLSKey: must be set together")
+	check(cfg.WallNotify >= 0, "invalid -wallNotify %d: must be 0 or more seconds", cfg.WallNotify)
+	check(!cfg.ContainerOnly || !cfg.RespectActiveTty, "invalid -containerOnly: can't be used with -respectActiveTty, which only applies to host sessions")
+	check(!cfg.SlurmCancel || cfg.Slurm, "invalid -slurmCancel: requires -slurm")
+	check(cfg.SplitStreams == "" || cfg.SplitStreams == "stdout" || cfg.SplitStreams == "stderr", "invalid -splitStreams %q: must be stdout, stderr or empty", cfg.SplitStreams)
+	check(cfg.Preview == "" || cfg.Preview == "table" || cfg.Preview == "json", "invalid -preview %q: must be table or json", cfg.Preview)
+	check(cfg.DescribePolicy == "" || cfg.DescribePolicy == "text" || cfg.DescribePolicy == "markdown", "invalid -describePolicy %q: must be text or markdown", cfg.DescribePolicy)
+	if cfg.WhatIf != "" {
+		_, err := parseThresholds(cfg.WhatIf)
+		check(err == nil, "invalid -whatIf %q: %v", cfg.WhatIf, err)
+	}
+	check(cfg.WhatIfFormat == "table" || cfg.WhatIfFormat == "json", "invalid -whatIfFormat %q: must be table or json", cfg.WhatIfFormat)
+	check(!cfg.WatchConfig || cfg.ConfigFile != "", "invalid -watchConfig: requires -config")
+	check(!cfg.WatchConfig || !isURL(cfg.ConfigFile), "invalid -watchConfig: a -config URL is checked for changes by -configRefresh")
+	check(!cfg.APIPersist || cfg.ConfigFile != "", "invalid -apiPersist: requires -config")
+	check(!cfg.APIPersist || !isURL(cfg.ConfigFile), "invalid -apiPersist: -config is a URL, which can't be written back to")
+	check(cfg.OnceSummary == "" || cfg.Once, "invalid -onceSummary: requires -once")
+	check(cfg.ConfigRefresh >= 0, "invalid -configRefresh %d: must not be negative", cfg.ConfigRefresh)
+	check(cfg.OnConflict == "exit" || cfg.OnConflict == "wait", "invalid -onConflict %q: must be exit or wait", cfg.OnConflict)
+	check(!cfg.K8sEvict || cfg.K8sNode != "", "invalid -k8sNode: -k8sEvict requires the node name, set NODE_NAME from spec.nodeName")
+	check(cfg.Backend == "csv" || cfg.Backend == "xml", "invalid -backend %q: must be csv or xml", cfg.Backend)
+	for i, ref := range cfg.WhitelistGPUs {
+		check(isGPURef(ref), "invalid -whitelistGPUs[%d] %q: expected a GPU index or UUID", i, ref)
+	}
+	check(cfg.DrainTimeout >= 0, "invalid -drainTimeout %d: must not be negative", cfg.DrainTimeout)
+	check(len(cfg.DrainGPUs) == 0 || cfg.Drain, "invalid -drainGPUs: requires -drain")
+	for i, ref := range cfg.DrainGPUs {
+		check(isGPURef(ref), "invalid -drainGPUs[%d] %q: expected a GPU index or UUID", i, ref)
+	}
+	if cfg.ActivityPaths != "" {
+		_, err := parseActivityPaths(cfg.ActivityPaths)
+		check(err == nil, "invalid -activityPaths: %v", err)
+	}
+	if cfg.BusyFileGlob != "" {
+		_, err := filepath.Match(cfg.BusyFileGlob, "")
+		check(err == nil, "invalid -busyFileGlob %q: %v", cfg.BusyFileGlob, err)
+	}
+	if cfg.IdleClassifierCommand != "" {
+		_, err := parseKillCommand(cfg.IdleClassifierCommand)
+		check(err == nil, "invalid -idleClassifierCommand: %v", err)
+	}
+	for i, pattern := range cfg.TargetImages {
+		check(validImagePattern(pattern), "invalid -targetImages[%d] %q: expected an image glob such as repository:tag, or a full digest such as repository@sha256:<digest>", i, pattern)
+	}
+	for i, pattern := range cfg.WhitelistImages {
+		check(validImagePattern(pattern), "invalid -whitelistImages[%d] %q: expected an image glob such as repository:tag, or a full digest such as repository@sha256:<digest>", i, pattern)
+	}
+	check(len(cfg.TargetImages)+len(cfg.WhitelistImages) == 0 || cfg.DockerEnabled, "invalid -targetImages/-whitelistImages: requires -docker")
+
+	extraFields, err := parseExtraFields(cfg.ExtraQueryFields)
+	check(err == nil, "invalid -extraQueryFields: %v", err)
+	if cfg.IdleExpr != "" && err == nil {
+		_, err := compileIdleExpr(cfg.IdleExpr, cfg.valueFields(extraFields))
+		check(err == nil, "invalid -idleExpr: %v", err)
+	}
+	if cfg.IdlePolicy != "" && err == nil {
+		_, err := parseIdlePolicy(cfg.IdlePolicy, cfg.valueFields(extraFields))
+		check(err == nil, "invalid -idlePolicy: %v", err)
+	}
+	check(cfg.OnNoAccounting == "conservative" || cfg.OnNoAccounting == "aggressive", "invalid -onNoAccounting %q: must be conservative or aggressive", cfg.OnNoAccounting)
+	check(cfg.IdleExpr == "" || cfg.IdlePolicy == "", "invalid -idlePolicy: can't be used with -idleExpr")
+	_, err = parseReclaimTargets(cfg.ReclaimTargetMB)
+	check(err == nil, "invalid -reclaimTargetMB: %v", err)
+	_, err = parseLadder(cfg.SignalLadder)
+	check(err == nil, "invalid -signalLadder: %v", err)
+	check(!cfg.ProbeBeforeKill || cfg.SignalLadder != "", "invalid -probeBeforeKill: requires -signalLadder")
+	if cfg.KillCommand != "" {
+		_, err := parseKillCommand(cfg.KillCommand)
+		check(err == nil, "invalid -killCommand: %v", err)
+		check(!cfg.SlurmCancel, "invalid -killCommand: can't be used with -slurmCancel")
+		check(cfg.SignalLadder == "", "invalid -killCommand: can't be used with -signalLadder")
+	}
+	if cfg.WebhookURL != "" {
+		_, err := newWebhookSink(cfg.WebhookURL, cfg.WebhookTemplate)
+		check(err == nil, "invalid -webhookTemplate: %v", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// valueFields returns every field whose values are collected for each process:
+// the extra query fields, plus the pmon fields with -pmon.
+func (cfg Config) valueFields(extraFields []queryField) []queryField {
+	if cfg.Pmon {
+		return append(append([]queryField{}, extraFields...), pmonFields...)
+	}
+	return extraFields
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInvalidConfigFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string // in the error, naming each setting at fault
+	}{
+		{"not JSON", `{"idleTimeThreshold": 600,}`, []string{"invalid character"}},
+		{"unknown setting", `{"idleTimeTreshold": 600}`, []string{"idleTimeTreshold: unknown setting"}},
+		{"command line only", `{"once": true}`, []string{"once: unknown setting"}},
+		{"wrong type", `{"idleTimeThreshold": "600", "warningOnly": "no"}`, []string{
+			`idleTimeThreshold: expected a whole number, got "600"`,
+			`warningOnly: expected true or false, got "no"`,
+		}},
+		{"fraction for a whole number", `{"idleTimeThreshold": 1.5}`, []string{"idleTimeThreshold: expected a whole number, got 1.5"}},
+		{"wrong list item", `{"whitelist": ["jupyter", 3]}`, []string{"whitelist[1]: expected a string, got 3"}},
+		{"bad enum", `{"reclaimOrder": "random", "containerIdlePolicy": "most"}`, []string{
+			`invalid -reclaimOrder "random"`,
+			`invalid -containerIdlePolicy "most"`,
+		}},
+		{"out of range", `{"massIdleGuard": 1.5, "oomProtectedAdj": -2000, "confirmCycles": 0}`, []string{
+			"invalid -massIdleGuard 1.5",
+			"invalid -oomProtectedAdj -2000",
+			"invalid -confirmCycles 0",
+		}},
+		{"missing requirement", `{"slurmCancel": true}`, []string{"invalid -slurmCancel: requires -slurm"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useConfigFile(t, tt.content)
+			err := loadConfigFile(path, bound.onCommandLine)
+			if err == nil {
+				err = bound.config().validate()
+			}
+			if err == nil {
+				t.Fatal("config accepted, want an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidConfigFile(t *testing.T) {
+	path := useConfigFile(t, `{"idleTimeThreshold": 600, "warningOnly": false, "whitelist": ["jupyter"], "reclaimOrder": "largest"}`)
+	if err := loadConfigFile(path, bound.onCommandLine); err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	cfg := bound.config()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if cfg.IdleTimeThreshold != 600 || cfg.WarningOnly || !equalStrings(cfg.Whitelist, []string{"jupyter"}) || cfg.ReclaimOrder != "largest" {
+		t.Errorf("config = %+v, want the file's settings", cfg)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := useConfigFile(t, `{"idleTimeThreshold": 120, "warningOnly": true, "confirmCycles": 4}`)
+	t.Setenv("NVIDLER_IDLE_TIME_THRESHOLD", "600")
+	t.Setenv("NVIDLER_WARNING_ONLY", "false")
+	// As if run with -idleTimeThreshold 900
+	if err := flag.Set("idleTimeThreshold", "900"); err != nil {
+		t.Fatal(err)
+	}
+	onCommandLine := map[string]bool{"idleTimeThreshold": true}
+
+	if err := loadConfigFile(path, onCommandLine); err != nil {
+		t.Fatalf("loadConfigFile: %v", err)
+	}
+	if err := loadEnv(onCommandLine); err != nil {
+		t.Fatalf("loadEnv: %v", err)
+	}
+	cfg := bound.config()
+	if cfg.IdleTimeThreshold != 900 {
+		t.Errorf("idleTimeThreshold = %d, want the flag's 900 over the environment and file", cfg.IdleTimeThreshold)
+	}
+	if cfg.WarningOnly {
+		t.Error("warningOnly = true, want the environment's false over the file")
+	}
+	if cfg.ConfirmCycles != 4 {
+		t.Errorf("confirmCycles = %d, want the file's 4 over the default", cfg.ConfirmCycles)
+	}
+	if cfg.MaxRuntime != 0 {
+		t.Errorf("maxRuntime = %d, want the default 0", cfg.MaxRuntime)
+	}
+}
+
+func TestEnvAlias(t *testing.T) {
+	resetFlags(t)
+	t.Setenv("NVIDLER_IDLE_THRESHOLD", "450")
+	if err := loadEnv(nil); err != nil {
+		t.Fatalf("loadEnv: %v", err)
+	}
+	if got := bound.config().IdleTimeThreshold; got != 450 {
+		t.Errorf("idleTimeThreshold = %d, want 450 from NVIDLER_IDLE_THRESHOLD", got)
+	}
+}
+
+func TestInvalidEnv(t *testing.T) {
+	resetFlags(t)
+	t.Setenv("NVIDLER_CONFIRM_CYCLES", "several")
+	err := loadEnv(nil)
+	if err == nil || !strings.Contains(err.Error(), "NVIDLER_CONFIRM_CYCLES") {
+		t.Fatalf("loadEnv = %v, want an error naming NVIDLER_CONFIRM_CYCLES", err)
+	}
+}
+
+func TestReadConfigVerifiesOtherURLs(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := `{"idleTimeThreshold": 1800}`
+	signed := base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(settings)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good.json", "/forged.json", "/unsigned.json":
+			w.Write([]byte(settings))
+		case "/good.json.sig":
+			w.Write([]byte(signed))
+		case "/forged.json.sig":
+			w.Write([]byte(base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	saved := remote
+	t.Cleanup(func() { remote = saved })
+
+	// Without -configPublicKey any URL is read as it is
+	remote = nil
+	if data, err := readConfig(server.URL + "/forged.json"); err != nil || string(data) != settings {
+		t.Fatalf("readConfig without a key = %q, %v, want the settings", data, err)
+	}
+
+	// With it, other URLs must be signed by the same key as -config's
+	remote = &remoteConfig{url: server.URL + "/config.json", publicKey: public}
+	if data, err := readConfig(server.URL + "/good.json"); err != nil || string(data) != settings {
+		t.Errorf("readConfig of a signed URL = %q, %v, want the settings", data, err)
+	}
+	for _, path := range []string{"/forged.json", "/unsigned.json"} {
+		if _, err := readConfig(server.URL + path); err == nil {
+			t.Errorf("readConfig of %s succeeded, want it rejected for -configPublicKey", path)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "log"
+
+// confirmer requires a process to be judged eligible for termination on a
+// number of consecutive scans before it's actually terminated, guarding against
+// a single bad sample from nvidia-smi.
+type confirmer struct {
+	cycles int
+	counts map[int]int // consecutive scans each PID has been eligible
+}
+
+func newConfirmer(cycles int) *confirmer {
+	return &confirmer{cycles: cycles, counts: make(map[int]int)}
+}
+
+// confirm records the PIDs judged eligible for termination in this scan and
+// returns those that have now been eligible for the required number of
+// consecutive scans. Any PID that isn't eligible in this scan starts over.
+func (c *confirmer) confirm(eligible map[int]bool, logger *log.Logger) map[int]bool {
+	counts := make(map[int]int, len(eligible))
+	confirmed := make(map[int]bool, len(eligible))
+	for pid := range eligible {
+		counts[pid] = c.counts[pid] + 1
+		if counts[pid] >= c.cycles {
+			confirmed[pid] = true
+		} else {
+			logger.Printf("PID %d is eligible for termination, awaiting confirmation (%d of %d consecutive scans).\n", pid, counts[pid], c.cycles)
+		}
+	}
+	for pid, count := range c.counts {
+		if !eligible[pid] && count < c.cycles {
+			logger.Printf("PID %d is no longer eligible for termination, resetting its confirmation.\n", pid)
+		}
+	}
+
+	c.counts = counts
+	return confirmed
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestConfirmerResetByBusySample(t *testing.T) {
+	c := newConfirmer(3)
+	logger := log.New(io.Discard, "", 0)
+	idle := map[int]bool{1001: true}
+
+	for scan := 1; scan <= 2; scan++ {
+		if got := c.confirm(idle, logger); got[1001] {
+			t.Fatalf("confirmed on scan %d of 3", scan)
+		}
+	}
+
+	// One busy sample in between starts the count over
+	c.confirm(map[int]bool{}, logger)
+	for scan := 1; scan <= 2; scan++ {
+		if got := c.confirm(idle, logger); got[1001] {
+			t.Fatalf("confirmed on scan %d after a busy sample, want 3 more consecutive scans", scan)
+		}
+	}
+	if got := c.confirm(idle, logger); !got[1001] {
+		t.Fatal("not confirmed after 3 consecutive eligible scans")
+	}
+}
+
+func TestScanAwaitsConfirmation(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.ConfirmCycles = 2
+	m := e.monitor(cfg)
+
+	e.gpuProcesses("1001, 0")
+	m.scan()
+	e.gpuProcesses("1001, 512")
+	m.scan()
+	e.gpuProcesses("1001, 0")
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v, want the busy scan to have reset the confirmation", got)
+	}
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v after 2 consecutive idle scans", got, want)
+	}
+}
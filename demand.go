@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// demandClient fetches -demandSignal when it's a URL.
+var demandClient = &http.Client{Timeout: 5 * time.Second}
+
+// demand is what -demandSignal reports is waiting for a GPU.
+type demand struct {
+	Pending int         `json:"pending"`
+	Jobs    []queuedJob `json:"jobs"` // if given, idle processes are only reclaimed to unblock them
+}
+
+// queuedJob is a GPU job waiting to run, as reported by the scheduler through
+// -demandSignal.
+type queuedJob struct {
+	ID       string   `json:"id"`
+	Priority int      `json:"priority"` // higher is more important
+	GPUs     []string `json:"gpus"`     // GPUs it could run on by index or UUID, empty for any
+	MemoryMB int      `json:"memoryMB"` // GPU memory it needs, 0 for a whole GPU
+}
+
+// readDemand reads what's waiting for a GPU from -demandSignal, a file written
+// by the scheduler or a URL serving the same.
+func readDemand(source string) (demand, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		var resp *http.Response
+		if resp, err = demandClient.Get(source); err != nil {
+			return demand{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return demand{}, fmt.Errorf("%s returned %s", source, resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return demand{}, err
+	}
+	return parseDemand(data)
+}
+
+// parseDemand parses a demand signal: the number of pending GPU jobs, true or
+// false, or a JSON object with the number as "pending" and optionally the
+// queued jobs themselves as "jobs", which count as pending if the number isn't
+// given. Empty means none.
+func parseDemand(data []byte) (demand, error) {
+	s := strings.TrimSpace(string(data))
+	switch strings.ToLower(s) {
+	case "", "false", "no":
+		return demand{}, nil
+	case "true", "yes":
+		return demand{Pending: 1}, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return demand{Pending: n}, nil
+	}
+	var signal struct {
+		Pending *int        `json:"pending"`
+		Jobs    []queuedJob `json:"jobs"`
+	}
+	if err := json.Unmarshal([]byte(s), &signal); err == nil && (signal.Pending != nil || signal.Jobs != nil) {
+		d := demand{Pending: len(signal.Jobs), Jobs: signal.Jobs}
+		if signal.Pending != nil {
+			d.Pending = *signal.Pending
+		}
+		for i, job := range d.Jobs {
+			if job.MemoryMB < 0 {
+				return demand{}, fmt.Errorf("invalid memoryMB %d for queued job %s, must not be negative", job.MemoryMB, job.ID)
+			}
+			for _, ref := range job.GPUs {
+				if !isGPURef(ref) {
+					return demand{}, fmt.Errorf("invalid GPU %q for queued job %s, expected an index or UUID", ref, job.ID)
+				}
+			}
+			if job.ID == "" {
+				d.Jobs[i].ID = strconv.Itoa(i)
+			}
+		}
+		if d.Pending >= 0 {
+			return d, nil
+		}
+	}
+	return demand{}, fmt.Errorf("expected a number of pending jobs, true, false or {\"pending\": N, \"jobs\": [...]}, got %q", truncate(s))
+}
+
+// checkDemand polls -demandSignal, reporting whether there are GPU jobs
+// waiting for idle processes to be reclaimed, and keeping any queued jobs it
+// lists for planPreemption. Without -demandSignal there's always taken to be
+// demand, and if it can't be read there's taken to be none, so nothing is
+// terminated on a guess. Changes in demand are logged.
+func (m *monitor) checkDemand() bool {
+	m.queuedJobs = nil
+	if m.cfg.DemandSignal == "" {
+		return true
+	}
+	d, err := readDemand(m.cfg.DemandSignal)
+	var state string
+	switch {
+	case err != nil:
+		state = fmt.Sprintf("Failed to read -demandSignal %s, treating it as no demand and only warning: %v", m.cfg.DemandSignal, err)
+	case d.Pending == 0:
+		state = "Demand: no GPU jobs are waiting, only warning about idle processes."
+	case len(d.Jobs) > 0:
+		state = fmt.Sprintf("Demand: GPU jobs are waiting (%d), reclaiming idle processes to unblock the %d queued jobs listed, highest priority first.", d.Pending, len(d.Jobs))
+	default:
+		state = fmt.Sprintf("Demand: GPU jobs are waiting (%d), enforcing.", d.Pending)
+	}
+
+	// The count is left out when comparing, so a queue that changes length
+	// while staying busy isn't logged every scan
+	key := state
+	if err == nil && d.Pending > 0 {
+		key = "pending"
+		if len(d.Jobs) > 0 {
+			key = "queued"
+		}
+	}
+	if key != m.demandState {
+		m.logger.Println(state)
+		m.demandState = key
+	}
+	if err != nil || d.Pending == 0 {
+		return false
+	}
+	m.queuedJobs = d.Jobs
+	return true
+}
+
+// planPreemption narrows the candidates due for termination down to those
+// blocking queued jobs, for targeted preemption rather than blanket reaping.
+// Jobs are taken highest priority first, and each is given the GPU it could
+// run on that needs the least memory reclaimed, largest idle processes first;
+// a job needing no particular amount of memory needs a GPU cleared of them. A
+// GPU goes to one job per scan. It returns the candidates to terminate and the
+// job each is meant to unblock.
+func planPreemption(candidates []candidate, terminate map[int]bool, jobs []queuedJob, gpus []gpuInfo, logger *log.Logger) (map[int]bool, map[int]queuedJob) {
+	byGPU := make(map[string][]candidate)
+	for _, c := range candidates {
+		if terminate[c.PID] {
+			byGPU[c.GPUUUID] = append(byGPU[c.GPUUUID], c)
+		}
+	}
+	for _, group := range byGPU {
+		sortCandidates(group, "largest")
+	}
+
+	jobs = append([]queuedJob(nil), jobs...)
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].Priority > jobs[j].Priority })
+
+	chosen := make(map[int]bool)
+	unblocks := make(map[int]queuedJob)
+	taken := make(map[string]bool)
+	for _, job := range jobs {
+		var best *gpuInfo
+		var bestVictims []candidate
+		bestReclaimed, fits := 0, false
+		for i, gpu := range gpus {
+			if taken[gpu.UUID] || (len(job.GPUs) > 0 && !gpu.matchesAny(job.GPUs)) {
+				continue
+			}
+			if job.MemoryMB > 0 && gpu.MemoryFree >= job.MemoryMB {
+				logger.Printf("Preemption: queued job %s (priority %d) already fits on GPU %d with %d MB free, it isn't blocked by idle processes.\n", job.ID, job.Priority, gpu.Index, gpu.MemoryFree)
+				best, fits = nil, true
+				break
+			}
+
+			var victims []candidate
+			free, reclaimed := gpu.MemoryFree, 0
+			for _, c := range byGPU[gpu.UUID] {
+				if job.MemoryMB > 0 && free >= job.MemoryMB {
+					break
+				}
+				victims = append(victims, c)
+				free += c.UsedMemory
+				reclaimed += c.UsedMemory
+			}
+			if len(victims) == 0 || (job.MemoryMB > 0 && free < job.MemoryMB) {
+				continue
+			}
+			if best == nil || reclaimed < bestReclaimed {
+				best, bestVictims, bestReclaimed = &gpus[i], victims, reclaimed
+			}
+		}
+		if best == nil {
+			if !fits {
+				logger.Printf("Preemption: queued job %s (priority %d) can't be unblocked by reclaiming the idle processes on the GPUs it could run on.\n", job.ID, job.Priority)
+			}
+			continue
+		}
+
+		taken[best.UUID] = true
+		for _, c := range bestVictims {
+			chosen[c.PID] = true
+			unblocks[c.PID] = job
+			logger.Printf("Preemption: selected PID %d (%s, %d MB) on GPU %d to unblock queued job %s (priority %d).\n", c.PID, c.Name, c.UsedMemory, best.Index, job.ID, job.Priority)
+		}
+	}
+
+	for pid := range terminate {
+		if !chosen[pid] {
+			logger.Printf("Preemption: sparing PID %d, it isn't blocking any queued job.\n", pid)
+		}
+	}
+	return chosen, unblocks
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxDetailLength caps the length of each captured detail.
+const maxDetailLength = 512
+
+// jobIDVariables are environment variables identifying the batch job or
+// workload a process belongs to.
+var jobIDVariables = []string{
+	"SLURM_JOB_ID",
+	"PBS_JOBID",
+	"LSB_JOBID",
+	"JOB_ID",
+	"KUBERNETES_POD_NAME",
+	"HOSTNAME",
+}
+
+// secretPattern matches names that suggest the value is a secret.
+var secretPattern = regexp.MustCompile(`(?i)(token|secret|passw(or)?d|api[_-]?key|credential|auth)`)
+
+// procDetails identifies what a process was, captured before it's terminated as
+// the information disappears along with the process.
+type procDetails struct {
+	Cmdline string
+	Cwd     string
+	JobIDs  map[string]string
+}
+
+// captureProcDetails reads a process's command line, working directory and job
+// identifiers. Anything that can't be read is left empty.
+func captureProcDetails(pid int) procDetails {
+	d := procDetails{JobIDs: make(map[string]string)}
+
+	if data, err := os.ReadFile(procPath(pid, "cmdline")); err == nil {
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		d.Cmdline = truncate(strings.Join(redactArgs(args), " "))
+	}
+	if cwd, err := os.Readlink(procPath(pid, "cwd")); err == nil {
+		d.Cwd = truncate(cwd)
+	}
+	if data, err := os.ReadFile(procPath(pid, "environ")); err == nil {
+		for _, kv := range bytes.Split(data, []byte{0}) {
+			key, value, ok := strings.Cut(string(kv), "=")
+			if ok && contains(jobIDVariables, key) && !secretPattern.MatchString(value) {
+				d.JobIDs[key] = truncate(value)
+			}
+		}
+	}
+	return d
+}
+
+// redactArgs replaces the values of arguments that look like secrets, whether
+// given as --name=value or as --name value.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = arg
+		if name, _, ok := strings.Cut(arg, "="); ok && secretPattern.MatchString(name) {
+			redacted[i] = name + "=REDACTED"
+		} else if i > 0 && strings.HasPrefix(args[i-1], "-") && !strings.Contains(args[i-1], "=") && secretPattern.MatchString(args[i-1]) {
+			redacted[i] = "REDACTED"
+		}
+	}
+	return redacted
+}
+
+func truncate(s string) string {
+	if len(s) > maxDetailLength {
+		return s[:maxDetailLength] + "..."
+	}
+	return s
+}
+
+// fields returns the details as a flat map, e.g. for structured event sinks.
+func (d procDetails) fields() map[string]string {
+	fields := map[string]string{"cmdline": d.Cmdline, "cwd": d.Cwd}
+	for key, value := range d.JobIDs {
+		fields[strings.ToLower(key)] = value
+	}
+	return fields
+}
+
+func (d procDetails) String() string {
+	s := fmt.Sprintf("cmdline=%q cwd=%q", d.Cmdline, d.Cwd)
+
+	keys := make([]string, 0, len(d.JobIDs))
+	for key := range d.JobIDs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s += fmt.Sprintf(" %s=%q", key, d.JobIDs[key])
+	}
+	return s
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// diagOutputMax is how much of each nvidia-smi output is kept in a cycle, so
+// a node with many processes can't grow the buffer without bound.
+const diagOutputMax = 64 << 10
+
+// diagDumpPrefix starts the names of dumps in -diagDumpDir, so pruning only
+// ever removes dumps.
+const diagDumpPrefix = "nvidler-diag-"
+
+// blackBox records the last -diagBufferSize scans, or is nil if it's
+// disabled. Like smiXML it's package level, as nvidia-smi is run from outside
+// the monitor.
+var blackBox *diagRecorder
+
+// diagCommand is an nvidia-smi run and what it returned.
+type diagCommand struct {
+	Time      time.Time `json:"time"`
+	Args      string    `json:"args"`
+	Output    string    `json:"output,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"` // beyond diagOutputMax
+	Error     string    `json:"error,omitempty"`
+}
+
+// diagContainer is a running container as listed at the start of a scan.
+type diagContainer struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	Daemon string `json:"daemon,omitempty"` // with -dockerHosts
+}
+
+// diagCandidate is a process a scan found idle, before any action was decided.
+type diagCandidate struct {
+	PID         int    `json:"pid"`
+	Process     string `json:"process"`
+	Container   string `json:"container,omitempty"`
+	GPU         string `json:"gpu"`
+	UsedMemory  int    `json:"usedMemory"`
+	IdleSeconds int64  `json:"idleSeconds"`
+	Category    string `json:"category,omitempty"`
+}
+
+// diagCycle is everything recorded during one scan: the raw nvidia-smi
+// output, the containers, the idle processes and the events emitted about
+// them.
+type diagCycle struct {
+	Start      time.Time       `json:"start"`
+	Commands   []diagCommand   `json:"commands"`
+	Containers []diagContainer `json:"containers,omitempty"`
+	Candidates []diagCandidate `json:"candidates"`
+	Events     []event         `json:"events"`
+}
+
+// diagRecorder keeps the inputs and decisions of the last few scans in memory
+// as a black box, dumped to a file on panic or SIGUSR2, to find out why a
+// process was acted on without verbose logging always on. Its methods do
+// nothing on a nil recorder.
+type diagRecorder struct {
+	clock    clock
+	logger   *log.Logger
+	size     int
+	dir      string
+	maxBytes int64
+
+	mu     sync.Mutex
+	cycles []*diagCycle
+	paused bool
+}
+
+func newDiagRecorder(size int, dir string, maxMB int, clk clock, logger *log.Logger) *diagRecorder {
+	return &diagRecorder{clock: clk, logger: logger, size: size, dir: dir, maxBytes: int64(maxMB) << 20}
+}
+
+// begin starts recording a new scan, forgetting the oldest once there are more
+// than the buffer holds.
+func (d *diagRecorder) begin() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cycles = append(d.cycles, &diagCycle{Start: d.clock.Now(), Commands: []diagCommand{}, Candidates: []diagCandidate{}, Events: []event{}})
+	if len(d.cycles) > d.size {
+		d.cycles = append([]*diagCycle(nil), d.cycles[len(d.cycles)-d.size:]...)
+	}
+}
+
+// current returns the scan being recorded, or nil before the first. The
+// caller must hold d.mu.
+func (d *diagRecorder) current() *diagCycle {
+	if len(d.cycles) == 0 {
+		return nil
+	}
+	return d.cycles[len(d.cycles)-1]
+}
+
+// pause stops or resumes recording nvidia-smi runs and container listings, for
+// -preview and -whatIf, which evaluate processes as a scan would but aren't
+// scans.
+func (d *diagRecorder) pause(paused bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused = paused
+}
+
+// recordCommand records an nvidia-smi run. Runs outside of scans, such as for
+// telemetry, are recorded with the scan in progress or last run.
+func (d *diagRecorder) recordCommand(args []string, out []byte, err error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cycle := d.current()
+	if cycle == nil || d.paused {
+		return
+	}
+	c := diagCommand{Time: d.clock.Now(), Args: strings.Join(args, " ")}
+	if len(out) > diagOutputMax {
+		out, c.Truncated = out[:diagOutputMax], true
+	}
+	c.Output = string(out)
+	if err != nil {
+		c.Error = err.Error()
+	}
+	cycle.Commands = append(cycle.Commands, c)
+}
+
+// recordContainers records the containers listed for a scan.
+func (d *diagRecorder) recordContainers(ci *containerIndex) {
+	if d == nil || ci == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cycle := d.current()
+	if cycle == nil || d.paused {
+		return
+	}
+	cycle.Containers = cycle.Containers[:0]
+	for _, c := range ci.containers {
+		container := diagContainer{ID: c.ID, Name: containerName(c), Image: c.Image}
+		if ci.multiple {
+			container.Daemon = ci.daemons[c.ID].host
+		}
+		cycle.Containers = append(cycle.Containers, container)
+	}
+	sort.Slice(cycle.Containers, func(i, j int) bool { return cycle.Containers[i].Name < cycle.Containers[j].Name })
+}
+
+// recordCandidates records the processes a scan found idle.
+func (d *diagRecorder) recordCandidates(candidates []candidate) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cycle := d.current()
+	if cycle == nil {
+		return
+	}
+	for _, c := range candidates {
+		cycle.Candidates = append(cycle.Candidates, diagCandidate{
+			PID:         c.PID,
+			Process:     c.Name,
+			Container:   c.Container,
+			GPU:         c.GPUUUID,
+			UsedMemory:  c.UsedMemory,
+			IdleSeconds: int64(c.IdleTime / time.Second),
+			Category:    c.category(),
+		})
+	}
+}
+
+// send records an event with the scan it was emitted in, as an event sink.
+func (d *diagRecorder) send(e event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cycle := d.current(); cycle != nil {
+		cycle.Events = append(cycle.Events, e)
+	}
+	return nil
+}
+
+// dump writes the recorded scans to a new file in -diagDumpDir, oldest first,
+// with why they were dumped, and removes the oldest dumps beyond
+// -diagDumpMaxMB. It returns the file's path.
+func (d *diagRecorder) dump(reason string) (string, error) {
+	d.mu.Lock()
+	now := d.clock.Now()
+	payload, err := json.MarshalIndent(struct {
+		Reason string       `json:"reason"`
+		Time   time.Time    `json:"time"`
+		Cycles []*diagCycle `json:"cycles"`
+	}{reason, now, d.cycles}, "", "  ")
+	d.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(d.dir, 0750); err != nil {
+		return "", err
+	}
+	path := filepath.Join(d.dir, diagDumpPrefix+now.Format("20060102T150405.000")+".json")
+	if err := os.WriteFile(path, payload, 0640); err != nil {
+		return "", err
+	}
+	if err := pruneDiagDumps(d.dir, d.maxBytes); err != nil {
+		d.logger.Printf("Failed to prune diagnostic dumps in %s: %v\n", d.dir, err)
+	}
+	return path, nil
+}
+
+// dumpOnSignal dumps the recorded scans on every SIGUSR2, until nvidler
+// exits.
+func (d *diagRecorder) dumpOnSignal() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		path, err := d.dump("SIGUSR2")
+		if err != nil {
+			d.logger.Printf("Received SIGUSR2, but failed to dump the recorded scans: %v\n", err)
+			continue
+		}
+		d.logger.Printf("Received SIGUSR2, dumped the recorded scans to %s.\n", path)
+	}
+}
+
+// pruneDiagDumps removes the oldest dumps in dir until their total size is no
+// more than maxBytes. The newest dump is always kept, however large it is.
+func pruneDiagDumps(dir string, maxBytes int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type dump struct {
+		path string
+		size int64
+	}
+	var dumps []dump
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), diagDumpPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		dumps = append(dumps, dump{filepath.Join(dir, entry.Name()), info.Size()})
+		total += info.Size()
+	}
+
+	// Names sort by the time they were dumped
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].path < dumps[j].path })
+	for _, d := range dumps[:max(len(dumps)-1, 0)] {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(d.path); err != nil {
+			return err
+		}
+		total -= d.size
+	}
+	return nil
+}
+
+// dumpPanic dumps the recorded scans when a scan panics, along with the panic
+// and its stack, before letting the panic carry on.
+func (m *monitor) dumpPanic(r interface{}, stack []byte) {
+	if blackBox == nil {
+		return
+	}
+	path, err := blackBox.dump(fmt.Sprintf("panic: %v\n\n%s", r, stack))
+	if err != nil {
+		m.logger.Printf("Failed to dump the recorded scans after a panic: %v\n", err)
+		return
+	}
+	m.logger.Printf("Panicked, dumped the recorded scans to %s.\n", path)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// dockerDaemon is a Docker daemon that containers are attributed from.
+type dockerDaemon struct {
+	host string // where it is, without any credentials
+	cli  *client.Client
+}
+
+// newDockerDaemons creates a client for each Docker daemon containers are
+// attributed from: every one in -dockerHosts, such as the system daemon and
+// the rootless daemons of each user, or else the one daemon given by
+// -dockerHost or the environment. The -dockerTLS* flags apply to them all.
+func newDockerDaemons(cfg Config) ([]*dockerDaemon, error) {
+	hosts := cfg.DockerHosts
+	if len(hosts) == 0 {
+		hosts = []string{cfg.DockerHost}
+	}
+	var daemons []*dockerDaemon
+	for _, host := range hosts {
+		cli, err := newDockerClient(cfg, host)
+		if err != nil {
+			return nil, err
+		}
+		daemons = append(daemons, &dockerDaemon{host: daemonHost(cli), cli: cli})
+	}
+	return daemons, nil
+}
+
+// newDockerClient creates a Docker client from the environment, as the docker
+// CLI does, with the host, if not empty, and the -dockerTLS* flags overriding
+// it.
+func newDockerClient(cfg Config, host string) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	if cfg.DockerTLSCACert != "" || cfg.DockerTLSCert != "" {
+		opts = append(opts, client.WithTLSClientConfig(cfg.DockerTLSCACert, cfg.DockerTLSCert, cfg.DockerTLSKey))
+	}
+	return client.NewClientWithOpts(opts...)
+}
+
+// daemonHost returns where a client's daemon is, leaving out any credentials.
+func daemonHost(cli *client.Client) string {
+	host := cli.DaemonHost()
+	if u, err := url.Parse(host); err == nil && u.User != nil {
+		u.User = nil
+		host = u.String()
+	}
+	return host
+}
+
+// pingDocker checks a Docker daemon can be reached, returning where it is and
+// how it's connected to for the log, leaving out any credentials.
+func pingDocker(d *dockerDaemon, cfg Config) (string, error) {
+	endpoint := d.host
+	switch {
+	case cfg.DockerTLSCert != "":
+		endpoint += " over TLS with a client certificate"
+	case cfg.DockerTLSCACert != "" || os.Getenv(client.EnvOverrideCertPath) != "":
+		endpoint += " over TLS"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := d.cli.Ping(ctx); err != nil {
+		return endpoint, fmt.Errorf("Docker daemon at %s isn't reachable: %v", endpoint, err)
+	}
+	return endpoint, nil
+}
+
+// containerIDPattern matches a container ID within a cgroup path, as used by
+// both the cgroupfs (/docker/<id>) and systemd (docker-<id>.scope) drivers.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// containerIDFromCgroup returns the ID of the container a process runs in,
+// taken from its cgroup, or an empty string if it isn't in a container.
+func containerIDFromCgroup(pid int) (string, error) {
+	data, err := os.ReadFile(procPath(pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	ids := containerIDPattern.FindAllString(string(data), -1)
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[len(ids)-1], nil
+}
+
+// containerRef identifies a Docker container.
+type containerRef struct {
+	ID      string
+	Name    string
+	Image   string
+	ImageID string // the local image ID, sha256:<digest>
+	Compose string // project/service, if started by Docker Compose
+	Daemon  string // the daemon it was listed by, with -dockerHosts
+}
+
+// newContainerRef identifies a listed container.
+func (ci *containerIndex) newContainerRef(c types.Container) containerRef {
+	ref := containerRef{ID: c.ID, Name: containerName(c), Image: c.Image, ImageID: c.ImageID, Compose: composeService(c)}
+	if ci.multiple {
+		ref.Daemon = ci.daemons[c.ID].host
+	}
+	return ref
+}
+
+// daemonNote names the daemon a container was listed by for messages, when
+// there's more than one.
+func (ref containerRef) daemonNote() string {
+	if ref.Daemon == "" {
+		return ""
+	}
+	return " of Docker daemon " + ref.Daemon
+}
+
+// containerIndex attributes processes to Docker containers during a single
+// scan, listing the containers only once. A new index is built for every scan,
+// so nothing it caches goes stale.
+type containerIndex struct {
+	containers   map[string]types.Container // by ID
+	daemons      map[string]*dockerDaemon   // the daemon each container was listed by, by ID
+	multiple     bool                       // containers are listed from more than one daemon
+	failed       []string                   // daemons whose containers couldn't be listed
+	initPIDs     map[int]containerRef       // built on first use
+	privileged   map[string]bool            // by ID, as containers are inspected
+	repoDigests  map[string][]string        // by image ID, as images are inspected
+	byPID        map[int]containerRef       // every process looked up so far, including ancestors
+	hits, misses int
+	logger       *log.Logger
+}
+
+// newContainerIndex lists the running containers of every daemon. A daemon
+// whose containers can't be listed is logged and left out, and it's only an
+// error if none of them can be.
+func newContainerIndex(daemons []*dockerDaemon, logger *log.Logger) (*containerIndex, error) {
+	index := &containerIndex{
+		containers:  make(map[string]types.Container),
+		daemons:     make(map[string]*dockerDaemon),
+		multiple:    len(daemons) > 1,
+		byPID:       make(map[int]containerRef),
+		privileged:  make(map[string]bool),
+		repoDigests: make(map[string][]string),
+		logger:      logger,
+	}
+	var err error
+	for _, d := range daemons {
+		var containers []types.Container
+		if containers, err = d.cli.ContainerList(context.Background(), types.ContainerListOptions{}); err != nil {
+			if index.multiple {
+				logger.Printf("Failed to list the containers of Docker daemon %s: %v\n", d.host, err)
+			}
+			index.failed = append(index.failed, d.host)
+			continue
+		}
+		for _, c := range containers {
+			index.containers[c.ID] = c
+			index.daemons[c.ID] = d
+		}
+	}
+	if len(index.failed) == len(daemons) {
+		return nil, err
+	}
+	return index, nil
+}
+
+// client returns the client of the daemon a container was listed by.
+func (ci *containerIndex) client(id string) *client.Client {
+	return ci.daemons[id].cli
+}
+
+// unlisted returns the ID of the container a process is in by its cgroup when
+// that container wasn't listed while a daemon's containers couldn't be, so it
+// may be one of that daemon's. It returns an empty string otherwise.
+func (ci *containerIndex) unlisted(pid int) string {
+	if len(ci.failed) == 0 {
+		return ""
+	}
+	id, err := containerIDFromCgroup(pid)
+	if err != nil || id == "" {
+		return ""
+	}
+	if _, ok := ci.containers[id]; ok {
+		return ""
+	}
+	return id
+}
+
+func containerName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return c.ID[:12]
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// composeService returns the Docker Compose project and service a container
+// was started for as project/service, taken from the labels Compose sets, or
+// an empty string if it wasn't started by Compose. Unlike its name, which has
+// a replica number, it stays the same as the service is recreated and scaled.
+func composeService(c types.Container) string {
+	project, service := c.Labels["com.docker.compose.project"], c.Labels["com.docker.compose.service"]
+	if project == "" || service == "" {
+		return ""
+	}
+	return project + "/" + service
+}
+
+// lookup returns the container a process belongs to. Processes are attributed by
+// their cgroup, falling back to matching the PID against each container's main
+// process, then to the container of its parent. The returned ref is empty if
+// the process isn't in a container. Results are remembered for the scan, so
+// sibling processes only walk their shared ancestry once.
+func (ci *containerIndex) lookup(pid int) containerRef {
+	if ref, ok := ci.byPID[pid]; ok {
+		ci.hits++
+		return ref
+	}
+	ci.misses++
+
+	ref := ci.resolve(pid)
+	ci.byPID[pid] = ref
+	return ref
+}
+
+func (ci *containerIndex) resolve(pid int) containerRef {
+	if id, err := containerIDFromCgroup(pid); err == nil && id != "" {
+		if c, ok := ci.containers[id]; ok {
+			return ci.newContainerRef(c)
+		}
+	}
+
+	if ci.initPIDs == nil {
+		ci.initPIDs = make(map[int]containerRef, len(ci.containers))
+		for _, c := range ci.containers {
+			inspect, err := ci.client(c.ID).ContainerInspect(context.Background(), c.ID)
+			if err != nil {
+				ci.logger.Printf("Failed to inspect container: %s\n", c.ID)
+				continue
+			}
+			ci.initPIDs[inspect.State.Pid] = ci.newContainerRef(c)
+			if inspect.HostConfig != nil {
+				ci.privileged[c.ID] = inspect.HostConfig.Privileged
+			}
+		}
+	}
+	if ref, ok := ci.initPIDs[pid]; ok {
+		return ref
+	}
+
+	// Processes started by a container's main process belong to it too, even
+	// when their cgroup doesn't say so, e.g. with a private cgroup namespace
+	if ppid, err := readPPID(pid); err == nil && ppid > 1 {
+		return ci.lookup(ppid)
+	}
+	return containerRef{}
+}
+
+// infrastructure reports why a container looks like infrastructure rather
+// than a workload, such as a monitoring agent or driver container, for
+// -skipPrivilegedContainers: it's privileged or shares the host's network
+// namespace. It returns an empty string for an ordinary container.
+func (ci *containerIndex) infrastructure(ref containerRef) (string, error) {
+	privileged, ok := ci.privileged[ref.ID]
+	if !ok {
+		inspect, err := ci.client(ref.ID).ContainerInspect(context.Background(), ref.ID)
+		if err != nil {
+			return "", err
+		}
+		privileged = inspect.HostConfig != nil && inspect.HostConfig.Privileged
+		ci.privileged[ref.ID] = privileged
+	}
+
+	var reasons []string
+	if privileged {
+		reasons = append(reasons, "privileged")
+	}
+	if ci.containers[ref.ID].HostConfig.NetworkMode == "host" {
+		reasons = append(reasons, "host networked")
+	}
+	return strings.Join(reasons, " and "), nil
+}
+
+// cutTag splits an image reference or pattern into its repository and tag,
+// dropping any digest. A colon before the last slash is a registry port rather
+// than the start of a tag.
+func cutTag(image string) (repository, tag string, ok bool) {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:], true
+	}
+	return image, "", false
+}
+
+// validImagePattern reports whether an image pattern is well formed.
+func validImagePattern(pattern string) bool {
+	if isDigestPattern(pattern) {
+		repository, digest, ok := strings.Cut(pattern, "@")
+		if !ok {
+			return validDigest(pattern)
+		}
+		repository, _, _ = cutTag(repository)
+		_, repoErr := path.Match(repository, "")
+		return repository != "" && repoErr == nil && validDigest(digest)
+	}
+	repository, tag, _ := cutTag(pattern)
+	_, repoErr := path.Match(repository, "")
+	_, tagErr := path.Match(tag, "")
+	return repository != "" && repoErr == nil && tagErr == nil
+}
+
+// matchImage returns the first pattern matching a container image, or an empty
+// string if none do. Patterns are globs matched separately against the
+// repository and tag, where * in a repository doesn't cross a slash, so
+// jupyter/* matches jupyter/scipy-notebook but not quay.io/jupyter/scipy-notebook.
+// A pattern without a tag matches any tag, and an image without a tag is tagged
+// latest, as Docker does.
+//
+// Digest patterns are left to matchImageDigest, so pinning an image by digest
+// never falls back to matching any tag of its repository.
+func matchImage(patterns []string, image string) string {
+	if image == "" {
+		return ""
+	}
+	repository, tag, ok := cutTag(image)
+	if !ok {
+		tag = "latest"
+	}
+	for _, pattern := range patterns {
+		if isDigestPattern(pattern) {
+			continue
+		}
+		patternRepository, patternTag, ok := cutTag(pattern)
+		if !ok {
+			patternTag = "*"
+		}
+		if matched, _ := path.Match(patternRepository, repository); !matched {
+			continue
+		}
+		if matched, _ := path.Match(patternTag, tag); matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// isDigestPattern reports whether an image pattern pins an image by digest,
+// either its local image ID, sha256:<digest>, or a registry digest,
+// repository@sha256:<digest>, where any tag before the @ is ignored as Docker
+// ignores it.
+func isDigestPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, "sha256:") || strings.Contains(pattern, "@")
+}
+
+// validDigest reports whether a digest is a full sha256 digest.
+func validDigest(digest string) bool {
+	hex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hex) != 64 {
+		return false
+	}
+	for _, r := range hex {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchImageDigest returns the first digest pattern matching a container's
+// image, and the digest it matched, or empty strings if none do. An image ID
+// pattern must equal the image's ID exactly. A registry digest pattern matches
+// one of the image's repository digests when the digests are equal and the
+// repository glob matches, so unlike a tag it can't be moved to a different
+// image. The image's repository digests are only looked up if
+// there's a registry digest pattern.
+func (ci *containerIndex) matchImageDigest(patterns []string, ref containerRef) (rule, digest string, err error) {
+	if ref.ImageID == "" {
+		return "", "", nil
+	}
+	for _, pattern := range patterns {
+		if !isDigestPattern(pattern) {
+			continue
+		}
+		if !strings.Contains(pattern, "@") {
+			if pattern == ref.ImageID {
+				return pattern, ref.ImageID, nil
+			}
+			continue
+		}
+
+		repoDigests, err := ci.imageRepoDigests(ref)
+		if err != nil {
+			return "", "", err
+		}
+		patternRepository, patternDigest, _ := strings.Cut(pattern, "@")
+		patternRepository, _, _ = cutTag(patternRepository)
+		for _, repoDigest := range repoDigests {
+			repository, digest, _ := strings.Cut(repoDigest, "@")
+			if matched, _ := path.Match(patternRepository, repository); matched && digest == patternDigest {
+				return pattern, repoDigest, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// imageRepoDigests returns the registry digests of a container's local image,
+// inspecting it on the container's daemon the first time it's needed in the
+// scan.
+func (ci *containerIndex) imageRepoDigests(ref containerRef) ([]string, error) {
+	repoDigests, ok := ci.repoDigests[ref.ImageID]
+	if !ok {
+		inspect, _, err := ci.client(ref.ID).ImageInspectWithRaw(context.Background(), ref.ImageID)
+		if err != nil {
+			return nil, err
+		}
+		repoDigests = inspect.RepoDigests
+		ci.repoDigests[ref.ImageID] = repoDigests
+	}
+	return repoDigests, nil
+}
+
+// staleAttribution says why the scan's Docker containers can't be relied on to
+// act with -requireFreshAttribution, as exemptions by container or image may
+// be missed: they couldn't all be listed, or were listed too long ago, as
+// when nvidia-smi or inspecting containers was slow. It's empty when they can
+// be, or -requireFreshAttribution isn't set.
+func (m *monitor) staleAttribution(state *scanState) string {
+	if m.cfg.RequireFreshAttribution == 0 || m.docker == nil {
+		return ""
+	}
+	last := "never"
+	if !m.containersListed.IsZero() {
+		last = m.containersListed.Format(time.RFC3339)
+	}
+	switch {
+	case state.containers == nil:
+		return fmt.Sprintf("the Docker containers couldn't be listed this scan (last listed %s)", last)
+	case len(state.containers.failed) > 0:
+		return fmt.Sprintf("the containers of Docker daemons %v couldn't be listed this scan (all last listed %s)", state.containers.failed, last)
+	}
+	if age := m.clock.Now().Sub(m.containersListed); age > time.Duration(m.cfg.RequireFreshAttribution)*time.Second {
+		return fmt.Sprintf("the Docker containers were listed %v ago, more than the %d seconds allowed", age.Truncate(time.Second), m.cfg.RequireFreshAttribution)
+	}
+	return ""
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// fakeDocker is a Docker daemon serving just the parts of the API nvidler
+// uses, from containers and images set up by a test.
+type fakeDocker struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	containers []types.Container
+	inspect    map[string]types.ContainerJSON // by container ID
+	images     map[string]types.ImageInspect  // by image ID
+	stopped    []string                       // IDs of containers stopped
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	t.Helper()
+	d := &fakeDocker{t: t, inspect: make(map[string]types.ContainerJSON), images: make(map[string]types.ImageInspect)}
+	d.server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+// daemon returns a dockerDaemon connected to the fake daemon.
+func (d *fakeDocker) daemon() *dockerDaemon {
+	d.t.Helper()
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+d.server.Listener.Addr().String()), client.WithVersion("1.43"))
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return &dockerDaemon{host: daemonHost(cli), cli: cli}
+}
+
+// addContainer adds a running container whose main process is pid, with any
+// labels as key=value pairs.
+func (d *fakeDocker) addContainer(id, name, image string, pid int, hostConfig container.HostConfig, labels ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := types.Container{ID: id, Names: []string{"/" + name}, Image: image, ImageID: "sha256:" + strings.Repeat(id[:1], 64), Labels: make(map[string]string)}
+	c.HostConfig.NetworkMode = string(hostConfig.NetworkMode)
+	for _, label := range labels {
+		key, value, _ := strings.Cut(label, "=")
+		c.Labels[key] = value
+	}
+	d.containers = append(d.containers, c)
+	d.inspect[id] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: "/" + name, State: &types.ContainerState{Running: true, Pid: pid}, HostConfig: &hostConfig},
+	}
+}
+
+// setImage sets the local image ID of a container's image and the registry
+// digests it was pulled by.
+func (d *fakeDocker) setImage(containerID, imageID string, repoDigests ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.containers {
+		if d.containers[i].ID == containerID {
+			d.containers[i].ImageID = imageID
+		}
+	}
+	d.images[imageID] = types.ImageInspect{ID: imageID, RepoDigests: repoDigests}
+}
+
+func (d *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path := r.URL.Path
+	if _, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/"); ok && strings.HasPrefix(path, "/v") {
+		path = "/" + rest
+	}
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	switch {
+	case path == "/_ping":
+		w.Write([]byte("OK"))
+	case path == "/containers/json":
+		reply(d.containers)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json")
+		if inspect, ok := d.inspect[id]; ok {
+			reply(inspect)
+			return
+		}
+		http.Error(w, `{"message": "No such container"}`, http.StatusNotFound)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/stop"):
+		d.stopped = append(d.stopped, strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/stop"))
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		if image, ok := d.images[id]; ok {
+			reply(image)
+			return
+		}
+		http.Error(w, `{"message": "No such image"}`, http.StatusNotFound)
+	default:
+		http.Error(w, `{"message": "not implemented by the fake daemon"}`, http.StatusNotImplemented)
+	}
+}
+
+// containerID is a full container ID made by repeating a character.
+func containerID(c string) string {
+	return strings.Repeat(c, 64)
+}
+
+// dockerCgroup is the cgroup of a process in a container.
+func dockerCgroup(id string) string {
+	return "0::/system.slice/docker-" + id + ".scope\n"
+}
+
+func TestScanSkipsPrivilegedContainers(t *testing.T) {
+	e := newTestEnv(t)
+	docker := newFakeDocker(t)
+	workload, agent, hostNet := containerID("a"), containerID("b"), containerID("c")
+	docker.addContainer(workload, "trainer", "pytorch/pytorch:2.1", 1001, container.HostConfig{})
+	docker.addContainer(agent, "dcgm-exporter", "nvidia/dcgm-exporter:3.3", 1002, container.HostConfig{Privileged: true})
+	docker.addContainer(hostNet, "node-agent", "agent:1", 1003, container.HostConfig{NetworkMode: "host"})
+	for pid, id := range map[int]string{1001: workload, 1002: agent, 1003: hostNet} {
+		e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(id)})
+	}
+	e.gpuProcesses("1001, 0", "1002, 0", "1003, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.SkipPrivilegedContainers = true
+	m := e.monitor(cfg, docker.daemon())
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want only %v, sparing the privileged and host networked containers", got, want)
+	}
+	for _, want := range []string{"container dcgm-exporter is privileged", "container node-agent is host networked"} {
+		if !strings.Contains(e.log.String(), want) {
+			t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+		}
+	}
+
+	// Without the option they're reclaimed like any other
+	e = newTestEnv(t)
+	for pid, id := range map[int]string{1001: workload, 1002: agent, 1003: hostNet} {
+		e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(id)})
+	}
+	e.gpuProcesses("1002, 0")
+	cfg.ProcRoot = e.proc
+	cfg.SkipPrivilegedContainers = false
+	m = e.monitor(cfg, docker.daemon())
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1002"}; !equalStrings(got, want) {
+		t.Fatalf("signals without -skipPrivilegedContainers = %v, want %v", got, want)
+	}
+}
+
+func TestScanMatchesComposeServices(t *testing.T) {
+	e := newTestEnv(t)
+	docker := newFakeDocker(t)
+	trainer, notebook, loader := containerID("a"), containerID("b"), containerID("c")
+	docker.addContainer(trainer, "ml-trainer-1", "pytorch/pytorch:2.1", 1001, container.HostConfig{}, "com.docker.compose.project=ml", "com.docker.compose.service=trainer")
+	docker.addContainer(notebook, "ml-notebook-1", "jupyter/pytorch-notebook", 1002, container.HostConfig{}, "com.docker.compose.project=ml", "com.docker.compose.service=notebook")
+	docker.addContainer(loader, "ml-loader-1", "pytorch/pytorch:2.1", 1003, container.HostConfig{}, "com.docker.compose.project=ml", "com.docker.compose.service=loader")
+	for pid, id := range map[int]string{1001: trainer, 1002: notebook, 1003: loader} {
+		e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(id)})
+	}
+	e.gpuProcesses("1001, 0", "1002, 0", "1003, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{"ml/trainer", "ml/notebook"}
+	cfg.Whitelist = []string{"ml/notebook"}
+	m := e.monitor(cfg, docker.daemon())
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want only %v: the notebook service is whitelisted and the loader service isn't targeted", got, want)
+	}
+	if want := "container ml-trainer-1 is of Compose service ml/trainer, targeted by -targetWorkloads"; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+}
+
+func TestScanWhitelistsImagesByDigest(t *testing.T) {
+	pinned, retagged := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	pinnedID, retaggedID := "sha256:"+strings.Repeat("d", 64), "sha256:"+strings.Repeat("e", 64)
+
+	tests := []struct {
+		rule string
+		want []string // PIDs signalled
+	}{
+		// A tag matches whatever image it points at now, including one
+		// retagged after the known-good image was pinned, but not the
+		// known-good image under another tag
+		{"pytorch/pytorch:2.1", []string{"-s TERM 1003"}},
+		// A digest matches exactly the known-good image, whatever its tag
+		{"pytorch/pytorch@" + pinned, []string{"-s TERM 1002"}},
+		{"pytorch/*@" + pinned, []string{"-s TERM 1002"}},
+		{pinnedID, []string{"-s TERM 1002"}},
+		{"pytorch/pytorch:2.1@" + retagged, []string{"-s TERM 1001", "-s TERM 1003"}},
+		{"nvidia/cuda@" + pinned, []string{"-s TERM 1001", "-s TERM 1002", "-s TERM 1003"}},
+	}
+	for _, tt := range tests {
+		e := newTestEnv(t)
+		docker := newFakeDocker(t)
+		known, reused, alias := containerID("a"), containerID("b"), containerID("c")
+		docker.addContainer(known, "known", "pytorch/pytorch:2.1", 1001, container.HostConfig{})
+		docker.setImage(known, pinnedID, "pytorch/pytorch@"+pinned)
+		docker.addContainer(reused, "reused", "pytorch/pytorch:2.1", 1002, container.HostConfig{})
+		docker.setImage(reused, retaggedID, "pytorch/pytorch@"+retagged)
+		docker.addContainer(alias, "alias", "pytorch/pytorch:stable", 1003, container.HostConfig{})
+		docker.setImage(alias, pinnedID, "pytorch/pytorch@"+pinned)
+		for pid, id := range map[int]string{1001: known, 1002: reused, 1003: alias} {
+			e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(id)})
+		}
+		e.gpuProcesses("1001, 0", "1002, 0", "1003, 0")
+		cfg := e.config()
+		cfg.WarningOnly = false
+		cfg.WhitelistImages = []string{tt.rule}
+		m := e.monitor(cfg, docker.daemon())
+
+		m.scan()
+		if got := e.signals(); !equalStrings(got, tt.want) {
+			t.Errorf("-whitelistImages %s: signals = %v, want %v", tt.rule, got, tt.want)
+		}
+		if isDigestPattern(tt.rule) && len(tt.want) < 3 && !strings.Contains(e.log.String(), " with digest ") {
+			t.Errorf("-whitelistImages %s: log doesn't name the matched digest:\n%s", tt.rule, e.log.String())
+		}
+	}
+}
+
+func TestScanAttributesContainersOfSeveralDaemons(t *testing.T) {
+	e := newTestEnv(t)
+	system, rootless := newFakeDocker(t), newFakeDocker(t)
+	trainer, notebook := containerID("a"), containerID("b")
+	system.addContainer(trainer, "trainer", "pytorch/pytorch:2.1", 1001, container.HostConfig{})
+	rootless.addContainer(notebook, "notebook", "jupyter/pytorch-notebook", 1002, container.HostConfig{})
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(trainer)})
+	// Found by its main process, as a rootless container's cgroup may not say
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0", "1002, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	systemDaemon, rootlessDaemon := system.daemon(), rootless.daemon()
+	m := e.monitor(cfg, systemDaemon, rootlessDaemon)
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001", "-s TERM 1002"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v", got, want)
+	}
+	for _, want := range []string{
+		"nvidia-smi PID 1001 is in Docker container trainer of Docker daemon " + systemDaemon.host,
+		"nvidia-smi PID 1002 is in Docker container notebook of Docker daemon " + rootlessDaemon.host,
+	} {
+		if !strings.Contains(e.log.String(), want) {
+			t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+		}
+	}
+
+	// A daemon that can't be reached doesn't stop the other's containers being
+	// attributed, but a process in a container that wasn't listed is skipped,
+	// as it may be one of the unreachable daemon's
+	e = newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(trainer)})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Cgroup: dockerCgroup(notebook)})
+	e.gpuProcesses("1001, 0", "1002, 0")
+	cfg.ProcRoot = e.proc
+	m = e.monitor(cfg, systemDaemon, rootlessDaemon)
+	rootless.server.Close()
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals with %s down = %v, want %v", rootlessDaemon.host, got, want)
+	}
+	for _, want := range []string{
+		"Failed to list the containers of Docker daemon " + rootlessDaemon.host,
+		"Skipping PID 1002 (python): its cgroup puts it in container bbbbbbbbbbbb, which wasn't listed",
+	} {
+		if !strings.Contains(e.log.String(), want) {
+			t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// categoryDrain marks events about processes acted on by -drain, as opposed
+// to idle ones.
+const categoryDrain = "drain"
+
+// drainingGPU reports whether a process is on a GPU being drained by -drain:
+// any GPU, or one of -drainGPUs if it's set. A process whose GPU can't be
+// resolved against -drainGPUs isn't drained.
+func (m *monitor) drainingGPU(process gpuProcess, state *scanState) bool {
+	if !m.cfg.Drain {
+		return false
+	}
+	if len(m.cfg.DrainGPUs) == 0 {
+		return true
+	}
+	gpu, ok := state.gpusByUUID[process.GPUUUID]
+	return ok && gpu.matchesAny(m.cfg.DrainGPUs)
+}
+
+// drain clears the GPUs being drained for maintenance. Each target process on
+// them is warned the first scan it's seen, whether it's idle or not, and
+// terminated once it's still running -drainTimeout later. As draining is
+// asked for explicitly, it terminates even with -warningOnly or while
+// enforcement is otherwise held off, except by -failSafeAfter or
+// -requireFreshAttribution, as the scan can't be trusted then.
+func (m *monitor) drain(candidates []candidate, state *scanState) {
+	now := m.clock.Now()
+	timeout := time.Duration(m.cfg.DrainTimeout) * time.Second
+	seen := make(map[int]bool, len(candidates))
+	for _, c := range candidates {
+		seen[c.PID] = true
+		warned, ok := m.drainNotices[c.PID]
+		if !ok {
+			m.drainNotices[c.PID] = now
+			m.events.emit(c.event(actionWarn, fmt.Sprintf("DRAIN WARNING: GPU %s is being drained for maintenance. Process %d (%s) in Docker container %s will be terminated in %v if it's still running.%s", c.GPUUUID, c.PID, c.Name, c.Container, timeout, c.jobNote())))
+			m.stats.recordWarning(c.Owner, c.Container)
+			continue
+		}
+		if now.Sub(warned) < timeout {
+			continue
+		}
+		if m.failSafe.Degraded {
+			m.logger.Printf("Not terminating PID %d (%s) for -drain while -failSafeAfter holds off enforcement.\n", c.PID, c.Name)
+			continue
+		}
+		if reason := m.staleAttribution(state); reason != "" {
+			m.logger.Printf("Not terminating PID %d (%s) for -drain (-requireFreshAttribution), as %s.\n", c.PID, c.Name, reason)
+			continue
+		}
+		note, err := m.signal(c)
+		if err == errNotDue {
+			continue
+		}
+		outcome := m.recordKill(state, c, err)
+		if err != nil {
+			m.emitKill(c.outcomeEvent(actionError, outcome, err.Error()))
+			continue
+		}
+		m.emitKill(c.outcomeEvent(actionTerminate, outcome, fmt.Sprintf("Terminated (drain): Process %d (%s) in Docker container %s was still running on GPU %s %v after being warned that it's being drained.%s%s", c.PID, c.Name, c.Container, c.GPUUUID, now.Sub(warned).Truncate(time.Second), c.jobNote(), note)))
+		m.stats.recordTermination(c.Owner, c.Container, 0, c.Share)
+	}
+
+	for pid := range m.drainNotices {
+		if !seen[pid] {
+			delete(m.drainNotices, pid)
+		}
+	}
+}
+
+// logDrain logs when drain mode is turned on or off, at startup or on a
+// reload.
+func (m *monitor) logDrain() {
+	if m.cfg.Drain == m.draining {
+		return
+	}
+	m.draining = m.cfg.Drain
+	if m.draining {
+		m.logger.Printf("Drain mode is on: every target process on %s is warned and terminated after -drainTimeout of %d seconds, whether idle or not.\n", m.drainedGPUs(), m.cfg.DrainTimeout)
+	} else {
+		m.logger.Println("Drain mode is off, back to idle enforcement only.")
+	}
+}
+
+// drainedGPUs names the GPUs being drained, for logging.
+func (m *monitor) drainedGPUs() string {
+	if len(m.cfg.DrainGPUs) == 0 {
+		return "every GPU"
+	}
+	return fmt.Sprintf("GPUs %v", m.cfg.DrainGPUs)
+}
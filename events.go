@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event actions, also used to pick the severity in sinks that support one.
+const (
+	actionWarn       = "warn"
+	actionTerminate  = "terminate"
+	actionError      = "error"
+	actionCritical   = "critical"
+	actionSummary    = "summary"
+	actionQuarantine = "quarantine" // with -quarantineAction
+	actionRelease    = "release"
+	actionReport     = "report" // the terminations of a scan, consolidated
+)
+
+// event is a notable action or condition, such as an idle process being warned
+// about or terminated.
+type event struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Message     string    `json:"message"`
+	PID         int       `json:"pid,omitempty"`
+	Process     string    `json:"process,omitempty"`
+	Container   string    `json:"container,omitempty"`
+	User        string    `json:"user,omitempty"`
+	GPU         string    `json:"gpu,omitempty"`
+	Job         string    `json:"job,omitempty"`         // SLURM job ID
+	Pod         string    `json:"pod,omitempty"`         // Kubernetes pod as namespace/name
+	GPUShare    float64   `json:"gpuShare,omitempty"`    // fraction of a shared GPU the process has
+	Memory      int       `json:"memory,omitempty"`      // MB of GPU memory held
+	IdleSeconds int64     `json:"idleSeconds,omitempty"` // how long it had been idle
+	Category    string    `json:"category,omitempty"`    // leakedContext, drain or runtime, empty when plain idle
+	Outcome     string    `json:"outcome,omitempty"`     // of an attempt to terminate, as in termination reports
+
+	// Report is the consolidated record of a scan's terminations, for a report
+	// event.
+	Report *sweepReport `json:"report,omitempty"`
+
+	// Details holds any additional context, such as the captured command line
+	// of a terminated process.
+	Details map[string]string `json:"details,omitempty"`
+
+	// batched is set on the event for each termination with -batchTerminations,
+	// when it's left out of the log, journal and webhook for the scan's report.
+	batched bool
+}
+
+// eventSink receives events in addition to the log.
+type eventSink interface {
+	send(e event) error
+}
+
+// streamSink writes events to a stream as JSON, one per line, for -splitStreams.
+type streamSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newStreamSink(w io.Writer) *streamSink {
+	return &streamSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *streamSink) send(e event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(e)
+}
+
+// Overflow policies of a subscription, for when its buffer is full.
+const (
+	overflowDropNewest = "dropNewest" // the new event is discarded
+	overflowDropOldest = "dropOldest" // the oldest buffered event is discarded to make room
+)
+
+// subscription receives events on a channel for a GET /events client, which is
+// how other programs act on events rather than parse the log. Events arrive in
+// the order they were emitted, each at most once. Delivery never blocks the
+// monitor: when the subscriber falls behind and the buffer is full, events are
+// dropped by the overflow policy and counted.
+type subscription struct {
+	events   chan event
+	overflow string
+	mu       sync.Mutex
+	dropped  int
+}
+
+// droppedEvents returns the number of events dropped because the buffer was
+// full.
+func (s *subscription) droppedEvents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *subscription) deliver(e event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.events <- e:
+		return
+	default:
+	}
+
+	// Either the new event or the oldest is lost
+	s.dropped++
+	if s.overflow == overflowDropOldest {
+		select {
+		case <-s.events:
+		default:
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+}
+
+// notifier writes events to the log and forwards them to any configured sinks
+// and subscriptions.
+type notifier struct {
+	logger *log.Logger
+	clock  clock
+	sinks  []eventSink
+
+	mu            sync.Mutex
+	subscriptions map[*subscription]bool
+}
+
+// subscribe returns a subscription to every event emitted from now on, with
+// room for buffer events the subscriber hasn't received yet. It must be
+// unsubscribed once done with.
+func (n *notifier) subscribe(buffer int, overflow string) *subscription {
+	s := &subscription{events: make(chan event, buffer), overflow: overflow}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subscriptions == nil {
+		n.subscriptions = make(map[*subscription]bool)
+	}
+	n.subscriptions[s] = true
+	return s
+}
+
+// unsubscribe stops delivering events to a subscription and closes its channel.
+func (n *notifier) unsubscribe(s *subscription) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subscriptions[s] {
+		delete(n.subscriptions, s)
+		close(s.events)
+	}
+}
+
+// emit logs an event's message, unless it's batched into a report, and
+// delivers it to every sink and subscription. A failing sink doesn't stop
+// delivery to the others.
+func (n *notifier) emit(e event) {
+	if e.Time.IsZero() {
+		e.Time = n.clock.Now()
+	}
+	if !e.batched {
+		n.logger.Println(e.Message)
+	}
+
+	for _, sink := range n.sinks {
+		if err := sink.send(e); err != nil {
+			n.logger.Printf("Failed to deliver event to %T: %v\n", sink, err)
+		}
+	}
+
+	n.mu.Lock()
+	for s := range n.subscriptions {
+		s.deliver(e)
+	}
+	n.mu.Unlock()
+}
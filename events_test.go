@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		overflow string
+		want     []string
+	}{
+		{overflowDropOldest, []string{"2", "3"}},
+		{overflowDropNewest, []string{"1", "2"}},
+	} {
+		n := &notifier{logger: log.New(io.Discard, "", 0), clock: newFakeClock(testEpoch)}
+		sub := n.subscribe(2, tt.overflow)
+		for _, message := range []string{"1", "2", "3"} {
+			n.emit(event{Action: actionWarn, Message: message})
+		}
+		n.unsubscribe(sub)
+
+		var got []string
+		for e := range sub.events {
+			got = append(got, e.Message)
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("%s: received %v, want %v", tt.overflow, got, tt.want)
+		}
+		if sub.droppedEvents() != 1 {
+			t.Errorf("%s: dropped %d events, want 1", tt.overflow, sub.droppedEvents())
+		}
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	m := e.monitor(e.config())
+	server := httptest.NewServer(http.HandlerFunc((&apiServer{m: m}).handleEvents))
+	defer server.Close()
+
+	// The client is subscribed by the time the response starts
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", got)
+	}
+
+	m.scan()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() {
+		t.Fatalf("stream ended without an event: %v", lines.Err())
+	}
+	var got event
+	if err := json.Unmarshal(lines.Bytes(), &got); err != nil {
+		t.Fatalf("event %s: %v", lines.Bytes(), err)
+	}
+	if got.Action != actionWarn || got.PID != 1001 || got.Process != "python" {
+		t.Errorf("streamed event = %+v, want a warning about PID 1001 (python)", got)
+	}
+}
+
+func TestEventsStreamAuthorization(t *testing.T) {
+	e := newTestEnv(t)
+	m := e.monitor(e.config())
+
+	// streamed subscribes to GET /events with a token and returns the first
+	// event streamed, or only the status if the request was refused
+	streamed := func(a *apiServer, token string) (int, event) {
+		t.Helper()
+		server := httptest.NewServer(http.HandlerFunc(a.handleEvents))
+		defer server.Close()
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, event{}
+		}
+		m.events.emit(event{Action: actionTerminate, Message: "Terminated", PID: 1001, User: "alice", Details: map[string]string{"cmdline": "python train.py"}})
+		lines := bufio.NewScanner(resp.Body)
+		if !lines.Scan() {
+			t.Fatalf("stream ended without an event: %v", lines.Err())
+		}
+		var got event
+		if err := json.Unmarshal(lines.Bytes(), &got); err != nil {
+			t.Fatalf("event %s: %v", lines.Bytes(), err)
+		}
+		return resp.StatusCode, got
+	}
+
+	secured := &apiServer{m: m, token: "secret"}
+	for _, token := range []string{"", "wrong"} {
+		if status, _ := streamed(secured, token); status != http.StatusUnauthorized {
+			t.Errorf("GET /events with token %q = %d, want %d", token, status, http.StatusUnauthorized)
+		}
+	}
+	if status, got := streamed(secured, "secret"); status != http.StatusOK || got.Details["cmdline"] != "python train.py" {
+		t.Errorf("GET /events with the token = %d, details %v, want the command line", status, got.Details)
+	}
+
+	// Without an API token anyone can stream, but without the details
+	if status, got := streamed(&apiServer{m: m}, ""); status != http.StatusOK || got.PID != 1001 || got.Details != nil {
+		t.Errorf("GET /events without an API token = %d, %+v, want the event without details", status, got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// explain evaluates a single PID as a scan would, without acting on it, and
+// writes each step of the decision to w. It goes through the same evaluation
+// as a scan so the explanation can't drift from what nvidler would actually do.
+func (m *monitor) explain(pid int, w io.Writer) error {
+	_, gpuProcesses, err := queryComputeApps(m.extraFields)
+	if err != nil {
+		return fmt.Errorf("failed to query GPU processes: %v", err)
+	}
+	if m.cfg.Pmon {
+		m.addPmonValues(gpuProcesses)
+	}
+
+	state := m.newScanState(gpuProcesses)
+	state.explainPID = pid
+
+	// Every process is evaluated, as reclaim targets depend on all candidates
+	var candidates []candidate
+	var target *candidate
+	found := false
+	for _, process := range gpuProcesses {
+		c, ok := m.evaluate(process, state)
+		if process.PID == pid {
+			found = true
+			if ok {
+				target = &c
+			}
+		}
+		if ok && !c.Drain {
+			candidates = append(candidates, c)
+		}
+	}
+
+	fmt.Fprintf(w, "PID %d:\n", pid)
+	if !found {
+		fmt.Fprintf(w, "  Not using a GPU according to nvidia-smi.\n")
+		fmt.Fprintf(w, "Decision: none, only GPU processes are considered.\n")
+		return nil
+	}
+	for _, step := range state.trace {
+		fmt.Fprintf(w, "  %s\n", step)
+	}
+
+	if target == nil {
+		fmt.Fprintf(w, "Decision: none.\n")
+		return nil
+	}
+	if target.Drain {
+		fmt.Fprintf(w, "Decision: drain, warned and then terminated if it's still running after -drainTimeout of %d seconds.\n", m.cfg.DrainTimeout)
+		return nil
+	}
+	if m.cfg.WarningOnly {
+		fmt.Fprintf(w, "Decision: warn, -warningOnly is set.\n")
+		return nil
+	}
+	terminate := planReclaim(candidates, m.reclaimTargets, m.cfg.ReclaimOrder, state.gpus, m.logger)
+	if !terminate[pid] {
+		fmt.Fprintf(w, "Decision: warn, terminating it isn't needed to meet -reclaimTargetMB.\n")
+		return nil
+	}
+	if m.cfg.ContainerIdlePolicy == "all" && target.ContainerID != "" {
+		stops := planContainerStops(candidates, terminate, state.gpuPIDsByContainer, m.logger)
+		if _, ok := stops[target.ContainerID]; ok {
+			fmt.Fprintf(w, "Decision: stop its container %s, all of the container's GPU processes are idle.\n", target.Container)
+		} else {
+			fmt.Fprintf(w, "Decision: warn, not all of container %s's GPU processes are idle and due for termination under -containerIdlePolicy all.\n", target.Container)
+		}
+		return nil
+	}
+	if m.cfg.ReapGranularity == "cgroup" && target.Cgroup != "" && reapableCgroup(target.Cgroup) {
+		reaps := planCgroupReaps(candidates, terminate, state.gpuPIDsByCgroup, m.logger)
+		if _, ok := reaps[target.Cgroup]; ok {
+			fmt.Fprintf(w, "Decision: terminate every process in its cgroup %s, all of the cgroup's GPU processes are idle.\n", target.Cgroup)
+		} else {
+			fmt.Fprintf(w, "Decision: warn, not all of cgroup %s's GPU processes are idle and due for termination under -reapGranularity cgroup.\n", target.Cgroup)
+		}
+		return nil
+	}
+	if state, err := processState(pid); err == nil && state == "D" {
+		fmt.Fprintf(w, "Decision: warn, it's in uninterruptible sleep (D state) and can't be signalled.\n")
+		return nil
+	}
+	if m.cfg.ConfirmCycles > 1 {
+		fmt.Fprintf(w, "Decision: terminate, once it has been eligible for %d consecutive scans (-confirmCycles).\n", m.cfg.ConfirmCycles)
+		return nil
+	}
+	fmt.Fprintf(w, "Decision: terminate.\n")
+	return nil
+}
+
+// formatValues formats the extra fields collected for a process for the
+// explanation.
+func formatValues(values map[string]float64, fields []queryField) string {
+	var b strings.Builder
+	for _, f := range fields {
+		if v, ok := values[f.Name]; ok {
+			fmt.Fprintf(&b, ", %s=%v", f.Name, v)
+		} else {
+			fmt.Fprintf(&b, ", %s=n/a", f.Name)
+		}
+	}
+	return b.String()
+}
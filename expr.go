@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a node of a parsed -idleExpr expression. Expressions operate purely on
+// numbers: comparisons and logical operators yield 1 for true and 0 for false,
+// and any non-zero value is treated as true.
+type expr interface {
+	eval(vars map[string]float64) (float64, error)
+}
+
+type numberExpr float64
+
+type identExpr string
+
+type unaryExpr struct {
+	op      string
+	operand expr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+func (n numberExpr) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (i identExpr) eval(vars map[string]float64) (float64, error) {
+	v, ok := vars[string(i)]
+	if !ok {
+		return 0, fmt.Errorf("no numeric value for %s", string(i))
+	}
+	return v, nil
+}
+
+func (u unaryExpr) eval(vars map[string]float64) (float64, error) {
+	v, err := u.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if u.op == "!" {
+		return boolValue(v == 0), nil
+	}
+	return -v, nil
+}
+
+func (b binaryExpr) eval(vars map[string]float64) (float64, error) {
+	l, err := b.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	// Short-circuit the logical operators so a missing value on the right
+	// doesn't matter once the result is known
+	switch {
+	case b.op == "&&" && l == 0:
+		return 0, nil
+	case b.op == "||" && l != 0:
+		return 1, nil
+	}
+
+	r, err := b.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case "&&", "||":
+		return boolValue(r != 0), nil
+	case "==":
+		return boolValue(l == r), nil
+	case "!=":
+		return boolValue(l != r), nil
+	case "<":
+		return boolValue(l < r), nil
+	case "<=":
+		return boolValue(l <= r), nil
+	case ">":
+		return boolValue(l > r), nil
+	case ">=":
+		return boolValue(l >= r), nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", b.op)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// exprIdents returns the identifiers referenced by an expression.
+func exprIdents(e expr) []string {
+	switch e := e.(type) {
+	case identExpr:
+		return []string{string(e)}
+	case unaryExpr:
+		return exprIdents(e.operand)
+	case binaryExpr:
+		return append(exprIdents(e.left), exprIdents(e.right)...)
+	}
+	return nil
+}
+
+// binaryPrecedence lists the binary operators from loosest to tightest binding.
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseExpr parses an idle expression such as "used_memory==0 && sm_util<5".
+func parseExpr(s string) (expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) parseBinary(level int) (expr, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for contains(binaryPrecedence[level], p.peek()) {
+		op := p.tokens[p.pos]
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if op := p.peek(); op == "!" || op == "-" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case tok == "(":
+		e, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return e, nil
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok)
+		}
+		return numberExpr(v), nil
+	case isIdentStart(rune(tok[0])):
+		return identExpr(tok), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// isIdent reports whether s can be referenced as an identifier in an expression.
+func isIdent(s string) bool {
+	for i, r := range s {
+		if !isIdentStart(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// compileIdleExpr parses -idleExpr, checking that it only references fields
+// that are requested from nvidia-smi.
+func compileIdleExpr(s string, extra []queryField) (expr, error) {
+	e, err := parseExpr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, f := range append(append([]queryField{}, computeAppsFields...), extra...) {
+		known[f.Name] = true
+	}
+	for _, ident := range exprIdents(e) {
+		if !known[ident] {
+			return nil, fmt.Errorf("unknown field %s (add it with -extraQueryFields)", ident)
+		}
+	}
+	return e, nil
+}
+
+func tokenizeExpr(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case isIdentStart(c):
+			j := i
+			for j < len(s) && (isIdentStart(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			if i+1 < len(s) && contains([]string{"==", "!=", "<=", ">=", "&&", "||"}, s[i:i+2]) {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else if strings.ContainsRune("<>!+-*/()", c) {
+				tokens = append(tokens, string(c))
+				i++
+			} else {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+	return tokens, nil
+}
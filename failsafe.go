@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// failSafe drops to warning only after a run of failed scans, as decisions
+// made on missing or stale data can't be trusted, and resumes enforcement
+// only after a run of clean scans.
+type failSafe struct {
+	failures  int // consecutive failed scans
+	successes int // consecutive clean scans while degraded
+	Degraded  bool
+}
+
+// record counts a scan as failed or clean, switching into or out of the
+// degraded state after failAfter failures or recoverAfter clean scans. A
+// failAfter of 0 disables it.
+func (f *failSafe) record(failed bool, failAfter, recoverAfter int, events *notifier) {
+	if failed {
+		f.failures++
+		f.successes = 0
+		if failAfter > 0 && !f.Degraded && f.failures >= failAfter {
+			f.Degraded = true
+			events.emit(event{
+				Action:  actionCritical,
+				Message: fmt.Sprintf("CRITICAL: %d consecutive scans have failed, only warning until %d scans in a row succeed.", f.failures, recoverAfter),
+			})
+		}
+		return
+	}
+
+	f.failures = 0
+	if !f.Degraded {
+		return
+	}
+	f.successes++
+	if f.successes >= recoverAfter {
+		f.Degraded = false
+		f.successes = 0
+		events.emit(event{
+			Action:  actionWarn,
+			Message: fmt.Sprintf("Resuming enforcement after %d clean scans.", recoverAfter),
+		})
+	}
+}
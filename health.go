@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// healthMonitor watches for GPU hardware errors and clock throttling,
+// independently of idle process reaping. Uncorrected ECC errors, fan speeds and
+// throttle reasons are read from nvidia-smi and Xid events from the kernel log,
+// which may require root or CAP_SYSLOG when kernel.dmesg_restrict is set.
+type healthMonitor struct {
+	eccErrors map[string]int64          // last uncorrected ECC count by GPU UUID
+	xidEvents int                       // Xid lines seen in the kernel log so far
+	primed    bool                      // whether a baseline has been taken
+	clocks    map[string]*gpuClockState // by GPU UUID
+
+	Alerts int // critical alerts raised over the lifetime of the monitor
+}
+
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{eccErrors: make(map[string]int64), clocks: make(map[string]*gpuClockState)}
+}
+
+// check polls GPU health and raises a critical alert for any errors that have
+// appeared since the previous check. The first check only records a baseline.
+func (h *healthMonitor) check(events *notifier) {
+	logger := events.logger
+
+	if smiCaps.supports(queryField{Field: "ecc.errors.uncorrected.aggregate.total", GPU: true}) {
+		h.checkECC(events)
+	}
+	h.checkClocks(events)
+
+	xids, err := xidEvents()
+	if err != nil {
+		logger.Printf("Failed to read Xid events from the kernel log: %v\n", err)
+	} else {
+		if h.primed && len(xids) > h.xidEvents {
+			for _, line := range xids[h.xidEvents:] {
+				events.emit(event{Action: actionCritical, Message: "CRITICAL: GPU Xid error: " + line})
+				h.Alerts++
+			}
+		}
+		h.xidEvents = len(xids)
+	}
+
+	h.primed = true
+}
+
+// checkECC raises a critical alert for each GPU whose uncorrected ECC error
+// count has increased.
+func (h *healthMonitor) checkECC(events *notifier) {
+	logger := events.logger
+
+	out, err := runSMI("--query-gpu=index,uuid,ecc.errors.uncorrected.aggregate.total", "--format=csv,noheader,nounits")
+	if err != nil {
+		logger.Printf("Failed to query GPU ECC errors: %v\n", err)
+		return
+	}
+	records, err := parseSMICSV(out, 3)
+	if err != nil {
+		logger.Printf("Failed to parse GPU ECC errors: %v\n", err)
+		return
+	}
+	for _, record := range records {
+		index, uuid := record[0], record[1]
+		count, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			// ECC isn't supported or enabled on this GPU
+			continue
+		}
+		if previous, ok := h.eccErrors[uuid]; ok && count > previous {
+			events.emit(event{
+				Action:  actionCritical,
+				Message: fmt.Sprintf("CRITICAL: GPU %s (%s) uncorrected ECC errors increased from %d to %d.", index, uuid, previous, count),
+				GPU:     uuid,
+			})
+			h.Alerts++
+		}
+		h.eccErrors[uuid] = count
+	}
+}
+
+// xidEvents returns the NVIDIA Xid error lines currently in the kernel log.
+func xidEvents() ([]string, error) {
+	out, err := exec.Command("dmesg").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var xids []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "NVRM: Xid") {
+			xids = append(xids, strings.TrimSpace(line))
+		}
+	}
+	return xids, nil
+}
+
+// throttleReasons are the clock throttle reasons alerted on, from the
+// clocks_throttle_reasons.active bitmask. The others, such as the GPU being idle
+// or clocks set by applications, are expected.
+var throttleReasons = []struct {
+	bit  uint64
+	name string
+}{
+	{0x4, "SW power cap"},
+	{0x8, "HW slowdown"},
+	{0x20, "SW thermal slowdown"},
+	{0x40, "HW thermal slowdown"},
+	{0x80, "HW power brake slowdown"},
+}
+
+// gpuClockState is the latest fan speed and clock throttling reading for a GPU.
+type gpuClockState struct {
+	Index      int      `json:"index"`
+	UUID       string   `json:"uuid"`
+	FanSpeed   *int     `json:"fanSpeed,omitempty"` // percent, absent for passively cooled GPUs
+	Throttling []string `json:"throttling,omitempty"`
+}
+
+// checkClocks reads fan speeds and clock throttle reasons, raising a critical
+// alert when a GPU starts throttling for a new reason and logging when it
+// stops.
+func (h *healthMonitor) checkClocks(events *notifier) {
+	logger := events.logger
+
+	// Throttle reasons were renamed to clock event reasons in newer drivers,
+	// which still accept the old name
+	reasons := smiCaps.gpuField("clocks_throttle_reasons.active", "clocks_event_reasons.active")
+	if reasons == "" {
+		return
+	}
+	out, err := runSMI("--query-gpu=index,uuid,fan.speed,"+reasons, "--format=csv,noheader,nounits")
+	if err != nil {
+		logger.Printf("Failed to query GPU clock throttle reasons: %v\n", err)
+		return
+	}
+	records, err := parseSMICSV(out, 4)
+	if err != nil {
+		logger.Printf("Failed to parse GPU clock throttle reasons: %v\n", err)
+		return
+	}
+
+	for _, record := range records {
+		index, err := strconv.Atoi(record[0])
+		if err != nil {
+			logger.Printf("Invalid GPU index %q in clock throttle reasons\n", record[0])
+			continue
+		}
+		state := &gpuClockState{Index: index, UUID: record[1]}
+		if fan, err := strconv.Atoi(record[2]); err == nil {
+			state.FanSpeed = &fan
+		}
+		if active, err := strconv.ParseUint(strings.TrimPrefix(record[3], "0x"), 16, 64); err == nil {
+			for _, reason := range throttleReasons {
+				if active&reason.bit != 0 {
+					state.Throttling = append(state.Throttling, reason.name)
+				}
+			}
+		}
+
+		var previous []string
+		if p, ok := h.clocks[state.UUID]; ok {
+			previous = p.Throttling
+		}
+		var started []string
+		for _, reason := range state.Throttling {
+			if !contains(previous, reason) {
+				started = append(started, reason)
+			}
+		}
+		fan := "n/a"
+		if state.FanSpeed != nil {
+			fan = fmt.Sprintf("%d%%", *state.FanSpeed)
+		}
+		switch {
+		case len(started) > 0:
+			events.emit(event{
+				Action:  actionCritical,
+				Message: fmt.Sprintf("CRITICAL: GPU %d (%s) is throttling its clocks: %s (fan speed %s).", index, state.UUID, strings.Join(state.Throttling, ", "), fan),
+				GPU:     state.UUID,
+			})
+			h.Alerts++
+		case len(state.Throttling) == 0 && len(previous) > 0:
+			logger.Printf("GPU %d (%s) is no longer throttling its clocks (fan speed %s).\n", index, state.UUID, fan)
+		}
+		h.clocks[state.UUID] = state
+	}
+}
+
+// clockStates returns the latest fan speed and throttling of each GPU, ordered
+// by index.
+func (h *healthMonitor) clockStates() []gpuClockState {
+	states := make([]gpuClockState, 0, len(h.clocks))
+	for _, state := range h.clocks {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Index < states[j].Index })
+	return states
+}
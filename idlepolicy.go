@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// idlePolicy is a declarative definition of an idle process for -idlePolicy:
+// the conditions that are set are combined with match, all of them (the
+// default) or any. Zero values leave a condition out.
+type idlePolicy struct {
+	Match             string  `json:"match,omitempty"`             // all or any
+	MemoryBelowMB     int     `json:"memoryBelowMB,omitempty"`     // used memory under this many MB
+	UtilizationBelow  float64 `json:"utilizationBelow,omitempty"`  // utilization under this
+	UtilizationField  string  `json:"utilizationField,omitempty"`  // field utilization is read from, sm_util by default
+	UtilizationWindow int     `json:"utilizationWindow,omitempty"` // for at least this many seconds
+	NoDeviceFds       bool    `json:"noDeviceFds,omitempty"`       // no GPU device files open
+	MinAge            int     `json:"minAge,omitempty"`            // started at least this many seconds ago
+}
+
+// defaultIdlePolicy is the policy used unless -idlePolicy or -idleExpr is
+// given: a process is idle when it uses no memory.
+var defaultIdlePolicy = idlePolicy{Match: "all", MemoryBelowMB: 1}
+
+// parseIdlePolicy parses and checks an -idlePolicy JSON object, given the
+// fields whose values are collected for each process.
+func parseIdlePolicy(s string, fields []queryField) (idlePolicy, error) {
+	var p idlePolicy
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return p, err
+	}
+
+	if p.Match == "" {
+		p.Match = "all"
+	}
+	if p.UtilizationField == "" {
+		p.UtilizationField = "sm_util"
+	}
+	var errs []error
+	if p.Match != "all" && p.Match != "any" {
+		errs = append(errs, fmt.Errorf("match must be all or any, got %q", p.Match))
+	}
+	if p.MemoryBelowMB < 0 || p.UtilizationBelow < 0 || p.UtilizationWindow < 0 || p.MinAge < 0 {
+		errs = append(errs, errors.New("values must not be negative"))
+	}
+	if p.UtilizationWindow > 0 && p.UtilizationBelow == 0 {
+		errs = append(errs, errors.New("utilizationWindow needs utilizationBelow"))
+	}
+	if p.UtilizationBelow > 0 {
+		known := false
+		for _, f := range fields {
+			known = known || f.Name == p.UtilizationField
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("unknown utilizationField %s (collect it with -pmon or -extraQueryFields)", p.UtilizationField))
+		}
+	}
+	if p.MemoryBelowMB == 0 && p.UtilizationBelow == 0 && !p.NoDeviceFds && p.MinAge == 0 {
+		errs = append(errs, errors.New("no conditions are set"))
+	}
+	return p, errors.Join(errs...)
+}
+
+// gpuDevicePattern matches the device file of a GPU, but not the control and
+// UVM device files a process may keep open without using a GPU.
+var gpuDevicePattern = regexp.MustCompile(`^/dev/nvidia[0-9]+$`)
+
+// openGPUDevices counts the GPU device files a process has open.
+func openGPUDevices(pid int) (int, error) {
+	dir := procPath(pid, "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		if target, err := os.Readlink(dir + "/" + entry.Name()); err == nil && gpuDevicePattern.MatchString(target) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// quietTracker remembers since when each process has had utilization below
+// the -idlePolicy threshold, across scans.
+type quietTracker struct {
+	since map[int]time.Time
+	seen  map[int]bool // processes checked this scan
+	known map[int]bool // processes checked in any scan since they were last missing
+}
+
+func newQuietTracker() *quietTracker {
+	return &quietTracker{since: make(map[int]time.Time), seen: make(map[int]bool), known: make(map[int]bool)}
+}
+
+// quiet records a process as below the threshold, returning for how long it
+// has been. A process that isn't tracked yet is taken to have been below it
+// since first.
+func (q *quietTracker) quiet(pid int, now, first time.Time) time.Duration {
+	q.seen[pid] = true
+	q.known[pid] = true
+	if _, ok := q.since[pid]; !ok {
+		q.since[pid] = first
+	}
+	return now.Sub(q.since[pid])
+}
+
+// checked reports whether a process has been checked before, whether it was
+// below the threshold or not.
+func (q *quietTracker) checked(pid int) bool {
+	return q.known[pid]
+}
+
+// busy records a process as at or above the threshold, or without a reading.
+func (q *quietTracker) busy(pid int) {
+	q.seen[pid] = true
+	q.known[pid] = true
+	delete(q.since, pid)
+}
+
+// clone returns a copy of the tracker.
+func (q *quietTracker) clone() *quietTracker {
+	c := newQuietTracker()
+	for pid, since := range q.since {
+		c.since[pid] = since
+	}
+	for pid := range q.seen {
+		c.seen[pid] = true
+	}
+	for pid := range q.known {
+		c.known[pid] = true
+	}
+	return c
+}
+
+// forget stops tracking processes that weren't checked in the latest scan.
+func (q *quietTracker) forget() {
+	for pid := range q.since {
+		if !q.seen[pid] {
+			delete(q.since, pid)
+		}
+	}
+	for pid := range q.known {
+		if !q.seen[pid] {
+			delete(q.known, pid)
+		}
+	}
+	q.seen = make(map[int]bool)
+}
+
+// policyClassifier judges a process by an idle policy, explaining which
+// conditions were met.
+type policyClassifier struct {
+	policy idlePolicy
+	quiet  *quietTracker
+	clock  clock
+
+	// With -seedIdleFromStartTime, a process first checked below the
+	// utilization threshold holding no memory is taken to have been below it since it
+	// started, or since its GPU was last reset in resets if that was later
+	seedFromStart bool
+	resets        map[string]time.Time
+}
+
+func (c policyClassifier) name() string {
+	return "readings"
+}
+
+func (c policyClassifier) classify(p gpuProcess) (idleVerdict, string, error) {
+	policy := c.policy
+	now := c.clock.Now()
+	var conditions []string
+	met := 0
+	condition := func(ok bool, format string, args ...interface{}) {
+		status := "not met"
+		if ok {
+			met++
+			status = "met"
+		}
+		conditions = append(conditions, fmt.Sprintf(format, args...)+" ("+status+")")
+	}
+
+	if policy.MemoryBelowMB > 0 {
+		condition(p.UsedMemory < policy.MemoryBelowMB, "used memory %d MB below %d MB", p.UsedMemory, policy.MemoryBelowMB)
+	}
+	if policy.UtilizationBelow > 0 {
+		window := time.Duration(policy.UtilizationWindow) * time.Second
+		value, ok := p.Values[policy.UtilizationField]
+		switch {
+		case !ok:
+			c.quiet.busy(p.PID)
+			condition(false, "no %s reading", policy.UtilizationField)
+		case value >= policy.UtilizationBelow:
+			c.quiet.busy(p.PID)
+			condition(false, "%s %v below %v", policy.UtilizationField, value, policy.UtilizationBelow)
+		default:
+			first, seeded := now, ""
+			if c.seedFromStart && p.UsedMemory == 0 && !c.quiet.checked(p.PID) {
+				first, seeded = c.seed(p, now)
+			}
+			quiet := c.quiet.quiet(p.PID, now, first)
+			condition(quiet >= window, "%s %v below %v for %v of %v%s", policy.UtilizationField, value, policy.UtilizationBelow, quiet.Truncate(time.Second), window, seeded)
+		}
+	}
+	if policy.NoDeviceFds {
+		open, err := openGPUDevices(p.PID)
+		if err != nil {
+			return verdictUnknown, "", fmt.Errorf("failed to read the open files: %v", err)
+		}
+		condition(open == 0, "%d GPU device files open", open)
+	}
+	if policy.MinAge > 0 {
+		start, err := processStartTime(p.PID)
+		if err != nil {
+			return verdictUnknown, "", fmt.Errorf("failed to get the start time: %v", err)
+		}
+		age := now.Sub(start).Truncate(time.Second)
+		minAge := time.Duration(policy.MinAge) * time.Second
+		condition(age >= minAge, "age %v at least %v", age, minAge)
+	}
+
+	reason := fmt.Sprintf("Idle policy needs %s of its conditions, %d of %d met: %s.", policy.Match, met, len(conditions), strings.Join(conditions, "; "))
+	if (policy.Match == "any" && met > 0) || met == len(conditions) {
+		return verdictIdle, reason, nil
+	}
+	return verdictActive, reason, nil
+}
+
+// seed returns when a process first seen below the utilization threshold is
+// taken to have been below it since for -seedIdleFromStartTime, and how that
+// was decided, for the reason. It's when the process started, or its GPU was
+// last reset if that was later, as nvidler has no history of it from before it
+// was first seen. If the start time can't be read it's now, as without the
+// option.
+func (c policyClassifier) seed(p gpuProcess, now time.Time) (time.Time, string) {
+	start, err := processStartTime(p.PID)
+	if err != nil {
+		return now, ""
+	}
+	if reset, ok := c.resets[p.GPUUUID]; ok && reset.After(start) {
+		return reset, fmt.Sprintf(", counted from its GPU's reset at %s by -seedIdleFromStartTime", reset.Format(time.RFC3339))
+	}
+	return start, fmt.Sprintf(", counted from its start at %s by -seedIdleFromStartTime", start.Format(time.RFC3339))
+}
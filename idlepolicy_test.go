@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// utilFields are the fields collected with -pmon, as far as idle policies care.
+var utilFields = []queryField{{Name: "sm_util"}}
+
+func TestParseIdlePolicy(t *testing.T) {
+	p, err := parseIdlePolicy(`{"memoryBelowMB": 100, "utilizationBelow": 5, "utilizationWindow": 60}`, utilFields)
+	if err != nil {
+		t.Fatalf("parseIdlePolicy: %v", err)
+	}
+	want := idlePolicy{Match: "all", MemoryBelowMB: 100, UtilizationBelow: 5, UtilizationField: "sm_util", UtilizationWindow: 60}
+	if p != want {
+		t.Errorf("policy = %+v, want %+v with the defaults filled in", p, want)
+	}
+
+	for spec, wantErr := range map[string]string{
+		`{"match": "most", "memoryBelowMB": 1}`:            "match must be all or any",
+		`{"memoryBelowMB": -1}`:                            "must not be negative",
+		`{"memoryBelowMB": 1, "utilizationWindow": 60}`:    "utilizationWindow needs utilizationBelow",
+		`{"utilizationBelow": 5, "utilizationField": "x"}`: "unknown utilizationField x",
+		`{"match": "any"}`:                                 "no conditions are set",
+		`{"memoryBelow": 1}`:                               "unknown field",
+	} {
+		if _, err := parseIdlePolicy(spec, utilFields); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("parseIdlePolicy(%s) = %v, want an error containing %q", spec, err, wantErr)
+		}
+	}
+}
+
+func TestIdlePolicyCombinations(t *testing.T) {
+	e := newTestEnv(t)
+	// Started an hour ago, holding 50 MB, at 2% utilization, with a GPU open
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	fds := filepath.Join(e.proc, "1001", "fd")
+	if err := os.MkdirAll(fds, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fd, target := range map[string]string{"3": "/dev/nvidiactl", "4": "/dev/nvidia0"} {
+		if err := os.Symlink(target, filepath.Join(fds, fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := gpuProcess{PID: 1001, UsedMemory: 50, GPUUUID: testGPU, Values: map[string]float64{"sm_util": 2}}
+
+	tests := []struct {
+		policy string
+		want   idleVerdict
+	}{
+		{`{"memoryBelowMB": 100}`, verdictIdle},
+		{`{"memoryBelowMB": 10}`, verdictActive},
+		{`{"memoryBelowMB": 100, "minAge": 1800}`, verdictIdle},
+		{`{"memoryBelowMB": 100, "minAge": 7200}`, verdictActive},
+		{`{"match": "any", "memoryBelowMB": 10, "minAge": 1800}`, verdictIdle},
+		{`{"match": "any", "memoryBelowMB": 10, "minAge": 7200}`, verdictActive},
+		{`{"noDeviceFds": true}`, verdictActive}, // nvidiactl doesn't count, nvidia0 does
+		{`{"match": "any", "noDeviceFds": true, "utilizationBelow": 5}`, verdictIdle},
+		{`{"utilizationBelow": 1}`, verdictActive},
+		// Below 5% now, but not yet for the window
+		{`{"memoryBelowMB": 100, "utilizationBelow": 5, "utilizationWindow": 60}`, verdictActive},
+	}
+	for _, tt := range tests {
+		policy, err := parseIdlePolicy(tt.policy, utilFields)
+		if err != nil {
+			t.Fatalf("parseIdlePolicy(%s): %v", tt.policy, err)
+		}
+		c := policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock}
+		verdict, reason, err := c.classify(p)
+		if err != nil || verdict != tt.want {
+			t.Errorf("%s: %v (%s) %v, want %v", tt.policy, verdict, reason, err, tt.want)
+		}
+	}
+}
+
+func TestIdlePolicyUtilizationWindow(t *testing.T) {
+	e := newTestEnv(t)
+	policy, err := parseIdlePolicy(`{"utilizationBelow": 5, "utilizationWindow": 60}`, utilFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock}
+	reading := func(util float64) idleVerdict {
+		t.Helper()
+		verdict, _, err := c.classify(gpuProcess{PID: 1001, Values: map[string]float64{"sm_util": util}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verdict
+	}
+
+	steps := []struct {
+		after time.Duration
+		util  float64
+		want  idleVerdict
+	}{
+		{0, 2, verdictActive},
+		{30 * time.Second, 2, verdictActive},
+		{30 * time.Second, 2, verdictIdle}, // quiet for the whole window
+		{10 * time.Second, 40, verdictActive},
+		{50 * time.Second, 2, verdictActive}, // the busy reading restarted the window
+		{60 * time.Second, 2, verdictIdle},
+	}
+	for i, step := range steps {
+		e.clock.Sleep(step.after)
+		if got := reading(step.util); got != step.want {
+			t.Fatalf("step %d, %v%% utilization: %v, want %v", i, step.util, got, step.want)
+		}
+	}
+}
+
+func TestIdlePolicySeedFromStartTime(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	policy, err := parseIdlePolicy(`{"utilizationBelow": 5, "utilizationWindow": 1800}`, utilFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classify := func(c policyClassifier, memory int, util float64) (idleVerdict, string) {
+		t.Helper()
+		verdict, reason, err := c.classify(gpuProcess{PID: 1001, UsedMemory: memory, GPUUUID: testGPU, Values: map[string]float64{"sm_util": util}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verdict, reason
+	}
+
+	// Without the option, a process idle since it started an hour ago gets a
+	// whole window when nvidler first sees it
+	c := policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock}
+	if verdict, reason := classify(c, 0, 2); verdict != verdictActive {
+		t.Errorf("first seen without -seedIdleFromStartTime: %v (%s), want active", verdict, reason)
+	}
+
+	// With it, its window counts from its start
+	c = policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock, seedFromStart: true}
+	verdict, reason := classify(c, 0, 2)
+	if verdict != verdictIdle || !strings.Contains(reason, "for 1h0m0s of 30m0s, counted from its start at 2024-03-04T11:00:00Z by -seedIdleFromStartTime") {
+		t.Errorf("first seen with -seedIdleFromStartTime: %v (%s), want idle since its start", verdict, reason)
+	}
+
+	// But not if it holds memory, as it may have been busy until recently
+	c = policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock, seedFromStart: true}
+	if verdict, reason := classify(c, 50, 2); verdict != verdictActive {
+		t.Errorf("first seen holding memory: %v (%s), want active, not seeded", verdict, reason)
+	}
+
+	// Nor once it's been seen busy, when the window restarts as usual
+	c = policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock, seedFromStart: true}
+	classify(c, 0, 40)
+	e.clock.Sleep(time.Minute)
+	if verdict, reason := classify(c, 0, 2); verdict != verdictActive || strings.Contains(reason, "counted from") {
+		t.Errorf("quiet after a busy reading: %v (%s), want active, not seeded", verdict, reason)
+	}
+
+	// A GPU reset since it started is as far back as it's counted
+	c = policyClassifier{policy: policy, quiet: newQuietTracker(), clock: e.clock, seedFromStart: true, resets: map[string]time.Time{testGPU: testEpoch.Add(-10 * time.Minute)}}
+	if verdict, reason := classify(c, 0, 2); verdict != verdictActive || !strings.Contains(reason, "counted from its GPU's reset at 2024-03-04T11:50:00Z") {
+		t.Errorf("first seen after a GPU reset: %v (%s), want active, counted from the reset", verdict, reason)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalPriority maps event actions to syslog severities.
+var journalPriority = map[string]int{
+	actionCritical:   2, // LOG_CRIT
+	actionError:      3, // LOG_ERR
+	actionWarn:       4, // LOG_WARNING
+	actionTerminate:  5, // LOG_NOTICE
+	actionQuarantine: 5, // LOG_NOTICE
+}
+
+// journalSink writes events to the systemd journal using its native protocol,
+// with nvidler's fields attached as NVIDLER_* journal fields.
+type journalSink struct {
+	conn *net.UnixConn
+}
+
+// newJournalSink connects to the journal, returning nil if its socket isn't
+// present (i.e. not running under systemd).
+func newJournalSink() (*journalSink, error) {
+	if _, err := os.Stat(journalSocket); err != nil {
+		return nil, nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn}, nil
+}
+
+func (j *journalSink) send(e event) error {
+	if e.batched {
+		return nil
+	}
+	priority, ok := journalPriority[e.Action]
+	if !ok {
+		priority = 6 // LOG_INFO
+	}
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", e.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(priority))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", "nvidler")
+	writeJournalField(&buf, "NVIDLER_ACTION", e.Action)
+	if e.PID != 0 {
+		writeJournalField(&buf, "NVIDLER_PID", strconv.Itoa(e.PID))
+	}
+	for key, value := range map[string]string{
+		"NVIDLER_PROCESS":   e.Process,
+		"NVIDLER_CONTAINER": e.Container,
+		"NVIDLER_USER":      e.User,
+		"NVIDLER_GPU":       e.GPU,
+		"NVIDLER_JOB":       e.Job,
+	} {
+		if value != "" {
+			writeJournalField(&buf, key, value)
+		}
+	}
+
+	for key, value := range e.Details {
+		if value != "" {
+			writeJournalField(&buf, "NVIDLER_"+strings.ToUpper(key), value)
+		}
+	}
+
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournalField appends a field in the journal's native format. Values
+// containing newlines must be written with an explicit length.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(key + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
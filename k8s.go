@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// kubeServiceAccountDir is where Kubernetes mounts a pod's service account
+// credentials.
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal client for the Kubernetes API, using the in-cluster
+// configuration of the pod nvidler runs in. Only the few calls -k8sEvict needs
+// are made, so the full client library isn't worth its weight.
+type kubeClient struct {
+	base string
+	http *http.Client
+}
+
+// newInClusterKubeClient creates a client from the service account and
+// environment Kubernetes provides to every pod.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set")
+	}
+	ca, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA")
+	}
+	return &kubeClient{
+		base: "https://" + net.JoinHostPort(host, port),
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// kubeError is an error response from the Kubernetes API.
+type kubeError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// do makes a request to the API, decoding the response into out if it's not
+// nil.
+func (k *kubeClient) do(method, path, contentType string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, k.base+path, reader)
+	if err != nil {
+		return err
+	}
+
+	// The token is read for every request, as the kubelet rotates it
+	token, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "token"))
+	if err != nil {
+		return fmt.Errorf("failed to read the service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&status)
+		return &kubeError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// podRef identifies a Kubernetes pod.
+type podRef struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+func (p podRef) String() string {
+	return p.Namespace + "/" + p.Name
+}
+
+// listGPUPods returns the pods on a node that request GPUs, by UID. Pods that
+// don't request GPUs are never evicted, even if they somehow hold GPU memory.
+func (k *kubeClient) listGPUPods(node string) (map[string]podRef, error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+				UID       string `json:"uid"`
+			} `json:"metadata"`
+			Spec struct {
+				Containers []struct {
+					Resources struct {
+						Limits   map[string]interface{} `json:"limits"`
+						Requests map[string]interface{} `json:"requests"`
+					} `json:"resources"`
+				} `json:"containers"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	selector := url.QueryEscape("spec.nodeName=" + node)
+	if err := k.do(http.MethodGet, "/api/v1/pods?fieldSelector="+selector, "", nil, &list); err != nil {
+		return nil, err
+	}
+
+	pods := make(map[string]podRef)
+	for _, item := range list.Items {
+		for _, c := range item.Spec.Containers {
+			if requestsGPU(c.Resources.Limits) || requestsGPU(c.Resources.Requests) {
+				pods[item.Metadata.UID] = podRef{Namespace: item.Metadata.Namespace, Name: item.Metadata.Name, UID: item.Metadata.UID}
+				break
+			}
+		}
+	}
+	return pods, nil
+}
+
+// requestsGPU reports whether container resources include NVIDIA GPUs, whole
+// (nvidia.com/gpu) or MIG slices (e.g. nvidia.com/mig-1g.5gb).
+func requestsGPU(resources map[string]interface{}) bool {
+	for name := range resources {
+		if name == "nvidia.com/gpu" || strings.HasPrefix(name, "nvidia.com/mig-") {
+			return true
+		}
+	}
+	return false
+}
+
+// annotate sets annotations on a pod.
+func (k *kubeClient) annotate(pod podRef, annotations map[string]string) error {
+	patch := map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}}
+	return k.do(http.MethodPatch, "/api/v1/namespaces/"+pod.Namespace+"/pods/"+pod.Name, "application/merge-patch+json", patch, nil)
+}
+
+// errEvictionBlocked is returned by evict when a PodDisruptionBudget doesn't
+// allow the pod to be evicted yet.
+var errEvictionBlocked = errors.New("eviction is blocked by a PodDisruptionBudget")
+
+// evict evicts a pod through the eviction API, which respects
+// PodDisruptionBudgets and the pod's termination grace period, unlike deleting
+// it or killing its processes.
+func (k *kubeClient) evict(pod podRef) error {
+	eviction := map[string]interface{}{
+		"apiVersion": "policy/v1",
+		"kind":       "Eviction",
+		"metadata":   map[string]string{"name": pod.Name, "namespace": pod.Namespace},
+	}
+	err := k.do(http.MethodPost, "/api/v1/namespaces/"+pod.Namespace+"/pods/"+pod.Name+"/eviction", "application/json", eviction, nil)
+	var kerr *kubeError
+	if errors.As(err, &kerr) && kerr.Code == http.StatusTooManyRequests {
+		return errEvictionBlocked
+	}
+	return err
+}
+
+// podUIDPattern matches a pod UID within a cgroup path, as used by both the
+// cgroupfs (/kubepods/burstable/pod<uid>/...) and systemd
+// (kubepods-burstable-pod<uid with underscores>.slice) drivers.
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// podUIDFromCgroup returns the UID of the Kubernetes pod a process runs in,
+// taken from its cgroup, or an empty string if it isn't in a pod.
+func podUIDFromCgroup(pid int) (string, error) {
+	data, err := os.ReadFile(procPath(pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	match := podUIDPattern.FindStringSubmatch(string(data))
+	if match == nil {
+		return "", nil
+	}
+	return strings.ReplaceAll(match[1], "_", "-"), nil
+}
+
+// evictPod evicts a candidate's pod, first annotating it with why, for
+// -k8sEvict.
+func (m *monitor) evictPod(c candidate) (string, error) {
+	reason := fmt.Sprintf("PID %d (%s) idle for more than %d seconds", c.PID, c.Name, m.thresholdSeconds())
+	if c.IdleTime == 0 {
+		reason = fmt.Sprintf("PID %d (%s) running for more than %d seconds", c.PID, c.Name, m.cfg.MaxRuntime)
+	}
+	annotations := map[string]string{
+		"nvidler/evicted-at": m.clock.Now().UTC().Format(time.RFC3339),
+		"nvidler/reason":     reason,
+	}
+	if err := m.kube.annotate(c.Pod, annotations); err != nil {
+		m.logger.Printf("Failed to annotate Kubernetes pod %s before evicting it: %v\n", c.Pod, err)
+	}
+	if err := m.kube.evict(c.Pod); err != nil {
+		return "", fmt.Errorf("Failed to evict Kubernetes pod %s of PID %d: %v", c.Pod, c.PID, err)
+	}
+	return fmt.Sprintf(" Evicted Kubernetes pod %s.", c.Pod), nil
+}
+
+// annotateIdle marks a warned about candidate's pod as idle, so it can be seen
+// with kubectl, for -k8sEvict.
+func (m *monitor) annotateIdle(c candidate) {
+	annotations := map[string]string{"nvidler/idle-warning": m.clock.Now().UTC().Format(time.RFC3339)}
+	if err := m.kube.annotate(c.Pod, annotations); err != nil {
+		m.logger.Printf("Failed to annotate Kubernetes pod %s as idle: %v\n", c.Pod, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// killCommand is a site tool run to terminate a process instead of signalling
+// it, for -killCommand. Each whitespace-separated argument is a text/template
+// rendered with the process's event, e.g. mycluster-reclaim {{.PID}}, and the
+// command is run directly rather than through a shell so values can't inject
+// further commands.
+type killCommand struct {
+	spec string
+	args []*template.Template
+}
+
+// parseKillCommand parses a -killCommand, checking it by rendering a sample
+// event.
+func parseKillCommand(spec string) (*killCommand, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	k := &killCommand{spec: spec}
+	for i, field := range fields {
+		tmpl, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=error").Parse(field)
+		if err != nil {
+			return nil, err
+		}
+		k.args = append(k.args, tmpl)
+	}
+
+	sample := event{Action: actionTerminate, PID: 1234, Process: "python", Container: "container", User: "user", GPU: "GPU-00000000-0000-0000-0000-000000000000", Job: "1"}
+	if _, err := k.render(sample); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *killCommand) render(e event) ([]string, error) {
+	args := make([]string, len(k.args))
+	for i, tmpl := range k.args {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, e); err != nil {
+			return nil, err
+		}
+		args[i] = b.String()
+	}
+	return args, nil
+}
+
+// run runs the command for a candidate, with its details also in NVIDLER_*
+// environment variables. Its exit status and output are logged.
+func (k *killCommand) run(c candidate, logger *log.Logger) error {
+	e := c.event(actionTerminate, "")
+	args, err := k.render(e)
+	if err != nil {
+		return fmt.Errorf("Failed to render -killCommand for PID %d: %v", c.PID, err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NVIDLER_PID="+strconv.Itoa(e.PID),
+		"NVIDLER_PROCESS="+e.Process,
+		"NVIDLER_CONTAINER="+e.Container,
+		"NVIDLER_USER="+e.User,
+		"NVIDLER_GPU="+e.GPU,
+		"NVIDLER_JOB="+e.Job,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); cmd.ProcessState == nil {
+		return fmt.Errorf("Failed to run -killCommand for PID %d: %v", c.PID, err)
+	}
+
+	logger.Printf("-killCommand for PID %d: %s exited with status %d, output: %q\n", c.PID, strings.Join(args, " "), cmd.ProcessState.ExitCode(), strings.TrimSpace(output.String()))
+	if !cmd.ProcessState.Success() {
+		return fmt.Errorf("-killCommand failed for PID %d: %v", c.PID, cmd.ProcessState)
+	}
+	return nil
+}
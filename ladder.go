@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ladderSignals are the signals that can be used in -signalLadder.
+var ladderSignals = []string{"HUP", "INT", "QUIT", "ABRT", "USR1", "USR2", "TERM", "KILL"}
+
+// ladderRung is a step of a signal escalation ladder: a signal sent once a
+// process has been due for termination for a while.
+type ladderRung struct {
+	Signal string
+	After  time.Duration
+}
+
+// parseLadder parses the -signalLadder flag, comma-separated <signal>@<delay>
+// rungs in order of their delays, e.g. USR1@0s,TERM@30s,KILL@120s. Signals may
+// be given with or without a SIG prefix.
+func parseLadder(spec string) ([]ladderRung, error) {
+	var ladder []ladderRung
+	for _, entry := range splitList(spec) {
+		name, delay, ok := strings.Cut(entry, "@")
+		if !ok {
+			return nil, fmt.Errorf("invalid rung %q, expected <signal>@<delay>", entry)
+		}
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+		if !contains(ladderSignals, name) {
+			return nil, fmt.Errorf("unsupported signal %q in rung %q, expected one of %s", name, entry, strings.Join(ladderSignals, ", "))
+		}
+		after, err := time.ParseDuration(strings.TrimSpace(delay))
+		if err != nil || after < 0 {
+			return nil, fmt.Errorf("invalid delay %q in rung %q", delay, entry)
+		}
+		if len(ladder) > 0 && after <= ladder[len(ladder)-1].After {
+			return nil, fmt.Errorf("rung %q must come after %v, rungs go in order of their delays", entry, ladder[len(ladder)-1].After)
+		}
+		ladder = append(ladder, ladderRung{Signal: name, After: after})
+	}
+	return ladder, nil
+}
+
+// ladderProgress is how far a process has been taken up the ladder.
+type ladderProgress struct {
+	started time.Time     // when it was first due for termination
+	next    int           // index of the next rung to send
+	probe   *processProbe // as of the last rung sent or probe, with -probeBeforeKill
+}
+
+// processProbe is what a process on the ladder was doing at a point in time,
+// compared before SIGKILL to tell a process shutting down slowly from one that
+// ignored the earlier signals.
+type processProbe struct {
+	Signal  string // the last rung sent
+	At      time.Time
+	State   string
+	Threads int
+	Memory  int // MB of GPU memory held
+}
+
+// probeProcess reads the state of a process on the ladder.
+func probeProcess(c candidate, signal string, now time.Time) (*processProbe, error) {
+	fields, err := readStat(c.PID)
+	if err != nil {
+		return nil, err
+	}
+	probe := &processProbe{Signal: signal, At: now, State: fields[0], Memory: c.UsedMemory}
+	if len(fields) > 17 {
+		probe.Threads, _ = strconv.Atoi(fields[17])
+	}
+	return probe, nil
+}
+
+// shuttingDown compares a process with an earlier probe, reporting whether it
+// has shown signs of shutting down since, by releasing GPU memory or ending
+// threads, along with the evidence either way. Its state isn't taken as a sign,
+// as a process flits between running and sleeping whatever it's doing.
+func (p *processProbe) shuttingDown(now *processProbe) (bool, string) {
+	var changes []string
+	if now.Memory < p.Memory {
+		changes = append(changes, fmt.Sprintf("GPU memory down from %d to %d MB", p.Memory, now.Memory))
+	}
+	if now.Threads < p.Threads {
+		changes = append(changes, fmt.Sprintf("threads down from %d to %d", p.Threads, now.Threads))
+	}
+	if len(changes) > 0 {
+		return true, strings.Join(changes, ", ")
+	}
+	return false, fmt.Sprintf("still holding %d MB of GPU memory with %d threads, in state %s (was %s)", now.Memory, now.Threads, now.State, p.State)
+}
+
+// errNotDue is returned by signal when a process is on the ladder but its next
+// rung isn't due yet.
+var errNotDue = errors.New("next rung not due")
+
+// climbLadder sends a process the latest rung of the ladder that has come due
+// since the last one sent, skipping any that were missed between scans, and
+// describes what was sent. It returns errNotDue if no rung is due.
+func (m *monitor) climbLadder(c candidate) (string, error) {
+	m.ladderSeen[c.PID] = true
+	progress, ok := m.ladderProgress[c.PID]
+	if !ok {
+		progress = &ladderProgress{started: m.clock.Now()}
+		m.ladderProgress[c.PID] = progress
+	}
+
+	elapsed := m.clock.Now().Sub(progress.started)
+	due := -1
+	for i := progress.next; i < len(m.ladder) && m.ladder[i].After <= elapsed; i++ {
+		due = i
+	}
+	if due < 0 {
+		if progress.next < len(m.ladder) {
+			m.logger.Printf("Signal ladder: PID %d (%s) is due SIG%s in %v.\n", c.PID, c.Name, m.ladder[progress.next].Signal, (m.ladder[progress.next].After - elapsed).Round(time.Second))
+		} else {
+			m.logger.Printf("Signal ladder: PID %d (%s) is still running after every rung was sent.\n", c.PID, c.Name)
+		}
+		return "", errNotDue
+	}
+
+	rung := m.ladder[due]
+	var evidence string
+	if rung.Signal == "KILL" && m.cfg.ProbeBeforeKill && progress.probe != nil {
+		now, err := probeProcess(c, progress.probe.Signal, m.clock.Now())
+		if err != nil {
+			m.logger.Printf("Signal ladder: failed to probe PID %d (%s) before SIGKILL, sending it anyway: %v\n", c.PID, c.Name, err)
+		} else {
+			shutting, changes := progress.probe.shuttingDown(now)
+			since := m.clock.Now().Sub(progress.probe.At).Truncate(time.Second)
+			if shutting {
+				m.logger.Printf("Signal ladder: holding off SIGKILL for PID %d (%s), it's shutting down after SIG%s: %s in the last %v.\n", c.PID, c.Name, now.Signal, changes, since)
+				progress.probe = now
+				return "", errNotDue
+			}
+			evidence = fmt.Sprintf("%v after SIG%s it was %s", since, now.Signal, changes)
+			m.logger.Printf("Signal ladder: PID %d (%s) is unresponsive, %s.\n", c.PID, c.Name, evidence)
+		}
+	}
+
+	if err := m.kill(c, rung.Signal); err != nil {
+		return "", err
+	}
+	progress.next = due + 1
+	if m.cfg.ProbeBeforeKill {
+		progress.probe, _ = probeProcess(c, rung.Signal, m.clock.Now())
+	}
+	m.logger.Printf("Signal ladder: sent SIG%s to PID %d (%s), rung %d of %d, %v after it was first due for termination.\n", rung.Signal, c.PID, c.Name, due+1, len(m.ladder), elapsed.Truncate(time.Second))
+	if evidence != "" {
+		return fmt.Sprintf(" Sent SIG%s, rung %d of %d of -signalLadder, as %s.", rung.Signal, due+1, len(m.ladder), evidence), nil
+	}
+	return fmt.Sprintf(" Sent SIG%s, rung %d of %d of -signalLadder.", rung.Signal, due+1, len(m.ladder)), nil
+}
+
+// forgetLadders stops tracking processes that weren't due for termination in
+// the latest scan, so a process that became active again starts from the
+// bottom of the ladder.
+func (m *monitor) forgetLadders() {
+	for pid := range m.ladderProgress {
+		if !m.ladderSeen[pid] {
+			delete(m.ladderProgress, pid)
+		}
+	}
+	m.ladderSeen = make(map[int]bool)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLadder(t *testing.T) {
+	ladder, err := parseLadder("usr1@0s, SIGTERM@30s,KILL@2m")
+	if err != nil {
+		t.Fatalf("parseLadder: %v", err)
+	}
+	want := []ladderRung{{"USR1", 0}, {"TERM", 30 * time.Second}, {"KILL", 2 * time.Minute}}
+	if len(ladder) != len(want) {
+		t.Fatalf("ladder = %v, want %v", ladder, want)
+	}
+	for i := range want {
+		if ladder[i] != want[i] {
+			t.Errorf("rung %d = %v, want %v", i, ladder[i], want[i])
+		}
+	}
+
+	if ladder, err := parseLadder(""); err != nil || len(ladder) != 0 {
+		t.Errorf("parseLadder of an empty ladder = %v, %v, want no rungs", ladder, err)
+	}
+}
+
+func TestParseLadderInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"TERM",                  // no delay
+		"STOP@0s",               // not a supported signal
+		"TERM@soon",             // not a duration
+		"TERM@-5s",              // negative
+		"TERM@30s,KILL@30s",     // not after the previous rung
+		"TERM@60s,USR1@30s",     // out of order
+		"USR1@0s,TERM@whenever", // a bad rung after a good one
+	} {
+		if ladder, err := parseLadder(spec); err == nil {
+			t.Errorf("parseLadder(%q) = %v, want an error", spec, ladder)
+		}
+	}
+}
+
+func TestSignalLadderSkipsMissedRungs(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.SignalLadder = "USR1@0s,TERM@30s,KILL@120s"
+	m := e.monitor(cfg)
+
+	m.scan()
+	e.clock.Sleep(5 * time.Minute)
+	m.scan()
+	if got, want := e.signals(), []string{"-s USR1 1001", "-s KILL 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v, skipping the TERM rung missed between scans", got, want)
+	}
+}
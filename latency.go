@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// p2Quantile estimates a quantile of a stream of values in constant memory
+// with the P² algorithm (Jain and Chlamtac, 1985), which keeps five markers
+// whose heights are adjusted towards the quantile as values arrive.
+type p2Quantile struct {
+	p       float64
+	count   int
+	heights [5]float64
+	pos     [5]float64 // actual marker positions
+	desired [5]float64 // desired marker positions
+	incr    [5]float64 // desired position increments
+}
+
+func newP2Quantile(p float64) *p2Quantile {
+	return &p2Quantile{
+		p:       p,
+		pos:     [5]float64{1, 2, 3, 4, 5},
+		desired: [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+		incr:    [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+// add adds a value to the stream.
+func (q *p2Quantile) add(x float64) {
+	if q.count < 5 {
+		q.heights[q.count] = x
+		q.count++
+		if q.count == 5 {
+			sort.Float64s(q.heights[:])
+		}
+		return
+	}
+	q.count++
+
+	// Find the cell the value falls in, extending the extremes if needed
+	var k int
+	switch {
+	case x < q.heights[0]:
+		q.heights[0], k = x, 0
+	case x >= q.heights[4]:
+		q.heights[4], k = x, 3
+	default:
+		for k = 0; k < 3 && x >= q.heights[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		q.pos[i]++
+	}
+	for i := range q.desired {
+		q.desired[i] += q.incr[i]
+	}
+
+	// Move the middle markers towards their desired positions
+	for i := 1; i <= 3; i++ {
+		d := q.desired[i] - q.pos[i]
+		if (d >= 1 && q.pos[i+1]-q.pos[i] > 1) || (d <= -1 && q.pos[i-1]-q.pos[i] < -1) {
+			step := math.Copysign(1, d)
+			h := q.parabolic(i, step)
+			if q.heights[i-1] >= h || h >= q.heights[i+1] {
+				h = q.linear(i, step)
+			}
+			q.heights[i] = h
+			q.pos[i] += step
+		}
+	}
+}
+
+func (q *p2Quantile) parabolic(i int, d float64) float64 {
+	n, h := q.pos, q.heights
+	return h[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(h[i+1]-h[i])/(n[i+1]-n[i])+(n[i+1]-n[i]-d)*(h[i]-h[i-1])/(n[i]-n[i-1]))
+}
+
+func (q *p2Quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return q.heights[i] + d*(q.heights[j]-q.heights[i])/(q.pos[j]-q.pos[i])
+}
+
+// value returns the estimate. Until five values have been seen it's taken
+// directly from those seen so far.
+func (q *p2Quantile) value() float64 {
+	if q.count >= 5 {
+		return q.heights[2]
+	}
+	if q.count == 0 {
+		return 0
+	}
+	seen := append([]float64{}, q.heights[:q.count]...)
+	sort.Float64s(seen)
+	return seen[int(math.Round(q.p*float64(q.count-1)))]
+}
+
+// latencyMinSamples is how many scans a window needs before its p95 is
+// compared with the sleep interval, so a single slow startup scan doesn't
+// raise a warning.
+const latencyMinSamples = 10
+
+// scanLatency tracks the distribution of scan durations over a rolling window,
+// warning when the p95 gets close to the sleep interval, as scans that take
+// longer than it start to fall behind.
+type scanLatency struct {
+	clock       clock
+	windowStart time.Time
+	p50, p95    *p2Quantile
+	slow        bool // whether the p95 was last over the threshold
+}
+
+func newScanLatency(clk clock) *scanLatency {
+	l := &scanLatency{clock: clk}
+	l.reset()
+	return l
+}
+
+func (l *scanLatency) reset() {
+	l.windowStart = l.clock.Now()
+	l.p50, l.p95 = newP2Quantile(0.5), newP2Quantile(0.95)
+}
+
+// latencyStats are the scan durations of the current window, as returned by
+// GET /status.
+type latencyStats struct {
+	Scans       int       `json:"scans"`
+	P50Seconds  float64   `json:"p50Seconds"`
+	P95Seconds  float64   `json:"p95Seconds"`
+	WindowStart time.Time `json:"windowStart"`
+}
+
+func (l *scanLatency) stats() latencyStats {
+	return latencyStats{Scans: l.p50.count, P50Seconds: l.p50.value(), P95Seconds: l.p95.value(), WindowStart: l.windowStart}
+}
+
+// record adds a scan's duration, starting a new window once window has passed,
+// and warns when the p95 crosses fraction of the sleep interval, and again
+// once it's back under. A fraction of 0 disables the warning.
+func (l *scanLatency) record(d, window, interval time.Duration, fraction float64, events *notifier) {
+	if window > 0 && l.clock.Now().Sub(l.windowStart) >= window {
+		l.reset()
+	}
+	l.p50.add(d.Seconds())
+	l.p95.add(d.Seconds())
+
+	if fraction <= 0 || l.p95.count < latencyMinSamples {
+		return
+	}
+	p50, p95 := l.p50.value(), l.p95.value()
+	threshold := fraction * interval.Seconds()
+	switch {
+	case p95 > threshold && !l.slow:
+		l.slow = true
+		events.emit(event{
+			Action:  actionWarn,
+			Message: fmt.Sprintf("WARNING: Scans are getting slow, p95 %.2fs (p50 %.2fs) over %d scans is more than -latencyWarnFraction %v of the %v sleep interval. Check nvidia-smi, Docker and the other lookups aren't degraded.", p95, p50, l.p95.count, fraction, interval),
+		})
+	case p95 <= threshold && l.slow:
+		l.slow = false
+		events.logger.Printf("Scan latency is back to normal, p95 %.2fs (p50 %.2fs).\n", p95, p50)
+	}
+}
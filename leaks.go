@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// categoryLeakedContext marks events about leaked CUDA contexts, as opposed to
+// plain idle processes.
+const categoryLeakedContext = "leakedContext"
+
+// leakedContext is a process holding GPU memory that hasn't changed while it
+// has had no SM utilization, the signature of a CUDA context left behind by
+// code that finished with the GPU without releasing it.
+type leakedContext struct {
+	PID      int       `json:"pid"`
+	GPU      string    `json:"gpu"`
+	MemoryMB int       `json:"memoryMB"`
+	Since    time.Time `json:"since"` // since when its memory has been unchanged without utilization
+}
+
+// leakTracker follows each process on each GPU for -leakedContextThreshold,
+// from when its memory was last seen unchanged, above zero and without SM
+// utilization. A change in memory, any utilization or a missing reading starts
+// it over.
+type leakTracker map[processGPU]*leakedContext
+
+// update records the readings from a scan, forgetting processes that are no
+// longer on a GPU.
+func (l leakTracker) update(processes []gpuProcess, now time.Time) {
+	seen := make(map[processGPU]bool, len(processes))
+	for _, process := range processes {
+		key := processGPU{process.PID, process.GPUUUID}
+		seen[key] = true
+		util, ok := process.Values["sm_util"]
+		if !ok || util > 0 || process.UsedMemory == 0 {
+			delete(l, key)
+			continue
+		}
+		if c, ok := l[key]; ok && c.MemoryMB == process.UsedMemory {
+			continue
+		}
+		l[key] = &leakedContext{PID: process.PID, GPU: process.GPUUUID, MemoryMB: process.UsedMemory, Since: now}
+	}
+	for key := range l {
+		if !seen[key] {
+			delete(l, key)
+		}
+	}
+}
+
+// stableFor returns how long a process's memory has been unchanged without
+// utilization.
+func (l leakTracker) stableFor(process gpuProcess, now time.Time) time.Duration {
+	if c, ok := l[processGPU{process.PID, process.GPUUUID}]; ok {
+		return now.Sub(c.Since)
+	}
+	return 0
+}
+
+// list returns the processes that have been stable for at least the
+// threshold, in PID order.
+func (l leakTracker) list(threshold time.Duration, now time.Time) []leakedContext {
+	list := []leakedContext{}
+	for _, c := range l {
+		if now.Sub(c.Since) >= threshold {
+			list = append(list, *c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PID != list[j].PID {
+			return list[i].PID < list[j].PID
+		}
+		return list[i].GPU < list[j].GPU
+	})
+	return list
+}
+
+// leakedContexts returns the processes that look like leaked CUDA contexts.
+func (m *monitor) leakedContexts() []leakedContext {
+	return m.leaks.list(time.Duration(m.cfg.LeakedContextThreshold)*time.Second, m.clock.Now())
+}
+
+// leakedContext reports whether a process not judged idle looks like a leaked
+// CUDA context with -leakedContextThreshold, returning for how long.
+func (m *monitor) leakedContext(process gpuProcess) (time.Duration, bool) {
+	if m.cfg.LeakedContextThreshold <= 0 {
+		return 0, false
+	}
+	stable := m.leaks.stableFor(process, m.clock.Now()).Truncate(time.Second)
+	return stable, stable >= time.Duration(m.cfg.LeakedContextThreshold)*time.Second
+}
+
+// idleDescription describes why a candidate is being acted on, for messages.
+func (m *monitor) idleDescription(c candidate) string {
+	if c.LeakedContext {
+		return fmt.Sprintf("looks like a leaked CUDA context, holding %d MB unchanged with no SM utilization for more than %d seconds", c.UsedMemory, m.cfg.LeakedContextThreshold)
+	}
+	return fmt.Sprintf("has been idle for more than %d seconds", m.thresholdSeconds())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// hoursWindow is one window of -businessHours: a time of day on some days of
+// the week, in a time zone.
+type hoursWindow struct {
+	days       [7]bool // by time.Weekday
+	start, end time.Duration
+	location   *time.Location
+}
+
+// businessHours is when the idle threshold is multiplied by
+// -businessHoursMultiplier, to be more forgiving of people stepping away from
+// their work while they're around to come back to it.
+type businessHours []hoursWindow
+
+// parseBusinessHours parses -businessHours, windows separated by semicolons,
+// each the days, the time of day, and optionally an IANA time zone, the local
+// time zone otherwise, e.g. "Mon-Fri 09:00-18:00; Sat 10:00-14:00
+// Europe/London". Days are names or ranges of them separated by commas, and a
+// range may wrap around the week, such as Sun-Thu or Fri-Mon. A window ends
+// at its end time, so it can't span midnight.
+func parseBusinessHours(spec string) (businessHours, error) {
+	var hours businessHours
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%q: expected days, a time of day and optionally a time zone, e.g. Mon-Fri 09:00-18:00", strings.TrimSpace(part))
+		}
+
+		window := hoursWindow{location: time.Local}
+		for _, days := range strings.Split(fields[0], ",") {
+			first, last, isRange := strings.Cut(days, "-")
+			from, ok := weekdays[strings.ToLower(first)]
+			to, toOK := weekdays[strings.ToLower(last)]
+			if !isRange {
+				to, toOK = from, ok
+			}
+			if !ok || !toOK {
+				return nil, fmt.Errorf("%q: %q isn't a day or range of days such as Mon-Fri", strings.TrimSpace(part), days)
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				window.days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+
+		start, end, ok := strings.Cut(fields[1], "-")
+		var err error
+		if window.start, err = parseTimeOfDay(start); err != nil || !ok {
+			return nil, fmt.Errorf("%q: %q isn't a time of day such as 09:00-18:00", strings.TrimSpace(part), fields[1])
+		}
+		if window.end, err = parseTimeOfDay(end); err != nil {
+			return nil, fmt.Errorf("%q: %q isn't a time of day such as 09:00-18:00", strings.TrimSpace(part), fields[1])
+		}
+		if window.end <= window.start {
+			return nil, fmt.Errorf("%q: must end after it starts, windows can't span midnight", strings.TrimSpace(part))
+		}
+
+		if len(fields) == 3 {
+			if window.location, err = time.LoadLocation(fields[2]); err != nil {
+				return nil, fmt.Errorf("%q: %v", strings.TrimSpace(part), err)
+			}
+		}
+		hours = append(hours, window)
+	}
+	if len(hours) == 0 {
+		return nil, fmt.Errorf("no windows given")
+	}
+	return hours, nil
+}
+
+// parseTimeOfDay parses a time of day as HH:MM, from 00:00 to 24:00.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether a time falls within any of the windows, from their
+// start up to but not including their end.
+func (b businessHours) contains(t time.Time) bool {
+	for _, w := range b {
+		local := t.In(w.location)
+		if !w.days[local.Weekday()] {
+			continue
+		}
+		offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+		if offset >= w.start && offset < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// logThreshold logs the idle threshold in effect on the first scan, and again
+// whenever it changes with -businessHours.
+func (m *monitor) logThreshold() {
+	if m.businessHours == nil {
+		m.thresholdState = ""
+		return
+	}
+	within := m.businessHours.contains(m.clock.Now())
+	state := fmt.Sprintf("%v %v", within, m.threshold())
+	if state == m.thresholdState {
+		return
+	}
+	m.thresholdState = state
+	base := time.Duration(m.cfg.IdleTimeThreshold) * time.Second
+	if within {
+		m.logger.Printf("Within -businessHours, the idle threshold is %v, %v× the base threshold of %v.\n", m.threshold(), m.cfg.BusinessHoursMultiplier, base)
+	} else {
+		m.logger.Printf("Outside -businessHours, the idle threshold is the base threshold of %v.\n", base)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBusinessHoursInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"Mon-Fri",
+		"Mon-Fri 09:00",
+		"Mon-Fri 09:00-18:00 UTC extra",
+		"Mon-Funday 09:00-18:00",
+		"Mon-Fri 9am-6pm",
+		"Mon-Fri 18:00-09:00",
+		"Mon-Fri 09:00-09:00",
+		"Mon-Fri 09:00-18:00 Nowhere/Special",
+	} {
+		if _, err := parseBusinessHours(spec); err == nil {
+			t.Errorf("parseBusinessHours(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestBusinessHoursBoundaries(t *testing.T) {
+	hours, err := parseBusinessHours("Mon-Fri 09:00-18:00 UTC; Sat 10:00-14:00 UTC; Sun 09:00-12:00 Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-03-04 is a Monday
+	at := func(day int, clock string) time.Time {
+		t.Helper()
+		tm, err := time.Parse("2006-01-02 15:04:05", fmt.Sprintf("2024-03-%02d %s", day, clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		time time.Time
+		want bool
+	}{
+		{at(4, "08:59:59"), false},
+		{at(4, "09:00:00"), true}, // from the start
+		{at(4, "17:59:59"), true},
+		{at(4, "18:00:00"), false}, // up to but not including the end
+		{at(8, "17:59:59"), true},  // Friday
+		{at(9, "09:00:00"), false}, // Saturday, outside its own window
+		{at(9, "10:00:00"), true},
+		{at(9, "14:00:00"), false},
+		{at(9, "23:59:59"), false},
+		// Sunday 09:00-12:00 in Tokyo is Sunday 00:00-03:00 UTC
+		{at(3, "00:00:00"), true},
+		{at(3, "02:59:59"), true},
+		{at(3, "03:00:00"), false},
+		{at(2, "23:59:59"), false},
+	}
+	for _, tt := range tests {
+		if got := hours.contains(tt.time); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.time.Format("Mon 15:04:05 MST"), got, tt.want)
+		}
+	}
+
+	// Ranges of days wrap around the week, and 24:00 is the end of the day
+	weekend, err := parseBusinessHours("Fri-Mon 00:00-24:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		time time.Time
+		want bool
+	}{
+		{at(4, "23:59:59"), true},  // Monday
+		{at(5, "00:00:00"), false}, // Tuesday
+		{at(7, "23:59:59"), false}, // Thursday
+		{at(8, "00:00:00"), true},  // Friday
+		{at(3, "12:00:00"), true},  // Sunday
+	} {
+		if got := weekend.contains(tt.time); got != tt.want {
+			t.Errorf("Fri-Mon contains(%s) = %v, want %v", tt.time.Format("Mon 15:04:05"), got, tt.want)
+		}
+	}
+}
+
+func TestScanThresholdAcrossBusinessHoursEnd(t *testing.T) {
+	e := newTestEnv(t)
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.IdleTimeThreshold = 300
+	cfg.BusinessHours = "Mon-Fri 09:00-18:00 UTC"
+	cfg.BusinessHoursMultiplier = 3
+	m := e.monitor(cfg)
+
+	// Idle from 17:50 on a Monday, past the base threshold of 5 minutes but
+	// not the 15 minutes allowed during business hours until 18:00
+	e.clock.Sleep(5*time.Hour + 50*time.Minute)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: e.clock.Now()})
+	e.gpuProcesses("1001, 0")
+	for i := 0; i < 10; i++ {
+		m.scan()
+		if got := e.signals(); got != nil {
+			t.Fatalf("signalled %v at %s, within business hours and the lengthened threshold", got, e.clock.Now().Format("15:04"))
+		}
+		e.clock.Sleep(time.Minute)
+	}
+	if want := "Within -businessHours, the idle threshold is 15m0s, 3× the base threshold of 5m0s."; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals at 18:00 = %v, want %v under the base threshold", got, want)
+	}
+	if want := "Outside -businessHours, the idle threshold is the base threshold of 5m0s."; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+}
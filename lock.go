@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errLocked is returned when another nvidler instance holds the lock.
+var errLocked = errors.New("lock is held by another nvidler instance")
+
+// instanceLock is an exclusive flock held for the lifetime of the monitor. As
+// the kernel tracks the lock, it's released even if nvidler dies uncleanly.
+type instanceLock struct {
+	file *os.File
+}
+
+// acquireLock takes an exclusive lock on path. If another process holds it,
+// acquireLock either blocks until it's released (wait) or returns errLocked.
+func acquireLock(path string, wait bool) (*instanceLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return &instanceLock{file: file}, nil
+}
+
+// release drops the lock.
+func (l *instanceLock) release() error {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return l.file.Close()
+}
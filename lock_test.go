@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireLockContended(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nvidler.lock")
+	first, err := acquireLock(path, false)
+	if err != nil {
+		t.Fatalf("first acquireLock: %v", err)
+	}
+
+	// A second instance, in another goroutine, either fails at once or waits
+	// for the first to release the lock
+	failed := make(chan error)
+	go func() {
+		_, err := acquireLock(path, false)
+		failed <- err
+	}()
+	if err := <-failed; !errors.Is(err, errLocked) {
+		t.Fatalf("second acquireLock without waiting = %v, want errLocked", err)
+	}
+
+	acquired := make(chan *instanceLock)
+	go func() {
+		lock, err := acquireLock(path, true)
+		if err != nil {
+			t.Errorf("second acquireLock while waiting: %v", err)
+		}
+		acquired <- lock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second instance acquired the lock while the first held it")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := first.release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	select {
+	case second := <-acquired:
+		if second != nil {
+			second.release()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second instance didn't acquire the lock once it was released")
+	}
+}
+
+func TestAcquireLockUnwritable(t *testing.T) {
+	_, err := acquireLock(filepath.Join(t.TempDir(), "missing", "nvidler.lock"), false)
+	if err == nil || errors.Is(err, errLocked) {
+		t.Fatalf("acquireLock in a missing directory = %v, want an error other than errLocked", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// logMaxAge is how long rotated logs are kept.
+const logMaxAge = 7 * 24 * time.Hour
+
+// needsRotation reports whether a log of size bytes should be rotated at
+// startup, which it is once it has grown past minBytes. A minBytes of 0
+// rotates any existing log.
+func needsRotation(size, minBytes int64) bool {
+	return size > 0 && size >= minBytes
+}
+
+// openLogFile opens the log at path for appending, creating it and any missing
+// parent directories, such as a fresh volume's /var/log/nvidler in a
+// container. Directories are created readable by all but only writable by
+// their owner, like /var/log itself. Errors give the absolute path, as a
+// relative -logFile is resolved against a working directory that may not be
+// obvious under a service manager.
+func openLogFile(path string) (*os.File, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the directory of log file %s: %v", abs, err)
+	}
+	f, err := os.OpenFile(abs, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file %s: %v", abs, err)
+	}
+	return f, nil
+}
+
+// rotateLog moves the log at path aside if it needs rotating, to a name with
+// the time so that earlier rotated logs are kept rather than overwritten, and
+// returns the new name, or "" if it was left alone.
+func rotateLog(path string, minBytes int64, now time.Time) (string, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !needsRotation(info.Size(), minBytes) {
+		return "", nil
+	}
+	rotated := path + "." + now.Format("20060102T150405")
+	return rotated, os.Rename(path, rotated)
+}
+
+// removeOldLogs removes rotated copies of the log at path last written more
+// than maxAge before now, returning their names.
+func removeOldLogs(path string, maxAge time.Duration, now time.Time) ([]string, error) {
+	dir, base := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), base+".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) <= maxAge {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		if err := os.Remove(name); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
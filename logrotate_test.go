@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeedsRotation(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		size, minBytes int64
+		want           bool
+	}{
+		{0, 0, false}, // an empty log is never rotated
+		{1, 0, true},  // with no minimum, any existing log is
+		{10*mb - 1, 10 * mb, false},
+		{10 * mb, 10 * mb, true},
+		{20 * mb, 10 * mb, true},
+	}
+	for _, tt := range tests {
+		if got := needsRotation(tt.size, tt.minBytes); got != tt.want {
+			t.Errorf("needsRotation(%d, %d) = %v, want %v", tt.size, tt.minBytes, got, tt.want)
+		}
+	}
+}
+
+func TestRotateLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nvidler.log")
+	if rotated, err := rotateLog(path, 0, testEpoch); err != nil || rotated != "" {
+		t.Fatalf("rotateLog of a missing log = %q, %v, want it left alone", rotated, err)
+	}
+
+	if err := os.WriteFile(path, []byte("small\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err := rotateLog(path, 1<<20, testEpoch); err != nil || rotated != "" {
+		t.Fatalf("rotateLog of a log under the minimum = %q, %v, want it left alone", rotated, err)
+	}
+
+	// Restarts rotate to distinct names rather than overwriting earlier logs
+	first, err := rotateLog(path, 0, testEpoch)
+	if err != nil || first != path+".20240304T120000" {
+		t.Fatalf("rotateLog = %q, %v, want it moved to %s.20240304T120000", first, err, path)
+	}
+	if err := os.WriteFile(path, []byte("restarted\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second, err := rotateLog(path, 0, testEpoch.Add(time.Minute))
+	if err != nil || second == first {
+		t.Fatalf("second rotateLog = %q, %v, want a name other than %q", second, err, first)
+	}
+	for _, name := range []string{first, second} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("rotated log %s: %v", name, err)
+		}
+	}
+}
+
+func TestRemoveOldLogs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nvidler.log")
+	old := path + ".20240201T120000"
+	recent := path + ".20240304T110000"
+	other := filepath.Join(dir, "other.log.20240201T120000")
+	for _, name := range []string{path, old, recent, other} {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, testEpoch.Add(-30*24*time.Hour), testEpoch.Add(-30*24*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(recent, testEpoch.Add(-time.Hour), testEpoch.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := removeOldLogs(path, logMaxAge, testEpoch)
+	if err != nil {
+		t.Fatalf("removeOldLogs: %v", err)
+	}
+	if !equalStrings(removed, []string{old}) {
+		t.Fatalf("removed %v, want only %s", removed, old)
+	}
+	// The current log is never removed, however old, nor are other logs
+	for _, name := range []string{path, recent, other} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestOpenLogFileCreatesDirectories(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "var", "log", "nvidler", "nvidler.log")
+	f, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("openLogFile in a nested directory that doesn't exist: %v", err)
+	}
+	if _, err := f.WriteString("first\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0755 {
+		t.Errorf("created directory mode = %v, want 0755", perm)
+	}
+
+	// It's appended to when opened again
+	if f, err = openLogFile(path); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("second\n")
+	f.Close()
+	if data, err := os.ReadFile(path); err != nil || string(data) != "first\nsecond\n" {
+		t.Errorf("log file = %q (%v), want both lines", data, err)
+	}
+
+	// A directory that can't be created fails with the path and the cause
+	blocker := filepath.Join(dir, "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = openLogFile(filepath.Join(blocker, "logs", "nvidler.log"))
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(blocker, "logs", "nvidler.log")) || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("openLogFile under a file = %v, want an error naming the path and the cause", err)
+	}
+}
@@ -1,184 +1,384 @@
 package main
 
 import (
-	"context"
-	"flag"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
 )
 
 func main() {
+	// nvidler preflight checks a node is ready rather than running, taking the
+	// same flags
+	preflightMode := len(os.Args) > 1 && os.Args[1] == "preflight"
+	if preflightMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	// Configuration with argument parsing
-	var idleTimeThreshold int
-	var warningOnly bool
-	var targetWorkloads, whitelist string
-	var logFile string
-	var sleepInterval int
-	var dockerEnabled bool
-
-	flag.IntVar(&idleTimeThreshold, "idleTimeThreshold", 300, "Time threshold for idle GPUs in seconds")
-	flag.BoolVar(&warningOnly, "warningOnly", true, "Warning only mode")
-	flag.StringVar(&targetWorkloads, "targetWorkloads", "python,tensorflow,cuda,pytorch", "List of target workload process names (comma-separated)")
-	flag.StringVar(&whitelist, "whitelist", "whitelisted_process,whitelisted_container,nvidia-smi,nvidler.sh", "Whitelisted processes and Docker containers (comma-separated)")
-	flag.StringVar(&logFile, "logFile", "/var/log/gpu_idle_monitor.log", "Log file")
-	flag.IntVar(&sleepInterval, "sleepInterval", 60, "Sleep interval in seconds")
-	flag.BoolVar(&dockerEnabled, "docker", true, "Enable Docker container tracking")
-
-	flag.Parse()
-
-	// Convert comma-separated strings to slices
-	targetWorkloadsSlice := strings.Split(targetWorkloads, ",")
-	whitelistSlice := strings.Split(whitelist, ",")
-
-	// Rotate and clean up old logs
-	if _, err := os.Stat(logFile); err == nil {
-		os.Rename(logFile, logFile+".1")
-	}
-
-	// Remove logs older than 7 days
-	files, _ := os.ReadDir("/var/log/")
-	for _, f := range files {
-		if strings.HasPrefix(f.Name(), "gpu_idle_monitor.log.") {
-			fileInfo, _ := os.Stat("/var/log/" + f.Name())
-			if time.Since(fileInfo.ModTime()).Hours() > 7*24 {
-				os.Remove("/var/log/" + f.Name())
+	cfg, err := parseFlags()
+	err = errors.Join(err, cfg.validate())
+	if preflightMode {
+		procRoot = cfg.ProcRoot
+		smiTimeout = time.Duration(cfg.SMITimeout) * time.Second
+		if cfg.Backend == "xml" {
+			smiXML = &xmlBackend{}
+		}
+		checks := preflight(cfg, err)
+		writePreflight(os.Stdout, checks)
+		if checks.failed() {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.ValidateConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid.")
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	procRoot = cfg.ProcRoot
+	smiTimeout = time.Duration(cfg.SMITimeout) * time.Second
+	if cfg.Backend == "xml" {
+		smiXML = &xmlBackend{}
+	}
+
+	if cfg.DescribePolicy != "" {
+		source := "the defaults, NVIDLER_* environment variables and flags"
+		if cfg.ConfigFile != "" {
+			source = fmt.Sprintf("%s, with -config %s", source, configSource(cfg.ConfigFile))
+		}
+		if err := writePolicy(os.Stdout, describePolicy(cfg), source, cfg.DescribePolicy == "markdown"); err != nil {
+			log.Fatalf("Failed to write the policy: %v", err)
+		}
+		return
+	}
+	if cfg.ExplainPID != 0 {
+		explain(cfg)
+		return
+	}
+	if cfg.Preview != "" {
+		preview(cfg)
+		return
+	}
+	if cfg.WhatIf != "" {
+		whatIf(cfg)
+		return
+	}
+
+	// Make sure no other instance is running before touching its log file
+	if cfg.LockFile != "" {
+		if cfg.OnConflict == "wait" {
+			log.Printf("Acquiring lock %s, waiting for any other instance to exit...", cfg.LockFile)
+		}
+		// A lock file that can't be created, such as /run's when running as a
+		// regular user, stops nvidler too, as it can't tell whether another
+		// instance is running. Only -lockFile "" runs without the check
+		lock, err := acquireLock(cfg.LockFile, cfg.OnConflict == "wait")
+		switch {
+		case errors.Is(err, errLocked):
+			log.Fatalf("Failed to acquire lock %s: %v", cfg.LockFile, err)
+		case err != nil:
+			log.Fatalf("Failed to acquire lock %s, set -lockFile to a writable path, or to empty to run without checking for other instances: %v", cfg.LockFile, err)
+		}
+		defer lock.release()
+	}
+
+	// Rotate the log once it's grown large, so frequent restarts don't churn
+	// it, and clean up rotated logs older than 7 days
+	toFile := cfg.LogFile != "-"
+	if toFile {
+		now := time.Now()
+		if cfg.RotateOnStart {
+			if _, err := rotateLog(cfg.LogFile, int64(cfg.RotateMinMB)<<20, now); err != nil {
+				log.Printf("Failed to rotate %s: %v", cfg.LogFile, err)
 			}
 		}
+		if _, err := removeOldLogs(cfg.LogFile, logMaxAge, now); err != nil {
+			log.Printf("Failed to remove old logs of %s: %v", cfg.LogFile, err)
+		}
 	}
 
-	// Initialize logger
-	logFileHandle, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+	// With -splitStreams the log goes to one stream and events as JSON to the
+	// other
+	logStream, eventStream := os.Stdout, os.Stderr
+	if cfg.SplitStreams == "stdout" {
+		logStream, eventStream = os.Stderr, os.Stdout
 	}
-	defer logFileHandle.Close()
 
-	multiWriter := io.MultiWriter(os.Stdout, logFileHandle)
-	logger := log.New(multiWriter, "", log.LstdFlags)
+	// Initialize logger, writing to the log file, stdout or both
+	var writers []io.Writer
+	if toFile {
+		logFileHandle, err := openLogFile(cfg.LogFile)
+		if err != nil {
+			log.Fatalf("Failed to set up logging: %v", err)
+		}
+		defer logFileHandle.Close()
+		writers = append(writers, logFileHandle)
+	}
+	if cfg.MirrorStdout || !toFile {
+		writers = append(writers, logStream)
+	}
+	logger := log.New(io.MultiWriter(writers...), "", log.LstdFlags)
 
-	// Output the date and program settings
+	// Output the date and every program setting as JSON
+	gpus, gpuErr := queryGPUs()
 	currentDate := time.Now().Format("Mon Jan 2 15:04:05 2006")
 	logger.Printf("Current Date: %s\n", currentDate)
-	logger.Printf("Configuration: idleTimeThreshold=%d, warningOnly=%v, targetWorkloads=%v, whitelist=%v, logFile=%s, sleepInterval=%d, dockerEnabled=%v\n",
-		idleTimeThreshold, warningOnly, targetWorkloadsSlice, whitelistSlice, logFile, sleepInterval, dockerEnabled)
+	logger.Printf("Effective configuration: %s\n", newStartupBanner(cfg, gpus, gpuErr))
+	if remote != nil {
+		remote.logProblems(logger)
+	}
+	if cfg.ConfigFile != "" {
+		logger.Printf("Configuration file: %s\n", configSource(cfg.ConfigFile))
+	}
+
+	applySelfLimits(cfg)
+	clk := realClock{}
+	events := &notifier{logger: logger, clock: clk}
+	if cfg.SplitStreams != "" {
+		events.sinks = append(events.sinks, newStreamSink(eventStream))
+	}
+	if cfg.Journal {
+		sink, err := newJournalSink()
+		switch {
+		case err != nil:
+			logger.Printf("Failed to connect to the systemd journal: %v\n", err)
+		case sink == nil:
+			logger.Println("The systemd journal socket isn't present, not writing events to the journal.")
+		default:
+			events.sinks = append(events.sinks, sink)
+		}
+	}
+
+	var webhook *webhookSink
+	if cfg.WebhookURL != "" {
+		if webhook, err = newWebhookSink(cfg.WebhookURL, cfg.WebhookTemplate); err != nil {
+			logger.Fatalf("Invalid -webhookTemplate: %v\n", err)
+		}
+		webhook.batch = cfg.BatchTerminations
+		webhook.start(logger)
+		events.sinks = append(events.sinks, webhook)
+	}
 
-	var cli *client.Client
-	if dockerEnabled {
+	var audit *auditSink
+	if cfg.AuditDB != "" {
+		if audit, err = newAuditSink(cfg.AuditDB, logger); err != nil {
+			logger.Fatalf("Failed to open the audit database %s: %v\n", cfg.AuditDB, err)
+		}
+		events.sinks = append(events.sinks, audit)
+	}
+
+	var daemons []*dockerDaemon
+	if cfg.DockerEnabled {
 		var err error
-		cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		daemons, err = newDockerDaemons(cfg)
 		if err != nil {
-			logger.Println("Failed to initialize Docker client.")
+			logger.Printf("Failed to initialize Docker client: %v\n", err)
 			return
 		}
+		// With -dockerHosts, a daemon that's down is retried every scan as long
+		// as any of the others can be reached
+		reachable := 0
+		for _, d := range daemons {
+			endpoint, err := pingDocker(d, cfg)
+			if err != nil {
+				if len(cfg.DockerHosts) == 0 {
+					logger.Fatalf("%v\n", err)
+				}
+				logger.Printf("WARNING: %v\n", err)
+				continue
+			}
+			reachable++
+			logger.Printf("Docker endpoint: %s\n", endpoint)
+		}
+		if reachable == 0 {
+			logger.Fatalf("None of the Docker daemons in -dockerHosts are reachable.\n")
+		}
+	}
+
+	extraFields, _ := parseExtraFields(cfg.ExtraQueryFields)
+	logCapabilities(extraFields, logger)
+
+	m, err := newMonitor(cfg, clk, logger, events, daemons)
+	if err != nil {
+		logger.Fatalf("Invalid configuration: %v\n", err)
+	}
+	if cfg.K8sEvict {
+		if m.kube, err = newInClusterKubeClient(); err != nil {
+			logger.Fatalf("Failed to set up the Kubernetes client for -k8sEvict: %v\n", err)
+		}
+		logger.Printf("Evicting idle GPU pods on Kubernetes node %s.\n", cfg.K8sNode)
 	}
 
-	logger.Println("Starting GPU idle monitor...")
+	if cfg.DiagBufferSize > 0 {
+		blackBox = newDiagRecorder(cfg.DiagBufferSize, cfg.DiagDumpDir, cfg.DiagDumpMaxMB, clk, logger)
+		events.sinks = append(events.sinks, blackBox)
+		go blackBox.dumpOnSignal()
+		logger.Printf("Recording the last %d scans, dumped to %s on SIGUSR2 or a panic.\n", cfg.DiagBufferSize, cfg.DiagDumpDir)
+	}
 
-	for {
-		// Get GPU processes
-		out, err := exec.Command("nvidia-smi", "--query-compute-apps=pid,used_memory", "--format=csv,noheader,nounits").Output()
+	if cfg.ShadowConfig != "" {
+		m.shadow, err = startShadow(cfg, clk, logger, daemons)
 		if err != nil {
-			logger.Println("Failed to query GPU processes.")
-			continue
+			logger.Fatalf("Failed to set up -shadowConfig: %v\n", err)
 		}
+		logger.Printf("Evaluating the candidate settings in %s alongside the live ones, without acting on them.\n", cfg.ShadowConfig)
+	}
 
-		gpuProcesses := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if cfg.TelemetryEndpoint != "" {
+		m.telemetry = newTelemetry(cfg.TelemetryEndpoint, clk, logger)
+		logger.Printf("Sending usage reports to %s every %d seconds.\n", redactedURL(cfg.TelemetryEndpoint), cfg.TelemetryInterval)
+	}
 
-		// Log GPU processes
-		logger.Printf("Current GPU Processes:\n%s\n", strings.Join(gpuProcesses, "\n"))
+	if cfg.Once {
+		code := m.runOnce(cfg.OnceSummary)
+		flushSinks(webhook, audit)
+		os.Exit(code)
+	}
+	go m.flushOnStop(webhook, audit)
 
-		for _, process := range gpuProcesses {
-			fields := strings.Split(process, ",")
-			pidStr := strings.TrimSpace(fields[0])
-			usedMemoryStr := strings.TrimSpace(fields[1])
+	if cfg.ConfigFile != "" {
+		go m.watchReload(cfg.ConfigFile, cfg.WatchConfig, time.Duration(cfg.ConfigRefresh)*time.Second)
+	}
 
-			pid, _ := strconv.Atoi(pidStr)
-			usedMemory, _ := strconv.Atoi(usedMemoryStr)
+	if cfg.APIAddr != "" {
+		if err := startAPI(cfg.APIAddr, cfg.APIToken, m); err != nil {
+			logger.Fatalf("Failed to start the API on %s: %v\n", cfg.APIAddr, err)
+		}
+		logger.Printf("Serving the API on %s\n", cfg.APIAddr)
+	}
 
-			// Get the process name
-			out, err := exec.Command("ps", "-p", pidStr, "-o", "comm=").Output()
-			if err != nil {
-				logger.Printf("Failed to get process name for PID %d.\n", pid)
-				continue
-			}
-			processName := strings.TrimSpace(string(out))
-
-			// Get the Docker container name
-			var dockerContainer string
-			if dockerEnabled {
-				containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{})
-				if err != nil {
-					logger.Println("Failed to get Docker container list.")
-					continue
-				}
+	// Log how GPU indices map to UUIDs, as indices may change between reboots
+	if gpuErr != nil {
+		logger.Printf("Failed to query GPUs: %v\n", gpuErr)
+	} else {
+		for _, gpu := range gpus {
+			logger.Printf("GPU %d: %s\n", gpu.Index, gpu.UUID)
+		}
+	}
 
-				for _, container := range containers {
-					inspect, err := cli.ContainerInspect(context.Background(), container.ID)
-					if err != nil {
-						logger.Printf("Failed to inspect container: %s\n", container.ID)
-						continue
-					}
-					logger.Printf("nvidia-smi PID %s with Docker container PID: %d Name: %s\n", pidStr, inspect.State.Pid, strings.TrimPrefix(container.Names[0], "/"))
-					if pidStr == strconv.Itoa(inspect.State.Pid) {
-						dockerContainer = strings.TrimPrefix(container.Names[0], "/")
-						break
-					}
-				}
-			}
+	m.run()
+}
 
-			// Check if the process name is in the target workloads list
-			if contains(targetWorkloadsSlice, processName) {
-				// Skip whitelisted processes and containers
-				if contains(whitelistSlice, processName) || contains(whitelistSlice, dockerContainer) {
-					continue
-				}
+// flushSinks delivers the events the webhook and audit database still have
+// queued, for when nvidler is about to exit.
+func flushSinks(webhook *webhookSink, audit *auditSink) {
+	if webhook != nil {
+		webhook.flush()
+	}
+	if audit != nil {
+		audit.flush()
+	}
+}
 
-				// If the used memory is zero, consider the process as idle
-				if usedMemory == 0 {
-					// Get the process start time
-					out, err := exec.Command("ps", "-o", "lstart=", "-p", pidStr).Output()
-					if err != nil {
-						logger.Printf("Failed to get start time for PID %d.\n", pid)
-						continue
-					}
-					startTimeStr := strings.TrimSpace(string(out))
-					startTime, _ := time.Parse("Mon Jan 2 15:04:05 2006", startTimeStr)
-					startTimeEpoch := startTime.Unix()
-
-					// Get the current time
-					currentTimeEpoch := time.Now().Unix()
-
-					// Calculate the idle time
-					idleTime := currentTimeEpoch - startTimeEpoch
-
-					// If idle time is greater than the threshold, take action
-					if idleTime > int64(idleTimeThreshold) {
-						if warningOnly {
-							logger.Printf("WARNING: Process %d (%s) in Docker container %s has been idle for more than %d seconds.\n", pid, processName, dockerContainer, idleTimeThreshold)
-						} else {
-							// Send a SIGTERM for graceful termination
-							if err := exec.Command("kill", "-15", pidStr).Run(); err != nil {
-								logger.Printf("Failed to send SIGTERM to PID %d.\n", pid)
-								continue
-							}
-							logger.Printf("Terminated: Process %d (%s) in Docker container %s has been idle for more than %d seconds.\n", pid, processName, dockerContainer, idleTimeThreshold)
-						}
-					}
-				}
-			}
+// flushOnStop exits on SIGTERM or SIGINT once any scan under way has finished
+// and the queued events have been delivered, so stopping nvidler doesn't lose
+// its latest actions.
+func (m *monitor) flushOnStop(webhook *webhookSink, audit *auditSink) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	m.mu.Lock()
+	m.logger.Printf("Received %v, stopping.\n", sig)
+	flushSinks(webhook, audit)
+	os.Exit(0)
+}
+
+// explain prints why nvidler would or wouldn't act on -explain's PID. Logging
+// goes to stderr so that the explanation itself can be read on its own.
+func explain(cfg Config) {
+	m := oneShotMonitor(cfg)
+	if err := m.explain(cfg.ExplainPID, os.Stdout); err != nil {
+		m.logger.Fatalf("Failed to explain PID %d: %v\n", cfg.ExplainPID, err)
+	}
+}
+
+// preview prints every GPU process ranked by waste for -preview, logging to
+// stderr like explain.
+func preview(cfg Config) {
+	m := oneShotMonitor(cfg)
+	entries, err := m.preview()
+	if err != nil {
+		m.logger.Fatalf("Failed to rank GPU processes: %v\n", err)
+	}
+	if cfg.Preview == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(entries)
+	} else {
+		err = writeWasteTable(os.Stdout, entries)
+	}
+	if err != nil {
+		m.logger.Fatalf("Failed to write the preview: %v\n", err)
+	}
+}
+
+// whatIf prints which GPU processes would be acted on at each of the -whatIf
+// thresholds, logging to stderr like explain.
+func whatIf(cfg Config) {
+	m := oneShotMonitor(cfg)
+	thresholds, _ := parseThresholds(cfg.WhatIf)
+	results, err := m.whatIf(thresholds)
+	if err != nil {
+		m.logger.Fatalf("Failed to evaluate the -whatIf thresholds: %v\n", err)
+	}
+	if cfg.WhatIfFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	} else {
+		err = writeWhatIfTable(os.Stdout, results)
+	}
+	if err != nil {
+		m.logger.Fatalf("Failed to write the -whatIf report: %v\n", err)
+	}
+}
+
+// oneShotMonitor creates a monitor for a single evaluation rather than
+// running, logging to stderr.
+func oneShotMonitor(cfg Config) *monitor {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	events := &notifier{logger: logger, clock: realClock{}}
+
+	var daemons []*dockerDaemon
+	if cfg.DockerEnabled {
+		var err error
+		if daemons, err = newDockerDaemons(cfg); err != nil {
+			logger.Fatalf("Failed to initialize Docker client: %v\n", err)
 		}
+	}
 
-		// Sleep for a minute before checking again
-		time.Sleep(time.Duration(sleepInterval) * time.Second)
+	extraFields, _ := parseExtraFields(cfg.ExtraQueryFields)
+	logCapabilities(extraFields, logger)
+
+	m, err := newMonitor(cfg, realClock{}, logger, events, daemons)
+	if err != nil {
+		logger.Fatalf("Invalid configuration: %v\n", err)
+	}
+	return m
+}
+
+// Helper function to split a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
 
 // Helper function to check if a slice contains a string
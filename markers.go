@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// readGPUDisableMarkers returns the GPUs marked as out of policy in
+// -gpuDisableMarkerDir, by the index or UUID each marker file is named after.
+// Files named anything else are ignored, and a missing directory has no
+// markers.
+func readGPUDisableMarkers(dir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	markers := make(map[string]bool)
+	for _, entry := range entries {
+		if isGPURef(entry.Name()) {
+			markers[entry.Name()] = true
+		}
+	}
+	return markers, nil
+}
+
+// updateDisabledGPUs reads -gpuDisableMarkerDir for the scan, logging each GPU
+// that's been disabled or re-enabled since the last. If the directory can't be
+// read, the GPUs disabled on the last scan stay disabled.
+func (m *monitor) updateDisabledGPUs() map[string]bool {
+	if m.cfg.GPUDisableMarkerDir == "" {
+		m.disabledGPUs = nil
+		return nil
+	}
+	markers, err := readGPUDisableMarkers(m.cfg.GPUDisableMarkerDir)
+	if err != nil {
+		m.logger.Printf("Failed to read -gpuDisableMarkerDir %s, keeping the GPUs disabled as they were: %v\n", m.cfg.GPUDisableMarkerDir, err)
+		return m.disabledGPUs
+	}
+	// A preview sees the markers as they are, leaving the change to be logged
+	// and taken in by the next scan
+	if m.previewing {
+		return markers
+	}
+
+	var disabled, enabled []string
+	for ref := range markers {
+		if !m.disabledGPUs[ref] {
+			disabled = append(disabled, ref)
+		}
+	}
+	for ref := range m.disabledGPUs {
+		if !markers[ref] {
+			enabled = append(enabled, ref)
+		}
+	}
+	sort.Strings(disabled)
+	sort.Strings(enabled)
+	for _, ref := range disabled {
+		m.logger.Printf("GPU %s disabled by a marker in %s, its processes won't be acted on until it's removed.\n", ref, m.cfg.GPUDisableMarkerDir)
+	}
+	for _, ref := range enabled {
+		m.logger.Printf("GPU %s re-enabled, its marker in %s was removed.\n", ref, m.cfg.GPUDisableMarkerDir)
+	}
+	m.disabledGPUs = markers
+	return markers
+}
+
+// disabledGPU returns the marker disabling the GPU a process is on, if any.
+// The process's own UUID is checked first, so MIG instances can be disabled
+// individually.
+func (s *scanState) disabledGPU(p gpuProcess) (string, bool) {
+	if s.disabledGPUs[p.GPUUUID] {
+		return p.GPUUUID, true
+	}
+	gpu, ok := s.gpusByUUID[p.GPUUUID]
+	if !ok {
+		return "", false
+	}
+	for ref := range s.disabledGPUs {
+		if gpu.matches(ref) {
+			return ref, true
+		}
+	}
+	return "", false
+}
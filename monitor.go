@@ -0,0 +1,1431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// monitor periodically scans the GPU processes and warns about or terminates
+// those that have been idle for too long.
+type monitor struct {
+	mu     sync.Mutex // held while scanning, and to change the configuration
+	cfg    Config
+	clock  clock
+	logger *log.Logger
+	events *notifier
+	docker []*dockerDaemon // nil when Docker tracking is disabled
+	kube   *kubeClient     // nil unless -k8sEvict is set
+
+	apiOverrides runtimeConfig // settings changed through the API, kept across reloads
+
+	extraFields    []queryField
+	readings       idleClassifier   // the built-in idle classifier, by -idleExpr or -idlePolicy
+	classifiers    []idleClassifier // site-specific idle classifiers, by -idleClassifierCommand
+	reclaimTargets map[string]int
+	killCommand    *killCommand // nil to signal processes directly
+	ladder         []ladderRung
+	activityPaths  []activityPath
+	businessHours  businessHours // nil unless -businessHours is set
+	thresholdState string        // the -businessHours state last logged
+
+	stats             *summary
+	confirmations     *confirmer
+	repeats           *warningRepeats
+	health            *healthMonitor
+	thermal           *thermalMonitor
+	latency           *scanLatency
+	self              *selfMonitor
+	recent            *recentEvents // the latest events, for -stateFile
+	quarantined       *quarantine   // processes quarantined by -quarantineAction
+	telemetry         *telemetry    // nil unless -telemetryEndpoint is set
+	shadow            *shadowEngine // nil unless -shadowConfig is set
+	peaks             memoryPeaks
+	leaks             leakTracker // with -leakedContextThreshold
+	failSafe          failSafe
+	memoryTotals      map[string]int // total memory by GPU UUID, for -logMemoryPercent
+	procMismatch      bool
+	pmonFailed        bool                   // nvidia-smi pmon failed on the last scan
+	scanFailed        bool                   // a lookup failed on the last scan
+	permissionErrors  int                    // signals nvidler wasn't permitted to send
+	demandState       string                 // the -demandSignal state last logged
+	inBootGrace       bool                   // enforcement is held off by -minNodeUptime
+	thresholdOverride time.Duration          // the threshold being tried by -whatIf, if any
+	previewing        bool                   // evaluating for -preview or -whatIf, which mustn't change later scans
+	queuedJobs        []queuedJob            // the jobs listed by -demandSignal on the last scan, if any
+	disabledGPUs      map[string]bool        // GPUs with a marker in -gpuDisableMarkerDir on the last scan
+	accountingFailed  bool                   // querying the accounting mode failed on the last scan
+	noAccounting      map[string]bool        // GPUs by UUID last seen with accounting mode disabled
+	dState            map[int]*dStateProcess // processes seen in uninterruptible sleep
+	quiet             *quietTracker          // processes below the -idlePolicy utilization
+	wallNotices       map[int]time.Time      // when each process's owner was given -wallNotify notice
+	drainNotices      map[int]time.Time      // when each process being drained was warned
+	unverified        map[int]pendingKill    // processes terminated on the last scan, to check they're gone
+	draining          bool                   // -drain was on at the last scan
+	containersListed  time.Time              // when the Docker containers were last all listed
+	resets            *resetDetector
+	gpuResets         map[string]time.Time // when each GPU was last seen reset, by UUID
+
+	ladderProgress map[int]*ladderProgress // processes on the -signalLadder
+	ladderSeen     map[int]bool            // processes due for termination this scan
+	whitelistUsage *whitelistUsage
+}
+
+// newMonitor validates the configuration and creates a monitor.
+func newMonitor(cfg Config, clk clock, logger *log.Logger, events *notifier, docker []*dockerDaemon) (*monitor, error) {
+	m := &monitor{
+		clock:        clk,
+		logger:       logger,
+		events:       events,
+		docker:       docker,
+		stats:        newSummary(clk),
+		health:       newHealthMonitor(),
+		thermal:      newThermalMonitor(clk),
+		latency:      newScanLatency(clk),
+		self:         newSelfMonitor(clk),
+		repeats:      newWarningRepeats(clk),
+		peaks:        make(memoryPeaks),
+		leaks:        make(leakTracker),
+		dState:       make(map[int]*dStateProcess),
+		wallNotices:  make(map[int]time.Time),
+		drainNotices: make(map[int]time.Time),
+		unverified:   make(map[int]pendingKill),
+		resets:       newResetDetector(),
+		gpuResets:    make(map[string]time.Time),
+		noAccounting: make(map[string]bool),
+		quiet:        newQuietTracker(),
+		quarantined:  newQuarantine(),
+
+		whitelistUsage: newWhitelistUsage(clk),
+
+		ladderProgress: make(map[int]*ladderProgress),
+		ladderSeen:     make(map[int]bool),
+	}
+	if err := m.apply(cfg); err != nil {
+		return nil, err
+	}
+	m.recent = &recentEvents{}
+	events.sinks = append(events.sinks, m.recent)
+	if cfg.StateFile != "" {
+		m.restorePeaks()
+	}
+	return m, nil
+}
+
+// apply validates a configuration and, if it's valid, switches the monitor
+// over to it. The caller must hold m.mu once the monitor is running.
+func (m *monitor) apply(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	extraFields, _ := parseExtraFields(cfg.ExtraQueryFields)
+	var readings idleClassifier = policyClassifier{policy: defaultIdlePolicy, quiet: m.quiet, clock: m.clock}
+	switch {
+	case cfg.IdleExpr != "":
+		idleExpression, _ := compileIdleExpr(cfg.IdleExpr, cfg.valueFields(extraFields))
+		readings = readingsClassifier{expr: idleExpression, source: cfg.IdleExpr}
+	case cfg.IdlePolicy != "":
+		policy, _ := parseIdlePolicy(cfg.IdlePolicy, cfg.valueFields(extraFields))
+		readings = policyClassifier{policy: policy, quiet: m.quiet, clock: m.clock, seedFromStart: cfg.SeedIdleFromStartTime, resets: m.gpuResets}
+	}
+	reclaimTargets, _ := parseReclaimTargets(cfg.ReclaimTargetMB)
+	ladder, _ := parseLadder(cfg.SignalLadder)
+	activityPaths, _ := parseActivityPaths(cfg.ActivityPaths)
+	var hours businessHours
+	if cfg.BusinessHours != "" {
+		hours, _ = parseBusinessHours(cfg.BusinessHours)
+	}
+	var killCommand *killCommand
+	if cfg.KillCommand != "" {
+		killCommand, _ = parseKillCommand(cfg.KillCommand)
+	}
+	var classifiers []idleClassifier
+	if cfg.IdleClassifierCommand != "" {
+		cmd, _ := parseKillCommand(cfg.IdleClassifierCommand)
+		classifiers = append(classifiers, commandClassifier{cmd: cmd})
+	}
+
+	if m.confirmations == nil || m.confirmations.cycles != cfg.ConfirmCycles {
+		m.confirmations = newConfirmer(cfg.ConfirmCycles)
+	}
+	m.cfg = cfg
+	m.extraFields = extraFields
+	m.readings = readings
+	m.reclaimTargets = reclaimTargets
+	m.killCommand = killCommand
+	m.classifiers = classifiers
+	m.ladder = ladder
+	m.activityPaths = activityPaths
+	m.businessHours = hours
+	return nil
+}
+
+// threshold is how long a process must be idle before it's acted on.
+// During -businessHours it's multiplied by -businessHoursMultiplier.
+func (m *monitor) threshold() time.Duration {
+	if m.thresholdOverride > 0 {
+		return m.thresholdOverride
+	}
+	base := time.Duration(m.cfg.IdleTimeThreshold) * time.Second
+	if m.businessHours != nil && m.businessHours.contains(m.clock.Now()) {
+		return time.Duration(float64(base) * m.cfg.BusinessHoursMultiplier)
+	}
+	return base
+}
+
+// thresholdSeconds is the idle threshold in whole seconds, for messages.
+func (m *monitor) thresholdSeconds() int {
+	return int(m.threshold() / time.Second)
+}
+
+// run scans the GPU processes every sleep interval, forever.
+func (m *monitor) run() {
+	m.logger.Println("Starting GPU idle monitor...")
+	defer func() {
+		if r := recover(); r != nil {
+			m.dumpPanic(r, debug.Stack())
+			panic(r)
+		}
+	}()
+
+	for {
+		m.mu.Lock()
+		start := m.clock.Now()
+		m.scan()
+		m.latency.record(m.clock.Now().Sub(start), time.Duration(m.cfg.LatencyWindow)*time.Second, time.Duration(m.cfg.SleepInterval)*time.Second, m.cfg.LatencyWarnFraction, m.events)
+
+		if m.stats.due(time.Duration(m.cfg.SummaryInterval) * time.Second) {
+			m.stats.report(m.events)
+		}
+		m.self.check(m, time.Duration(m.cfg.SelfStatsInterval)*time.Second)
+		if m.cfg.StateFile != "" {
+			m.writeState()
+		}
+		if m.telemetry != nil && m.telemetry.due(time.Duration(m.cfg.TelemetryInterval)*time.Second) {
+			m.reportTelemetry()
+		}
+		interval := time.Duration(m.cfg.SleepInterval) * time.Second
+		m.mu.Unlock()
+
+		// Sleep for a minute before checking again
+		m.clock.Sleep(interval)
+	}
+}
+
+// scanState is gathered once at the start of each scan and shared by the
+// evaluation of every process.
+type scanState struct {
+	gpus               []gpuInfo
+	gpusByUUID         map[string]gpuInfo
+	protected          map[int]string // why each of nvidler's own processes is protected, by PID
+	containers         *containerIndex
+	pods               map[string]podRef    // GPU pods on the node by UID, with -k8sEvict
+	migDevices         map[string]migDevice // MIG instances by UUID, if any process is on one
+	disabledGPUs       map[string]bool      // GPUs by index or UUID with a marker in -gpuDisableMarkerDir
+	gpuPIDsByContainer map[string][]int
+	gpuPIDsByCgroup    map[string][]int // with -reapGranularity cgroup
+	ps                 map[int]psInfo   // with -batchPs
+	failed             bool             // whether any lookup for the scan failed
+	suppress           bool             // only warn this scan, whatever the settings
+	warningOnly        bool             // whether this scan only warns
+	demandGated        bool             // whether it's because no jobs are waiting, with -demandSignal
+	overRuntime        []candidate      // processes running for longer than -maxRuntime
+	terminating        map[int]bool     // processes due for termination, for -shadowConfig
+	sweep              sweepReport      // the scan's terminations, reported together
+
+	// With -maxLoggedProcesses, the evaluation of processes beyond the cap is
+	// logged to a buffer, only written out if the process is acted on
+	logger  *log.Logger
+	held    map[int]*bytes.Buffer
+	loggers map[int]*log.Logger
+
+	// With -explain, the steps of the decision for explainPID
+	explainPID int
+	trace      []string
+}
+
+// log returns the logger for a process's evaluation.
+func (s *scanState) log(pid int) *log.Logger {
+	buf, ok := s.held[pid]
+	if !ok || pid == s.explainPID {
+		return s.logger
+	}
+	if s.loggers[pid] == nil {
+		s.loggers[pid] = log.New(buf, s.logger.Prefix(), s.logger.Flags())
+	}
+	return s.loggers[pid]
+}
+
+// release writes out the held evaluation log of a process that's being acted
+// on, reporting whether it had been held.
+func (s *scanState) release(pid int) bool {
+	buf, ok := s.held[pid]
+	if ok {
+		s.logger.Writer().Write(buf.Bytes())
+		delete(s.held, pid)
+	}
+	return ok
+}
+
+// processComm, processOwner and processStartTime use the results of a batched
+// ps call when there are any, and otherwise look the process up directly.
+// A process missing from the batch has most likely exited, which the direct
+// lookup then reports.
+
+func (s *scanState) processComm(pid int) (string, error) {
+	if info, ok := s.ps[pid]; ok {
+		return info.Comm, nil
+	}
+	return processComm(pid)
+}
+
+func (s *scanState) processOwner(pid int) (string, error) {
+	if info, ok := s.ps[pid]; ok {
+		return info.Owner, nil
+	}
+	return processOwner(pid)
+}
+
+func (s *scanState) processStartTime(pid int) (time.Time, error) {
+	if info, ok := s.ps[pid]; ok {
+		return info.Start, nil
+	}
+	return processStartTime(pid)
+}
+
+// recordScan tracks failed scans for -failSafeAfter and -once.
+func (m *monitor) recordScan(failed bool) {
+	m.scanFailed = failed
+	m.failSafe.record(failed, m.cfg.FailSafeAfter, m.cfg.FailSafeRecovery, m.events)
+}
+
+// note records a step of the decision for a process being explained.
+func (s *scanState) note(pid int, format string, args ...interface{}) {
+	if pid == s.explainPID {
+		s.trace = append(s.trace, fmt.Sprintf(format, args...))
+	}
+}
+
+// scan performs a single pass over the GPU processes.
+func (m *monitor) scan() {
+	blackBox.begin()
+	if smiXML != nil {
+		smiXML.invalidate()
+	}
+	if m.cfg.MonitorGPUHealth {
+		m.health.check(m.events)
+	}
+	m.logThreshold()
+	m.logDrain()
+	if m.cfg.TempThreshold > 0 {
+		m.thermal.check(m.events, m.cfg.TempThreshold, time.Duration(m.cfg.TempSustain)*time.Second)
+	}
+
+	// Get GPU processes
+	out, gpuProcesses, err := queryComputeApps(m.extraFields)
+	if err != nil {
+		m.logger.Printf("Failed to query GPU processes: %v\n", err)
+		m.recordScan(true)
+		return
+	}
+
+	// Log GPU processes, up to -maxLoggedProcesses of them
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if n := m.cfg.MaxLoggedProcesses; n > 0 && len(lines) > n {
+		lines = append(lines[:n], fmt.Sprintf("+%d more", len(lines)-n))
+	}
+	m.logger.Printf("Current GPU Processes:\n%s\n", strings.Join(lines, "\n"))
+
+	if m.cfg.Pmon {
+		m.addPmonValues(gpuProcesses)
+	}
+
+	// If none of the GPU processes exist under /proc we're most likely in a
+	// container that can't see the host's PIDs, and every lookup would fail
+	if len(gpuProcesses) > 0 && !anyProcessExists(gpuProcesses) {
+		if !m.procMismatch {
+			m.logger.Printf("ERROR: None of the GPU PIDs reported by nvidia-smi exist under %s. nvidler appears to be running in a separate PID namespace; run it with host PIDs (hostPID: true in Kubernetes, --pid=host with Docker) or mount the host's /proc and point -procRoot at it.\n", procRoot)
+			m.procMismatch = true
+		}
+		m.recordScan(true)
+		return
+	}
+	if m.procMismatch {
+		m.logger.Printf("GPU PIDs are visible under %s again.\n", procRoot)
+		m.procMismatch = false
+	}
+
+	var startTime func(int) (time.Time, error)
+	if m.cfg.StateFile != "" {
+		startTime = processStartTime
+	}
+	m.peaks.update(gpuProcesses, startTime)
+	if m.cfg.LeakedContextThreshold > 0 {
+		m.leaks.update(gpuProcesses, m.clock.Now())
+	} else {
+		m.leaks = make(leakTracker)
+	}
+
+	state := m.newScanState(gpuProcesses)
+	m.recordScan(state.failed)
+	m.detectResets(gpuProcesses, state)
+
+	var candidates, drained []candidate
+	for _, process := range gpuProcesses {
+		if c, ok := m.evaluate(process, state); ok {
+			state.release(c.PID)
+			if c.Drain {
+				drained = append(drained, c)
+				continue
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	blackBox.recordCandidates(candidates)
+	if len(state.held) > 0 {
+		m.logger.Printf("+%d more GPU processes evaluated without being acted on, not logged beyond -maxLoggedProcesses of %d.\n", len(state.held), m.cfg.MaxLoggedProcesses)
+	}
+	if state.containers != nil && state.containers.misses > 0 {
+		m.logger.Printf("Container attribution: %d processes and ancestors looked up, %d lookups answered from the scan's cache.\n", state.containers.misses, state.containers.hits)
+	}
+
+	// Nearly every process going idle at once is far more likely to be a bad
+	// reading, such as nvidia-smi reporting no memory in use after a driver
+	// hiccup, than reality
+	if m.cfg.MassIdleGuard > 0 && len(gpuProcesses) >= m.cfg.MassIdleMinProcesses {
+		fraction := float64(len(candidates)) / float64(len(gpuProcesses))
+		if fraction > m.cfg.MassIdleGuard {
+			m.logger.Printf("WARNING: %d of %d GPU processes (%.0f%%) appear idle at once, above -massIdleGuard of %.0f%%. This is most likely bad data from nvidia-smi, not terminating anything this scan.\n", len(candidates), len(gpuProcesses), fraction*100, m.cfg.MassIdleGuard*100)
+			state.suppress = true
+		}
+	}
+
+	state.warningOnly = m.warningOnly(state)
+	if state.demandGated && len(candidates) > 0 {
+		m.logger.Printf("No GPU jobs are waiting by -demandSignal, so %d idle processes are only warned about rather than terminated.\n", len(candidates))
+	}
+	var shadowed map[int]shadowDecision
+	if m.shadow != nil {
+		shadowed = m.shadow.decide(gpuProcesses, state, state.warningOnly && !m.cfg.WarningOnly)
+	}
+	m.verifyKills(state)
+	m.act(candidates, state)
+	if m.shadow != nil {
+		m.shadow.compare(decisions(m.cfg, candidates, state.terminating), shadowed)
+	}
+	m.releaseQuarantined(candidates)
+	m.enforceRuntime(candidates, state)
+	m.drain(drained, state)
+	m.reportSweep(state)
+	m.forgetLadders()
+	m.quiet.forget()
+	m.repeats.forget()
+	m.whitelistUsage.warnUnused(m.cfg.Whitelist, time.Duration(m.cfg.WarnUnusedWhitelist)*time.Second, m.logger)
+}
+
+// warningOnly decides whether a scan should only warn rather than terminate.
+func (m *monitor) warningOnly(state *scanState) bool {
+	demand := m.checkDemand()
+	if m.cfg.WarningOnly || m.failSafe.Degraded || state.suppress {
+		return true
+	}
+	if m.bootGrace() {
+		return true
+	}
+	if m.cfg.TempPause && m.cfg.TempThreshold > 0 && m.thermal.overheated() {
+		m.logger.Println("A GPU is over temperature, only warning until it cools down (-tempPauseEnforcement).")
+		return true
+	}
+	if reason := m.staleAttribution(state); reason != "" {
+		m.logger.Printf("Only warning this scan (-requireFreshAttribution), as %s, so processes can't be checked against the exemptions that depend on their container.\n", reason)
+		return true
+	}
+	if !demand {
+		state.demandGated = true
+		return true
+	}
+	return false
+}
+
+// bootGrace reports whether the node has been up for less than
+// -minNodeUptime, while jobs are still starting and nvidia-smi and Docker may
+// be unsettled after a boot. It logs when enforcement is held off and again
+// once it becomes active. If the uptime can't be read, enforcement isn't held
+// off.
+func (m *monitor) bootGrace() bool {
+	minimum := time.Duration(m.cfg.MinNodeUptime) * time.Second
+	if minimum <= 0 {
+		return false
+	}
+	uptime, err := nodeUptime()
+	if err != nil {
+		m.logger.Printf("Failed to read the node's uptime for -minNodeUptime, not holding off enforcement: %v\n", err)
+		return false
+	}
+	uptime = uptime.Truncate(time.Second)
+	if uptime < minimum {
+		if !m.inBootGrace {
+			m.inBootGrace = true
+			m.logger.Printf("The node has only been up for %v, under -minNodeUptime of %v, only warning until it has been up for %v more.\n", uptime, minimum, minimum-uptime)
+		}
+		return true
+	}
+	if m.inBootGrace {
+		m.inBootGrace = false
+		m.logger.Printf("The node has now been up for %v, past -minNodeUptime of %v, enforcement is active.\n", uptime, minimum)
+	}
+	return false
+}
+
+// categoryRuntime marks events about processes over -maxRuntime, as opposed to
+// idle ones.
+const categoryRuntime = "runtime"
+
+// enforceRuntime warns about or terminates processes running for longer than
+// -maxRuntime. Processes that are also idle are left to idle enforcement.
+func (m *monitor) enforceRuntime(idle []candidate, state *scanState) {
+	isIdle := make(map[int]bool, len(idle))
+	for _, c := range idle {
+		isIdle[c.PID] = true
+	}
+
+	for _, c := range state.overRuntime {
+		if isIdle[c.PID] {
+			continue
+		}
+		c.OverRuntime = true
+		runtime := m.clock.Now().Sub(c.StartTime).Truncate(time.Second)
+		if state.warningOnly || m.cfg.MaxRuntimeAction != "terminate" {
+			m.events.emit(c.event(actionWarn, fmt.Sprintf("RUNTIME WARNING: Process %d (%s) in Docker container %s has been running for %v, over -maxRuntime of %d seconds.%s", c.PID, c.Name, c.Container, runtime, m.cfg.MaxRuntime, c.jobNote())))
+			m.stats.recordWarning(c.Owner, c.Container)
+			continue
+		}
+		note, err := m.signal(c)
+		if err == errNotDue {
+			continue
+		}
+		outcome := m.recordKill(state, c, err)
+		if err != nil {
+			m.emitKill(c.outcomeEvent(actionError, outcome, err.Error()))
+			continue
+		}
+		m.emitKill(c.outcomeEvent(actionTerminate, outcome, fmt.Sprintf("Terminated (runtime limit): Process %d (%s) in Docker container %s has been running for %v, over -maxRuntime of %d seconds.%s%s", c.PID, c.Name, c.Container, runtime, m.cfg.MaxRuntime, c.jobNote(), note)))
+		m.stats.recordTermination(c.Owner, c.Container, 0, c.Share)
+	}
+}
+
+// newScanState gathers what's needed to evaluate the GPU processes.
+func (m *monitor) newScanState(processes []gpuProcess) *scanState {
+	state := &scanState{
+		gpuPIDsByContainer: make(map[string][]int),
+		gpuPIDsByCgroup:    make(map[string][]int),
+		logger:             m.logger,
+		held:               make(map[int]*bytes.Buffer),
+		loggers:            make(map[int]*log.Logger),
+	}
+	if m.cfg.MaxLoggedProcesses > 0 {
+		for _, process := range processes[min(m.cfg.MaxLoggedProcesses, len(processes)):] {
+			state.held[process.PID] = new(bytes.Buffer)
+		}
+	}
+
+	// Resolve GPU indices and UUIDs each cycle, so GPUs can be referenced by
+	// either
+	var err error
+	state.disabledGPUs = m.updateDisabledGPUs()
+	if len(m.cfg.WhitelistGPUs) > 0 || len(m.reclaimTargets) > 0 || len(state.disabledGPUs) > 0 || m.cfg.DemandSignal != "" || m.cfg.DetectGPUResets || len(m.cfg.DrainGPUs) > 0 {
+		if state.gpus, err = queryGPUs(); err != nil {
+			m.logger.Printf("Failed to query GPUs: %v\n", err)
+			state.failed = true
+		}
+	}
+	state.gpusByUUID = make(map[string]gpuInfo, len(state.gpus))
+	for _, gpu := range state.gpus {
+		state.gpusByUUID[gpu.UUID] = gpu
+	}
+
+	// nvidler, other copies of it and anything they spawn must never be
+	// flagged or killed
+	state.protected = selfProcesses()
+
+	// Look up every process with one ps call rather than several per process
+	if m.cfg.BatchPs && procRoot == defaultProcRoot {
+		pids := make([]int, len(processes))
+		for i, process := range processes {
+			pids[i] = process.PID
+		}
+		if state.ps, err = psBatch(pids); err != nil {
+			m.logger.Printf("Failed to look up GPU processes with ps, falling back to one lookup per process: %v\n", err)
+		}
+	}
+
+	// List the Docker containers once for the whole scan
+	if m.docker != nil {
+		state.containers, err = newContainerIndex(m.docker, m.logger)
+		blackBox.recordContainers(state.containers)
+		if err != nil {
+			m.logger.Println("Failed to get Docker container list.")
+			state.failed = true
+		} else if len(state.containers.failed) == 0 && !m.previewing {
+			m.containersListed = m.clock.Now()
+		}
+	}
+
+	// MIG instances are only listed when a process is on one, to find its share
+	// of the GPU
+	for _, process := range processes {
+		if strings.HasPrefix(process.GPUUUID, "MIG-") {
+			if state.migDevices, err = queryMIGDevices(); err != nil {
+				m.logger.Printf("Failed to list MIG instances, taking their processes to have whole GPUs: %v\n", err)
+			}
+			break
+		}
+	}
+
+	// Likewise the node's GPU pods
+	if m.kube != nil {
+		if state.pods, err = m.kube.listGPUPods(m.cfg.K8sNode); err != nil {
+			m.logger.Printf("Failed to list the Kubernetes pods on node %s: %v\n", m.cfg.K8sNode, err)
+			state.failed = true
+		}
+	}
+	return state
+}
+
+// evaluate decides whether a GPU process has been idle for longer than the
+// threshold, returning it as a candidate for action if so.
+func (m *monitor) evaluate(process gpuProcess, state *scanState) (candidate, bool) {
+	pid := process.PID
+	usedMemory := process.UsedMemory
+
+	if reason, ok := state.protected[pid]; ok {
+		state.log(pid).Printf("Skipping PID %d: %s.\n", pid, reason)
+		state.note(pid, "It %s, so it's never acted on.", reason)
+		return candidate{}, false
+	}
+
+	// Under cgroup granularity every GPU process in a cgroup counts towards
+	// whether it's entirely idle, including those skipped below
+	var group string
+	if m.cfg.ReapGranularity == "cgroup" {
+		if g, err := processCgroup(pid); err == nil {
+			group = g
+			state.gpuPIDsByCgroup[group] = append(state.gpuPIDsByCgroup[group], pid)
+		} else {
+			state.log(pid).Printf("Failed to read the cgroup of PID %d, it can only be acted on by itself: %v\n", pid, err)
+		}
+	}
+
+	if ref, ok := state.disabledGPU(process); ok {
+		state.log(pid).Printf("Skipping PID %d: GPU %s is disabled by a marker in -gpuDisableMarkerDir.\n", pid, ref)
+		state.note(pid, "On GPU %s, which is disabled by a marker in %s.", ref, m.cfg.GPUDisableMarkerDir)
+		return candidate{}, false
+	}
+
+	if len(m.cfg.WhitelistGPUs) > 0 {
+		gpu, ok := state.gpusByUUID[process.GPUUUID]
+		if !ok {
+			state.log(pid).Printf("Skipping PID %d: unable to resolve GPU %s against -whitelistGPUs.\n", pid, process.GPUUUID)
+			state.note(pid, "Unable to resolve GPU %s against -whitelistGPUs, so it's skipped.", process.GPUUUID)
+			return candidate{}, false
+		}
+		if gpu.matchesAny(m.cfg.WhitelistGPUs) {
+			state.log(pid).Printf("Skipping PID %d: on whitelisted GPU %d (%s).\n", pid, gpu.Index, gpu.UUID)
+			state.note(pid, "On GPU %d (%s), which is whitelisted by -whitelistGPUs.", gpu.Index, gpu.UUID)
+			return candidate{}, false
+		}
+		state.note(pid, "On GPU %d (%s), which isn't in -whitelistGPUs.", gpu.Index, gpu.UUID)
+	}
+
+	// Get the process name
+	processName, err := state.processComm(pid)
+	if err != nil {
+		state.log(pid).Printf("Failed to get process name for PID %d.\n", pid)
+		state.note(pid, "Failed to get the process name: %v", err)
+		return candidate{}, false
+	}
+	processName = fullProcessName(pid, processName)
+	state.note(pid, "Process name: %s", processName)
+
+	// Entries in -targetWorkloads and -whitelist that are paths are matched
+	// against the executable rather than the name
+	var exe string
+	if hasPathEntry(m.cfg.TargetWorkloads) || hasPathEntry(m.cfg.Whitelist) {
+		if exe, err = processExe(pid); err != nil {
+			state.log(pid).Printf("Failed to resolve the executable of PID %d, path entries can't match it: %v\n", pid, err)
+			state.note(pid, "Failed to resolve the executable, so path entries in -targetWorkloads and -whitelist can't match it: %v", err)
+		} else {
+			state.note(pid, "Executable: %s", exe)
+		}
+	}
+
+	// MPS daemons hold the GPU on behalf of their clients and are never
+	// candidates themselves
+	if daemon := neverKilled(pid, processName); daemon != "" {
+		if daemon == mpsServerName {
+			state.log(pid).Printf("Skipping PID %d: MPS server (%d MB), never terminated as its clients share the GPU through it.\n", pid, usedMemory)
+		} else {
+			state.log(pid).Printf("Skipping PID %d: %s is never terminated.\n", pid, daemon)
+		}
+		state.note(pid, "%s is a GPU system daemon that's never terminated.", daemon)
+		return candidate{}, false
+	}
+
+	// As are processes shielded from the kernel's OOM killer, which have been
+	// marked as too important to lose
+	if m.cfg.RespectOomScore {
+		adj, err := oomScoreAdj(pid)
+		if err != nil {
+			state.log(pid).Printf("Skipping PID %d (%s): failed to read its oom_score_adj for -respectOomScore: %v\n", pid, processName, err)
+			state.note(pid, "Failed to read the oom_score_adj for -respectOomScore, so it's skipped: %v", err)
+			return candidate{}, false
+		}
+		if adj <= m.cfg.OomProtectedAdj {
+			state.log(pid).Printf("Skipping PID %d (%s): its oom_score_adj is %d, at or below -oomProtectedAdj of %d, so it's protected.\n", pid, processName, adj, m.cfg.OomProtectedAdj)
+			state.note(pid, "Its oom_score_adj is %d, at or below -oomProtectedAdj of %d, so it's protected like a process the OOM killer spares.", adj, m.cfg.OomProtectedAdj)
+			return candidate{}, false
+		}
+		state.log(pid).Printf("PID %d (%s) has oom_score_adj %d, above -oomProtectedAdj of %d.\n", pid, processName, adj, m.cfg.OomProtectedAdj)
+		state.note(pid, "Its oom_score_adj is %d, above -oomProtectedAdj of %d.", adj, m.cfg.OomProtectedAdj)
+	}
+
+	// Get the owner, and skip processes outside of -onlyUsers entirely
+	owner, err := state.processOwner(pid)
+	if len(m.cfg.OnlyUsers) > 0 {
+		if err != nil {
+			state.log(pid).Printf("Skipping PID %d: failed to determine its owner for -onlyUsers: %v\n", pid, err)
+			state.note(pid, "Failed to determine the owner for -onlyUsers: %v", err)
+			return candidate{}, false
+		}
+		if !contains(m.cfg.OnlyUsers, owner) {
+			state.log(pid).Printf("Skipping PID %d (%s): owned by %s, who isn't in -onlyUsers.\n", pid, processName, owner)
+			state.note(pid, "Owned by %s, who isn't in -onlyUsers.", owner)
+			return candidate{}, false
+		}
+		state.log(pid).Printf("PID %d (%s) is owned by %s, who is in -onlyUsers.\n", pid, processName, owner)
+		state.note(pid, "Owned by %s, who is in -onlyUsers.", owner)
+	} else if err == nil {
+		state.note(pid, "Owned by %s.", owner)
+	}
+
+	// Get the Docker container name
+	var owningContainer containerRef
+	if m.docker != nil {
+		if state.containers == nil {
+			state.note(pid, "Failed to list Docker containers, so it's skipped.")
+			return candidate{}, false
+		}
+		owningContainer = state.containers.lookup(pid)
+		if owningContainer.ID != "" {
+			if owningContainer.Compose != "" {
+				state.log(pid).Printf("nvidia-smi PID %d is in Docker container %s%s of Compose service %s\n", pid, owningContainer.Name, owningContainer.daemonNote(), owningContainer.Compose)
+				state.note(pid, "In Docker container %s%s of Compose service %s, running image %s.", owningContainer.Name, owningContainer.daemonNote(), owningContainer.Compose, owningContainer.Image)
+			} else {
+				state.log(pid).Printf("nvidia-smi PID %d is in Docker container %s%s\n", pid, owningContainer.Name, owningContainer.daemonNote())
+				state.note(pid, "In Docker container %s%s, running image %s.", owningContainer.Name, owningContainer.daemonNote(), owningContainer.Image)
+			}
+			state.gpuPIDsByContainer[owningContainer.ID] = append(state.gpuPIDsByContainer[owningContainer.ID], pid)
+		} else if id := state.containers.unlisted(pid); id != "" {
+			state.log(pid).Printf("Skipping PID %d (%s): its cgroup puts it in container %s, which wasn't listed, and the containers of Docker daemons %v couldn't be listed.\n", pid, processName, id[:12], state.containers.failed)
+			state.note(pid, "In container %s by its cgroup, which may be one of the Docker daemons %v whose containers couldn't be listed, so it's skipped.", id[:12], state.containers.failed)
+			return candidate{}, false
+		} else if m.cfg.ContainerOnly {
+			state.log(pid).Printf("Skipping PID %d (%s): not in a Docker container, and -containerOnly is set.\n", pid, processName)
+			state.note(pid, "Not in a Docker container, and -containerOnly is set.")
+			return candidate{}, false
+		} else {
+			state.note(pid, "Not in a Docker container.")
+		}
+	}
+	dockerContainer := owningContainer.Name
+	if !m.previewing {
+		m.whitelistUsage.record(m.cfg.Whitelist, processName, exe, dockerContainer, owningContainer.Compose)
+	}
+
+	// Processes in GPU pods are evicted through the Kubernetes API rather
+	// than signalled
+	var pod podRef
+	if m.kube != nil {
+		if state.pods == nil {
+			state.note(pid, "Failed to list Kubernetes pods, so it's skipped.")
+			return candidate{}, false
+		}
+		if uid, err := podUIDFromCgroup(pid); err == nil && uid != "" {
+			if pod = state.pods[uid]; pod.Name != "" {
+				state.log(pid).Printf("PID %d is in Kubernetes pod %s\n", pid, pod)
+				state.note(pid, "In Kubernetes pod %s, which would be evicted.", pod)
+			} else {
+				state.note(pid, "In a Kubernetes pod that doesn't request GPUs, so it would be signalled.")
+			}
+		} else {
+			state.note(pid, "Not in a Kubernetes pod, so it would be signalled.")
+		}
+	}
+
+	var job string
+	if m.cfg.Slurm {
+		if job = slurmJob(pid); job != "" {
+			state.log(pid).Printf("PID %d is in SLURM job %s\n", pid, job)
+			state.note(pid, "In SLURM job %s.", job)
+		} else {
+			state.note(pid, "Not in a SLURM job.")
+		}
+	}
+
+	// On a shared GPU, idle time is accounted for by the share the process has
+	share, shareSource := m.gpuShare(process, state)
+	if shareSource != "" {
+		state.log(pid).Printf("PID %d has %.0f%% of its GPU (%s)\n", pid, share*100, shareSource)
+		state.note(pid, "Has %.0f%% of its GPU (%s).", share*100, shareSource)
+	}
+
+	// Containers are exempted by image before anything else about them is
+	// considered, whether it's pinned by digest or matched by tag
+	rule, digest, err := state.containers.matchImageDigest(m.cfg.WhitelistImages, owningContainer)
+	if err != nil {
+		state.log(pid).Printf("Skipping PID %d (%s): failed to inspect image %s of container %s to check its digest against -whitelistImages: %v\n", pid, processName, owningContainer.Image, dockerContainer, err)
+		state.note(pid, "Image %s couldn't be inspected to check its digest against -whitelistImages, so it's skipped.", owningContainer.Image)
+		return candidate{}, false
+	}
+	if rule != "" {
+		state.log(pid).Printf("Skipping PID %d (%s): container %s runs image %s with digest %s, whitelisted by -whitelistImages rule %s.\n", pid, processName, dockerContainer, owningContainer.Image, digest, rule)
+		state.note(pid, "Image %s with digest %s is whitelisted by the -whitelistImages rule %q.", owningContainer.Image, digest, rule)
+		return candidate{}, false
+	}
+	if rule := matchImage(m.cfg.WhitelistImages, owningContainer.Image); rule != "" {
+		state.log(pid).Printf("Skipping PID %d (%s): container %s runs image %s, whitelisted by -whitelistImages rule %s.\n", pid, processName, dockerContainer, owningContainer.Image, rule)
+		state.note(pid, "Image %s is whitelisted by the -whitelistImages rule %q.", owningContainer.Image, rule)
+		return candidate{}, false
+	}
+
+	// As are infrastructure containers, such as monitoring agents and driver
+	// containers, which tend to be privileged or host networked
+	if m.cfg.SkipPrivilegedContainers && owningContainer.ID != "" {
+		reason, err := state.containers.infrastructure(owningContainer)
+		if err != nil {
+			state.log(pid).Printf("Skipping PID %d (%s): failed to inspect container %s to check whether it's privileged: %v\n", pid, processName, dockerContainer, err)
+			state.note(pid, "Container %s couldn't be inspected to check whether it's privileged, so it's skipped.", dockerContainer)
+			return candidate{}, false
+		}
+		if reason != "" {
+			state.log(pid).Printf("Skipping PID %d (%s): container %s is %s, skipped by -skipPrivilegedContainers.\n", pid, processName, dockerContainer, reason)
+			state.note(pid, "Container %s is %s, so it's skipped by -skipPrivilegedContainers.", dockerContainer, reason)
+			return candidate{}, false
+		}
+	}
+
+	// Check if the process name is in the target workloads list, or its
+	// container's image or Compose service is targeted
+	compose := owningContainer.Compose
+	targetRule, targetDigest, err := state.containers.matchImageDigest(m.cfg.TargetImages, owningContainer)
+	if err != nil {
+		state.log(pid).Printf("Failed to inspect image %s of container %s to check its digest against -targetImages: %v\n", owningContainer.Image, dockerContainer, err)
+	}
+	if targetRule != "" {
+		state.log(pid).Printf("PID %d (%s): container %s runs image %s with digest %s, targeted by -targetImages rule %s.\n", pid, processName, dockerContainer, owningContainer.Image, targetDigest, targetRule)
+		state.note(pid, "Image %s with digest %s is targeted by the -targetImages rule %q.", owningContainer.Image, targetDigest, targetRule)
+	} else if rule := matchImage(m.cfg.TargetImages, owningContainer.Image); rule != "" {
+		state.log(pid).Printf("PID %d (%s): container %s runs image %s, targeted by -targetImages rule %s.\n", pid, processName, dockerContainer, owningContainer.Image, rule)
+		state.note(pid, "Image %s is targeted by the -targetImages rule %q.", owningContainer.Image, rule)
+	} else if compose != "" && contains(m.cfg.TargetWorkloads, compose) {
+		state.log(pid).Printf("PID %d (%s): container %s is of Compose service %s, targeted by -targetWorkloads.\n", pid, processName, dockerContainer, compose)
+		state.note(pid, "Compose service %s is in -targetWorkloads.", compose)
+	} else if rule, identity := matchProcess(m.cfg.TargetWorkloads, processName, exe); rule == "" {
+		state.note(pid, "%s isn't in -targetWorkloads %v.", processName, m.cfg.TargetWorkloads)
+		return candidate{}, false
+	} else {
+		state.log(pid).Printf("PID %d (%s) is targeted by -targetWorkloads entry %s, matched by its %s.\n", pid, processName, rule, identity)
+		state.note(pid, "Targeted by the -targetWorkloads entry %q, matched by its %s.", rule, identity)
+	}
+
+	// Skip whitelisted processes and containers
+	whitelisted, identity := matchProcess(m.cfg.Whitelist, processName, exe)
+	if whitelisted != "" || contains(m.cfg.Whitelist, dockerContainer) || (compose != "" && contains(m.cfg.Whitelist, compose)) {
+		switch {
+		case whitelisted != "":
+			state.log(pid).Printf("Skipping PID %d (%s): whitelisted by -whitelist entry %s, matched by its %s.\n", pid, processName, whitelisted, identity)
+			state.note(pid, "Whitelisted by the -whitelist entry %q, matched by its %s.", whitelisted, identity)
+		case contains(m.cfg.Whitelist, dockerContainer):
+			state.note(pid, "Whitelisted by the -whitelist entry %q for its container.", dockerContainer)
+		default:
+			state.note(pid, "Whitelisted by the -whitelist entry %q for its Compose service.", compose)
+		}
+		return candidate{}, false
+	}
+	state.note(pid, "Not whitelisted by -whitelist.")
+
+	// On a GPU being drained every target process is acted on, whether it's
+	// idle or not, so none of the idle checks apply
+	if m.drainingGPU(process, state) {
+		state.log(pid).Printf("PID %d (%s) is on GPU %s, which is being drained by -drain.\n", pid, processName, process.GPUUUID)
+		state.note(pid, "On GPU %s, which is being drained by -drain, so it's warned and then terminated after -drainTimeout whether it's idle or not.", process.GPUUUID)
+		startTime, _ := state.processStartTime(pid)
+		return candidate{
+			gpuProcess:  process,
+			Name:        processName,
+			Container:   dockerContainer,
+			ContainerID: owningContainer.ID,
+			Owner:       owner,
+			Job:         job,
+			Pod:         pod,
+			Share:       share,
+			StartTime:   startTime,
+			Drain:       true,
+		}, true
+	}
+
+	// Runtime limits apply whether or not the process is idle
+	if m.cfg.MaxRuntime > 0 {
+		if startTime, err := state.processStartTime(pid); err == nil {
+			runtime := m.clock.Now().Sub(startTime).Truncate(time.Second)
+			limit := time.Duration(m.cfg.MaxRuntime) * time.Second
+			if runtime > limit {
+				state.note(pid, "Running for %v, over -maxRuntime of %v.", runtime, limit)
+				state.overRuntime = append(state.overRuntime, candidate{
+					gpuProcess:  process,
+					Name:        processName,
+					Container:   dockerContainer,
+					ContainerID: owningContainer.ID,
+					Owner:       owner,
+					Job:         job,
+					Share:       share,
+					Pod:         pod,
+					StartTime:   startTime,
+				})
+			} else {
+				state.note(pid, "Running for %v, within -maxRuntime of %v.", runtime, limit)
+			}
+		}
+	}
+
+	// Ask the idle classifiers whether the process is idle, which by default is
+	// when its used memory is zero unless -idleExpr or -idlePolicy decides
+	// instead
+	state.note(pid, "Readings: used_memory=%d MB%s", usedMemory, formatValues(process.Values, m.cfg.valueFields(m.extraFields)))
+	if !m.classifyIdle(process, state) {
+		// Memory held unchanged without any utilization is waste whatever the
+		// idle classifiers say, and is acted on after its own threshold
+		stable, leaked := m.leakedContext(process)
+		if !leaked {
+			state.note(pid, "Not judged idle.")
+			return candidate{}, false
+		}
+		state.log(pid).Printf("PID %d (%s) looks like a leaked CUDA context: it has held %d MB unchanged with no SM utilization for %v.\n", pid, processName, usedMemory, stable)
+		state.note(pid, "Not judged idle, but it has held %d MB unchanged with no SM utilization for %v, beyond -leakedContextThreshold of %v, so it looks like a leaked CUDA context.", usedMemory, stable, time.Duration(m.cfg.LeakedContextThreshold)*time.Second)
+		if m.tooSmallToReclaim(process, processName, state) {
+			return candidate{}, false
+		}
+		if m.cfg.RespectMemTransfers && m.memTransfer(process, processName, state) {
+			return candidate{}, false
+		}
+		if m.cfg.RespectActiveTty && m.ttyActive(pid, processName, state) {
+			return candidate{}, false
+		}
+		startTime, _ := state.processStartTime(pid)
+		return candidate{
+			gpuProcess:    process,
+			Name:          processName,
+			Container:     dockerContainer,
+			ContainerID:   owningContainer.ID,
+			Owner:         owner,
+			Job:           job,
+			Pod:           pod,
+			Share:         share,
+			StartTime:     startTime,
+			IdleTime:      stable,
+			Cgroup:        group,
+			LeakedContext: true,
+		}, true
+	}
+
+	// A process copying data to or from the GPU is busy even with no SM
+	// utilization
+	if m.cfg.RespectMemTransfers && m.memTransfer(process, processName, state) {
+		return candidate{}, false
+	}
+
+	// A process that once used a lot of memory is more likely to be doing real
+	// work than one that never did
+	peak := m.peaks.peak(process)
+	state.log(pid).Printf("PID %d (%s) is idle, its peak GPU memory use was %d MB.\n", pid, processName, peak)
+	if m.cfg.MaxPeakMB > 0 {
+		if peak >= m.cfg.MaxPeakMB {
+			state.note(pid, "Its peak memory use was %d MB, not below -maxPeakMB of %d MB.", peak, m.cfg.MaxPeakMB)
+			return candidate{}, false
+		}
+		state.note(pid, "Its peak memory use was %d MB, below -maxPeakMB of %d MB.", peak, m.cfg.MaxPeakMB)
+	} else {
+		state.note(pid, "Its peak memory use was %d MB.", peak)
+	}
+	if m.tooSmallToReclaim(process, processName, state) {
+		return candidate{}, false
+	}
+
+	// Get the process start time
+	startTime, err := state.processStartTime(pid)
+	if err != nil {
+		state.log(pid).Printf("Failed to get start time for PID %d.\n", pid)
+		state.note(pid, "Failed to get the start time: %v", err)
+		return candidate{}, false
+	}
+
+	// Calculate the idle time, and if it's greater than the threshold, take
+	// action. A process that started before its GPU was reset is only counted
+	// from the reset
+	idleSince, since := startTime, "it started at "+startTime.Format(time.RFC3339)
+	if reset, ok := m.gpuResets[process.GPUUUID]; ok && reset.After(startTime) {
+		idleSince, since = reset, "its GPU was reset at "+reset.Format(time.RFC3339)
+	}
+	idleTime := m.clock.Now().Sub(idleSince).Truncate(time.Second)
+	if idleTime <= m.threshold() {
+		state.note(pid, "Idle for %v since %s, within the threshold of %v.", idleTime, since, m.threshold())
+		return candidate{}, false
+	}
+	state.note(pid, "Idle for %v since %s, beyond the threshold of %v.", idleTime, since, m.threshold())
+
+	// Spare processes with someone still at the terminal they were started from
+	if m.cfg.RespectActiveTty && m.ttyActive(pid, processName, state) {
+		return candidate{}, false
+	}
+
+	return candidate{
+		gpuProcess:  process,
+		Name:        processName,
+		Container:   dockerContainer,
+		ContainerID: owningContainer.ID,
+		Owner:       owner,
+		Job:         job,
+		Pod:         pod,
+		Share:       share,
+		StartTime:   startTime,
+		IdleTime:    idleTime,
+		Cgroup:      group,
+	}, true
+}
+
+// ttyActive reports whether a process's controlling terminal has had input
+// within the idle threshold, logging the evidence either way.
+func (m *monitor) ttyActive(pid int, processName string, state *scanState) bool {
+	tty, err := processTTY(pid)
+	if err != nil {
+		state.log(pid).Printf("Failed to determine the controlling terminal of PID %d: %v\n", pid, err)
+		state.note(pid, "Failed to determine the controlling terminal for -respectActiveTty: %v", err)
+		return false
+	}
+	if tty == "" {
+		state.note(pid, "Has no controlling terminal for -respectActiveTty.")
+		return false
+	}
+	lastInput, err := ttyLastInput(tty)
+	if err != nil {
+		state.log(pid).Printf("Failed to check activity on %s for PID %d: %v\n", tty, pid, err)
+		state.note(pid, "Failed to check activity on its terminal %s: %v", tty, err)
+		return false
+	}
+
+	inactive := m.clock.Now().Sub(lastInput).Truncate(time.Second)
+	if inactive <= m.threshold() {
+		state.log(pid).Printf("Skipping PID %d (%s): its terminal %s had input %v ago, within the idle threshold.\n", pid, processName, tty, inactive)
+		state.note(pid, "Its terminal %s had input %v ago, within the idle threshold, so it's spared by -respectActiveTty.", tty, inactive)
+		return true
+	}
+	state.log(pid).Printf("PID %d (%s) has terminal %s, but it has had no input for %v.\n", pid, processName, tty, inactive)
+	state.note(pid, "Its terminal %s has had no input for %v.", tty, inactive)
+	return false
+}
+
+// act warns about or terminates the idle candidates found by a scan.
+func (m *monitor) act(candidates []candidate, state *scanState) {
+	// Work out which candidates to terminate, limited to just enough to meet
+	// any reclaim targets
+	terminate := make(map[int]bool)
+	var unblocks map[int]queuedJob
+	if !state.warningOnly && len(candidates) > 0 {
+		terminate = planReclaim(candidates, m.reclaimTargets, m.cfg.ReclaimOrder, state.gpus, m.logger)
+		if len(m.queuedJobs) > 0 {
+			terminate, unblocks = planPreemption(candidates, terminate, m.queuedJobs, state.gpus, m.logger)
+		}
+	}
+	terminate = m.confirmations.confirm(terminate, m.logger)
+	state.terminating = terminate
+	m.withdrawWallNotices(terminate)
+
+	// Under the "all" policy, containers are stopped as a whole only once all of
+	// their GPU processes are idle, rather than having individual processes
+	// killed
+	var stopContainers map[string][]candidate
+	if m.cfg.ContainerIdlePolicy == "all" && !state.warningOnly {
+		stopContainers = planContainerStops(candidates, terminate, state.gpuPIDsByContainer, m.logger)
+	}
+
+	for id, members := range stopContainers {
+		c := members[0]
+		err := state.containers.client(id).ContainerStop(context.Background(), id, container.StopOptions{})
+		var outcome string
+		for _, member := range members {
+			outcome = m.recordKill(state, member, err)
+		}
+		if err != nil {
+			m.emitKill(c.outcomeEvent(actionError, outcome, fmt.Sprintf("Failed to stop Docker container %s: %v", c.Container, err)))
+			continue
+		}
+		m.emitKill(c.outcomeEvent(actionTerminate, outcome, fmt.Sprintf("Stopped: Docker container %s, all %d of its GPU processes have been idle for more than %d seconds.", c.Container, len(members), m.thresholdSeconds())))
+		for _, member := range members {
+			m.stats.recordTermination(member.Owner, member.Container, member.IdleTime, member.Share)
+		}
+	}
+
+	// Under cgroup granularity, a cgroup's processes are all sent SIGTERM
+	// together once all of its GPU processes are idle, rather than one by one
+	var reapCgroups map[string][]candidate
+	if m.cfg.ReapGranularity == "cgroup" && !state.warningOnly {
+		reapCgroups = planCgroupReaps(candidates, terminate, state.gpuPIDsByCgroup, m.logger)
+	}
+
+	for group, members := range reapCgroups {
+		c := members[0]
+		err := m.reapCgroup(group, members, state)
+		var outcome string
+		for _, member := range members {
+			outcome = m.recordKill(state, member, err)
+		}
+		if err != nil {
+			m.emitKill(c.outcomeEvent(actionError, outcome, err.Error()))
+			continue
+		}
+		m.emitKill(c.outcomeEvent(actionTerminate, outcome, fmt.Sprintf("Terminated: cgroup %s, all %d of its GPU processes have been idle for more than %d seconds.", group, len(members), m.thresholdSeconds())))
+		for _, member := range members {
+			m.stats.recordTermination(member.Owner, member.Container, member.IdleTime, member.Share)
+		}
+	}
+
+	inDState := make(map[int]bool)
+	defer func() {
+		for pid := range m.dState {
+			if !inDState[pid] {
+				delete(m.dState, pid)
+			}
+		}
+	}()
+
+	for _, c := range candidates {
+		if _, ok := stopContainers[c.ContainerID]; ok {
+			continue
+		}
+		if _, ok := reapCgroups[c.Cgroup]; ok && c.Cgroup != "" {
+			continue
+		}
+		if !terminate[c.PID] {
+			warned, due := m.repeats.due(c.PID, time.Duration(m.cfg.WarnRepeatInterval)*time.Second)
+			if !due {
+				continue
+			}
+			message := fmt.Sprintf("WARNING: Process %d (%s) in Docker container %s %s.%s%s", c.PID, c.Name, c.Container, m.idleDescription(c), c.jobNote(), m.memoryShare(c))
+			if warned.count > 1 && m.cfg.WarnRepeatInterval > 0 {
+				message = fmt.Sprintf("WARNING (repeat %d): Process %d (%s) in Docker container %s is still idle, %v after it was first warned about.%s%s", warned.count-1, c.PID, c.Name, c.Container, m.clock.Now().Sub(warned.first).Truncate(time.Second), c.jobNote(), m.memoryShare(c))
+			}
+			m.events.emit(c.event(actionWarn, message))
+			m.stats.recordWarning(c.Owner, c.Container)
+			if c.LeakedContext {
+				m.stats.recordLeakedContext()
+			}
+			if c.Pod.Name != "" {
+				m.annotateIdle(c)
+			}
+			continue
+		}
+
+		// With -quarantineAction, it's quarantined rather than terminated
+		if m.cfg.QuarantineAction != "" {
+			m.quarantine(c)
+			continue
+		}
+
+		// A process in uninterruptible sleep won't act on SIGTERM until whatever
+		// it's blocked on returns, so signalling it again every scan is pointless
+		if m.stuckInDState(c) {
+			inDState[c.PID] = true
+			continue
+		}
+
+		// With -wallNotify, its owner is given notice on their terminals first
+		if !m.wallNotice(c) {
+			continue
+		}
+
+		// Details have to be captured before the process is gone
+		var details procDetails
+		if m.cfg.CaptureProcDetails {
+			details = captureProcDetails(c.PID)
+		}
+		snapshot := m.snapshot(c.PID)
+
+		note, err := m.signal(c)
+		if err == errNotDue {
+			continue
+		}
+		outcome := m.recordKill(state, c, err)
+		if err != nil {
+			m.emitKill(c.outcomeEvent(actionError, outcome, err.Error()))
+			continue
+		}
+		if job, ok := unblocks[c.PID]; ok {
+			note += fmt.Sprintf(" Reclaimed to unblock queued job %s (priority %d).", job.ID, job.Priority)
+		}
+		terminated := c.outcomeEvent(actionTerminate, outcome, fmt.Sprintf("Terminated: Process %d (%s) in Docker container %s %s.%s%s%s", c.PID, c.Name, c.Container, m.idleDescription(c), c.jobNote(), m.memoryShare(c), note))
+		if m.cfg.CaptureProcDetails {
+			terminated.Message += " Details: " + details.String()
+			terminated.Details = details.fields()
+		}
+		if snapshot != "" {
+			terminated.Message += " Snapshot: " + snapshot
+			if terminated.Details == nil {
+				terminated.Details = make(map[string]string)
+			}
+			terminated.Details["snapshot"] = snapshot
+		}
+		m.emitKill(terminated)
+		m.stats.recordTermination(c.Owner, c.Container, c.IdleTime, c.Share)
+		if c.LeakedContext {
+			m.stats.recordLeakedContext()
+		}
+	}
+}
+
+// dStateProcess tracks a process seen in uninterruptible sleep.
+type dStateProcess struct {
+	since   time.Time
+	alerted bool
+}
+
+// stuckInDState reports whether a process to be terminated is in
+// uninterruptible sleep. It warns when the process is first seen in that state
+// and raises a critical alert once it has been stuck for -dStateAlertAfter.
+func (m *monitor) stuckInDState(c candidate) bool {
+	if state, err := processState(c.PID); err != nil || state != "D" {
+		return false
+	}
+
+	stuck, ok := m.dState[c.PID]
+	if !ok {
+		stuck = &dStateProcess{since: m.clock.Now()}
+		m.dState[c.PID] = stuck
+		m.events.emit(c.event(actionWarn, fmt.Sprintf("WARNING: Process %d (%s) is in uninterruptible sleep (D state), possibly blocked on storage or a hung driver call. Not signalling it until it wakes.", c.PID, c.Name)))
+	}
+
+	alertAfter := time.Duration(m.cfg.DStateAlertAfter) * time.Second
+	if alertAfter > 0 && !stuck.alerted && m.clock.Now().Sub(stuck.since) >= alertAfter {
+		stuck.alerted = true
+		m.events.emit(c.event(actionCritical, fmt.Sprintf("CRITICAL: Process %d (%s) has been in uninterruptible sleep (D state) for more than %d seconds, check for a storage or GPU driver problem.", c.PID, c.Name, m.cfg.DStateAlertAfter)))
+	}
+	return true
+}
+
+// signal terminates a candidate, evicting its pod if it's in a GPU pod with
+// -k8sEvict, running -killCommand instead if set, or cancelling its whole SLURM
+// job with -slurmCancel. With -signalLadder the process is taken up the ladder
+// instead of sent SIGTERM, returning errNotDue when its next rung isn't due.
+// Any note about what was done is returned for the termination message.
+func (m *monitor) signal(c candidate) (string, error) {
+	if c.Pod.Name != "" {
+		return m.evictPod(c)
+	}
+	if m.killCommand != nil {
+		return "", m.killCommand.run(c, m.logger)
+	}
+	if m.cfg.SlurmCancel && c.Job != "" {
+		if err := exec.Command("scancel", c.Job).Run(); err != nil {
+			return "", fmt.Errorf("Failed to cancel SLURM job %s of PID %d: %v", c.Job, c.PID, err)
+		}
+		return "", nil
+	}
+	if len(m.ladder) > 0 {
+		return m.climbLadder(c)
+	}
+
+	// Send a SIGTERM for graceful termination
+	return "", m.kill(c, "TERM")
+}
+
+// nullSignal sends the null signal to a process, which checks that it exists
+// and that nvidler may signal it without delivering anything. Tests replace it
+// to simulate processes nvidler isn't permitted to signal.
+var nullSignal = func(pid int) error {
+	return syscall.Kill(pid, 0)
+}
+
+// kill sends a signal to a candidate. When it fails because nvidler isn't
+// permitted to signal the process, which kill doesn't distinguish by its exit
+// status, the null signal is sent to find out, so the error can say what to
+// fix, and the failure is counted for GET /status. Failures are returned as a
+// killError with their outcome for the termination report.
+func (m *monitor) kill(c candidate, signal string) error {
+	if err := exec.Command("kill", "-s", signal, strconv.Itoa(c.PID)).Run(); err == nil {
+		return nil
+	}
+	switch err := nullSignal(c.PID); {
+	case errors.Is(err, syscall.EPERM):
+		m.permissionErrors++
+		return &killError{outcomeNotPermitted, fmt.Sprintf("Not permitted to send SIG%s to PID %d owned by %s: run nvidler as root or with CAP_KILL, or as the user running the process.", signal, c.PID, c.Owner)}
+	case errors.Is(err, syscall.ESRCH):
+		return &killError{outcomeAlreadyGone, fmt.Sprintf("PID %d had already exited before SIG%s could be sent.", c.PID, signal)}
+	}
+	return &killError{outcomeFailed, fmt.Sprintf("Failed to send SIG%s to PID %d.", signal, c.PID)}
+}
+
+// memoryShare describes how much of its GPU's memory a candidate held when
+// -logMemoryPercent is set.
+func (m *monitor) memoryShare(c candidate) string {
+	if !m.cfg.LogMemoryPercent {
+		return ""
+	}
+	total := m.memoryTotal(c.GPUUUID)
+	if total == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" It held %d MB, %.1f%% of its GPU's %d MB.", c.UsedMemory, float64(c.UsedMemory)*100/float64(total), total)
+}
+
+// memoryTotal returns a GPU's total memory in MB, or 0 if it can't be found.
+// Total memory doesn't change, so it's only queried again for GPUs that haven't
+// been seen before.
+func (m *monitor) memoryTotal(uuid string) int {
+	if _, ok := m.memoryTotals[uuid]; !ok {
+		totals, err := queryMemoryTotal()
+		if err != nil {
+			m.logger.Printf("Failed to query GPU memory totals: %v\n", err)
+			return 0
+		}
+		m.memoryTotals = totals
+	}
+	return m.memoryTotals[uuid]
+}
+
+// snapshot saves the state of a process about to be terminated when
+// -snapshotBeforeKill is set, returning the snapshot's path.
+func (m *monitor) snapshot(pid int) string {
+	if !m.cfg.SnapshotBeforeKill {
+		return ""
+	}
+
+	path, err := takeSnapshot(m.cfg.SnapshotDir, pid, m.clock.Now())
+	if err != nil {
+		m.logger.Printf("Failed to snapshot PID %d: %v\n", pid, err)
+	}
+	if err := pruneSnapshots(m.cfg.SnapshotDir, int64(m.cfg.SnapshotMaxMB)<<20); err != nil {
+		m.logger.Printf("Failed to prune snapshots in %s: %v\n", m.cfg.SnapshotDir, err)
+	}
+	return path
+}
+
+// candidate is a GPU process that has been idle for longer than the threshold
+type candidate struct {
+	gpuProcess
+	Name        string
+	Container   string
+	ContainerID string
+	Cgroup      string // with -reapGranularity cgroup
+	Owner       string
+	Job         string  // SLURM job ID, with -slurm
+	Pod         podRef  // Kubernetes pod, with -k8sEvict
+	Share       float64 // fraction of its GPU it has, 1 unless the GPU is shared
+	StartTime   time.Time
+	IdleTime    time.Duration
+	// LeakedContext is set when it holds memory unchanged without utilization,
+	// with -leakedContextThreshold, rather than being judged idle
+	LeakedContext bool
+	// Drain is set when it's on a GPU being drained by -drain, rather than
+	// being judged idle
+	Drain bool
+	// OverRuntime is set when it's been running for longer than -maxRuntime,
+	// rather than being judged idle
+	OverRuntime bool
+}
+
+// event describes an action taken on the candidate
+func (c candidate) event(action, message string) event {
+	return event{
+		Action:      action,
+		Message:     message,
+		PID:         c.PID,
+		Process:     c.Name,
+		Container:   c.Container,
+		User:        c.Owner,
+		GPU:         c.GPUUUID,
+		Job:         c.Job,
+		Pod:         c.podName(),
+		GPUShare:    c.shareOf(),
+		Memory:      c.UsedMemory,
+		IdleSeconds: int64(c.IdleTime / time.Second),
+		Category:    c.category(),
+	}
+}
+
+// outcomeEvent describes an attempt to terminate the candidate, with its outcome
+// as in termination reports
+func (c candidate) outcomeEvent(action, outcome, message string) event {
+	e := c.event(action, message)
+	e.Outcome = outcome
+	return e
+}
+
+// category is the kind of waste a candidate is, for events: empty for a plain
+// idle process.
+func (c candidate) category() string {
+	if c.LeakedContext {
+		return categoryLeakedContext
+	}
+	if c.Drain {
+		return categoryDrain
+	}
+	if c.OverRuntime {
+		return categoryRuntime
+	}
+	return ""
+}
+
+// jobNote names the SLURM job of a candidate, if it has one, for messages.
+func (c candidate) jobNote() string {
+	if c.Job == "" {
+		return ""
+	}
+	return fmt.Sprintf(" SLURM job %s.", c.Job)
+}
+
+// shareOf returns the fraction of a shared GPU a candidate has, or 0 if it has
+// the whole GPU.
+func (c candidate) shareOf() float64 {
+	if c.Share >= 1 {
+		return 0
+	}
+	return c.Share
+}
+
+// podName names the Kubernetes pod of a candidate, if it has one.
+func (c candidate) podName() string {
+	if c.Pod.Name == "" {
+		return ""
+	}
+	return c.Pod.String()
+}
+
+// Helper function to check whether any of the GPU processes are visible
+func anyProcessExists(processes []gpuProcess) bool {
+	for _, p := range processes {
+		if processExists(p.PID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testEpoch is when the fake clock starts, and when fake processes start
+// unless they say otherwise.
+var testEpoch = time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+
+// testSelfPID is nvidler's own PID in the fake /proc.
+const testSelfPID = 100
+
+// testGPU is the UUID of the fake node's only GPU.
+const testGPU = "GPU-00000000-0000-0000-0000-000000000000"
+
+var parseDefaults sync.Once
+
+// testConfig returns the default configuration, as if nvidler had been run
+// without any flags, environment variables or config file.
+func testConfig(t testing.TB) Config {
+	t.Helper()
+	parseDefaults.Do(func() {
+		if _, err := parseFlags(); err != nil {
+			t.Fatalf("parseFlags: %v", err)
+		}
+	})
+	return bound.config()
+}
+
+// fakeProcess is a process in a testEnv's fake /proc.
+type fakeProcess struct {
+	PID, PPID int
+	Comm      string    // truncated to the kernel's 15 characters
+	Argv      []string  // defaults to Comm
+	State     string    // defaults to S
+	Start     time.Time // defaults to testEpoch
+	UID       int
+	Exe       string // what /proc/<pid>/exe links to, if anything
+	Cgroup    string // the contents of /proc/<pid>/cgroup, if any
+}
+
+// testEnv is a fake node for a monitor to scan: a /proc under procRoot, and an
+// nvidia-smi and kill on PATH, which answer from and record to files under
+// dir rather than touching real GPUs or processes.
+type testEnv struct {
+	t     testing.TB
+	dir   string
+	proc  string
+	clock *fakeClock
+	log   syncBuffer
+
+	mu     sync.Mutex
+	events []event
+}
+
+func newTestEnv(t testing.TB) *testEnv {
+	t.Helper()
+	e := &testEnv{t: t, dir: t.TempDir(), clock: newFakeClock(testEpoch)}
+	e.proc = filepath.Join(e.dir, "proc")
+	bin := filepath.Join(e.dir, "bin")
+	for _, dir := range []string{e.proc, bin, filepath.Join(e.dir, "smi")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nvidia-smi answers each query with the file named after its first
+	// argument, and kill records what it was asked to send
+	e.writeScript(filepath.Join(bin, "nvidia-smi"), fmt.Sprintf(`f=%q/smi/$(printf '%%s' "$1" | tr -c 'A-Za-z0-9._-' _)
+[ -f "$f" ] && cat "$f"
+exit 0`, e.dir))
+	e.writeScript(filepath.Join(bin, "kill"), fmt.Sprintf(`echo "$*" >> %q/signals
+[ ! -f %q/kill-fails ]`, e.dir, e.dir))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	saved := procRoot
+	procRoot = e.proc
+	t.Cleanup(func() { procRoot = saved })
+
+	e.write(filepath.Join(e.proc, "stat"), fmt.Sprintf("cpu  0 0 0 0\nbtime %d\n", testEpoch.Add(-24*time.Hour).Unix()))
+	if err := os.Symlink(strconv.Itoa(testSelfPID), filepath.Join(e.proc, "self")); err != nil {
+		t.Fatal(err)
+	}
+	e.addProcess(fakeProcess{PID: testSelfPID, PPID: 1, Comm: "nvidler", Start: testEpoch.Add(-time.Hour)})
+	e.smi("--query-gpu=index,uuid,memory.free", "0, "+testGPU+", 1024\n")
+	e.smi("--query-gpu=uuid,memory.total", testGPU+", 40960\n")
+	return e
+}
+
+func (e *testEnv) write(path, content string) {
+	e.t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func (e *testEnv) writeScript(path, body string) {
+	e.t.Helper()
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// smi sets what the fake nvidia-smi answers when its first argument is arg.
+func (e *testEnv) smi(arg, out string) {
+	e.t.Helper()
+	name := strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r) {
+			return r
+		}
+		return '_'
+	}, arg)
+	e.write(filepath.Join(e.dir, "smi", name), out)
+}
+
+// gpuProcesses sets the compute processes nvidia-smi lists, as
+// "<pid>, <used memory>" lines on the test GPU.
+func (e *testEnv) gpuProcesses(processes ...string) {
+	e.t.Helper()
+	var out strings.Builder
+	for _, p := range processes {
+		fmt.Fprintf(&out, "%s, %s\n", p, testGPU)
+	}
+	e.smi("--query-compute-apps="+joinFields(computeAppsFields), out.String())
+}
+
+// addProcess adds a process to the fake /proc.
+func (e *testEnv) addProcess(p fakeProcess) {
+	e.t.Helper()
+	if p.State == "" {
+		p.State = "S"
+	}
+	if p.Start.IsZero() {
+		p.Start = testEpoch
+	}
+	if p.Argv == nil {
+		p.Argv = []string{p.Comm}
+	}
+	comm := p.Comm
+	if len(comm) > commLen {
+		comm = comm[:commLen]
+	}
+
+	dir := filepath.Join(e.proc, strconv.Itoa(p.PID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		e.t.Fatal(err)
+	}
+	ticks := int64(p.Start.Sub(testEpoch.Add(-24*time.Hour)) / (time.Second / clockTicks))
+	e.write(filepath.Join(dir, "stat"), fmt.Sprintf("%d (%s) %s %d 0 0 0 -1 0 0 0 0 0 0 0 0 0 20 0 1 0 %d 0 0\n", p.PID, comm, p.State, p.PPID, ticks))
+	e.write(filepath.Join(dir, "comm"), comm+"\n")
+	e.write(filepath.Join(dir, "cmdline"), strings.Join(p.Argv, "\x00")+"\x00")
+	e.write(filepath.Join(dir, "status"), fmt.Sprintf("Name:\t%s\nState:\t%s\nUid:\t%d\t%d\t%d\t%d\n", comm, p.State, p.UID, p.UID, p.UID, p.UID))
+	if p.Cgroup != "" {
+		e.write(filepath.Join(dir, "cgroup"), p.Cgroup)
+	}
+	if p.Exe != "" {
+		if err := os.Symlink(p.Exe, filepath.Join(dir, "exe")); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+}
+
+// removeProcess takes a process out of the fake /proc, as if it had exited.
+func (e *testEnv) removeProcess(pid int) {
+	e.t.Helper()
+	if err := os.RemoveAll(filepath.Join(e.proc, strconv.Itoa(pid))); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// signals returns what the fake kill was asked to send, such as "-s TERM 1001",
+// in order.
+func (e *testEnv) signals() []string {
+	e.t.Helper()
+	return e.readLines("signals")
+}
+
+// readLines returns the lines of a file under dir, or nil if it doesn't exist.
+func (e *testEnv) readLines(name string) []string {
+	e.t.Helper()
+	data, err := os.ReadFile(filepath.Join(e.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// config returns the default configuration for the fake node, with Docker
+// tracking off.
+func (e *testEnv) config() Config {
+	cfg := testConfig(e.t)
+	cfg.ProcRoot = e.proc
+	cfg.DockerEnabled = false
+	return cfg
+}
+
+// monitor creates a monitor for the fake node, logging to e.log and recording
+// its events in e.events. Containers are attributed from any Docker daemons
+// given.
+func (e *testEnv) monitor(cfg Config, docker ...*dockerDaemon) *monitor {
+	e.t.Helper()
+	logger := log.New(&e.log, "", 0)
+	events := &notifier{logger: logger, clock: e.clock, sinks: []eventSink{e}}
+	if len(docker) > 0 {
+		cfg.DockerEnabled = true
+	}
+	m, err := newMonitor(cfg, e.clock, logger, events, docker)
+	if err != nil {
+		e.t.Fatalf("newMonitor: %v", err)
+	}
+	return m
+}
+
+// send records an event, making the testEnv an event sink.
+func (e *testEnv) send(ev event) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, ev)
+	return nil
+}
+
+// actions returns the action and PID of each event recorded, such as
+// "terminate 1001", in order.
+func (e *testEnv) actions() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var actions []string
+	for _, ev := range e.events {
+		actions = append(actions, fmt.Sprintf("%s %d", ev.Action, ev.PID))
+	}
+	return actions
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScanTerminatesOnceIdlePastThreshold(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python"})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v as soon as it started, want nothing within the %ds threshold", got, cfg.IdleTimeThreshold)
+	}
+
+	e.clock.Sleep(time.Duration(cfg.IdleTimeThreshold) * time.Second)
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v at exactly the threshold, want nothing until it's passed", got)
+	}
+
+	e.clock.Sleep(time.Second)
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals once past the threshold = %v, want %v", got, want)
+	}
+}
+
+func TestScanOnlyWarnsInWarningOnlyMode(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	m := e.monitor(e.config())
+
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v in warning-only mode", got)
+	}
+	if got, want := e.actions(), []string{"warn 1001"}; !equalStrings(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+func TestBatchTerminationsLogsOnlyTheReport(t *testing.T) {
+	e := newTestEnv(t)
+	for _, pid := range []int{1001, 1002} {
+		e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	}
+	e.gpuProcesses("1001, 0", "1002, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.BatchTerminations = true
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got, want := e.actions(), []string{"terminate 1001", "terminate 1002", "report 0"}; !equalStrings(got, want) {
+		t.Fatalf("events = %v, want %v, each termination still sent to sinks", got, want)
+	}
+	log := e.log.String()
+	if strings.Contains(log, "Terminated: Process") {
+		t.Errorf("log has a line for each termination, want only the report:\n%s", log)
+	}
+	if want := "TERMINATION REPORT: 2 terminated this scan (2 sent). Terminated: PID 1001 (python) sent, PID 1002 (python) sent."; !strings.Contains(log, want) {
+		t.Errorf("log doesn't have the report %q:\n%s", want, log)
+	}
+}
+
+func TestSignalLadderEscalates(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.SignalLadder = "USR1@0s,TERM@30s,KILL@120s"
+	m := e.monitor(cfg)
+
+	steps := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{0, []string{"-s USR1 1001"}},
+		{10 * time.Second, []string{"-s USR1 1001"}},
+		{25 * time.Second, []string{"-s USR1 1001", "-s TERM 1001"}},
+		{60 * time.Second, []string{"-s USR1 1001", "-s TERM 1001"}},
+		{30 * time.Second, []string{"-s USR1 1001", "-s TERM 1001", "-s KILL 1001"}},
+	}
+	for _, step := range steps {
+		e.clock.Sleep(step.after)
+		m.scan()
+		if got := e.signals(); !equalStrings(got, step.want) {
+			t.Fatalf("signals %v after the first = %v, want %v", e.clock.Now().Sub(testEpoch), got, step.want)
+		}
+	}
+}
+
+func TestScanLeavesProcessesInDStateAlone(t *testing.T) {
+	e := newTestEnv(t)
+	stuck := fakeProcess{PID: 1001, PPID: 1, Comm: "python", State: "D", Start: testEpoch.Add(-time.Hour)}
+	e.addProcess(stuck)
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.DStateAlertAfter = 60
+	m := e.monitor(cfg)
+
+	m.scan()
+	e.clock.Sleep(30 * time.Second)
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v in D state, want it left until it wakes", got)
+	}
+	if got, want := e.actions(), []string{"warn 1001"}; !equalStrings(got, want) {
+		t.Fatalf("events = %v, want a single %v", got, want)
+	}
+
+	e.clock.Sleep(30 * time.Second)
+	m.scan()
+	m.scan()
+	if got, want := e.actions(), []string{"warn 1001", "critical 1001"}; !equalStrings(got, want) {
+		t.Fatalf("events after -dStateAlertAfter = %v, want a single alert: %v", got, want)
+	}
+
+	stuck.State = "S"
+	e.addProcess(stuck)
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals once it woke = %v, want %v", got, want)
+	}
+}
+
+func TestMassIdleGuardSuppressesAllZeroSnapshot(t *testing.T) {
+	e := newTestEnv(t)
+	for pid := 1001; pid <= 1004; pid++ {
+		e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	}
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.MassIdleGuard = 0.9
+	m := e.monitor(cfg)
+
+	// A driver hiccup makes every process appear to hold no memory
+	e.gpuProcesses("1001, 0", "1002, 0", "1003, 0", "1004, 0")
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v on an all-zero snapshot, want nothing", got)
+	}
+	if !strings.Contains(e.log.String(), "4 of 4 GPU processes (100%) appear idle at once") {
+		t.Fatalf("log doesn't warn about the mass idle snapshot:\n%s", e.log.String())
+	}
+
+	e.gpuProcesses("1001, 0", "1002, 2048", "1003, 2048", "1004, 2048")
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals once the readings recovered = %v, want %v", got, want)
+	}
+}
+
+// denySignals makes nvidler appear not to be permitted to signal any process,
+// as when it runs without root or CAP_KILL, until the test ends.
+func (e *testEnv) denySignals() {
+	e.write(filepath.Join(e.dir, "kill-fails"), "")
+	signal := nullSignal
+	nullSignal = func(int) error { return syscall.EPERM }
+	e.t.Cleanup(func() { nullSignal = signal })
+}
+
+func TestScanReportsSignalsNotPermitted(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	e.denySignals()
+	cfg := e.config()
+	cfg.WarningOnly = false
+	m := e.monitor(cfg)
+
+	m.scan()
+	if !strings.Contains(e.log.String(), "Not permitted to send SIGTERM to PID 1001") || !strings.Contains(e.log.String(), "run nvidler as root or with CAP_KILL") {
+		t.Fatalf("log doesn't say how to fix the denied signal:\n%s", e.log.String())
+	}
+	if m.permissionErrors != 1 {
+		t.Errorf("permissionErrors = %d, want 1", m.permissionErrors)
+	}
+	var outcomes []string
+	for _, ev := range e.events {
+		if ev.PID == 1001 && ev.Outcome != "" {
+			outcomes = append(outcomes, ev.Outcome)
+		}
+	}
+	if want := []string{outcomeNotPermitted}; !equalStrings(outcomes, want) {
+		t.Errorf("outcomes for PID 1001 = %v, want %v", outcomes, want)
+	}
+
+	var checks preflightChecks
+	checkSignalling(&checks, cfg, []gpuProcess{{PID: 1001}})
+	if !checks.failed() || !strings.Contains(checks[0].Detail, "not permitted to signal 1 of 1") {
+		t.Errorf("preflight signalling check = %+v, want it to fail", checks)
+	}
+}
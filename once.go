@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Exit codes of -once, for cron wrappers to tell finding waste apart from
+// acting on it. They're stable: new outcomes get new codes rather than
+// changing these.
+const (
+	exitNothingIdle = 0 // no idle process was warned about, nothing was acted on
+	exitError       = 1 // the scan or an action failed
+	exitIdleFound   = 2 // idle processes were only warned about
+	exitActed       = 3 // processes were terminated, stopped or quarantined
+)
+
+// onceResults names each exit code in the -onceSummary file.
+var onceResults = map[int]string{
+	exitNothingIdle: "nothingIdle",
+	exitError:       "error",
+	exitIdleFound:   "idleFound",
+	exitActed:       "acted",
+}
+
+// onceSummary is the machine-readable outcome of a -once scan, written to
+// -onceSummary.
+type onceSummary struct {
+	Time     time.Time `json:"time"`
+	ExitCode int       `json:"exitCode"`
+	Result   string    `json:"result"`
+	Warned   int       `json:"warned"`        // idle processes only warned about
+	Other    int       `json:"otherWarnings"` // other warnings, such as -maxRuntime, leaked contexts or nvidler's own
+	Acted    int       `json:"acted"`         // processes terminated, stopped or quarantined
+	Errors   []string  `json:"errors"`
+	Events   []event   `json:"events"`
+}
+
+// onceRecorder collects the events of a -once scan, as an event sink.
+type onceRecorder struct {
+	mu     sync.Mutex
+	events []event
+}
+
+func (r *onceRecorder) send(e event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+// runOnce performs a single scan for -once, writes its outcome to
+// -onceSummary if set, and returns the exit code. A scan that fails to query
+// nvidia-smi or Docker, or any action that fails, is an error whatever else
+// happened, then acting on a process outranks only warning about one.
+func (m *monitor) runOnce(summaryPath string) int {
+	recorder := &onceRecorder{}
+	m.events.sinks = append(m.events.sinks, recorder)
+
+	m.mu.Lock()
+	m.scan()
+	failed := m.scanFailed
+	m.mu.Unlock()
+
+	recorder.mu.Lock()
+	summary := onceSummary{Time: m.clock.Now(), Errors: []string{}, Events: append([]event{}, recorder.events...)}
+	recorder.mu.Unlock()
+	if failed {
+		summary.Errors = append(summary.Errors, "the scan failed to query nvidia-smi or a container runtime, see the log")
+	}
+	for _, e := range summary.Events {
+		switch e.Action {
+		case actionWarn:
+			// Only plain idle processes count towards exitIdleFound
+			if e.PID != 0 && e.Category == "" {
+				summary.Warned++
+			} else {
+				summary.Other++
+			}
+		case actionTerminate, actionQuarantine:
+			summary.Acted++
+		case actionError:
+			summary.Errors = append(summary.Errors, e.Message)
+		}
+	}
+
+	switch {
+	case len(summary.Errors) > 0:
+		summary.ExitCode = exitError
+	case summary.Acted > 0:
+		summary.ExitCode = exitActed
+	case summary.Warned > 0:
+		summary.ExitCode = exitIdleFound
+	default:
+		summary.ExitCode = exitNothingIdle
+	}
+	summary.Result = onceResults[summary.ExitCode]
+	m.logger.Printf("Single scan done (-once): %d idle warned about, %d other warnings, %d acted on, %d errors, exiting with %d (%s).\n", summary.Warned, summary.Other, summary.Acted, len(summary.Errors), summary.ExitCode, summary.Result)
+
+	if summaryPath != "" {
+		if err := writeOnceSummary(summaryPath, summary); err != nil {
+			m.logger.Printf("Failed to write the -onceSummary %s: %v\n", summaryPath, err)
+			return exitError
+		}
+	}
+	return summary.ExitCode
+}
+
+// writeOnceSummary writes the outcome of a -once scan as JSON, replacing the
+// file in one step so a wrapper never reads it half written.
+func writeOnceSummary(path string, summary onceSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, append(data, '\n'))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOnceCountsOnlyIdleWarnings(t *testing.T) {
+	tests := []struct {
+		name       string
+		processes  []string
+		wantWarned int
+		wantOther  int
+		wantExit   int
+	}{
+		// A busy process over -maxRuntime is warned about, but isn't idle
+		{"runtime only", []string{"1002, 500"}, 0, 1, exitNothingIdle},
+		{"idle and runtime", []string{"1001, 0", "1002, 500"}, 1, 1, exitIdleFound},
+	}
+	for _, tt := range tests {
+		e := newTestEnv(t)
+		e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+		e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+		e.gpuProcesses(tt.processes...)
+		cfg := e.config()
+		cfg.MaxRuntime = 60
+		m := e.monitor(cfg)
+
+		path := filepath.Join(e.dir, "summary.json")
+		if code := m.runOnce(path); code != tt.wantExit {
+			t.Errorf("%s: exit code = %d, want %d", tt.name, code, tt.wantExit)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summary onceSummary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			t.Fatal(err)
+		}
+		if summary.Warned != tt.wantWarned || summary.Other != tt.wantOther {
+			t.Errorf("%s: warned = %d, otherWarnings = %d, want %d and %d", tt.name, summary.Warned, summary.Other, tt.wantWarned, tt.wantOther)
+		}
+	}
+}
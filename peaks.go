@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// processMemory is the GPU memory use of a process on one GPU.
+type processMemory struct {
+	PID        int    `json:"pid"`
+	GPU        string `json:"gpu"`
+	UsedMemory int    `json:"usedMemory"`
+	PeakMemory int    `json:"peakMemory"`
+
+	// Start is when the process started, with -stateFile, so its peak is only
+	// restored after a restart if the PID is still the same process
+	Start *time.Time `json:"start,omitempty"`
+}
+
+type processGPU struct {
+	pid int
+	gpu string
+}
+
+// memoryPeaks tracks the highest GPU memory use seen for each process on each
+// GPU, for as long as it stays on the GPU. This tells a process that never
+// used much memory apart from one that's winding down.
+type memoryPeaks map[processGPU]*processMemory
+
+// update records the memory use from a scan, forgetting processes that are no
+// longer on a GPU. With startTime, the start time of each new process is kept
+// too.
+func (p memoryPeaks) update(processes []gpuProcess, startTime func(pid int) (time.Time, error)) {
+	seen := make(map[processGPU]bool, len(processes))
+	for _, process := range processes {
+		key := processGPU{process.PID, process.GPUUUID}
+		seen[key] = true
+		m, ok := p[key]
+		if !ok {
+			m = &processMemory{PID: process.PID, GPU: process.GPUUUID}
+			if startTime != nil {
+				if start, err := startTime(process.PID); err == nil {
+					m.Start = &start
+				}
+			}
+			p[key] = m
+		}
+		m.UsedMemory = process.UsedMemory
+		if process.UsedMemory > m.PeakMemory {
+			m.PeakMemory = process.UsedMemory
+		}
+	}
+	for key := range p {
+		if !seen[key] {
+			delete(p, key)
+		}
+	}
+}
+
+// restore adds the peaks of processes from an earlier run, such as before a
+// restart, that are still running as the same process, returning how many it
+// added. Those without a start time, or whose PID now has another start time,
+// are left out.
+func (p memoryPeaks) restore(earlier []processMemory, startTime func(pid int) (time.Time, error)) int {
+	restored := 0
+	for _, m := range earlier {
+		if m.Start == nil {
+			continue
+		}
+		if start, err := startTime(m.PID); err != nil || !start.Equal(*m.Start) {
+			continue
+		}
+		m := m
+		p[processGPU{m.PID, m.GPU}] = &m
+		restored++
+	}
+	return restored
+}
+
+// peak returns the highest memory use seen for a process on its GPU.
+func (p memoryPeaks) peak(process gpuProcess) int {
+	if m, ok := p[processGPU{process.PID, process.GPUUUID}]; ok {
+		return m.PeakMemory
+	}
+	return process.UsedMemory
+}
+
+// list returns the tracked processes in PID order.
+func (p memoryPeaks) list() []processMemory {
+	list := make([]processMemory, 0, len(p))
+	for _, m := range p {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PID != list[j].PID {
+			return list[i].PID < list[j].PID
+		}
+		return list[i].GPU < list[j].GPU
+	})
+	return list
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryPeaks(t *testing.T) {
+	peaks := make(memoryPeaks)
+	a := gpuProcess{PID: 1001, GPUUUID: "GPU-a"}
+	b := gpuProcess{PID: 1002, GPUUUID: "GPU-a"}
+	scan := func(aMB, bMB int) {
+		a.UsedMemory, b.UsedMemory = aMB, bMB
+		peaks.update([]gpuProcess{a, b}, nil)
+	}
+
+	scan(512, 100)
+	scan(4096, 50)
+	scan(256, 75)
+	if got := peaks.peak(a); got != 4096 {
+		t.Errorf("peak of PID 1001 = %d MB, want 4096", got)
+	}
+	if got := peaks.peak(b); got != 100 {
+		t.Errorf("peak of PID 1002 = %d MB, want 100", got)
+	}
+	want := []processMemory{
+		{PID: 1001, GPU: "GPU-a", UsedMemory: 256, PeakMemory: 4096},
+		{PID: 1002, GPU: "GPU-a", UsedMemory: 75, PeakMemory: 100},
+	}
+	if got := peaks.list(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("list = %+v, want %+v", got, want)
+	}
+
+	// A process that leaves the GPU is forgotten, so its PID starts again
+	peaks.update([]gpuProcess{b}, nil)
+	a.UsedMemory = 10
+	if got := peaks.peak(a); got != 10 {
+		t.Errorf("peak of PID 1001 after leaving the GPU = %d MB, want its current 10", got)
+	}
+	if got := peaks.list(); len(got) != 1 || got[0].PID != 1002 {
+		t.Errorf("list after PID 1001 left = %+v, want only PID 1002", got)
+	}
+}
+
+func TestScanSparesProcessesPeakingAboveMaxPeakMB(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.MaxPeakMB = 1024
+	m := e.monitor(cfg)
+
+	e.gpuProcesses("1001, 4096", "1002, 512")
+	m.scan()
+	e.gpuProcesses("1001, 0", "1002, 0")
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1002"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want only %v, whose peak stayed below -maxPeakMB", got, want)
+	}
+}
+
+func TestRestartRestoresMemoryPeaks(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 4096", "1002, 2048")
+	cfg := e.config()
+	cfg.StateFile = filepath.Join(e.dir, "state.json")
+	m := e.monitor(cfg)
+	m.scan()
+	m.writeState()
+
+	// After a restart, 1001 is still the same process, now using less, while
+	// 1002 has exited and its PID been reused
+	e.removeProcess(1002)
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Minute)})
+	e.gpuProcesses("1001, 256", "1002, 100")
+	m = e.monitor(cfg)
+	if want := "Restored the peak memory use of 1 processes from -stateFile"; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+	m.scan()
+	if got := m.peaks.peak(gpuProcess{PID: 1001, GPUUUID: testGPU, UsedMemory: 256}); got != 4096 {
+		t.Errorf("peak of PID 1001 after a restart = %d MB, want the 4096 from before it", got)
+	}
+	if got := m.peaks.peak(gpuProcess{PID: 1002, GPUUUID: testGPU, UsedMemory: 100}); got != 100 {
+		t.Errorf("peak of the new PID 1002 after a restart = %d MB, want its own 100, not the old process's", got)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pmonFields are the per-process utilization values taken from nvidia-smi pmon,
+// named for use in -idleExpr.
+var pmonFields = []queryField{
+	{Name: "sm_util", Field: "sm"},
+	{Name: "mem_util", Field: "mem"},
+	{Name: "enc_util", Field: "enc"},
+	{Name: "dec_util", Field: "dec"},
+}
+
+// pmonKey identifies a process on a GPU, as a process may use several GPUs.
+type pmonKey struct {
+	GPU int // index
+	PID int
+}
+
+// queryPmon samples per-process utilization once with nvidia-smi pmon, which
+// unlike --query-compute-apps reports what each process is doing rather than
+// the whole GPU.
+func queryPmon() (map[pmonKey]map[string]float64, error) {
+	out, err := runSMI("pmon", "-c", "1", "-s", "u")
+	if err != nil {
+		return nil, err
+	}
+	return parsePmon(string(out))
+}
+
+// parsePmon parses nvidia-smi pmon output. Its columns are whitespace aligned
+// and vary with the driver version, so they're found by name from the first
+// header line, e.g.
+//
+//	# gpu        pid  type    sm   mem   enc   dec   command
+//	# Idx          #   C/G     %     %     %     %   name
+//	    0      12345     C    45    12     -     -   python
+//
+// Values of "-", reported when there's no sample or for GPUs without
+// processes, are left out.
+func parsePmon(out string) (map[pmonKey]map[string]float64, error) {
+	var columns map[string]int
+	samples := make(map[pmonKey]map[string]float64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "#" {
+			if columns == nil {
+				columns = make(map[string]int, len(fields)-1)
+				for i, name := range fields[1:] {
+					columns[name] = i
+				}
+			}
+			continue
+		}
+		if columns == nil {
+			return nil, fmt.Errorf("missing header before %q", line)
+		}
+
+		gpuColumn, ok := columns["gpu"]
+		pidColumn, ok2 := columns["pid"]
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("missing gpu or pid column")
+		}
+		if len(fields) <= gpuColumn || len(fields) <= pidColumn {
+			continue
+		}
+		gpu, err := strconv.Atoi(fields[gpuColumn])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gpu %q", fields[gpuColumn])
+		}
+		pid, err := strconv.Atoi(fields[pidColumn])
+		if err != nil {
+			// A GPU with no processes is listed with a pid of "-"
+			continue
+		}
+
+		values := make(map[string]float64)
+		for _, f := range pmonFields {
+			i, ok := columns[f.Field]
+			if !ok || i >= len(fields) {
+				continue
+			}
+			if v, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				values[f.Name] = v
+			}
+		}
+		samples[pmonKey{GPU: gpu, PID: pid}] = values
+	}
+	return samples, nil
+}
+
+// addPmonValues adds per-process utilization from nvidia-smi pmon to the
+// processes' values. If pmon is unavailable, such as on GPUs that don't
+// support it, the processes are left as they are and a message is logged the
+// first time; -idleExpr then can't be evaluated for them and they're left
+// alone rather than judged on device-wide readings. Processes on GPUs without
+// accounting mode are then handled as -onNoAccounting says.
+func (m *monitor) addPmonValues(processes []gpuProcess) {
+	defer m.handleNoAccounting(processes)
+	samples, err := queryPmon()
+	var gpus []gpuInfo
+	if err == nil {
+		gpus, err = queryGPUs()
+	}
+	if err != nil {
+		if !m.pmonFailed {
+			m.logger.Printf("Failed to sample per-process utilization with nvidia-smi pmon, using --query-compute-apps readings only: %v\n", err)
+			m.pmonFailed = true
+		}
+		return
+	}
+	if m.pmonFailed {
+		m.logger.Println("Sampling per-process utilization with nvidia-smi pmon again.")
+		m.pmonFailed = false
+	}
+
+	indices := make(map[string]int, len(gpus))
+	for _, gpu := range gpus {
+		indices[gpu.UUID] = gpu.Index
+	}
+	for _, p := range processes {
+		index, ok := indices[p.GPUUUID]
+		if !ok {
+			continue
+		}
+		for name, value := range samples[pmonKey{GPU: index, PID: p.PID}] {
+			p.Values[name] = value
+		}
+	}
+}
+
+// memTransfer reports whether a process that would otherwise be acted on is
+// copying data between the host and its GPU, such as while loading a model,
+// by its memory controller utilization from nvidia-smi pmon, for
+// -respectMemTransfers. Any memory controller activity counts, even with no SM
+// utilization. The evidence is logged either way.
+func (m *monitor) memTransfer(process gpuProcess, processName string, state *scanState) bool {
+	pid := process.PID
+	memUtil, ok := process.Values["mem_util"]
+	if !ok {
+		state.log(pid).Printf("PID %d (%s) has no memory controller utilization sample from nvidia-smi pmon, so it can't be checked for data transfers.\n", pid, processName)
+		state.note(pid, "No memory controller utilization sample from pmon, so -respectMemTransfers can't check it for data transfers.")
+		return false
+	}
+	smUtil := "no"
+	if v, ok := process.Values["sm_util"]; ok {
+		smUtil = fmt.Sprintf("%.0f%%", v)
+	}
+	if memUtil > 0 {
+		state.log(pid).Printf("Skipping PID %d (%s): its memory controller utilization is %.0f%% with %s SM utilization, so it looks to be transferring data.\n", pid, processName, memUtil, smUtil)
+		state.note(pid, "Its memory controller utilization is %.0f%% with %s SM utilization, so it looks to be transferring data and is spared by -respectMemTransfers.", memUtil, smUtil)
+		return true
+	}
+	state.log(pid).Printf("PID %d (%s) has 0%% memory controller utilization, it isn't transferring data.\n", pid, processName)
+	state.note(pid, "Its memory controller utilization is 0%%, so it isn't transferring data.")
+	return false
+}
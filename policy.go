@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// policySection is a part of the policy set out by -describePolicy: a heading
+// and the rules under it. Flags and values in the rules are quoted in
+// backticks, which are kept for Markdown and dropped for plain text.
+type policySection struct {
+	Title string
+	Rules []string
+}
+
+// describePolicy sets out the policy a configuration enforces: what's acted
+// on and how, how idleness is defined, the thresholds, what's exempt and why,
+// and what holds enforcement off. It's generated from the effective
+// configuration rather than written by hand, so it can't drift from it.
+func describePolicy(cfg Config) []policySection {
+	return []policySection{
+		{"Enforcement", enforcementRules(cfg)},
+		{"Targets", targetRules(cfg)},
+		{"Idleness", idlenessRules(cfg)},
+		{"Thresholds", thresholdRules(cfg)},
+		{"Exemptions", exemptionRules(cfg)},
+		{"Safeguards", safeguardRules(cfg)},
+	}
+}
+
+func enforcementRules(cfg Config) []string {
+	var rules []string
+	if cfg.WarningOnly {
+		rules = append(rules, "Warning only (`-warningOnly`): idle processes are warned about but never acted on.")
+	}
+	acted := "terminated"
+	switch {
+	case cfg.QuarantineAction == quarantineRenice:
+		acted = "quarantined rather than terminated, by renicing them to 19 (`-quarantineAction renice`), and restored once they're active again"
+	case cfg.QuarantineAction == quarantineCgroupLimit:
+		acted = "quarantined rather than terminated, by limiting their cgroup to 5% of a CPU (`-quarantineAction cgroup-limit`), and restored once they're active again"
+	case cfg.ReapGranularity == "cgroup":
+		acted = "reaped by cgroup (`-reapGranularity cgroup`): every process in a cgroup is sent SIGTERM once all of its GPU processes are idle"
+	case cfg.ContainerIdlePolicy == "all":
+		acted = "stopped by container (`-containerIdlePolicy all`): a Docker container is stopped once all of its GPU processes are idle, and other processes are terminated"
+	}
+	if cfg.WarningOnly {
+		rules = append(rules, fmt.Sprintf("Without `-warningOnly`, idle processes would be %s.", acted))
+	} else {
+		rules = append(rules, fmt.Sprintf("Idle processes past the idle threshold are %s.", acted))
+	}
+
+	switch {
+	case cfg.K8sEvict:
+		rules = append(rules, fmt.Sprintf("Processes in GPU-requesting pods on node `%s` are evicted through the Kubernetes API, respecting PodDisruptionBudgets (`-k8sEvict`).", cfg.K8sNode))
+	case cfg.Slurm && cfg.SlurmCancel:
+		rules = append(rules, "Processes in SLURM jobs are terminated by cancelling the job with scancel (`-slurmCancel`).")
+	}
+	switch {
+	case cfg.KillCommand != "":
+		rules = append(rules, fmt.Sprintf("Processes are terminated by running `%s` (`-killCommand`) rather than being signalled.", cfg.KillCommand))
+	case cfg.SignalLadder != "":
+		rule := fmt.Sprintf("Signals escalate over successive scans by `-signalLadder` `%s`", cfg.SignalLadder)
+		if ladder, err := parseLadder(cfg.SignalLadder); err == nil {
+			var rungs []string
+			for _, rung := range ladder {
+				rungs = append(rungs, fmt.Sprintf("SIG%s after %v", rung.Signal, rung.After))
+			}
+			rule += ": " + strings.Join(rungs, ", then ")
+		}
+		if cfg.ProbeBeforeKill {
+			rule += ", holding off SIGKILL while the process shows signs of shutting down (`-probeBeforeKill`)"
+		}
+		rules = append(rules, rule+".")
+	default:
+		rules = append(rules, "Processes are terminated with SIGTERM.")
+	}
+
+	if cfg.ConfirmCycles > 1 {
+		rules = append(rules, fmt.Sprintf("A process must be judged due for termination on `%d` consecutive scans before it's acted on (`-confirmCycles`).", cfg.ConfirmCycles))
+	}
+	if cfg.WarnRepeatInterval > 0 {
+		rules = append(rules, fmt.Sprintf("An idle process is warned about again every `%v` rather than every scan (`-warnRepeatInterval`).", seconds(cfg.WarnRepeatInterval)))
+	}
+	if cfg.WallNotify > 0 {
+		rules = append(rules, fmt.Sprintf("The owner of an idle process is sent a notice on their terminals `%v` before it's terminated (`-wallNotify`).", seconds(cfg.WallNotify)))
+	}
+	if cfg.Drain {
+		rules = append(rules, fmt.Sprintf("Drain mode is on (`-drain`): every target process on %s is warned and terminated `%v` later (`-drainTimeout`), whether idle or not, even with `-warningOnly`.", describeGPUs(cfg.DrainGPUs, "every GPU"), seconds(cfg.DrainTimeout)))
+	}
+	rules = append(rules, fmt.Sprintf("GPU processes are checked every `%v` (`-sleepInterval`).", seconds(cfg.SleepInterval)))
+	return rules
+}
+
+func targetRules(cfg Config) []string {
+	rules := []string{fmt.Sprintf("Processes named, or with an executable at, any of `%s` are targeted (`-targetWorkloads`). Other processes are never acted on.", strings.Join(cfg.TargetWorkloads, ", "))}
+	if len(cfg.TargetImages) > 0 {
+		rules = append(rules, fmt.Sprintf("So are processes in Docker containers whose image matches any of `%s` (`-targetImages`), whatever they're called.", strings.Join(cfg.TargetImages, ", ")))
+	}
+	if len(cfg.OnlyUsers) > 0 {
+		rules = append(rules, fmt.Sprintf("Only processes owned by `%s` are acted on (`-onlyUsers`).", strings.Join(cfg.OnlyUsers, ", ")))
+	}
+	if cfg.ContainerOnly {
+		rules = append(rules, "Only processes in Docker containers are acted on (`-containerOnly`), never host processes.")
+	}
+	if cfg.MaxRuntime > 0 {
+		if cfg.MaxRuntimeAction == "terminate" {
+			rules = append(rules, fmt.Sprintf("Target processes running for longer than `%v` are terminated whether idle or not (`-maxRuntime`).", seconds(cfg.MaxRuntime)))
+		} else {
+			rules = append(rules, fmt.Sprintf("Target processes running for longer than `%v` are warned about whether idle or not (`-maxRuntime`).", seconds(cfg.MaxRuntime)))
+		}
+	}
+	return rules
+}
+
+func idlenessRules(cfg Config) []string {
+	var rules []string
+	switch {
+	case cfg.IdleExpr != "":
+		rules = append(rules, fmt.Sprintf("A process is idle when `-idleExpr` `%s` is true.", cfg.IdleExpr))
+	case cfg.IdlePolicy != "":
+		extraFields, _ := parseExtraFields(cfg.ExtraQueryFields)
+		if policy, err := parseIdlePolicy(cfg.IdlePolicy, cfg.valueFields(extraFields)); err == nil {
+			rules = append(rules, describeIdlePolicy(policy, "`-idlePolicy`"))
+		}
+		if cfg.SeedIdleFromStartTime {
+			rules = append(rules, "A process first seen below the utilization threshold holding no GPU memory counts as below it since it started (`-seedIdleFromStartTime`).")
+		}
+	default:
+		rules = append(rules, describeIdlePolicy(defaultIdlePolicy, "the default policy"))
+	}
+	if cfg.ActivityPaths != "" {
+		if paths, err := parseActivityPaths(cfg.ActivityPaths); err == nil {
+			for _, p := range paths {
+				target := "any process"
+				if p.Target != "" {
+					target = fmt.Sprintf("a `%s` process", p.Target)
+				}
+				rules = append(rules, fmt.Sprintf("%s is active while a file matching `%s` has been modified within the idle threshold (`-activityPaths`).", capitalize(target), p.Glob))
+			}
+		}
+	}
+	if cfg.BusyFileGlob != "" {
+		rules = append(rules, fmt.Sprintf("A process is active while a file matching `%s`, with {pid} replaced by its PID, has been modified within the idle threshold (`-busyFileGlob`).", cfg.BusyFileGlob))
+	}
+	if cfg.IdleClassifierCommand != "" {
+		rules = append(rules, fmt.Sprintf("Each process is also judged by the site's own command, `%s`, which can hold it active, judge it idle or leave it to the other rules (`-idleClassifierCommand`).", cfg.IdleClassifierCommand))
+	}
+	if cfg.RespectActiveTty {
+		rules = append(rules, "A process whose controlling terminal has had input within the idle threshold is active (`-respectActiveTty`).")
+	}
+	if cfg.RespectMemTransfers {
+		rules = append(rules, "A process with any memory controller utilization is active, as it's copying data to or from its GPU (`-respectMemTransfers`).")
+	}
+	if cfg.Pmon {
+		if cfg.OnNoAccounting == "aggressive" {
+			rules = append(rules, "On GPUs with accounting mode disabled, the GPU's device-wide utilization stands in for each process's (`-onNoAccounting aggressive`).")
+		} else {
+			rules = append(rules, "On GPUs with accounting mode disabled, per-process utilization is ignored so it can't mark processes idle (`-onNoAccounting conservative`).")
+		}
+	}
+	if cfg.LeakedContextThreshold > 0 {
+		rules = append(rules, fmt.Sprintf("A process that has held GPU memory unchanged with no SM utilization for `%v` is acted on as a leaked CUDA context, even if not judged idle (`-leakedContextThreshold`).", seconds(cfg.LeakedContextThreshold)))
+	}
+	if cfg.DetectGPUResets {
+		rules = append(rules, "After a GPU appears to have been reset, its processes are counted as idle only from the reset (`-detectGpuResets`).")
+	}
+	return rules
+}
+
+// describeIdlePolicy describes the conditions of an idle policy.
+func describeIdlePolicy(p idlePolicy, source string) string {
+	var conditions []string
+	if p.MemoryBelowMB > 0 {
+		conditions = append(conditions, fmt.Sprintf("it holds less than `%d MB` of GPU memory", p.MemoryBelowMB))
+	}
+	if p.UtilizationBelow > 0 {
+		condition := fmt.Sprintf("its `%s` is below `%v`", p.UtilizationField, p.UtilizationBelow)
+		if p.UtilizationWindow > 0 {
+			condition += fmt.Sprintf(" for `%v`", seconds(p.UtilizationWindow))
+		}
+		conditions = append(conditions, condition)
+	}
+	if p.NoDeviceFds {
+		conditions = append(conditions, "it has no GPU device files open")
+	}
+	if p.MinAge > 0 {
+		conditions = append(conditions, fmt.Sprintf("it started at least `%v` ago", seconds(p.MinAge)))
+	}
+	join := " and "
+	if p.Match == "any" {
+		join = " or "
+	}
+	return fmt.Sprintf("By %s, a process is idle when %s.", source, strings.Join(conditions, join))
+}
+
+func thresholdRules(cfg Config) []string {
+	rules := []string{fmt.Sprintf("An idle process is acted on once it has been running for more than `%v` (`-idleTimeThreshold`), as it's counted as idle since it started.", seconds(cfg.IdleTimeThreshold))}
+	if cfg.BusinessHours != "" {
+		rules = append(rules, fmt.Sprintf("During business hours, `%s` (`-businessHours`), the threshold is multiplied by `%v` to `%v` (`-businessHoursMultiplier`).", cfg.BusinessHours, cfg.BusinessHoursMultiplier, time.Duration(float64(seconds(cfg.IdleTimeThreshold))*cfg.BusinessHoursMultiplier).Truncate(time.Second)))
+	}
+	if cfg.ReclaimTargetMB != "" {
+		if targets, err := parseReclaimTargets(cfg.ReclaimTargetMB); err == nil {
+			gpus := make([]string, 0, len(targets))
+			for gpu := range targets {
+				gpus = append(gpus, gpu)
+			}
+			sort.Strings(gpus)
+			for _, gpu := range gpus {
+				where := "each GPU"
+				if gpu != "*" {
+					where = "GPU `" + gpu + "`"
+				}
+				rules = append(rules, fmt.Sprintf("On %s, only enough idle processes are terminated to free `%d MB` (`-reclaimTargetMB`), choosing the %s first (`-reclaimOrder`).", where, targets[gpu], cfg.ReclaimOrder))
+			}
+		}
+	}
+	if cfg.MaxPeakMB > 0 {
+		rules = append(rules, fmt.Sprintf("Only idle processes whose peak GPU memory use was below `%d MB` are acted on (`-maxPeakMB`).", cfg.MaxPeakMB))
+	}
+	if cfg.MinReclaimableMB > 0 {
+		rules = append(rules, fmt.Sprintf("Only idle processes holding at least `%d MB` of GPU memory are acted on (`-minReclaimableMB`).", cfg.MinReclaimableMB))
+	}
+	return rules
+}
+
+func exemptionRules(cfg Config) []string {
+	rules := []string{fmt.Sprintf("`%s` are never acted on, as terminating the NVIDIA daemons would take down the processes relying on them.", strings.Join(neverKill, ", "))}
+	if len(cfg.Whitelist) > 0 {
+		rules = append(rules, fmt.Sprintf("Processes and Docker containers named `%s` are never acted on (`-whitelist`).", strings.Join(cfg.Whitelist, ", ")))
+	}
+	if len(cfg.WhitelistImages) > 0 {
+		rules = append(rules, fmt.Sprintf("Processes in Docker containers whose image matches any of `%s` are never acted on (`-whitelistImages`).", strings.Join(cfg.WhitelistImages, ", ")))
+	}
+	if len(cfg.WhitelistGPUs) > 0 {
+		rules = append(rules, fmt.Sprintf("Processes on %s are never acted on (`-whitelistGPUs`).", describeGPUs(cfg.WhitelistGPUs, "")))
+	}
+	if cfg.GPUDisableMarkerDir != "" {
+		rules = append(rules, fmt.Sprintf("Processes on a GPU are not acted on while `%s` holds a marker file named after its index or UUID (`-gpuDisableMarkerDir`).", cfg.GPUDisableMarkerDir))
+	}
+	if cfg.DockerEnabled && cfg.SkipPrivilegedContainers {
+		rules = append(rules, "Processes in privileged or host networked Docker containers are never acted on, as they're usually infrastructure such as monitoring agents or drivers (`-skipPrivilegedContainers`).")
+	}
+	if cfg.RespectOomScore {
+		rules = append(rules, fmt.Sprintf("Processes with an oom_score_adj at or below `%d` are never acted on, as they've been shielded from the kernel's OOM killer (`-respectOomScore`).", cfg.OomProtectedAdj))
+	}
+	if cfg.DockerEnabled {
+		rules = append(rules, "Processes in Docker containers are skipped on any scan their containers can't be listed.")
+	}
+	return rules
+}
+
+func safeguardRules(cfg Config) []string {
+	var rules []string
+	if cfg.FailSafeAfter > 0 {
+		rules = append(rules, fmt.Sprintf("After `%d` consecutive scans fail to query nvidia-smi or Docker, only warn until `%d` clean scans in a row (`-failSafeAfter`, `-failSafeRecovery`).", cfg.FailSafeAfter, cfg.FailSafeRecovery))
+	}
+	if cfg.MassIdleGuard > 0 {
+		rules = append(rules, fmt.Sprintf("Don't terminate anything on a scan where more than `%.0f%%` of at least `%d` GPU processes appear idle at once, as it most likely means bad data (`-massIdleGuard`).", cfg.MassIdleGuard*100, cfg.MassIdleMinProcesses))
+	}
+	if cfg.MinNodeUptime > 0 {
+		rules = append(rules, fmt.Sprintf("Only warn until the node has been up for `%v` (`-minNodeUptime`).", seconds(cfg.MinNodeUptime)))
+	}
+	if cfg.TempPause && cfg.TempThreshold > 0 {
+		rules = append(rules, fmt.Sprintf("Only warn while a GPU has been above `%d°C` for `%v` (`-tempPauseEnforcement`).", cfg.TempThreshold, seconds(cfg.TempSustain)))
+	}
+	if cfg.DemandSignal != "" {
+		rules = append(rules, fmt.Sprintf("Only terminate while `%s` reports GPU jobs waiting to run, and otherwise only warn (`-demandSignal`).", cfg.DemandSignal))
+	}
+	if cfg.RequireFreshAttribution > 0 {
+		rules = append(rules, fmt.Sprintf("Only warn on a scan whose Docker containers couldn't all be listed, or were listed more than `%v` before acting (`-requireFreshAttribution`).", seconds(cfg.RequireFreshAttribution)))
+	}
+	if len(rules) == 0 {
+		rules = append(rules, "None: enforcement is never held off beyond the exemptions above.")
+	}
+	return rules
+}
+
+// describeGPUs names a list of GPUs by index or UUID, or returns all if the
+// list is empty.
+func describeGPUs(gpus []string, all string) string {
+	if len(gpus) == 0 {
+		return all
+	}
+	if len(gpus) == 1 {
+		return fmt.Sprintf("GPU `%s`", gpus[0])
+	}
+	return fmt.Sprintf("GPUs `%s`", strings.Join(gpus, ", "))
+}
+
+// seconds converts a setting in seconds to a duration.
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// writePolicy writes the policy as plain text, or as Markdown for pasting
+// into runbooks, headed by where the configuration came from.
+func writePolicy(w io.Writer, sections []policySection, source string, markdown bool) error {
+	generated := fmt.Sprintf("Generated from %s at %s.", source, time.Now().Format(time.RFC3339))
+	var b strings.Builder
+	if markdown {
+		fmt.Fprintf(&b, "# nvidler policy\n\n_%s_\n", generated)
+	} else {
+		fmt.Fprintf(&b, "nvidler policy\n%s\n", generated)
+	}
+	for _, section := range sections {
+		if markdown {
+			fmt.Fprintf(&b, "\n## %s\n\n", section.Title)
+		} else {
+			fmt.Fprintf(&b, "\n%s:\n", section.Title)
+		}
+		for _, rule := range section.Rules {
+			if markdown {
+				fmt.Fprintf(&b, "- %s\n", rule)
+			} else {
+				fmt.Fprintf(&b, "  - %s\n", strings.ReplaceAll(rule, "`", ""))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// preflightCheck is the outcome of one of nvidler preflight's checks. A check
+// that doesn't apply to the configuration is skipped rather than passed.
+type preflightCheck struct {
+	Name   string
+	Status string // PASS, FAIL or SKIP
+	Detail string
+}
+
+// preflightChecks collects the outcomes of the checks.
+type preflightChecks []preflightCheck
+
+func (c *preflightChecks) pass(name, format string, args ...interface{}) {
+	*c = append(*c, preflightCheck{Name: name, Status: "PASS", Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *preflightChecks) fail(name, format string, args ...interface{}) {
+	*c = append(*c, preflightCheck{Name: name, Status: "FAIL", Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *preflightChecks) skip(name, format string, args ...interface{}) {
+	*c = append(*c, preflightCheck{Name: name, Status: "SKIP", Detail: fmt.Sprintf(format, args...)})
+}
+
+// failed reports whether any check failed.
+func (c preflightChecks) failed() bool {
+	for _, check := range c {
+		if check.Status == "FAIL" {
+			return true
+		}
+	}
+	return false
+}
+
+// preflight checks that everything nvidler needs to run with the configuration
+// is in place, for nvidler preflight: a valid configuration, a working
+// nvidia-smi, visible host processes, a reachable Docker daemon or Kubernetes
+// API, a writable log file and the privileges to signal processes. The checks
+// go through the same lookups the monitor does.
+func preflight(cfg Config, cfgErr error) preflightChecks {
+	var checks preflightChecks
+
+	if cfgErr != nil {
+		checks.fail("configuration", "%s", strings.ReplaceAll(cfgErr.Error(), "\n", "; "))
+	} else {
+		checks.pass("configuration", "valid")
+	}
+
+	var processes []gpuProcess
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		checks.fail("nvidia-smi", "%v", err)
+	} else if caps, err := probeSMI(); err != nil {
+		checks.fail("nvidia-smi", "failed to probe supported fields: %v", err)
+	} else {
+		smiCaps = caps
+		extraFields, _ := parseExtraFields(cfg.ExtraQueryFields)
+		gpus, err := queryGPUs()
+		if err == nil {
+			_, processes, err = queryComputeApps(extraFields)
+		}
+		if err != nil {
+			checks.fail("nvidia-smi", "failed to query GPUs and processes: %v", err)
+		} else {
+			checks.pass("nvidia-smi", "%d GPUs, %d processes", len(gpus), len(processes))
+		}
+	}
+
+	switch {
+	case len(processes) == 0:
+		if _, err := readStat(os.Getpid()); err != nil {
+			checks.fail("process visibility", "can't read %s: %v", procRoot, err)
+		} else {
+			checks.skip("process visibility", "no GPU processes to look up under %s", procRoot)
+		}
+	case !anyProcessExists(processes):
+		checks.fail("process visibility", "none of the GPU PIDs exist under %s, run with host PIDs or point -procRoot at the host's /proc", procRoot)
+	default:
+		checks.pass("process visibility", "GPU PIDs found under %s", procRoot)
+	}
+
+	if !cfg.DockerEnabled {
+		checks.skip("docker", "-docker is disabled")
+	} else if daemons, err := newDockerDaemons(cfg); err != nil {
+		checks.fail("docker", "failed to initialize the client: %v", err)
+	} else {
+		for _, d := range daemons {
+			if endpoint, err := pingDocker(d, cfg); err != nil {
+				checks.fail("docker", "%v", err)
+			} else {
+				checks.pass("docker", "daemon reachable at %s", endpoint)
+			}
+		}
+	}
+
+	if !cfg.K8sEvict {
+		checks.skip("kubernetes", "-k8sEvict is disabled")
+	} else if kube, err := newInClusterKubeClient(); err != nil {
+		checks.fail("kubernetes", "%v", err)
+	} else if pods, err := kube.listGPUPods(cfg.K8sNode); err != nil {
+		checks.fail("kubernetes", "failed to list the pods on node %s: %v", cfg.K8sNode, err)
+	} else {
+		checks.pass("kubernetes", "%d GPU pods on node %s", len(pods), cfg.K8sNode)
+	}
+
+	if cfg.LogFile == "-" {
+		checks.skip("log file", "logging to stdout")
+	} else if err := checkWritable(cfg.LogFile); err != nil {
+		checks.fail("log file", "%s isn't writable: %v", cfg.LogFile, err)
+	} else {
+		checks.pass("log file", "%s is writable", cfg.LogFile)
+	}
+
+	if cfg.LockFile == "" {
+		checks.skip("lock file", "-lockFile is disabled")
+	} else if lock, err := acquireLock(cfg.LockFile, false); errors.Is(err, errLocked) {
+		checks.fail("lock file", "%s: %v", cfg.LockFile, err)
+	} else if err != nil {
+		checks.fail("lock file", "%s can't be created, set -lockFile to a writable path, or to empty to run without checking for other instances: %v", cfg.LockFile, err)
+	} else {
+		lock.release()
+		checks.pass("lock file", "%s is free", cfg.LockFile)
+	}
+
+	checkSignalling(&checks, cfg, processes)
+	return checks
+}
+
+// checkWritable reports whether a file can be appended to, or if it doesn't
+// exist yet, created, without changing it.
+func checkWritable(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	return syscall.Access(filepath.Dir(path), 2) // W_OK
+}
+
+// checkSignalling checks that the processes can be terminated the way the
+// configuration says, by sending them the null signal, which checks
+// permission without delivering anything.
+func checkSignalling(checks *preflightChecks, cfg Config, processes []gpuProcess) {
+	if cfg.WarningOnly {
+		checks.skip("signalling", "-warningOnly is set")
+		return
+	}
+	if cfg.SlurmCancel {
+		if _, err := exec.LookPath("scancel"); err != nil {
+			checks.fail("signalling", "-slurmCancel needs scancel: %v", err)
+			return
+		}
+	}
+
+	denied, checked := 0, 0
+	for _, p := range processes {
+		err := nullSignal(p.PID)
+		if errors.Is(err, syscall.ESRCH) {
+			continue
+		}
+		checked++
+		if errors.Is(err, syscall.EPERM) {
+			denied++
+		}
+	}
+	switch {
+	case denied > 0:
+		checks.fail("signalling", "not permitted to signal %d of %d GPU processes, run as root or with CAP_KILL", denied, checked)
+	case checked > 0:
+		checks.pass("signalling", "permitted to signal all %d GPU processes", checked)
+	case os.Geteuid() != 0:
+		checks.fail("signalling", "not running as root, so other users' processes can't be signalled")
+	default:
+		checks.pass("signalling", "running as root")
+	}
+}
+
+// writePreflight prints the outcomes of the checks as a table.
+func writePreflight(w io.Writer, checks preflightChecks) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, check := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Status, check.Name, check.Detail)
+	}
+	return tw.Flush()
+}
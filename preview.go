@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// wasteEntry is a GPU process along with an estimate of how much GPU capacity
+// it's wasting, for ranking which processes to reclaim first.
+type wasteEntry struct {
+	PID         int     `json:"pid"`
+	Process     string  `json:"process,omitempty"`
+	User        string  `json:"user,omitempty"`
+	Container   string  `json:"container,omitempty"`
+	Job         string  `json:"job,omitempty"`
+	GPU         string  `json:"gpu"`
+	UsedMemory  int     `json:"usedMemory"`
+	PeakMemory  int     `json:"peakMemory"`
+	GPUFraction float64 `json:"gpuFraction"` // of its GPU's total memory
+	GPUShare    float64 `json:"gpuShare"`    // of a shared GPU, 1 for a whole GPU
+	Idle        bool    `json:"idle"`
+	IdleSeconds int64   `json:"idleSeconds"`
+	Score       float64 `json:"score"` // idle seconds × fraction of a GPU held
+}
+
+// preview ranks every current GPU process by its waste score, the time it has
+// been idle multiplied by the fraction of a GPU it holds, worst first: its
+// share of a MIG or MPS shared GPU, or otherwise the fraction of its GPU's
+// memory it holds. Processes are attributed and judged idle as a scan
+// would, but none are acted on, enforcement settings don't matter and later
+// scans are unaffected.
+func (m *monitor) preview() ([]wasteEntry, error) {
+	defer m.startPreview()()
+	if smiXML != nil {
+		smiXML.invalidate()
+	}
+	_, processes, err := queryComputeApps(m.extraFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query GPU processes: %v", err)
+	}
+	if m.cfg.Pmon {
+		m.addPmonValues(processes)
+	}
+
+	state := m.newScanState(processes)
+	now := m.clock.Now()
+	entries := make([]wasteEntry, 0, len(processes))
+	for _, p := range processes {
+		e := wasteEntry{
+			PID:        p.PID,
+			GPU:        p.GPUUUID,
+			UsedMemory: p.UsedMemory,
+			PeakMemory: max(m.peaks.peak(p), p.UsedMemory),
+		}
+		if name, err := state.processComm(p.PID); err == nil {
+			e.Process = fullProcessName(p.PID, name)
+		}
+		if owner, err := state.processOwner(p.PID); err == nil {
+			e.User = owner
+		}
+		if state.containers != nil {
+			e.Container = state.containers.lookup(p.PID).Name
+		}
+		if m.cfg.Slurm {
+			e.Job = slurmJob(p.PID)
+		}
+		e.GPUShare, _ = m.gpuShare(p, state)
+		if total := m.memoryTotal(p.GPUUUID); total > 0 {
+			e.GPUFraction = float64(p.UsedMemory) / float64(total)
+		}
+
+		// As elsewhere, an idle process is taken to have been idle since it
+		// started
+		if e.Idle = m.classifyIdle(p, state); e.Idle {
+			if start, err := state.processStartTime(p.PID); err == nil {
+				e.IdleSeconds = int64(now.Sub(start) / time.Second)
+			}
+		}
+		held := e.GPUFraction
+		if e.GPUShare < 1 {
+			held = e.GPUShare
+		}
+		e.Score = float64(e.IdleSeconds) * held
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Score > entries[j].Score })
+	return entries, nil
+}
+
+// writeWasteTable writes ranked processes as a human readable table.
+func writeWasteTable(w io.Writer, entries []wasteEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCORE\tPID\tPROCESS\tUSER\tCONTAINER\tJOB\tGPU\tMEMORY\tGPU%\tSHARE\tIDLE")
+	for _, e := range entries {
+		idle := "-"
+		if e.Idle {
+			idle = (time.Duration(e.IdleSeconds) * time.Second).String()
+		}
+		fmt.Fprintf(tw, "%.1f\t%d\t%s\t%s\t%s\t%s\t%s\t%d MB\t%.1f\t%.0f%%\t%s\n",
+			e.Score, e.PID, orDash(e.Process), orDash(e.User), orDash(e.Container), orDash(e.Job), e.GPU, e.UsedMemory, e.GPUFraction*100, e.GPUShare*100, idle)
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreviewScoresIdleTimeByShareHeld(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-3 * time.Hour)})
+	e.addProcess(fakeProcess{PID: 1003, PPID: 1, Comm: "python", Start: testEpoch.Add(-3 * time.Hour)})
+	e.write(filepath.Join(e.proc, "1003", "environ"), "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE=25\x00")
+	// Half, a fifth and none of the GPU's 40960 MB, the last with a quarter of
+	// it through MPS
+	e.gpuProcesses("1001, 20480", "1002, 8192", "1003, 0")
+	cfg := e.config()
+	cfg.IdleExpr = "used_memory >= 0"
+	m := e.monitor(cfg)
+
+	entries, err := m.preview()
+	if err != nil {
+		t.Fatalf("preview: %v", err)
+	}
+	want := []struct {
+		pid   int
+		score float64
+	}{
+		{1003, 3 * 3600 * 0.25},
+		{1002, 3 * 3600 * 0.2},
+		{1001, 3600 * 0.5},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		if got := entries[i]; got.PID != w.pid || got.Score < w.score-0.001 || got.Score > w.score+0.001 {
+			t.Errorf("entry %d = PID %d scoring %v, want PID %d scoring %v", i, got.PID, got.Score, w.pid, w.score)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultProcRoot = "/proc"
+
+// procRoot is where process information is read from. It can point at the
+// host's /proc mounted into a container, in which case processes are inspected
+// directly rather than through ps.
+var procRoot = defaultProcRoot
+
+// clockTicks is the kernel's USER_HZ, which /proc/<pid>/stat times are
+// expressed in. It is 100 on all mainstream Linux architectures.
+const clockTicks = 100
+
+func procPath(pid int, name string) string {
+	return filepath.Join(procRoot, strconv.Itoa(pid), name)
+}
+
+// readStat returns the fields of /proc/<pid>/stat following the command name,
+// so that index 0 is the process state.
+func readStat(pid int) ([]string, error) {
+	data, err := os.ReadFile(procPath(pid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name is wrapped in parentheses and may itself contain spaces or
+	// parentheses, so the remaining fields are taken from after the last ')'.
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return nil, os.ErrInvalid
+	}
+	return fields, nil
+}
+
+// readPPID returns the parent PID of a process as reported by /proc/<pid>/stat.
+func readPPID(pid int) (int, error) {
+	fields, err := readStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// processState returns the state of a process from /proc/<pid>/stat, such as R
+// for running or D for uninterruptible sleep.
+func processState(pid int) (string, error) {
+	fields, err := readStat(pid)
+	if err != nil {
+		return "", err
+	}
+	return fields[0], nil
+}
+
+// processExists reports whether a PID is visible under procRoot.
+func processExists(pid int) bool {
+	_, err := os.Stat(filepath.Join(procRoot, strconv.Itoa(pid)))
+	return err == nil
+}
+
+// processComm returns the command name of a process.
+func processComm(pid int) (string, error) {
+	if procRoot == defaultProcRoot {
+		out, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "comm=").Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	data, err := os.ReadFile(procPath(pid, "comm"))
+	return strings.TrimSpace(string(data)), err
+}
+
+// commLen is the longest command name the kernel keeps for a process, longer
+// names are truncated to it.
+const commLen = 15
+
+// fullProcessName returns the untruncated name of a process given its command
+// name. A command name of the maximum length may have been truncated, e.g.
+// python3.11-train becomes python3.11-trai, in which case the basename of
+// argv[0] from /proc/<pid>/cmdline is used if it extends the command name.
+func fullProcessName(pid int, comm string) string {
+	if len(comm) < commLen {
+		return comm
+	}
+	data, err := os.ReadFile(procPath(pid, "cmdline"))
+	if err != nil {
+		return comm
+	}
+	argv0, _, _ := strings.Cut(string(data), "\x00")
+	if name := filepath.Base(argv0); strings.HasPrefix(name, comm) {
+		return name
+	}
+	return comm
+}
+
+// matchesName reports whether a process name is in a list of names. A name
+// that may have been truncated also matches longer names it's the start of,
+// for when the full name couldn't be found.
+func matchesName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name || (len(name) == commLen && len(n) > commLen && n[:commLen] == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identities of a process that -targetWorkloads and -whitelist entries are
+// matched against, for logging which one matched.
+const (
+	matchedByComm    = "command name"
+	matchedByCmdline = "command line" // when the command name was truncated
+	matchedByPath    = "executable path"
+)
+
+// isPathEntry reports whether a -targetWorkloads or -whitelist entry is an
+// executable path, such as /opt/conda/envs/bad/bin/python, matched against a
+// process's executable rather than its name. Any absolute path is one.
+func isPathEntry(entry string) bool {
+	return strings.HasPrefix(entry, "/")
+}
+
+// hasPathEntry reports whether any of the entries is an executable path.
+func hasPathEntry(entries []string) bool {
+	for _, entry := range entries {
+		if isPathEntry(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// processExe returns the path of a process's executable, with any symlinks
+// already resolved by the kernel. An executable that has been replaced or
+// removed since the process started is reported with a " (deleted)" suffix,
+// which is dropped.
+func processExe(pid int) (string, error) {
+	exe, err := os.Readlink(procPath(pid, "exe"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// matchProcess returns the first of a list of names and executable paths that
+// a process matches, along with which of its identities matched. Names are
+// matched as matchesName does; paths are matched against its executable, as
+// given or with symlinks resolved, so /opt/conda/envs/bad/bin/python also
+// matches the python3.11 it links to. exe may be empty if it's unknown, in
+// which case no path matches.
+func matchProcess(entries []string, name, exe string) (entry, identity string) {
+	for _, e := range entries {
+		if isPathEntry(e) {
+			if exe == "" {
+				continue
+			}
+			if e == exe {
+				return e, matchedByPath
+			}
+			if resolved, err := filepath.EvalSymlinks(e); err == nil && resolved == exe {
+				return e, matchedByPath
+			}
+			continue
+		}
+		if matchesName([]string{e}, name) {
+			if len(name) > commLen {
+				return e, matchedByCmdline
+			}
+			return e, matchedByComm
+		}
+	}
+	return "", ""
+}
+
+// processStartTime returns when a process was started.
+func processStartTime(pid int) (time.Time, error) {
+	if procRoot == defaultProcRoot {
+		out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(string(out)), time.Local)
+	}
+
+	fields, err := readStat(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	startTicks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(startTicks) * time.Second / clockTicks), nil
+}
+
+// nodeUptime returns how long the system has been up, from /proc/uptime.
+func nodeUptime() (time.Duration, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, "uptime"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("no uptime in " + filepath.Join(procRoot, "uptime"))
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// bootTime returns when the system booted, from the btime line of /proc/stat.
+func bootTime() (time.Time, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if btime, ok := strings.CutPrefix(line, "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(btime), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("btime not found in " + filepath.Join(procRoot, "stat"))
+}
+
+// selfPID returns nvidler's own PID as seen from procRoot, which differs from
+// os.Getpid when procRoot is the host's /proc and nvidler runs in a container.
+func selfPID() int {
+	if target, err := os.Readlink(filepath.Join(procRoot, "self")); err == nil {
+		if pid, err := strconv.Atoi(target); err == nil {
+			return pid
+		}
+	}
+	return os.Getpid()
+}
+
+// selfProcesses returns the PIDs of nvidler itself, of any other process
+// running the same executable, such as a second instance, and of every process
+// descended from either, each with why it's protected. These are never
+// candidates for warning or termination, regardless of how they are named or
+// whitelisted. The executable is compared by device and inode rather than by
+// name or path, so a copy renamed like a target workload, or one reached
+// through a different path, is still recognised.
+func selfProcesses() map[int]string {
+	self := selfPID()
+	protected := map[int]string{self: "is nvidler itself"}
+
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return protected
+	}
+
+	exe, exeErr := os.Stat(procPath(self, "exe"))
+	parents := make(map[int]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if exeErr == nil && pid != self {
+			if info, err := os.Stat(procPath(pid, "exe")); err == nil && os.SameFile(exe, info) {
+				protected[pid] = "runs nvidler's own executable"
+			}
+		}
+		ppid, err := readPPID(pid)
+		if err != nil {
+			continue
+		}
+		parents[pid] = ppid
+	}
+
+	// Keep sweeping until no new descendants are found, as /proc isn't ordered
+	// by ancestry.
+	for found := true; found; {
+		found = false
+		for pid, ppid := range parents {
+			if protected[pid] == "" && protected[ppid] != "" {
+				protected[pid] = fmt.Sprintf("is descended from nvidler (PID %d)", ppid)
+				found = true
+			}
+		}
+	}
+
+	return protected
+}
+
+// processOwner returns the name of the user owning a process, resolved from the
+// real UID in /proc/<pid>/status. The numeric UID is returned when it has no
+// corresponding user.
+func processOwner(pid int) (string, error) {
+	data, err := os.ReadFile(procPath(pid, "status"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Uid:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Uid:"))
+		if len(fields) == 0 {
+			break
+		}
+		return userName(fields[0]), nil
+	}
+	return "", os.ErrInvalid
+}
+
+// userName returns the name of the user with a UID, or the UID itself if it
+// can't be resolved.
+func userName(uid string) string {
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// psInfo is what a batched ps call returns for each process.
+type psInfo struct {
+	Comm  string
+	Start time.Time
+	Owner string
+}
+
+// psBatch looks up the name, start time and owner of many processes with a
+// single ps call, rather than one per process. PIDs that have exited are left
+// out of the result.
+func psBatch(pids []int) (map[int]psInfo, error) {
+	if len(pids) == 0 {
+		return nil, nil
+	}
+	list := make([]string, len(pids))
+	for i, pid := range pids {
+		list[i] = strconv.Itoa(pid)
+	}
+
+	// comm goes last as it may contain spaces, whereas lstart is always five
+	// fields
+	out, err := exec.Command("ps", "-o", "pid=,ruid=,lstart=,comm=", "-p", strings.Join(list, ",")).Output()
+	if err != nil && len(out) == 0 {
+		// ps exits non-zero when none of the PIDs exist any more
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	info := make(map[int]psInfo, len(pids))
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		start, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.Join(fields[2:7], " "), time.Local)
+		if err != nil {
+			continue
+		}
+		info[pid] = psInfo{
+			Comm:  strings.Join(fields[7:], " "),
+			Start: start,
+			Owner: userName(fields[1]),
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfProcessesIncludesDescendants(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 200, PPID: testSelfPID, Comm: "sh"})
+	e.addProcess(fakeProcess{PID: 300, PPID: 200, Comm: "python"})
+	e.addProcess(fakeProcess{PID: 400, PPID: 1, Comm: "python"})
+
+	protected := selfProcesses()
+	for _, pid := range []int{testSelfPID, 200, 300} {
+		if protected[pid] == "" {
+			t.Errorf("PID %d isn't protected, want nvidler and its descendants protected", pid)
+		}
+	}
+	if reason, ok := protected[400]; ok {
+		t.Errorf("unrelated PID 400 is protected: %s", reason)
+	}
+}
+
+func TestScanNeverActsOnOwnProcesses(t *testing.T) {
+	e := newTestEnv(t)
+	// nvidler itself and a child it spawned, named and idle like a target
+	e.addProcess(fakeProcess{PID: 200, PPID: testSelfPID, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses(strconv.Itoa(testSelfPID)+", 0", "200, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = append(cfg.TargetWorkloads, "nvidler")
+	cfg.Whitelist = nil
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v, want nvidler's own processes left alone", got)
+	}
+	if got := e.actions(); got != nil {
+		t.Fatalf("events = %v, want none about nvidler's own processes", got)
+	}
+}
+
+func TestFullProcessName(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 200, PPID: 1, Comm: "python3.11-train", Argv: []string{"/opt/bin/python3.11-train", "--epochs", "10"}})
+	e.addProcess(fakeProcess{PID: 201, PPID: 1, Comm: "python3.11-train", Argv: []string{"/usr/bin/python3", "train.py"}})
+	e.addProcess(fakeProcess{PID: 202, PPID: 1, Comm: "python3", Argv: []string{"/usr/bin/python3-wrapper"}})
+
+	tests := []struct {
+		pid  int
+		want string
+	}{
+		{200, "python3.11-train"}, // argv[0] extends the truncated name
+		{201, "python3.11-trai"},  // argv[0] is something else
+		{202, "python3"},          // short names are never truncated
+	}
+	for _, tt := range tests {
+		comm, err := processComm(tt.pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fullProcessName(tt.pid, comm); got != tt.want {
+			t.Errorf("fullProcessName(%d, %q) = %q, want %q", tt.pid, comm, got, tt.want)
+		}
+	}
+	if got := fullProcessName(999, "python3.11-trai"); got != "python3.11-trai" {
+		t.Errorf("fullProcessName of a process without a cmdline = %q, want the command name", got)
+	}
+}
+
+func TestMatchesTruncatedName(t *testing.T) {
+	names := []string{"python", "python3.11-train"}
+	for name, want := range map[string]bool{
+		"python3.11-train": true,
+		"python3.11-trai":  true,  // possibly truncated, the start of a longer entry
+		"python3.11-tra":   false, // too short to have been truncated
+		"python3.11-xxxx":  false,
+		"python":           true,
+	} {
+		if got := matchesName(names, name); got != want {
+			t.Errorf("matchesName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestScanMatchesLongBinaryName(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python3.11-train", Argv: []string{"/opt/bin/python3.11-train"}, Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{"python3.11-train"}
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v for a target longer than the kernel keeps", got, want)
+	}
+}
+
+func TestSelfProcessesIncludesSameExecutable(t *testing.T) {
+	e := newTestEnv(t)
+	exe := filepath.Join(e.dir, "usr", "bin", "nvidler")
+	link := filepath.Join(e.dir, "opt", "nvidler")
+	copied := filepath.Join(e.dir, "home", "nvidler")
+	for _, path := range []string{exe, copied} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		e.writeScript(path, "exit 0")
+	}
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(exe, link); err != nil {
+		t.Fatal(err)
+	}
+	e.addProcess(fakeProcess{PID: testSelfPID, PPID: 1, Comm: "nvidler", Start: testEpoch.Add(-time.Hour), Exe: exe})
+	// Another instance, one started through a hard link to the same file, and
+	// an identical copy of it that's a different file
+	e.addProcess(fakeProcess{PID: 300, PPID: 1, Comm: "nvidler", Start: testEpoch.Add(-time.Hour), Exe: exe})
+	e.addProcess(fakeProcess{PID: 301, PPID: 1, Comm: "nvidler", Start: testEpoch.Add(-time.Hour), Exe: link})
+	e.addProcess(fakeProcess{PID: 302, PPID: 1, Comm: "nvidler", Start: testEpoch.Add(-time.Hour), Exe: copied})
+
+	protected := selfProcesses()
+	for _, pid := range []int{300, 301} {
+		if protected[pid] != "runs nvidler's own executable" {
+			t.Errorf("PID %d = %q, want it protected for running nvidler's own executable", pid, protected[pid])
+		}
+	}
+	if reason, ok := protected[302]; ok {
+		t.Errorf("PID 302, running a copy of nvidler, is protected: %s", reason)
+	}
+
+	// The protection can't be overridden by targeting nvidler by name
+	e.gpuProcesses(strconv.Itoa(testSelfPID)+", 0", "300, 0", "301, 0", "302, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{"nvidler"}
+	cfg.Whitelist = nil
+	m := e.monitor(cfg)
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 302"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v, leaving nvidler and processes running its executable alone", got, want)
+	}
+}
+
+// condaPythons makes two python executables under dir, the one in the bad
+// environment reached through a python symlink as conda does, returning the
+// symlink and the real files.
+func condaPythons(t *testing.T, e *testEnv) (badLink, bad, good string) {
+	t.Helper()
+	for _, env := range []string{"bad", "good"} {
+		bin := filepath.Join(e.dir, "conda", "envs", env, "bin")
+		if err := os.MkdirAll(bin, 0755); err != nil {
+			t.Fatal(err)
+		}
+		e.writeScript(filepath.Join(bin, "python3.11"), "exit 0")
+		if err := os.Symlink("python3.11", filepath.Join(bin, "python")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bin := filepath.Join(e.dir, "conda", "envs")
+	return filepath.Join(bin, "bad", "bin", "python"), filepath.Join(bin, "bad", "bin", "python3.11"), filepath.Join(bin, "good", "bin", "python3.11")
+}
+
+func TestMatchProcessByPath(t *testing.T) {
+	e := newTestEnv(t)
+	badLink, bad, good := condaPythons(t, e)
+
+	tests := []struct {
+		entries      []string
+		name, exe    string
+		wantEntry    string
+		wantIdentity string
+	}{
+		{[]string{bad}, "python3.11", bad, bad, matchedByPath},
+		{[]string{badLink}, "python3.11", bad, badLink, matchedByPath}, // resolved to what it links to
+		{[]string{badLink}, "python3.11", good, "", ""},
+		{[]string{badLink}, "python3.11", "", "", ""}, // the executable couldn't be read
+		{[]string{"python3.11"}, "python3.11", good, "python3.11", matchedByComm},
+		{[]string{"python3.11-train"}, "python3.11-train", good, "python3.11-train", matchedByCmdline},
+		{[]string{badLink, "python3.11"}, "python3.11", good, "python3.11", matchedByComm},
+	}
+	for _, tt := range tests {
+		entry, identity := matchProcess(tt.entries, tt.name, tt.exe)
+		if entry != tt.wantEntry || identity != tt.wantIdentity {
+			t.Errorf("matchProcess(%q, %q, %q) = %q, %q, want %q, %q", tt.entries, tt.name, tt.exe, entry, identity, tt.wantEntry, tt.wantIdentity)
+		}
+	}
+}
+
+func TestScanMatchesExecutablePaths(t *testing.T) {
+	e := newTestEnv(t)
+	badLink, bad, good := condaPythons(t, e)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Exe: bad})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Exe: good})
+	e.gpuProcesses("1001, 0", "1002, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{badLink}
+	cfg.Whitelist = nil
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals targeting %s = %v, want %v, not the other python", badLink, got, want)
+	}
+	if want := "PID 1001 (python) is targeted by -targetWorkloads entry " + badLink + ", matched by its executable path."; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+
+	// Likewise a path exempts only that executable
+	e = newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Exe: bad})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour), Exe: good})
+	e.gpuProcesses("1001, 0", "1002, 0")
+	cfg = e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{"python"}
+	cfg.Whitelist = []string{good}
+	m = e.monitor(cfg)
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals whitelisting %s = %v, want %v", good, got, want)
+	}
+	if want := "Skipping PID 1002 (python): whitelisted by -whitelist entry " + good + ", matched by its executable path."; !strings.Contains(e.log.String(), want) {
+		t.Errorf("log doesn't say %q:\n%s", want, e.log.String())
+	}
+}
+
+// benchmarkProcesses is how many GPU processes the ps benchmarks look up, a
+// busy multi-GPU node.
+const benchmarkProcesses = 32
+
+// fakePs adds processes to the fake /proc and a ps answering the queries
+// nvidler makes from it, returning their PIDs. ps is only run for the real
+// /proc, so the benchmarks point procRoot back at it while they run.
+func fakePs(b *testing.B) []int {
+	b.Helper()
+	e := newTestEnv(b)
+	var pids []int
+	for i := 0; i < benchmarkProcesses; i++ {
+		pid := 1001 + i
+		e.addProcess(fakeProcess{PID: pid, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+		pids = append(pids, pid)
+	}
+	// Only shell builtins, so the cost is running ps rather than what it runs
+	e.writeScript(filepath.Join(e.dir, "bin", "ps"), fmt.Sprintf(`proc=%q
+case "$2" in
+pid=,ruid=,lstart=,comm=)
+	IFS=,
+	for pid in $4; do
+		[ -f "$proc/$pid/comm" ] && read -r comm < "$proc/$pid/comm" && echo "$pid 0 Mon Mar  4 11:00:00 2024 $comm"
+	done ;;
+lstart=)
+	echo "Mon Mar  4 11:00:00 2024" ;;
+*)
+	read -r comm < "$proc/$2/comm" && echo "$comm" ;;
+esac`, e.proc))
+	procRoot = defaultProcRoot
+	return pids
+}
+
+func BenchmarkPsBatch(b *testing.B) {
+	pids := fakePs(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		info, err := psBatch(pids)
+		if err != nil || len(info) != len(pids) {
+			b.Fatalf("psBatch = %d processes, %v, want %d", len(info), err, len(pids))
+		}
+	}
+}
+
+// BenchmarkPsPerPID is the baseline for BenchmarkPsBatch: the name, start time
+// and owner of each process looked up on its own, as without -batchPs.
+func BenchmarkPsPerPID(b *testing.B) {
+	pids := fakePs(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, pid := range pids {
+			if _, err := processComm(pid); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := processStartTime(pid); err != nil {
+				b.Fatal(err)
+			}
+			// The owner is read from the real /proc, where these PIDs may not
+			// exist, but that costs next to nothing beside running ps
+			processOwner(pid)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mpsServerName is the NVIDIA Multi-Process Service server. Under MPS it owns
+// the GPU contexts of its clients, so on GPUs where clients aren't listed
+// separately by nvidia-smi the memory it reports is theirs.
+const mpsServerName = "nvidia-cuda-mps-server"
+
+// neverKill lists processes that are never warned about or terminated,
+// regardless of the target workloads and whitelist. Terminating the MPS daemons
+// would take down every client sharing the GPU through them.
+var neverKill = []string{
+	"nvidia-cuda-mps-control",
+	mpsServerName,
+	"nvidia-persistenced",
+}
+
+// neverKilled returns which of the neverKill daemons a process is, or "" if
+// it's none of them. It's matched on the full name of its executable, as
+// command names are truncated to 15 characters, nvidia-cuda-mps-control and
+// nvidia-cuda-mps-server both becoming nvidia-cuda-mps, and a process can set
+// its own. Only if the executable can't be read is the process's name, with any
+// truncation undone by fullProcessName, matched instead.
+func neverKilled(pid int, name string) string {
+	if exe, err := processExe(pid); err == nil {
+		name = filepath.Base(exe)
+	}
+	if contains(neverKill, name) {
+		return name
+	}
+	return ""
+}
+
+// oomScoreAdj reads a process's oom_score_adj, from -1000, which the kernel's
+// OOM killer never picks, to 1000, which it picks first.
+func oomScoreAdj(pid int) (int, error) {
+	data, err := os.ReadFile(procPath(pid, "oom_score_adj"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScanUnderMPS(t *testing.T) {
+	e := newTestEnv(t)
+	started := testEpoch.Add(-time.Hour)
+	e.addProcess(fakeProcess{PID: 2000, PPID: 1, Comm: "nvidia-cuda-mps-control", Exe: "/usr/bin/nvidia-cuda-mps-control", Start: started})
+	e.addProcess(fakeProcess{PID: 2001, PPID: 2000, Comm: mpsServerName, Exe: "/usr/bin/nvidia-cuda-mps-server", Start: started})
+	e.addProcess(fakeProcess{PID: 2002, PPID: 1, Comm: "python", Exe: "/usr/bin/python3", Start: started})
+	// A process that has set its command name to look like an MPS daemon
+	e.addProcess(fakeProcess{PID: 2003, PPID: 1, Comm: "nvidia-cuda-mps", Argv: []string{"worker"}, Exe: "/usr/bin/python3", Start: started})
+
+	// On Volta and newer nvidia-smi lists the MPS server and each client, the
+	// client with its own memory
+	e.gpuProcesses("2001, 0", "2002, 0", "2003, 0")
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{"python", "/usr/bin/python3", "nvidia-cuda-mps-server"}
+	m := e.monitor(cfg)
+
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 2002", "-s TERM 2003"}; !equalStrings(got, want) {
+		t.Fatalf("signals = %v, want %v: the idle clients terminated but never the MPS server", got, want)
+	}
+}
+
+func TestNeverKilledFallsBackToFullName(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 2001, PPID: 1, Comm: mpsServerName})
+	e.addProcess(fakeProcess{PID: 2002, PPID: 1, Comm: "nvidia-cuda-mps", Argv: []string{"worker"}})
+
+	if got := neverKilled(2001, fullProcessName(2001, "nvidia-cuda-mps")); got != mpsServerName {
+		t.Errorf("neverKilled for the MPS server without an executable = %q, want %q", got, mpsServerName)
+	}
+	if got := neverKilled(2002, fullProcessName(2002, "nvidia-cuda-mps")); got != "" {
+		t.Errorf("neverKilled for a truncated name of unknown origin = %q, want none", got)
+	}
+}
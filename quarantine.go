@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Quarantine actions for -quarantineAction.
+const (
+	quarantineRenice      = "renice"
+	quarantineCgroupLimit = "cgroup-limit"
+)
+
+// quarantineNice is the nice value a quarantined process is lowered to.
+const quarantineNice = 19
+
+// quarantineCPUMax is the cpu.max a quarantined process's cgroup is limited
+// to: 5% of one CPU.
+const quarantineCPUMax = "5000 100000"
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// quarantinedProcess is an idle process that has been quarantined rather than
+// terminated, with what's needed to restore it.
+type quarantinedProcess struct {
+	c      candidate
+	since  time.Time
+	nice   int    // its nice value before it was reniced
+	cgroup string // the cgroup that was limited
+}
+
+// quarantine tracks the processes quarantined by -quarantineAction, so they
+// can be restored once they're active again. A cgroup is limited while any of
+// its processes are quarantined, and restored once the last is released.
+type quarantine struct {
+	processes map[int]*quarantinedProcess
+	cpuMax    map[string]string // original cpu.max by limited cgroup
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{processes: make(map[int]*quarantinedProcess), cpuMax: make(map[string]string)}
+}
+
+// list returns the quarantined PIDs in order.
+func (q *quarantine) list() []int {
+	pids := make([]int, 0, len(q.processes))
+	for pid := range q.processes {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// quarantine lowers the priority of an idle process due for termination
+// instead of terminating it. A process already quarantined is left as it is.
+func (m *monitor) quarantine(c candidate) {
+	if _, ok := m.quarantined.processes[c.PID]; ok {
+		return
+	}
+	q := &quarantinedProcess{c: c, since: m.clock.Now()}
+	var err error
+	var detail string
+	switch m.cfg.QuarantineAction {
+	case quarantineRenice:
+		detail, err = q.renice()
+	case quarantineCgroupLimit:
+		detail, err = m.quarantined.limit(q)
+	}
+	if err != nil {
+		m.events.emit(c.event(actionError, fmt.Sprintf("Failed to quarantine process %d (%s): %v", c.PID, c.Name, err)))
+		return
+	}
+	m.quarantined.processes[c.PID] = q
+	m.events.emit(c.event(actionQuarantine, fmt.Sprintf("Quarantined: Process %d (%s) in Docker container %s %s, %s rather than terminating it. It's restored once it's active again.%s", c.PID, c.Name, c.Container, m.idleDescription(c), detail, c.jobNote())))
+}
+
+// renice lowers a process's CPU priority, remembering its nice value.
+func (q *quarantinedProcess) renice() (string, error) {
+	fields, err := readStat(q.c.PID)
+	if err != nil {
+		return "", err
+	}
+	if q.nice, err = strconv.Atoi(fields[16]); err != nil {
+		return "", err
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, q.c.PID, quarantineNice); err != nil {
+		return "", fmt.Errorf("failed to renice it: %v", err)
+	}
+	return fmt.Sprintf("reniced from %d to %d", q.nice, quarantineNice), nil
+}
+
+// limit limits the CPU of a process's cgroup, remembering its original limit
+// if it's the first of the cgroup's processes to be quarantined. Only cgroup
+// v2 is supported, and the root cgroup and systemd slices are never limited,
+// as they hold unrelated processes.
+func (qs *quarantine) limit(q *quarantinedProcess) (string, error) {
+	group, err := processCgroup(q.c.PID)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(group, ":") {
+		return "", fmt.Errorf("it's in cgroup v1 hierarchy %s, only cgroup v2 can be limited", group)
+	}
+	if !reapableCgroup(group) {
+		return "", fmt.Errorf("its cgroup %s holds unrelated processes, so it isn't limited", group)
+	}
+
+	q.cgroup = group
+	if _, ok := qs.cpuMax[group]; ok {
+		return fmt.Sprintf("kept under the limit already on its cgroup %s", group), nil
+	}
+	path := filepath.Join(cgroupRoot, group, "cpu.max")
+	original, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%s doesn't exist, the cpu controller must be enabled for its cgroup %s on cgroup v2", path, group)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(quarantineCPUMax), 0644); err != nil {
+		return "", fmt.Errorf("failed to limit its cgroup %s: %v", group, err)
+	}
+	qs.cpuMax[group] = strings.TrimSpace(string(original))
+	return fmt.Sprintf("limited its cgroup %s to cpu.max %s", group, quarantineCPUMax), nil
+}
+
+// releaseQuarantined restores every quarantined process that's no longer idle,
+// and forgets those that have exited.
+func (m *monitor) releaseQuarantined(candidates []candidate) {
+	idle := make(map[int]bool, len(candidates))
+	for _, c := range candidates {
+		idle[c.PID] = true
+	}
+	for _, pid := range m.quarantined.list() {
+		if idle[pid] {
+			continue
+		}
+		q := m.quarantined.processes[pid]
+		delete(m.quarantined.processes, pid)
+
+		if _, err := os.Stat(procPath(pid, "stat")); errors.Is(err, fs.ErrNotExist) {
+			m.logger.Printf("Quarantined process %d (%s) has exited.\n", pid, q.c.Name)
+			if _, err := m.quarantined.unlimit(q); err != nil {
+				m.logger.Printf("Failed to restore the limit of cgroup %s: %v\n", q.cgroup, err)
+			}
+			continue
+		}
+		detail, err := m.quarantined.restore(q)
+		if err != nil {
+			m.events.emit(q.c.event(actionError, fmt.Sprintf("Failed to release quarantined process %d (%s): %v", pid, q.c.Name, err)))
+			continue
+		}
+		m.events.emit(q.c.event(actionRelease, fmt.Sprintf("Released: Process %d (%s) in Docker container %s is no longer idle after %v in quarantine, %s.", pid, q.c.Name, q.c.Container, m.clock.Now().Sub(q.since).Truncate(time.Second), detail)))
+	}
+}
+
+// restore undoes a process's quarantine.
+func (qs *quarantine) restore(q *quarantinedProcess) (string, error) {
+	if q.cgroup != "" {
+		return qs.unlimit(q)
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, q.c.PID, q.nice); err != nil {
+		return "", fmt.Errorf("failed to renice it back to %d: %v", q.nice, err)
+	}
+	return fmt.Sprintf("reniced back to %d", q.nice), nil
+}
+
+// unlimit restores a cgroup's original limit once none of its processes are
+// quarantined.
+func (qs *quarantine) unlimit(q *quarantinedProcess) (string, error) {
+	if q.cgroup == "" {
+		return "", nil
+	}
+	for _, other := range qs.processes {
+		if other.cgroup == q.cgroup {
+			return fmt.Sprintf("its cgroup %s stays limited for its other quarantined processes", q.cgroup), nil
+		}
+	}
+	original := qs.cpuMax[q.cgroup]
+	delete(qs.cpuMax, q.cgroup)
+	if err := os.WriteFile(filepath.Join(cgroupRoot, q.cgroup, "cpu.max"), []byte(original), 0644); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to restore cpu.max %s of its cgroup %s: %v", original, q.cgroup, err)
+	}
+	return fmt.Sprintf("restored its cgroup %s to cpu.max %s", q.cgroup, original), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseReclaimTargets parses the -reclaimTargetMB flag, either a single value
+// applying to every GPU or comma-separated <gpu>=<MB> pairs, where GPUs are
+// referenced by index or UUID. The returned map is keyed by GPU reference, with
+// "*" holding the value for all GPUs.
+func parseReclaimTargets(spec string) (map[string]int, error) {
+	targets := make(map[string]int)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		gpu, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			gpu, value = "*", entry
+		}
+		gpu = strings.TrimSpace(gpu)
+		if gpu != "*" && !isGPURef(gpu) {
+			return nil, fmt.Errorf("invalid GPU %q, expected an index or UUID", gpu)
+		}
+
+		mb, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("invalid target %q for GPU %s", value, gpu)
+		}
+		targets[gpu] = mb
+	}
+	return targets, nil
+}
+
+// reclaimTarget returns the free memory target for a GPU, or 0 if it has none.
+// A target set by UUID takes precedence over one set by index.
+func reclaimTarget(targets map[string]int, gpu gpuInfo) int {
+	if mb, ok := targets[gpu.UUID]; ok {
+		return mb
+	}
+	if mb, ok := targets[strconv.Itoa(gpu.Index)]; ok {
+		return mb
+	}
+	return targets["*"]
+}
+
+// reclaimOrders are the orders candidates can be chosen in to meet a reclaim
+// target.
+var reclaimOrders = []string{"largest", "smallest", "oldest", "newest"}
+
+// sortCandidates sorts candidates into the order they're chosen in: largest or
+// smallest memory use first, or the oldest or newest processes first.
+func sortCandidates(candidates []candidate, order string) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch order {
+		case "smallest":
+			return a.UsedMemory < b.UsedMemory
+		case "oldest":
+			return a.StartTime.Before(b.StartTime)
+		case "newest":
+			return a.StartTime.After(b.StartTime)
+		default:
+			return a.UsedMemory > b.UsedMemory
+		}
+	})
+}
+
+// planReclaim decides which idle candidates should be terminated. On GPUs with
+// a reclaim target, candidates are chosen in the given order until free memory
+// reaches the target, and none are if the target is already met. Candidates on
+// other GPUs are all chosen, while those on GPUs whose free memory couldn't be
+// determined are spared.
+func planReclaim(candidates []candidate, targets map[string]int, order string, gpus []gpuInfo, logger *log.Logger) map[int]bool {
+	terminate := make(map[int]bool)
+	if len(targets) == 0 {
+		for _, c := range candidates {
+			terminate[c.PID] = true
+		}
+		return terminate
+	}
+
+	byGPU := make(map[string][]candidate)
+	for _, c := range candidates {
+		byGPU[c.GPUUUID] = append(byGPU[c.GPUUUID], c)
+	}
+
+	gpusByUUID := make(map[string]gpuInfo)
+	for _, gpu := range gpus {
+		gpusByUUID[gpu.UUID] = gpu
+	}
+
+	for uuid, group := range byGPU {
+		gpu, ok := gpusByUUID[uuid]
+		if !ok {
+			logger.Printf("Reclaim: no memory information for GPU %s; sparing %d idle process(es).\n", uuid, len(group))
+			continue
+		}
+		target := reclaimTarget(targets, gpu)
+		if target == 0 {
+			for _, c := range group {
+				terminate[c.PID] = true
+			}
+			continue
+		}
+
+		if gpu.MemoryFree >= target {
+			logger.Printf("Reclaim: GPU %d has %d MB free, meeting its target of %d MB; sparing %d idle process(es).\n", gpu.Index, gpu.MemoryFree, target, len(group))
+			continue
+		}
+
+		sortCandidates(group, order)
+
+		free := gpu.MemoryFree
+		for _, c := range group {
+			if free >= target {
+				logger.Printf("Reclaim: sparing PID %d (%d MB) on GPU %d, target of %d MB reached.\n", c.PID, c.UsedMemory, gpu.Index, target)
+				continue
+			}
+			free += c.UsedMemory
+			terminate[c.PID] = true
+			logger.Printf("Reclaim: selected PID %d (%s, %d MB, started %s) on GPU %d, next by -reclaimOrder %s; %d of %d MB target free after termination.\n", c.PID, c.Name, c.UsedMemory, c.StartTime.Format(time.RFC3339), gpu.Index, order, free, target)
+		}
+		if free < target {
+			logger.Printf("Reclaim: GPU %d can only reach %d of its %d MB target by terminating every idle process.\n", gpu.Index, free, target)
+		}
+	}
+
+	return terminate
+}
+
+// planContainerStops groups candidates by container for the "all" container
+// idle policy. A container is returned to be stopped when every one of its GPU
+// processes is idle and due to be terminated; otherwise none of its processes
+// are terminated. Candidates not in a container are unaffected.
+func planContainerStops(candidates []candidate, terminate map[int]bool, gpuPIDsByContainer map[string][]int, logger *log.Logger) map[string][]candidate {
+	idle := make(map[string][]candidate)
+	for _, c := range candidates {
+		if c.ContainerID != "" {
+			idle[c.ContainerID] = append(idle[c.ContainerID], c)
+		}
+	}
+
+	stop := make(map[string][]candidate)
+	for id, members := range idle {
+		name := members[0].Container
+		total := len(gpuPIDsByContainer[id])
+
+		eligible := 0
+		for _, c := range members {
+			if terminate[c.PID] {
+				eligible++
+			}
+			delete(terminate, c.PID)
+		}
+
+		switch {
+		case len(members) < total:
+			logger.Printf("Container %s: %d of %d GPU processes idle, leaving it running.\n", name, len(members), total)
+		case eligible < total:
+			logger.Printf("Container %s: all %d GPU processes idle, but only %d due for termination, leaving it running.\n", name, total, eligible)
+		default:
+			logger.Printf("Container %s: all %d GPU processes idle, stopping it.\n", name, total)
+			stop[id] = members
+		}
+	}
+	return stop
+}
+
+// tooSmallToReclaim reports whether terminating a process would free less GPU
+// memory than -minReclaimableMB, too little to be worth the disruption, logging
+// that it's spared if so.
+func (m *monitor) tooSmallToReclaim(process gpuProcess, processName string, state *scanState) bool {
+	if m.cfg.MinReclaimableMB <= 0 {
+		return false
+	}
+	pid := process.PID
+	if process.UsedMemory < m.cfg.MinReclaimableMB {
+		state.log(pid).Printf("Sparing PID %d (%s): it holds only %d MB on GPU %s, below -minReclaimableMB of %d MB, too little to be worth reclaiming.\n", pid, processName, process.UsedMemory, process.GPUUUID, m.cfg.MinReclaimableMB)
+		state.note(pid, "It holds %d MB, below -minReclaimableMB of %d MB, so it's too small to be worth reclaiming.", process.UsedMemory, m.cfg.MinReclaimableMB)
+		return true
+	}
+	state.note(pid, "It holds %d MB, at least -minReclaimableMB of %d MB.", process.UsedMemory, m.cfg.MinReclaimableMB)
+	return false
+}
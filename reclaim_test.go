@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestPlanReclaimOrders(t *testing.T) {
+	// Sizes and ages are in different orders, so each ordering picks differently
+	idle := func(pid, memory int, age time.Duration) candidate {
+		return candidate{gpuProcess: gpuProcess{PID: pid, UsedMemory: memory, GPUUUID: testGPU}, StartTime: testEpoch.Add(-age)}
+	}
+	candidates := []candidate{
+		idle(1001, 2048, 2*time.Hour),
+		idle(1002, 8192, 150*time.Minute),
+		idle(1003, 1024, 3*time.Hour),
+		idle(1004, 4096, 30*time.Minute),
+	}
+	gpus := []gpuInfo{{Index: 0, UUID: testGPU, MemoryFree: 1024}}
+	// 3000 MB more is needed to reach the target
+	targets := map[string]int{"*": 4024}
+
+	tests := []struct {
+		order string
+		want  []int
+	}{
+		{"largest", []int{1002}},
+		{"smallest", []int{1003, 1001}},
+		{"oldest", []int{1003, 1002}},
+		{"newest", []int{1004}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			terminate := planReclaim(append([]candidate{}, candidates...), targets, tt.order, gpus, log.New(io.Discard, "", 0))
+			if len(terminate) != len(tt.want) {
+				t.Fatalf("terminating %v, want %v", terminate, tt.want)
+			}
+			for _, pid := range tt.want {
+				if !terminate[pid] {
+					t.Errorf("terminating %v, want %v", terminate, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSortCandidates(t *testing.T) {
+	candidates := []candidate{
+		{gpuProcess: gpuProcess{PID: 1, UsedMemory: 200}, StartTime: testEpoch.Add(-time.Hour)},
+		{gpuProcess: gpuProcess{PID: 2, UsedMemory: 300}, StartTime: testEpoch.Add(-3 * time.Hour)},
+		{gpuProcess: gpuProcess{PID: 3, UsedMemory: 100}, StartTime: testEpoch.Add(-2 * time.Hour)},
+	}
+	tests := map[string][]int{
+		"largest":  {2, 1, 3},
+		"smallest": {3, 1, 2},
+		"oldest":   {2, 3, 1},
+		"newest":   {1, 3, 2},
+	}
+	for order, want := range tests {
+		sorted := append([]candidate{}, candidates...)
+		sortCandidates(sorted, order)
+		for i, c := range sorted {
+			if c.PID != want[i] {
+				t.Errorf("-reclaimOrder %s: PID %d at %d, want order %v", order, c.PID, i, want)
+				break
+			}
+		}
+	}
+}
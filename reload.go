@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// reloadDebounce is how long the config file must go unchanged before it's
+// reloaded, so a file being written in several steps is only read once done.
+const reloadDebounce = 500 * time.Millisecond
+
+// keepRestartOnly carries the restart-only settings of the running
+// configuration over to a reloaded one, returning the names of any that were
+// changed in the file.
+func keepRestartOnly(running, reloaded Config) (Config, []string) {
+	var changed []string
+	keep := func(name string, running, reloaded interface{}) {
+		if running != reloaded {
+			changed = append(changed, name)
+		}
+	}
+	keep("logFile", running.LogFile, reloaded.LogFile)
+	keep("mirrorStdout", running.MirrorStdout, reloaded.MirrorStdout)
+	keep("rotateOnStart", running.RotateOnStart, reloaded.RotateOnStart)
+	keep("rotateMinMB", running.RotateMinMB, reloaded.RotateMinMB)
+	keep("splitStreams", running.SplitStreams, reloaded.SplitStreams)
+	keep("lockFile", running.LockFile, reloaded.LockFile)
+	keep("onConflict", running.OnConflict, reloaded.OnConflict)
+	keep("docker", running.DockerEnabled, reloaded.DockerEnabled)
+	keep("dockerHost", running.DockerHost, reloaded.DockerHost)
+	keep("dockerHosts", fmt.Sprint(running.DockerHosts), fmt.Sprint(reloaded.DockerHosts))
+	keep("dockerTLSCACert", running.DockerTLSCACert, reloaded.DockerTLSCACert)
+	keep("dockerTLSCert", running.DockerTLSCert, reloaded.DockerTLSCert)
+	keep("dockerTLSKey", running.DockerTLSKey, reloaded.DockerTLSKey)
+	keep("backend", running.Backend, reloaded.Backend)
+	keep("k8sEvict", running.K8sEvict, reloaded.K8sEvict)
+	keep("k8sNode", running.K8sNode, reloaded.K8sNode)
+	keep("procRoot", running.ProcRoot, reloaded.ProcRoot)
+	keep("smiTimeout", running.SMITimeout, reloaded.SMITimeout)
+	keep("journal", running.Journal, reloaded.Journal)
+	keep("webhookURL", running.WebhookURL, reloaded.WebhookURL)
+	keep("webhookTemplate", running.WebhookTemplate, reloaded.WebhookTemplate)
+	keep("batchTerminations", running.BatchTerminations, reloaded.BatchTerminations)
+	keep("auditDb", running.AuditDB, reloaded.AuditDB)
+	keep("apiAddr", running.APIAddr, reloaded.APIAddr)
+	keep("apiToken", running.APIToken, reloaded.APIToken)
+	keep("watchConfig", running.WatchConfig, reloaded.WatchConfig)
+	keep("telemetryEndpoint", running.TelemetryEndpoint, reloaded.TelemetryEndpoint)
+	keep("selfMemoryLimitMB", running.SelfMemoryLimitMB, reloaded.SelfMemoryLimitMB)
+	keep("selfMaxProcs", running.SelfMaxProcs, reloaded.SelfMaxProcs)
+	keep("diagBufferSize", running.DiagBufferSize, reloaded.DiagBufferSize)
+	keep("diagDumpDir", running.DiagDumpDir, reloaded.DiagDumpDir)
+	keep("diagDumpMaxMB", running.DiagDumpMaxMB, reloaded.DiagDumpMaxMB)
+	keep("shadowConfig", running.ShadowConfig, reloaded.ShadowConfig)
+	keep("shadowLogFile", running.ShadowLogFile, reloaded.ShadowLogFile)
+
+	reloaded.LogFile = running.LogFile
+	reloaded.MirrorStdout = running.MirrorStdout
+	reloaded.RotateOnStart = running.RotateOnStart
+	reloaded.RotateMinMB = running.RotateMinMB
+	reloaded.SplitStreams = running.SplitStreams
+	reloaded.LockFile = running.LockFile
+	reloaded.OnConflict = running.OnConflict
+	reloaded.DockerEnabled = running.DockerEnabled
+	reloaded.DockerHost = running.DockerHost
+	reloaded.DockerHosts = running.DockerHosts
+	reloaded.DockerTLSCACert = running.DockerTLSCACert
+	reloaded.DockerTLSCert = running.DockerTLSCert
+	reloaded.DockerTLSKey = running.DockerTLSKey
+	reloaded.Backend = running.Backend
+	reloaded.K8sEvict = running.K8sEvict
+	reloaded.K8sNode = running.K8sNode
+	reloaded.ProcRoot = running.ProcRoot
+	reloaded.SMITimeout = running.SMITimeout
+	reloaded.Journal = running.Journal
+	reloaded.WebhookURL = running.WebhookURL
+	reloaded.WebhookTemplate = running.WebhookTemplate
+	reloaded.BatchTerminations = running.BatchTerminations
+	reloaded.AuditDB = running.AuditDB
+	reloaded.APIAddr = running.APIAddr
+	reloaded.APIToken = running.APIToken
+	reloaded.WatchConfig = running.WatchConfig
+	reloaded.TelemetryEndpoint = running.TelemetryEndpoint
+	reloaded.SelfMemoryLimitMB = running.SelfMemoryLimitMB
+	reloaded.SelfMaxProcs = running.SelfMaxProcs
+	reloaded.DiagBufferSize = running.DiagBufferSize
+	reloaded.DiagDumpDir = running.DiagDumpDir
+	reloaded.DiagDumpMaxMB = running.DiagDumpMaxMB
+	reloaded.ShadowConfig = running.ShadowConfig
+	reloaded.ShadowLogFile = running.ShadowLogFile
+	return reloaded, changed
+}
+
+// reload reads the config file at path again and switches the monitor over to
+// it, keeping any settings changed through the API. If the file is invalid the
+// running configuration is kept.
+func (m *monitor) reload(path string) {
+	cfg, err := reloadConfigFile()
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		m.logger.Printf("Failed to reload %s, keeping the current configuration:\n%v\n", path, err)
+		return
+	}
+
+	m.mu.Lock()
+	cfg, changed := keepRestartOnly(m.cfg, m.apiOverrides.over(cfg))
+	err = m.apply(cfg)
+	m.mu.Unlock()
+	if err != nil {
+		m.logger.Printf("Failed to reload %s, keeping the current configuration:\n%v\n", path, err)
+		return
+	}
+
+	m.logger.Printf("Reloaded %s: idleTimeThreshold=%d, warningOnly=%v, targetWorkloads=%v, whitelist=%v\n", configSource(path), cfg.IdleTimeThreshold, cfg.WarningOnly, cfg.TargetWorkloads, cfg.Whitelist)
+	for _, name := range changed {
+		m.logger.Printf("WARNING: -%s changed in %s, but only takes effect on restart.\n", name, path)
+	}
+}
+
+// watchReload reloads the config file at path on SIGHUP and, with watch,
+// whenever the file changes, until the process exits. A -config URL is
+// fetched again on SIGHUP and checked for changes every refresh instead.
+func (m *monitor) watchReload(path string, watch bool, refresh time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var check <-chan time.Time
+	if remote != nil && refresh > 0 {
+		check = m.clock.After(refresh)
+		m.logger.Printf("Checking %s for changes every %v.\n", path, refresh)
+	}
+
+	changed := make(chan struct{}, 1)
+	if watch {
+		if err := watchFile(path, changed); err != nil {
+			m.logger.Printf("Failed to watch %s for changes, only reloading on SIGHUP: %v\n", path, err)
+		} else {
+			m.logger.Printf("Watching %s for changes.\n", path)
+		}
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			m.logger.Printf("Received SIGHUP, reloading %s.\n", path)
+			if remote != nil {
+				if _, err := remote.fetch(); err != nil {
+					m.logger.Printf("Failed to fetch %s, keeping the current configuration: %v\n", path, err)
+					continue
+				}
+				remote.logProblems(m.logger)
+			}
+			m.reload(path)
+		case <-check:
+			check = m.clock.After(refresh)
+			updated, err := remote.fetch()
+			if err != nil {
+				m.logger.Printf("Failed to fetch %s, keeping the current configuration: %v\n", path, err)
+				continue
+			}
+			remote.logProblems(m.logger)
+			if updated {
+				m.logger.Printf("%s changed, reloading it.\n", path)
+				m.reload(path)
+			}
+		case <-changed:
+			debounce = m.clock.After(reloadDebounce)
+		case <-debounce:
+			debounce = nil
+			m.logger.Printf("%s changed, reloading it.\n", path)
+			m.reload(path)
+		}
+	}
+}
+
+// watchFile signals changed whenever path is written, replaced or removed,
+// using inotify. The directory is watched rather than the file itself, as
+// editors and tools such as Kubernetes replace files rather than writing them
+// in place, which a watch on the file would lose track of. Kubernetes swaps a
+// ..data symlink to update mounted files, which is also treated as a change.
+func watchFile(path string, changed chan<- struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("%s: %v", dir, err)
+	}
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				var event syscall.InotifyEvent
+				binary.Read(bytes.NewReader(buf[offset:offset+syscall.SizeofInotifyEvent]), binary.NativeEndian, &event)
+				start := offset + syscall.SizeofInotifyEvent
+				eventName := string(bytes.TrimRight(buf[start:start+int(event.Len)], "\x00"))
+				offset = start + int(event.Len)
+
+				if eventName == name || eventName == "..data" {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
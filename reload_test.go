@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetFlags puts the flags back to their defaults once the test is done, for
+// tests that set them.
+func resetFlags(t *testing.T) {
+	t.Helper()
+	testConfig(t)
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if !bound.onCommandLine[f.Name] && !contains(commandLineOnly, f.Name) {
+				f.Value.Set(f.DefValue)
+			}
+		})
+	})
+}
+
+// useConfigFile writes a config file for reloadConfigFile to read, returning
+// its path. The flags it sets are put back to their defaults afterwards.
+func useConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	resetFlags(t)
+	path := filepath.Join(t.TempDir(), "nvidler.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := bound.cfg.ConfigFile
+	bound.cfg.ConfigFile = path
+	t.Cleanup(func() { bound.cfg.ConfigFile = saved })
+	return path
+}
+
+func TestReloadKeepsAPIChanges(t *testing.T) {
+	e := newTestEnv(t)
+	path := useConfigFile(t, `{"idleTimeThreshold": 120, "warningOnly": true}`)
+	m := e.monitor(e.config())
+	a := &apiServer{m: m, token: "secret"}
+
+	req := httptest.NewRequest(http.MethodPut, "/config", strings.NewReader(`{"warningOnly": false}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.handleConfig(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /config = %d %s", rec.Code, rec.Body)
+	}
+
+	m.reload(path)
+	if m.cfg.WarningOnly {
+		t.Error("warningOnly is true after reloading, want the API's false kept")
+	}
+	if m.cfg.IdleTimeThreshold != 120 {
+		t.Errorf("idleTimeThreshold = %d after reloading, want the file's 120", m.cfg.IdleTimeThreshold)
+	}
+}
+
+func TestAPIPersistsChanges(t *testing.T) {
+	e := newTestEnv(t)
+	path := useConfigFile(t, `{"idleTimeThreshold": 120, "apiToken": "secret"}`)
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := e.config()
+	cfg.ConfigFile = path
+	cfg.APIPersist = true
+	m := e.monitor(cfg)
+	a := &apiServer{m: m, token: "secret"}
+
+	for _, body := range []string{`{"maxRuntime": 86400}`, `{"warningOnly": false, "minReclaimableMB": 512}`} {
+		req := httptest.NewRequest(http.MethodPut, "/config", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		a.handleConfig(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("PUT /config %s = %d %s", body, rec.Code, rec.Body)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("config file after persisting = %v, %v, want it still 0600", info.Mode(), err)
+	}
+
+	// As if restarted, the file has both changes along with its own settings
+	reloaded, err := reloadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.IdleTimeThreshold != 120 || reloaded.APIToken != "secret" || reloaded.MaxRuntime != 86400 || reloaded.WarningOnly || reloaded.MinReclaimableMB != 512 {
+		t.Errorf("config file after persisting has idleTimeThreshold=%d, apiToken=%q, maxRuntime=%d, warningOnly=%v, minReclaimableMB=%d, want 120, secret, 86400, false and 512",
+			reloaded.IdleTimeThreshold, reloaded.APIToken, reloaded.MaxRuntime, reloaded.WarningOnly, reloaded.MinReclaimableMB)
+	}
+
+	// A -config URL can't be written back to
+	cfg.ConfigFile = "https://config.example.com/nvidler.json"
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "invalid -apiPersist: -config is a URL") {
+		t.Errorf("validate with -apiPersist and a -config URL = %v, want it refused", err)
+	}
+}
+
+func TestWatchedConfigFileReloads(t *testing.T) {
+	e := newTestEnv(t)
+	path := useConfigFile(t, `{"idleTimeThreshold": 120}`)
+	m := e.monitor(e.config())
+	changed := make(chan struct{}, 1)
+	if err := watchFile(path, changed); err != nil {
+		t.Fatalf("watchFile: %v", err)
+	}
+	waitForChange := func(what string) {
+		t.Helper()
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change seen after %s", what)
+		}
+	}
+	threshold := func() int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.cfg.IdleTimeThreshold
+	}
+
+	e.write(filepath.Join(filepath.Dir(path), "unrelated.json"), "{}")
+	select {
+	case <-changed:
+		t.Fatal("change seen after writing another file in the directory")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	e.write(path, `{"idleTimeThreshold": 600}`)
+	waitForChange("writing the file in place")
+	m.reload(path)
+	if got := threshold(); got != 600 {
+		t.Fatalf("idleTimeThreshold = %d after writing in place, want 600", got)
+	}
+
+	// Replaced as editors and configuration management tools do
+	replacement := filepath.Join(filepath.Dir(path), ".nvidler.json.new")
+	e.write(replacement, `{"idleTimeThreshold": 900}`)
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange("replacing the file")
+	m.reload(path)
+	if got := threshold(); got != 900 {
+		t.Fatalf("idleTimeThreshold = %d after replacing the file, want 900", got)
+	}
+
+	e.write(path, `{"idleTimeThreshold": "soon"}`)
+	waitForChange("writing an invalid file")
+	m.reload(path)
+	if got := threshold(); got != 900 {
+		t.Fatalf("idleTimeThreshold = %d after an invalid change, want 900 kept", got)
+	}
+	if !strings.Contains(e.log.String(), "Failed to reload") {
+		t.Errorf("invalid change wasn't logged:\n%s", e.log.String())
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configMaxBytes is the most read of a config fetched from a URL.
+const configMaxBytes = 1 << 20
+
+// configClient fetches -config when it's a URL.
+var configClient = &http.Client{Timeout: 10 * time.Second}
+
+// remote holds the config fetched from -config when it's a URL, or is nil.
+// Like smiXML it's package level, as the config is loaded before the monitor
+// exists.
+var remote *remoteConfig
+
+// isURL reports whether a source is an http(s) URL rather than a file.
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// cachedConfig is the last config fetched from a URL, kept in -configCache to
+// fall back on when the URL can't be reached.
+type cachedConfig struct {
+	URL       string    `json:"url"`
+	ETag      string    `json:"etag,omitempty"`
+	Version   string    `json:"version"`
+	Fetched   time.Time `json:"fetched"`
+	Signature string    `json:"signature,omitempty"`
+	Settings  string    `json:"settings"` // verbatim, as it was signed
+}
+
+// remoteConfig fetches the config from a URL for centrally managed fleets,
+// revalidating it with its ETag so an unchanged config isn't reloaded. With
+// -configPublicKey, each config must come with an Ed25519 signature at the
+// same URL with .sig appended. Every config accepted is cached locally, and
+// the cached copy is used if the URL can't be reached at startup.
+type remoteConfig struct {
+	url       string
+	cachePath string
+	publicKey ed25519.PublicKey // nil to accept unsigned configs
+
+	mu       sync.Mutex
+	current  cachedConfig
+	source   string // where the current config came from: the URL or the cache
+	fetchErr error  // why the URL couldn't be used at startup, if the cache was
+	cacheErr error  // why the config last fetched couldn't be cached, if it couldn't
+}
+
+// newRemoteConfig fetches the config from -config's URL, falling back to the
+// copy in -configCache if it can't be fetched or verified.
+func newRemoteConfig(cfg Config) (*remoteConfig, error) {
+	r := &remoteConfig{url: cfg.ConfigFile, cachePath: cfg.ConfigCache}
+	if cfg.ConfigPublicKey != "" {
+		key, err := parsePublicKey(cfg.ConfigPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -configPublicKey: %v", err)
+		}
+		r.publicKey = key
+	}
+
+	_, err := r.fetch()
+	if err == nil {
+		return r, nil
+	}
+	cached, cacheErr := r.readCache()
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%s: %v, and there's no usable cached copy: %v", r.url, err, cacheErr)
+	}
+	r.current, r.source, r.fetchErr = cached, r.cachePath, err
+	return r, nil
+}
+
+// parsePublicKey decodes a base64 Ed25519 public key.
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a %d byte Ed25519 key, got %d bytes", ed25519.PublicKeySize, len(key))
+	}
+	return key, nil
+}
+
+// fetch gets the config from the URL, reporting whether it differs from the
+// one held. A config the server reports unchanged isn't fetched again. A new
+// config is verified against -configPublicKey, if set, and cached before it's
+// used.
+func (r *remoteConfig) fetch() (bool, error) {
+	r.mu.Lock()
+	etag := r.current.ETag
+	r.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := configClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		r.mu.Lock()
+		r.source, r.fetchErr = r.url, nil
+		r.mu.Unlock()
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("%s returned %s", r.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, configMaxBytes+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > configMaxBytes {
+		return false, fmt.Errorf("%s is over %d bytes", r.url, configMaxBytes)
+	}
+	if !json.Valid(body) {
+		return false, fmt.Errorf("%s isn't valid JSON", r.url)
+	}
+
+	fetched := cachedConfig{URL: r.url, ETag: resp.Header.Get("ETag"), Fetched: time.Now(), Settings: string(body)}
+	sum := sha256.Sum256(body)
+	fetched.Version = hex.EncodeToString(sum[:6])
+	if fetched.ETag != "" {
+		fetched.Version = strings.Trim(strings.TrimPrefix(fetched.ETag, "W/"), `"`)
+	}
+	if r.publicKey != nil {
+		if fetched.Signature, err = r.fetchSignature(); err != nil {
+			return false, err
+		}
+		if err := r.verify(fetched); err != nil {
+			return false, err
+		}
+	}
+
+	cacheErr := r.writeCache(fetched)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := fetched.Settings != r.current.Settings
+	r.current, r.source, r.fetchErr, r.cacheErr = fetched, r.url, nil, cacheErr
+	return changed, nil
+}
+
+// fetchSignature gets the base64 signature of the config from the URL with
+// .sig appended.
+func (r *remoteConfig) fetchSignature() (string, error) {
+	resp, err := configClient.Get(r.url + ".sig")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s.sig returned %s", r.url, resp.Status)
+	}
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(sig)), nil
+}
+
+// verify checks a config's signature against -configPublicKey.
+func (r *remoteConfig) verify(c cachedConfig) error {
+	sig, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(r.publicKey, []byte(c.Settings), sig) {
+		return fmt.Errorf("%s doesn't match its signature for -configPublicKey", r.url)
+	}
+	return nil
+}
+
+// readCache reads the cached copy of the config, which must be from the same
+// URL and, with -configPublicKey, still carry a valid signature.
+func (r *remoteConfig) readCache() (cachedConfig, error) {
+	var cached cachedConfig
+	if r.cachePath == "" {
+		return cached, fmt.Errorf("-configCache isn't set")
+	}
+	data, err := os.ReadFile(r.cachePath)
+	if err != nil {
+		return cached, err
+	}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return cached, fmt.Errorf("%s: %v", r.cachePath, err)
+	}
+	if cached.URL != r.url {
+		return cached, fmt.Errorf("%s is a copy of %s", r.cachePath, cached.URL)
+	}
+	if r.publicKey != nil {
+		if err := r.verify(cached); err != nil {
+			return cached, fmt.Errorf("%s: %v", r.cachePath, err)
+		}
+	}
+	return cached, nil
+}
+
+// writeCache replaces the cached copy of the config. It's written to a
+// temporary file and renamed over the old copy, so a crash can't leave it
+// half written, and it's only readable by its owner as it may hold secrets
+// such as -apiToken.
+func (r *remoteConfig) writeCache(c cachedConfig) error {
+	if r.cachePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.cachePath), 0750); err != nil {
+		return err
+	}
+	tmp := r.cachePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.cachePath)
+}
+
+// settings returns the config currently held.
+func (r *remoteConfig) settings() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return []byte(r.current.Settings)
+}
+
+// describe says where the config currently held came from and its version,
+// for logging.
+func (r *remoteConfig) describe() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.source != r.url {
+		return fmt.Sprintf("version %s, the copy cached in %s at %s", r.current.Version, r.source, r.current.Fetched.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("version %s, fetched at %s", r.current.Version, r.current.Fetched.Format(time.RFC3339))
+}
+
+// logProblems logs why the URL couldn't be used at startup or the config last
+// fetched couldn't be cached, once each.
+func (r *remoteConfig) logProblems(logger *log.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fetchErr != nil {
+		logger.Printf("WARNING: Failed to fetch %s, using the copy cached in %s instead: %v\n", r.url, r.cachePath, r.fetchErr)
+		r.fetchErr = nil
+	}
+	if r.cacheErr != nil {
+		logger.Printf("Failed to cache %s in %s: %v\n", r.url, r.cachePath, r.cacheErr)
+		r.cacheErr = nil
+	}
+}
+
+// configSource names the config file for logging, along with the version of
+// the config held when -config is a URL.
+func configSource(path string) string {
+	if remote != nil && path == remote.url {
+		return fmt.Sprintf("%s (%s)", path, remote.describe())
+	}
+	return path
+}
+
+// readConfig reads a config file, the config held for -config's URL, or any
+// other URL afresh. Another URL, such as -shadowConfig's, is verified against
+// -configPublicKey when -config is a URL with one, but is never cached.
+func readConfig(path string) ([]byte, error) {
+	if remote != nil && path == remote.url {
+		return remote.settings(), nil
+	}
+	if !isURL(path) {
+		return os.ReadFile(path)
+	}
+	resp, err := configClient.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, configMaxBytes))
+	if err != nil || remote == nil || remote.publicKey == nil {
+		return data, err
+	}
+	other := &remoteConfig{url: path, publicKey: remote.publicKey}
+	sig, err := other.fetchSignature()
+	if err != nil {
+		return nil, err
+	}
+	if err := other.verify(cachedConfig{Signature: sig, Settings: string(data)}); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
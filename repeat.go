@@ -0,0 +1,50 @@
+package main
+
+import "time"
+
+// warnedProcess is an idle process that's been warned about.
+type warnedProcess struct {
+	first, last time.Time
+	count       int
+}
+
+// warningRepeats coalesces the warnings about an idle process that isn't
+// terminated, so it's warned about again only every -warnRepeatInterval rather
+// than every scan. A process that stops being idle starts over.
+type warningRepeats struct {
+	clock  clock
+	warned map[int]*warnedProcess
+	seen   map[int]bool // processes idle this scan
+}
+
+func newWarningRepeats(clk clock) *warningRepeats {
+	return &warningRepeats{clock: clk, warned: make(map[int]*warnedProcess), seen: make(map[int]bool)}
+}
+
+// due reports whether a process should be warned about this scan, and if so
+// how many times it has been before and since when.
+func (w *warningRepeats) due(pid int, interval time.Duration) (*warnedProcess, bool) {
+	w.seen[pid] = true
+	now := w.clock.Now()
+	warned, ok := w.warned[pid]
+	if !ok {
+		w.warned[pid] = &warnedProcess{first: now, last: now, count: 1}
+		return w.warned[pid], true
+	}
+	if interval > 0 && now.Sub(warned.last) < interval {
+		return warned, false
+	}
+	warned.last = now
+	warned.count++
+	return warned, true
+}
+
+// forget stops tracking processes that weren't idle in the latest scan.
+func (w *warningRepeats) forget() {
+	for pid := range w.warned {
+		if !w.seen[pid] {
+			delete(w.warned, pid)
+		}
+	}
+	w.seen = make(map[int]bool)
+}
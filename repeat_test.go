@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarningsSuppressedWithinRepeatInterval(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.WarnRepeatInterval = 600
+	m := e.monitor(cfg)
+
+	m.scan()
+	for i := 0; i < 9; i++ {
+		e.clock.Sleep(time.Minute)
+		m.scan()
+	}
+	if got, want := e.actions(), []string{"warn 1001"}; !equalStrings(got, want) {
+		t.Fatalf("events in the first 9 minutes = %v, want only the first warning", got)
+	}
+
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	if got, want := e.actions(), []string{"warn 1001", "warn 1001"}; !equalStrings(got, want) {
+		t.Fatalf("events once -warnRepeatInterval passed = %v, want %v", got, want)
+	}
+	if want := "WARNING (repeat 1): Process 1001 (python) in Docker container  is still idle, 10m0s after it was first warned about."; !strings.Contains(e.events[1].Message, want) {
+		t.Errorf("repeated warning = %q, want it to say %q", e.events[1].Message, want)
+	}
+
+	// A process that becomes busy starts over, and is warned about as soon as
+	// it's idle again
+	e.gpuProcesses("1001, 2048")
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	e.gpuProcesses("1001, 0")
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	if got := e.actions(); len(got) != 3 {
+		t.Fatalf("events after becoming busy and idle again = %v, want a third warning", got)
+	}
+	if strings.Contains(e.events[2].Message, "repeat") {
+		t.Errorf("warning after becoming busy again = %q, want a first warning", e.events[2].Message)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// gpuReset is a GPU that appears to have been reset since the last scan, and
+// why.
+type gpuReset struct {
+	uuid   string
+	reason string
+}
+
+// resetDetector looks for signs between scans that a GPU was reset or the
+// driver restarted, after which the processes and memory seen before are no
+// guide to those seen after. nvidia-smi has no reading for a reset having
+// happened, only for one being needed, so it's inferred from discontinuities.
+type resetDetector struct {
+	present   map[string]bool      // GPUs listed on the last scan, by UUID
+	missing   map[string]time.Time // GPUs listed before but not since, from when
+	processes map[string][]int     // processes listed on each GPU on the last scan
+}
+
+func newResetDetector() *resetDetector {
+	return &resetDetector{missing: make(map[string]time.Time), processes: make(map[string][]int)}
+}
+
+// check compares a scan's GPUs and processes with the last scan's, returning
+// the GPUs that look to have been reset: those that dropped out of
+// nvidia-smi's list, as when a GPU falls off the bus, and have come back, and
+// those whose processes have all lost their GPU memory at once while still
+// running, as their contexts are destroyed by a reset. The GPUs are nil if
+// they couldn't be listed this scan.
+func (r *resetDetector) check(gpus []gpuInfo, processes []gpuProcess, now time.Time) []gpuReset {
+	var resets []gpuReset
+	reset := make(map[string]bool)
+	if gpus != nil {
+		present := make(map[string]bool, len(gpus))
+		for _, gpu := range gpus {
+			present[gpu.UUID] = true
+			if since, ok := r.missing[gpu.UUID]; ok {
+				resets = append(resets, gpuReset{gpu.UUID, fmt.Sprintf("it dropped out of nvidia-smi at %s and has come back", since.Format(time.RFC3339))})
+				reset[gpu.UUID] = true
+				delete(r.missing, gpu.UUID)
+			}
+		}
+		for uuid := range r.present {
+			if !present[uuid] {
+				r.missing[uuid] = now
+			}
+		}
+		r.present = present
+	}
+
+	listed := make(map[string][]int)
+	for _, process := range processes {
+		listed[process.GPUUUID] = append(listed[process.GPUUUID], process.PID)
+	}
+	for uuid, pids := range r.processes {
+		if reset[uuid] || len(listed[uuid]) > 0 {
+			continue
+		}
+		if _, ok := r.missing[uuid]; ok {
+			continue
+		}
+		if allRunning(pids) {
+			resets = append(resets, gpuReset{uuid, fmt.Sprintf("all %d of its processes lost their GPU memory at once while still running", len(pids))})
+		}
+	}
+	r.processes = listed
+
+	sort.Slice(resets, func(i, j int) bool { return resets[i].uuid < resets[j].uuid })
+	return resets
+}
+
+// allRunning reports whether every one of the processes is still running.
+func allRunning(pids []int) bool {
+	for _, pid := range pids {
+		if _, err := os.Stat(procPath(pid, "stat")); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// detectResets forgets what's tracked for the processes on any GPU that
+// appears to have been reset since the last scan, and counts them as idle
+// only from the reset, so nothing is acted on from what was seen before it.
+func (m *monitor) detectResets(processes []gpuProcess, state *scanState) {
+	if !m.cfg.DetectGPUResets {
+		return
+	}
+	for _, reset := range m.resets.check(state.gpus, processes, m.clock.Now()) {
+		m.events.emit(event{
+			Action:  actionCritical,
+			Message: fmt.Sprintf("CRITICAL: GPU %s appears to have been reset or its driver restarted: %s. Forgetting what was tracked for its processes, which are only counted as idle from now.", reset.uuid, reset.reason),
+			GPU:     reset.uuid,
+		})
+		m.resetGPU(reset.uuid)
+		if m.shadow != nil {
+			m.shadow.m.resetGPU(reset.uuid)
+		}
+	}
+}
+
+// resetGPU restarts the idle time of the processes on a GPU and the peaks,
+// leak baselines, quiet periods and confirmations tracked for them.
+func (m *monitor) resetGPU(uuid string) {
+	now := m.clock.Now()
+	m.gpuResets[uuid] = now
+	for key, p := range m.peaks {
+		if key.gpu == uuid {
+			p.PeakMemory = p.UsedMemory
+			delete(m.quiet.since, key.pid)
+			delete(m.quiet.known, key.pid)
+			delete(m.confirmations.counts, key.pid)
+		}
+	}
+	for key, c := range m.leaks {
+		if key.gpu == uuid {
+			c.Since = now
+		}
+	}
+}
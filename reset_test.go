@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetDetector(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python"})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python"})
+	a, b := gpuInfo{UUID: "GPU-a"}, gpuInfo{UUID: "GPU-b"}
+	on := func(gpu string, pids ...int) []gpuProcess {
+		var processes []gpuProcess
+		for _, pid := range pids {
+			processes = append(processes, gpuProcess{PID: pid, GPUUUID: gpu, UsedMemory: 1024})
+		}
+		return processes
+	}
+	r := newResetDetector()
+	check := func(gpus []gpuInfo, processes []gpuProcess) []string {
+		t.Helper()
+		var reset []string
+		for _, gpu := range r.check(gpus, processes, e.clock.Now()) {
+			reset = append(reset, gpu.uuid+": "+gpu.reason)
+		}
+		return reset
+	}
+
+	if got := check([]gpuInfo{a, b}, append(on("GPU-a", 1001), on("GPU-b", 1002)...)); got != nil {
+		t.Fatalf("first scan found resets %v, want none", got)
+	}
+	// GPU-b falls off the bus, so neither it nor its process is listed, then
+	// comes back
+	if got := check([]gpuInfo{a}, on("GPU-a", 1001)); got != nil {
+		t.Fatalf("resets while GPU-b was missing = %v, want none until it's back", got)
+	}
+	if got := check(nil, on("GPU-a", 1001)); got != nil {
+		t.Fatalf("resets when the GPUs couldn't be listed = %v, want none", got)
+	}
+	e.clock.Sleep(time.Minute)
+	got := check([]gpuInfo{a, b}, on("GPU-a", 1001))
+	if len(got) != 1 || !strings.HasPrefix(got[0], "GPU-b: it dropped out of nvidia-smi at") {
+		t.Fatalf("resets once GPU-b came back = %v, want GPU-b as having dropped out", got)
+	}
+
+	// Every process losing its memory at once while still running is a reset,
+	// but not when they've exited
+	if got := check([]gpuInfo{a, b}, on("GPU-b", 1002)); len(got) != 1 || got[0] != "GPU-a: all 1 of its processes lost their GPU memory at once while still running" {
+		t.Fatalf("resets after GPU-a's process lost its memory = %v, want GPU-a", got)
+	}
+	e.removeProcess(1002)
+	if got := check([]gpuInfo{a, b}, nil); got != nil {
+		t.Fatalf("resets after GPU-b's process exited = %v, want none", got)
+	}
+}
+
+func TestScanForgetsIdleTimeBeforeGPUReset(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.DetectGPUResets = true
+	m := e.monitor(cfg)
+
+	e.gpuProcesses("1001, 2048")
+	m.scan()
+
+	// The GPU drops out and comes back, its process's context wiped, which
+	// without a reset would look like an hour idle
+	e.smi("--query-gpu=index,uuid,memory.free", "")
+	e.gpuProcesses()
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	e.smi("--query-gpu=index,uuid,memory.free", "0, "+testGPU+", 1024\n")
+	e.gpuProcesses("1001, 0")
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v right after the GPU reset, want its idle time counted from the reset", got)
+	}
+	if !strings.Contains(e.log.String(), "CRITICAL: GPU "+testGPU+" appears to have been reset or its driver restarted") {
+		t.Fatalf("log doesn't report the reset:\n%s", e.log.String())
+	}
+
+	e.clock.Sleep(time.Duration(cfg.IdleTimeThreshold+1) * time.Second)
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals once idle past the threshold since the reset = %v, want %v", got, want)
+	}
+}
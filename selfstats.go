@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selfStats is nvidler's own footprint, as logged every -selfStatsInterval and
+// returned by GET /status.
+type selfStats struct {
+	RSSMB            float64 `json:"rssMB"`
+	HeapMB           float64 `json:"heapMB"`
+	Goroutines       int     `json:"goroutines"`
+	TrackedProcesses int     `json:"trackedProcesses"` // entries across the per-process state kept between scans
+	MemoryLimitMB    int     `json:"memoryLimitMB,omitempty"`
+	MaxProcs         int     `json:"maxProcs"`
+}
+
+// applySelfLimits sets the soft memory limit and GOMAXPROCS from
+// -selfMemoryLimitMB and -selfMaxProcs, leaving the Go defaults when unset.
+func applySelfLimits(cfg Config) {
+	if cfg.SelfMemoryLimitMB > 0 {
+		debug.SetMemoryLimit(int64(cfg.SelfMemoryLimitMB) << 20)
+	}
+	if cfg.SelfMaxProcs > 0 {
+		runtime.GOMAXPROCS(cfg.SelfMaxProcs)
+	}
+}
+
+// readSelfStats measures nvidler's footprint. Its RSS is read from its own
+// /proc, which is always the real one whatever -procRoot is.
+func (m *monitor) readSelfStats() selfStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	s := selfStats{
+		HeapMB:           float64(mem.HeapAlloc) / (1 << 20),
+		Goroutines:       runtime.NumGoroutine(),
+		TrackedProcesses: len(m.peaks) + len(m.leaks) + len(m.ladderProgress) + len(m.dState) + len(m.wallNotices) + len(m.drainNotices) + len(m.unverified) + len(m.repeats.warned) + len(m.quiet.since) + len(m.confirmations.counts) + len(m.quarantined.processes),
+		MemoryLimitMB:    m.cfg.SelfMemoryLimitMB,
+		MaxProcs:         runtime.GOMAXPROCS(0),
+	}
+	if file, err := os.Open("/proc/self/status"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "VmRSS:"); ok {
+				kb, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), " kB"))
+				s.RSSMB = float64(kb) / 1024
+				break
+			}
+		}
+	}
+	return s
+}
+
+// selfMonitor logs nvidler's footprint every -selfStatsInterval, warning once
+// if it has grown well beyond the first measurement, which would most likely
+// be a leak in the state kept between scans.
+type selfMonitor struct {
+	clock      clock
+	lastLogged time.Time
+	baseline   *selfStats
+	grown      bool
+}
+
+func newSelfMonitor(clk clock) *selfMonitor {
+	return &selfMonitor{clock: clk}
+}
+
+// check logs the footprint if it's due.
+func (s *selfMonitor) check(m *monitor, interval time.Duration) {
+	now := s.clock.Now()
+	if interval <= 0 || (s.baseline != nil && now.Sub(s.lastLogged) < interval) {
+		return
+	}
+	s.lastLogged = now
+	stats := m.readSelfStats()
+	m.logger.Printf("Self: RSS %.1f MB, heap %.1f MB, %d goroutines, %d processes tracked.\n", stats.RSSMB, stats.HeapMB, stats.Goroutines, stats.TrackedProcesses)
+	if s.baseline == nil {
+		s.baseline = &stats
+		return
+	}
+
+	// Small absolute growth is ordinary, from caches filling and the GC
+	// settling
+	base := s.baseline
+	grown := (stats.RSSMB > 2*base.RSSMB && stats.RSSMB-base.RSSMB > 50) || stats.Goroutines > 2*base.Goroutines+50
+	if grown && !s.grown {
+		m.events.emit(event{
+			Action:  actionWarn,
+			Message: fmt.Sprintf("WARNING: nvidler's own footprint has grown from RSS %.1f MB and %d goroutines at startup to RSS %.1f MB and %d goroutines, with %d processes tracked. This may be a leak, please report it.", base.RSSMB, base.Goroutines, stats.RSSMB, stats.Goroutines, stats.TrackedProcesses),
+		})
+	}
+	s.grown = grown
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// shadowDecision is what one set of settings decided for an idle process on a
+// scan: warn, terminate or quarantine.
+type shadowDecision struct {
+	action string
+	c      candidate
+}
+
+// shadowDivergence is a process the live and candidate settings disagree
+// about, by their actions, empty for a process one of them didn't find idle.
+type shadowDivergence struct {
+	live, candidate string
+}
+
+// shadowStats counts how the candidate settings have differed from the live
+// ones since startup, as reported by GET /status.
+type shadowStats struct {
+	Config         string `json:"config"`
+	Scans          int    `json:"scans"`
+	DivergentScans int    `json:"divergentScans"` // scans where the settings disagreed about any process
+	Divergences    int    `json:"divergences"`    // times they started disagreeing about a process
+	WouldTerminate int    `json:"wouldTerminate"` // the candidate would have terminated or quarantined a process live didn't
+	WouldSpare     int    `json:"wouldSpare"`     // live terminated or quarantined a process the candidate wouldn't have
+	Diverging      int    `json:"diverging"`      // processes they disagree about now
+}
+
+// shadowEngine evaluates every scan a second time with the candidate settings
+// of -shadowConfig, to see how they would behave on the live workload before
+// rolling them out. It has its own trackers, so idle times, confirmations and
+// the like build up as they would for real, but it never acts on anything and
+// its evaluations aren't logged. Only the processes where its decisions differ
+// from the live ones are, once when they start to differ.
+type shadowEngine struct {
+	m         *monitor
+	logger    *log.Logger
+	diverging map[int]shadowDivergence
+	stats     shadowStats
+}
+
+// startShadow sets up the shadow engine for -shadowConfig, with the live
+// configuration as read at startup and the file's settings applied over it.
+// Divergences are logged to -shadowLogFile if it's set, or else to the main
+// log, prefixed "shadow:" either way.
+func startShadow(live Config, clk clock, logger *log.Logger, docker []*dockerDaemon) (*shadowEngine, error) {
+	cfg, err := overlayConfigFile(live.ShadowConfig)
+	if err != nil {
+		return nil, err
+	}
+	out := logger.Writer()
+	if live.ShadowLogFile != "" {
+		if out, err = openLogFile(live.ShadowLogFile); err != nil {
+			return nil, err
+		}
+	}
+
+	discard := log.New(io.Discard, "", 0)
+	m, err := newMonitor(cfg, clk, discard, &notifier{logger: discard, clock: clk}, docker)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", live.ShadowConfig, err)
+	}
+	return &shadowEngine{
+		m:         m,
+		logger:    log.New(out, "shadow: ", log.LstdFlags|log.Lmsgprefix),
+		diverging: make(map[int]shadowDivergence),
+		stats:     shadowStats{Config: live.ShadowConfig},
+	}, nil
+}
+
+// decide evaluates the processes of a live scan with the candidate settings,
+// sharing what the scan already gathered. Whatever held off enforcement for
+// the live scan other than -warningOnly, such as -failSafeAfter or
+// -minNodeUptime, holds it off for the candidate too.
+func (s *shadowEngine) decide(processes []gpuProcess, live *scanState, held bool) map[int]shadowDecision {
+	m := s.m
+	m.peaks.update(processes, nil)
+	if m.cfg.LeakedContextThreshold > 0 {
+		m.leaks.update(processes, m.clock.Now())
+	}
+
+	state := *live
+	state.gpuPIDsByContainer = make(map[string][]int)
+	state.gpuPIDsByCgroup = make(map[string][]int)
+	state.overRuntime = nil
+	state.logger = m.logger
+	state.held = make(map[int]*bytes.Buffer)
+	state.loggers = make(map[int]*log.Logger)
+	state.explainPID, state.trace = 0, nil
+	if state.gpus == nil && (len(m.cfg.WhitelistGPUs) > 0 || len(m.reclaimTargets) > 0) {
+		if gpus, err := queryGPUs(); err == nil {
+			state.gpus = gpus
+			state.gpusByUUID = make(map[string]gpuInfo, len(gpus))
+			for _, gpu := range gpus {
+				state.gpusByUUID[gpu.UUID] = gpu
+			}
+		}
+	}
+
+	var candidates []candidate
+	for _, process := range processes {
+		if c, ok := m.evaluate(process, &state); ok {
+			candidates = append(candidates, c)
+		}
+	}
+	m.quiet.forget()
+
+	terminate := make(map[int]bool)
+	if !m.cfg.WarningOnly && !held && len(candidates) > 0 {
+		terminate = planReclaim(candidates, m.reclaimTargets, m.cfg.ReclaimOrder, state.gpus, m.logger)
+	}
+	terminate = m.confirmations.confirm(terminate, m.logger)
+	return decisions(m.cfg, candidates, terminate)
+}
+
+// decisions returns the action decided for each idle candidate.
+func decisions(cfg Config, candidates []candidate, terminate map[int]bool) map[int]shadowDecision {
+	decided := make(map[int]shadowDecision, len(candidates))
+	for _, c := range candidates {
+		if c.Drain {
+			continue
+		}
+		action := actionWarn
+		if terminate[c.PID] {
+			action = actionTerminate
+			if cfg.QuarantineAction != "" {
+				action = actionQuarantine
+			}
+		}
+		decided[c.PID] = shadowDecision{action, c}
+	}
+	return decided
+}
+
+// compare logs the processes the live and candidate settings have started to
+// disagree about and counts the divergences.
+func (s *shadowEngine) compare(live, candidate map[int]shadowDecision) {
+	s.stats.Scans++
+	pids := make(map[int]bool)
+	for pid := range live {
+		pids[pid] = true
+	}
+	for pid := range candidate {
+		pids[pid] = true
+	}
+	for pid := range s.diverging {
+		pids[pid] = true
+	}
+	sorted := make([]int, 0, len(pids))
+	for pid := range pids {
+		sorted = append(sorted, pid)
+	}
+	sort.Ints(sorted)
+
+	divergent := false
+	for _, pid := range sorted {
+		d := shadowDivergence{live[pid].action, candidate[pid].action}
+		if d.live == d.candidate {
+			delete(s.diverging, pid)
+			continue
+		}
+		divergent = true
+		if s.diverging[pid] == d {
+			continue
+		}
+		s.diverging[pid] = d
+		s.stats.Divergences++
+		switch {
+		case acts(d.candidate) && !acts(d.live):
+			s.stats.WouldTerminate++
+		case acts(d.live) && !acts(d.candidate):
+			s.stats.WouldSpare++
+		}
+
+		c := live[pid].c
+		if d.candidate != "" {
+			c = candidate[pid].c
+		}
+		s.logger.Printf("PID %d (%s) on GPU %s: candidate would have %s, live %s.%s\n", pid, c.Name, c.GPUUUID, shadowVerb(d.candidate), shadowVerb(d.live), c.jobNote())
+	}
+	if divergent {
+		s.stats.DivergentScans++
+	}
+	s.stats.Diverging = len(s.diverging)
+}
+
+// acts reports whether an action frees the GPU.
+func acts(action string) bool {
+	return action == actionTerminate || action == actionQuarantine
+}
+
+// shadowVerb describes a decision for the divergence log.
+func shadowVerb(action string) string {
+	switch action {
+	case actionWarn:
+		return "only warned about it"
+	case actionTerminate:
+		return "terminated it"
+	case actionQuarantine:
+		return "quarantined it"
+	}
+	return "spared it"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// migDevice is a MIG instance, as listed by nvidia-smi -L.
+type migDevice struct {
+	Parent   string // UUID of the GPU it's a slice of
+	Profile  string // e.g. 3g.20gb
+	MemoryGB int
+}
+
+var (
+	smiListGPUPattern = regexp.MustCompile(`^GPU \d+: .*\(UUID: (GPU-[^)\s]+)\)`)
+	smiListMIGPattern = regexp.MustCompile(`^\s+MIG (\S+)\s+Device\s+\d+: \(UUID: (MIG-[^)\s]+)\)`)
+	migProfilePattern = regexp.MustCompile(`^\d+g\.(\d+)gb`)
+)
+
+// queryMIGDevices returns the MIG instances by UUID.
+func queryMIGDevices() (map[string]migDevice, error) {
+	out, err := runSMI("-L")
+	if err != nil {
+		return nil, err
+	}
+	return parseMIGDevices(string(out)), nil
+}
+
+// parseMIGDevices parses nvidia-smi -L output, in which each GPU's MIG
+// instances follow it, e.g.
+//
+//	GPU 0: NVIDIA A100-SXM4-40GB (UUID: GPU-5d5ba0d6-...)
+//	  MIG 3g.20gb     Device  0: (UUID: MIG-c6d4f1ef-...)
+func parseMIGDevices(out string) map[string]migDevice {
+	devices := make(map[string]migDevice)
+	var parent string
+	for _, line := range strings.Split(out, "\n") {
+		if match := smiListGPUPattern.FindStringSubmatch(line); match != nil {
+			parent = match[1]
+			continue
+		}
+		match := smiListMIGPattern.FindStringSubmatch(line)
+		if match == nil || parent == "" {
+			continue
+		}
+		device := migDevice{Parent: parent, Profile: match[1]}
+		if size := migProfilePattern.FindStringSubmatch(match[1]); size != nil {
+			device.MemoryGB, _ = strconv.Atoi(size[1])
+		}
+		devices[match[2]] = device
+	}
+	return devices
+}
+
+// mpsThreadPercentage returns the share of the SMs an MPS client was limited
+// to with CUDA_MPS_ACTIVE_THREAD_PERCENTAGE, or 0 if it wasn't.
+func mpsThreadPercentage(pid int) float64 {
+	data, err := os.ReadFile(procPath(pid, "environ"))
+	if err != nil {
+		return 0
+	}
+	for _, variable := range strings.Split(string(data), "\x00") {
+		if value, ok := strings.CutPrefix(variable, "CUDA_MPS_ACTIVE_THREAD_PERCENTAGE="); ok {
+			if percentage, err := strconv.ParseFloat(value, 64); err == nil && percentage > 0 && percentage < 100 {
+				return percentage
+			}
+		}
+	}
+	return 0
+}
+
+// gpuShare returns the fraction of a GPU a process has to itself, along with
+// how it was found: the size of its MIG instance relative to the whole GPU, by
+// memory, or its MPS active thread percentage. A process is taken to have the
+// whole GPU, 1, when it isn't shared or its share can't be found.
+func (m *monitor) gpuShare(p gpuProcess, state *scanState) (float64, string) {
+	if device, ok := state.migDevices[p.GPUUUID]; ok {
+		if total := m.memoryTotal(device.Parent); total > 0 && device.MemoryGB > 0 {
+			return min(1, float64(device.MemoryGB*1024)/float64(total)), fmt.Sprintf("MIG %s instance of %s", device.Profile, device.Parent)
+		}
+		return 1, ""
+	}
+	if percentage := mpsThreadPercentage(p.PID); percentage > 0 {
+		return percentage / 100, fmt.Sprintf("MPS active thread percentage of %v", percentage)
+	}
+	return 1, ""
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// slurmJobPattern matches the job component of a SLURM cgroup path, such as
+// /slurm/uid_1000/job_1234/step_0 under cgroup v1 or
+// /system.slice/slurmstepd.scope/job_1234/step_0 under cgroup v2.
+var slurmJobPattern = regexp.MustCompile(`/job_(\d+)(/|$)`)
+
+// slurmJob returns the ID of the SLURM job a process belongs to, or an empty
+// string if it isn't in one. The job is read from the process's cgroup, falling
+// back to its SLURM_JOB_ID environment variable on nodes where SLURM doesn't
+// manage cgroups.
+func slurmJob(pid int) string {
+	if data, err := os.ReadFile(procPath(pid, "cgroup")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if !strings.Contains(line, "slurm") {
+				continue
+			}
+			if match := slurmJobPattern.FindStringSubmatch(line); match != nil {
+				return match[1]
+			}
+		}
+	}
+
+	if data, err := os.ReadFile(procPath(pid, "environ")); err == nil {
+		for _, variable := range strings.Split(string(data), "\x00") {
+			if job, ok := strings.CutPrefix(variable, "SLURM_JOB_ID="); ok {
+				return job
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queryField is a single field requested from nvidia-smi.
+type queryField struct {
+	Name  string // identifier the value is exposed as, e.g. in -idleExpr
+	Field string // nvidia-smi field name
+	GPU   bool   // queried per GPU with --query-gpu rather than per process
+}
+
+// computeAppsFields are the fields always requested from nvidia-smi for each
+// compute process, in the order they appear in its CSV output.
+var computeAppsFields = []queryField{
+	{Name: "pid", Field: "pid"},
+	{Name: "used_memory", Field: "used_memory"},
+	{Name: "gpu_uuid", Field: "gpu_uuid"},
+}
+
+// gpuInfo describes a single GPU.
+type gpuInfo struct {
+	Index      int
+	UUID       string
+	MemoryFree int // MiB
+}
+
+// gpuProcess is a single compute process as reported by nvidia-smi.
+type gpuProcess struct {
+	PID        int
+	UsedMemory int
+	GPUUUID    string
+
+	// Values holds every numeric field collected for the process, including any
+	// per-GPU fields for the GPU it runs on, keyed by queryField.Name.
+	Values map[string]float64
+}
+
+// parseExtraFields parses the -extraQueryFields flag. Each entry is an
+// nvidia-smi field, optionally prefixed with "gpu:" to query it per GPU (e.g.
+// gpu:utilization.gpu) and with "name=" to choose the identifier it is exposed
+// as. Without a name, dots in the field are replaced by underscores.
+func parseExtraFields(spec string) ([]queryField, error) {
+	var fields []queryField
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var f queryField
+		if name, field, ok := strings.Cut(entry, "="); ok {
+			f.Name, entry = strings.TrimSpace(name), strings.TrimSpace(field)
+		}
+		if field, ok := strings.CutPrefix(entry, "gpu:"); ok {
+			f.GPU, entry = true, field
+		}
+		f.Field = entry
+		if f.Name == "" {
+			f.Name = strings.ReplaceAll(f.Field, ".", "_")
+		}
+
+		if f.Field == "" {
+			return nil, fmt.Errorf("missing field name in %q", entry)
+		}
+		if !isIdent(f.Name) {
+			return nil, fmt.Errorf("invalid identifier %q for field %s", f.Name, f.Field)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// runSMI runs nvidia-smi with the given arguments and returns its output. With
+// -backend xml, queries are answered from the scan's XML output instead.
+func runSMI(args ...string) ([]byte, error) {
+	if smiXML != nil {
+		if out, ok, err := smiXML.query(args); ok {
+			return out, err
+		}
+	}
+	return execSMI(args...)
+}
+
+// smiTimeout is how long nvidia-smi is given to answer, from -smiTimeout, or 0
+// for as long as it takes.
+var smiTimeout time.Duration
+
+// smiKillGrace is how long a timed out nvidia-smi is given to exit once it's
+// been killed.
+const smiKillGrace = 5 * time.Second
+
+// execSMI runs nvidia-smi, killing it if it hasn't answered within
+// smiTimeout, as it can hang indefinitely on a wedged driver. A killed
+// nvidia-smi stuck in the driver can't exit until the driver lets it go, so
+// rather than wait for it, it's given up on after smiKillGrace and left to be
+// reaped in the background whenever it does exit.
+func execSMI(args ...string) (out []byte, err error) {
+	defer func() { blackBox.recordCommand(args, out, err) }()
+	if smiTimeout <= 0 {
+		return exec.Command("nvidia-smi", args...).Output()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), smiTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "nvidia-smi", args...)
+	cmd.WaitDelay = time.Second // for any children of its left holding its output open
+
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := cmd.Output()
+		done <- result{out, err}
+	}()
+
+	select {
+	case r := <-done:
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("nvidia-smi %s timed out after %v and was killed", strings.Join(args, " "), smiTimeout)
+		}
+		return r.out, r.err
+	case <-time.After(smiTimeout + smiKillGrace):
+		return nil, fmt.Errorf("nvidia-smi %s timed out after %v and hasn't exited since being killed, it's most likely stuck in the driver", strings.Join(args, " "), smiTimeout)
+	}
+}
+
+func joinFields(fields []queryField) string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Field
+	}
+	return strings.Join(names, ",")
+}
+
+// queryComputeApps asks nvidia-smi for the compute processes currently on the
+// GPUs, along with any extra fields it supports, returning the raw output
+// alongside the parsed processes.
+func queryComputeApps(extra []queryField) ([]byte, []gpuProcess, error) {
+	fields := append([]queryField{}, computeAppsFields...)
+	var gpuFields []queryField
+	for _, f := range extra {
+		if !smiCaps.supports(f) {
+			continue
+		}
+		if f.GPU {
+			gpuFields = append(gpuFields, f)
+		} else {
+			fields = append(fields, f)
+		}
+	}
+	out, err := runSMI("--query-compute-apps="+joinFields(fields), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, nil, err
+	}
+	processes, err := parseComputeApps(out, fields)
+	if err != nil || len(gpuFields) == 0 {
+		return out, processes, err
+	}
+
+	gpuValues, err := queryGPUFields(gpuFields)
+	if err != nil {
+		return out, nil, fmt.Errorf("failed to query GPU fields: %v", err)
+	}
+	for _, p := range processes {
+		for name, value := range gpuValues[p.GPUUUID] {
+			p.Values[name] = value
+		}
+	}
+	return out, processes, nil
+}
+
+// isGPURef reports whether ref looks like a GPU reference: either an index or
+// a UUID (GPU-... or MIG-...). GPU indices can change between reboots, whereas
+// UUIDs are stable.
+func isGPURef(ref string) bool {
+	if _, err := strconv.Atoi(ref); err == nil {
+		return true
+	}
+	return strings.HasPrefix(ref, "GPU-") || strings.HasPrefix(ref, "MIG-")
+}
+
+// matches reports whether a GPU reference, an index or UUID, refers to the GPU.
+func (g gpuInfo) matches(ref string) bool {
+	return ref == g.UUID || ref == strconv.Itoa(g.Index)
+}
+
+// matchesAny reports whether any of the GPU references refer to the GPU.
+func (g gpuInfo) matchesAny(refs []string) bool {
+	for _, ref := range refs {
+		if g.matches(ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryGPUs returns the GPUs in the system.
+func queryGPUs() ([]gpuInfo, error) {
+	out, err := runSMI("--query-gpu=index,uuid,memory.free", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseSMICSV(out, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	gpus := make([]gpuInfo, 0, len(records))
+	for _, record := range records {
+		var gpu gpuInfo
+		if gpu.Index, err = strconv.Atoi(record[0]); err != nil {
+			return nil, fmt.Errorf("invalid GPU index %q: %v", record[0], err)
+		}
+		gpu.UUID = record[1]
+		if gpu.MemoryFree, err = strconv.Atoi(record[2]); err != nil {
+			return nil, fmt.Errorf("invalid memory.free %q for GPU %d: %v", record[2], gpu.Index, err)
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus, nil
+}
+
+// queryMemoryTotal returns the total memory of each GPU in MB, by UUID.
+func queryMemoryTotal() (map[string]int, error) {
+	out, err := runSMI("--query-gpu=uuid,memory.total", "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseSMICSV(out, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int, len(records))
+	for _, record := range records {
+		total, err := strconv.Atoi(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory.total %q for GPU %s: %v", record[1], record[0], err)
+		}
+		totals[record[0]] = total
+	}
+	return totals, nil
+}
+
+// queryGPUFields queries per-GPU fields, returning their numeric values keyed by
+// GPU UUID and then field name.
+func queryGPUFields(fields []queryField) (map[string]map[string]float64, error) {
+	fields = append([]queryField{{Name: "uuid", Field: "uuid"}}, fields...)
+	out, err := runSMI("--query-gpu="+joinFields(fields), "--format=csv,noheader,nounits")
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseSMICSV(out, len(fields))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]map[string]float64, len(records))
+	for _, record := range records {
+		gpu := make(map[string]float64)
+		for i, f := range fields[1:] {
+			if v, err := strconv.ParseFloat(record[i+1], 64); err == nil {
+				gpu[f.Name] = v
+			}
+		}
+		values[record[0]] = gpu
+	}
+	return values, nil
+}
+
+// parseSMICSV parses nvidia-smi CSV output (as produced by
+// --format=csv,noheader), requiring every record to have exactly the given
+// number of fields. Quoted fields are handled and values are trimmed.
+func parseSMICSV(out []byte, fields int) ([][]string, error) {
+	reader := csv.NewReader(bytes.NewReader(out))
+	reader.FieldsPerRecord = fields
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+	}
+	return records, nil
+}
+
+// parseComputeApps parses the output of a --query-compute-apps query made with
+// the given fields. Non-numeric values such as "[N/A]" are left out of Values.
+func parseComputeApps(out []byte, fields []queryField) ([]gpuProcess, error) {
+	records, err := parseSMICSV(out, len(fields))
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]gpuProcess, 0, len(records))
+	for _, record := range records {
+		p := gpuProcess{Values: make(map[string]float64)}
+		for i, f := range fields {
+			value := record[i]
+			switch f.Field {
+			case "pid":
+				if p.PID, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid pid %q: %v", value, err)
+				}
+			case "used_memory":
+				if p.UsedMemory, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("invalid used_memory %q for PID %d: %v", value, p.PID, err)
+				}
+			case "gpu_uuid":
+				p.GPUUUID = value
+			}
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				p.Values[f.Name] = v
+			}
+		}
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+// smiCapabilities are the query fields the installed nvidia-smi supports, as
+// these vary between driver versions. They're probed once at startup.
+type smiCapabilities struct {
+	computeApps map[string]bool
+	gpu         map[string]bool
+}
+
+// smiCaps holds the probed capabilities for the lifetime of the process. While
+// nil, such as when probing failed, every field is assumed to be supported.
+var smiCaps *smiCapabilities
+
+// probeSMI finds the supported query fields from nvidia-smi's own help, which
+// is harmless to request and lists every field along with any aliases. With
+// -backend xml they're the fields the XML backend can answer.
+func probeSMI() (*smiCapabilities, error) {
+	if smiXML != nil {
+		return smiXML.capabilities(), nil
+	}
+	apps, err := runSMI("--help-query-compute-apps")
+	if err != nil {
+		return nil, err
+	}
+	gpu, err := runSMI("--help-query-gpu")
+	if err != nil {
+		return nil, err
+	}
+	return &smiCapabilities{computeApps: parseHelpFields(apps), gpu: parseHelpFields(gpu)}, nil
+}
+
+// parseHelpFields returns the field names listed in --help-query-* output,
+// which appear quoted at the start of a line, e.g.
+//
+//	"clocks_event_reasons.active" or "clocks_throttle_reasons.active"
+func parseHelpFields(out []byte) map[string]bool {
+	fields := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, `"`) {
+			continue
+		}
+		for i, part := range strings.Split(line, `"`) {
+			// Names are the odd parts, between pairs of quotes
+			if i%2 == 1 && part != "" {
+				fields[part] = true
+			}
+		}
+	}
+	return fields
+}
+
+// supports reports whether nvidia-smi supports a query field.
+func (c *smiCapabilities) supports(f queryField) bool {
+	if c == nil {
+		return true
+	}
+	if f.GPU {
+		return c.gpu[f.Field]
+	}
+	return c.computeApps[f.Field]
+}
+
+// gpuField returns the first of a field's names that nvidia-smi supports, for
+// fields that have been renamed between driver versions, or an empty string if
+// none are.
+func (c *smiCapabilities) gpuField(names ...string) string {
+	for _, name := range names {
+		if c.supports(queryField{Field: name, GPU: true}) {
+			return name
+		}
+	}
+	return ""
+}
+
+// optionalFields are the fields nvidler uses that not every driver supports,
+// beyond any -extraQueryFields.
+var optionalFields = []queryField{
+	{Field: "ecc.errors.uncorrected.aggregate.total", GPU: true},
+	{Field: "fan.speed", GPU: true},
+	{Field: "clocks_throttle_reasons.active", GPU: true},
+	{Field: "temperature.gpu", GPU: true},
+	{Field: "memory.total", GPU: true},
+}
+
+// logCapabilities probes nvidia-smi's capabilities, caching them in smiCaps,
+// and logs which optional fields are available.
+func logCapabilities(extra []queryField, logger *log.Logger) {
+	caps, err := probeSMI()
+	if err != nil {
+		logger.Printf("Failed to probe nvidia-smi for supported fields, assuming all are supported: %v\n", err)
+		return
+	}
+	smiCaps = caps
+
+	var available, unavailable []string
+	for _, f := range append(append([]queryField{}, optionalFields...), extra...) {
+		if contains(available, f.Field) || contains(unavailable, f.Field) {
+			continue
+		}
+		if caps.supports(f) {
+			available = append(available, f.Field)
+		} else {
+			unavailable = append(unavailable, f.Field)
+		}
+	}
+	logger.Printf("nvidia-smi optional fields available: %s; unavailable: %s\n", strings.Join(available, ", "), strings.Join(unavailable, ", "))
+	for _, f := range extra {
+		if !caps.supports(f) {
+			logger.Printf("WARNING: -extraQueryFields field %s isn't supported by this nvidia-smi and won't be queried.\n", f.Field)
+		}
+	}
+}
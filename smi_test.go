@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSMICSV(t *testing.T) {
+	out := []byte(`0, "NVIDIA A100-SXM4-40GB, rev 2", GPU-aaaa
+1,  Tesla T4 ,GPU-bbbb
+`)
+	records, err := parseSMICSV(out, 3)
+	if err != nil {
+		t.Fatalf("parseSMICSV: %v", err)
+	}
+	want := [][]string{
+		{"0", "NVIDIA A100-SXM4-40GB, rev 2", "GPU-aaaa"},
+		{"1", "Tesla T4", "GPU-bbbb"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %q", len(records), len(want), records)
+	}
+	for i := range want {
+		if !equalStrings(records[i], want[i]) {
+			t.Errorf("record %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestParseSMICSVRejectsWrongFieldCount(t *testing.T) {
+	if _, err := parseSMICSV([]byte("1234, 512\n"), 3); err == nil {
+		t.Fatal("parseSMICSV accepted a record with 2 fields, want an error for 3")
+	}
+}
+
+func TestParseComputeApps(t *testing.T) {
+	fields := append(append([]queryField{}, computeAppsFields...), queryField{Name: "name", Field: "process_name"})
+	processes, err := parseComputeApps([]byte("1234, 512, GPU-aaaa, \"python, worker\"\n"), fields)
+	if err != nil {
+		t.Fatalf("parseComputeApps: %v", err)
+	}
+	if len(processes) != 1 {
+		t.Fatalf("got %d processes, want 1", len(processes))
+	}
+	p := processes[0]
+	if p.PID != 1234 || p.UsedMemory != 512 || p.GPUUUID != "GPU-aaaa" {
+		t.Errorf("process = %+v, want PID 1234 using 512 MB on GPU-aaaa", p)
+	}
+	if _, ok := p.Values["name"]; ok {
+		t.Errorf("non-numeric value kept in Values: %v", p.Values)
+	}
+	if p.Values["used_memory"] != 512 {
+		t.Errorf("Values[used_memory] = %v, want 512", p.Values["used_memory"])
+	}
+
+	if _, err := parseComputeApps([]byte("5678, [N/A], GPU-bbbb, python\n"), fields); err == nil {
+		t.Error("parseComputeApps accepted a used_memory of [N/A]")
+	}
+}
+
+func TestExecSMITimesOut(t *testing.T) {
+	e := newTestEnv(t)
+	// A wedged nvidia-smi that never answers
+	pidFile := filepath.Join(e.dir, "nvidia-smi.pid")
+	e.writeScript(filepath.Join(e.dir, "bin", "nvidia-smi"), fmt.Sprintf(`echo $$ > %q
+exec sleep 60`, pidFile))
+	timeout := smiTimeout
+	smiTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { smiTimeout = timeout })
+
+	start := time.Now()
+	_, err := execSMI("--query-gpu=uuid", "--format=csv,noheader")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms and was killed") {
+		t.Fatalf("execSMI = %v, want it to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed > smiKillGrace {
+		t.Errorf("execSMI took %v to give up, want about -smiTimeout", elapsed)
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("the timed out nvidia-smi, PID %d, is still there (%v), want it killed and reaped", pid, err)
+	}
+
+	// A scan that times out fails, counting towards -failSafeAfter
+	cfg := e.config()
+	cfg.FailSafeAfter = 1
+	m := e.monitor(cfg)
+	m.scan()
+	if !m.scanFailed || !m.failSafe.Degraded {
+		t.Errorf("after a timed out scan, scanFailed = %v and Degraded = %v, want both", m.scanFailed, m.failSafe.Degraded)
+	}
+}
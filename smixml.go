@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// xmlNode is an element of nvidia-smi's XML output. The output is read as a
+// generic tree rather than into fixed structs, as elements are added, renamed
+// and moved between driver versions.
+type xmlNode struct {
+	XMLName xml.Name
+	Content string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// child returns the first child element with the given name.
+func (n *xmlNode) child(name string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// text returns the content of the element at the first of the slash-separated
+// paths that exists, or an empty string if none do.
+func (n *xmlNode) text(paths ...string) string {
+	for _, path := range paths {
+		node := n
+		for _, name := range strings.Split(path, "/") {
+			node = node.child(name)
+		}
+		if node != nil {
+			return strings.TrimSpace(node.Content)
+		}
+	}
+	return ""
+}
+
+// children returns the child elements with the given name.
+func (n *xmlNode) children(name string) []*xmlNode {
+	if n == nil {
+		return nil
+	}
+	var nodes []*xmlNode
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			nodes = append(nodes, &n.Nodes[i])
+		}
+	}
+	return nodes
+}
+
+// xmlValue converts a value from the XML output to how it appears in CSV output
+// without units: "300 MiB" becomes 300, and values that aren't available
+// become [N/A].
+func xmlValue(s string) string {
+	switch s {
+	case "", "N/A", "Not Supported", "Unknown Error":
+		return "[N/A]"
+	}
+	if fields := strings.Fields(s); len(fields) == 2 {
+		if _, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			return fields[0]
+		}
+	}
+	return s
+}
+
+// xmlGPUFields are the --query-gpu fields the XML backend can answer, as the
+// path or paths to their element under <gpu>.
+var xmlGPUFields = map[string][]string{
+	"uuid":                {"uuid"},
+	"name":                {"product_name"},
+	"memory.total":        {"fb_memory_usage/total"},
+	"memory.used":         {"fb_memory_usage/used"},
+	"memory.free":         {"fb_memory_usage/free"},
+	"utilization.gpu":     {"utilization/gpu_util"},
+	"utilization.memory":  {"utilization/memory_util"},
+	"utilization.encoder": {"utilization/encoder_util"},
+	"utilization.decoder": {"utilization/decoder_util"},
+	"accounting.mode":     {"accounting_mode"},
+	"temperature.gpu":     {"temperature/gpu_temp"},
+	"fan.speed":           {"fan_speed"},
+	"power.draw":          {"power_readings/power_draw", "gpu_power_readings/power_draw", "gpu_power_readings/instant_power_draw"},
+	"clocks.sm":           {"clocks/sm_clock"},
+	"clocks.mem":          {"clocks/mem_clock"},
+	"mig.mode.current":    {"mig_mode/current_mig"},
+}
+
+// xmlComputedGPUFields are the --query-gpu fields the XML backend derives from
+// several elements.
+var xmlComputedGPUFields = map[string]func(gpu *xmlNode) string{
+	"ecc.errors.uncorrected.aggregate.total": xmlECCErrors,
+	"clocks_throttle_reasons.active":         xmlClockReasons,
+	"clocks_event_reasons.active":            xmlClockReasons,
+}
+
+// xmlProcessFields are the --query-compute-apps fields the XML backend can
+// answer, as the path to their element under <process_info>.
+var xmlProcessFields = map[string]string{
+	"pid":             "pid",
+	"used_memory":     "used_memory",
+	"used_gpu_memory": "used_memory",
+	"process_name":    "process_name",
+	"name":            "process_name",
+}
+
+// xmlECCErrors totals a GPU's aggregate uncorrected ECC errors. Newer GPUs
+// split them between SRAM and DRAM, with SRAM further split into parity and
+// SEC-DED errors by newer drivers, while older ones report double bit errors.
+func xmlECCErrors(gpu *xmlNode) string {
+	aggregate := gpu.child("ecc_errors").child("aggregate")
+	if aggregate == nil {
+		return "[N/A]"
+	}
+	var parts []string
+	switch {
+	case aggregate.child("sram_uncorrectable") != nil:
+		parts = []string{"sram_uncorrectable", "dram_uncorrectable"}
+	case aggregate.child("sram_uncorrectable_parity") != nil:
+		parts = []string{"sram_uncorrectable_parity", "sram_uncorrectable_secded", "dram_uncorrectable"}
+	default:
+		parts = []string{"double_bit/total"}
+	}
+
+	var total int64
+	for _, part := range parts {
+		value := aggregate.text(part)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "[N/A]"
+		}
+		total += n
+	}
+	return strconv.FormatInt(total, 10)
+}
+
+// xmlClockReasonBits are the bits of the clock throttle reasons bitmask, by the
+// suffix of their element in the XML output.
+var xmlClockReasonBits = map[string]uint64{
+	"gpu_idle":                    0x1,
+	"applications_clocks_setting": 0x2,
+	"sw_power_cap":                0x4,
+	"hw_slowdown":                 0x8,
+	"sync_boost":                  0x10,
+	"sw_thermal_slowdown":         0x20,
+	"hw_thermal_slowdown":         0x40,
+	"hw_power_brake_slowdown":     0x80,
+	"display_clocks_setting":      0x100,
+}
+
+// xmlClockReasons rebuilds the bitmask of a GPU's active clock throttle
+// reasons, which the XML output lists as separate elements, under either their
+// older throttle or newer event name.
+func xmlClockReasons(gpu *xmlNode) string {
+	reasons := gpu.child("clocks_event_reasons")
+	if reasons == nil {
+		reasons = gpu.child("clocks_throttle_reasons")
+	}
+	if reasons == nil {
+		return "[N/A]"
+	}
+	var active uint64
+	for _, reason := range reasons.Nodes {
+		name := reason.XMLName.Local
+		if i := strings.Index(name, "reason_"); i >= 0 && strings.TrimSpace(reason.Content) == "Active" {
+			active |= xmlClockReasonBits[name[i+len("reason_"):]]
+		}
+	}
+	return fmt.Sprintf("0x%016X", active)
+}
+
+// xmlBackend answers nvidia-smi queries from a single nvidia-smi -q -x call per
+// scan, for -backend xml. Queries it can't answer, such as pmon, still run
+// nvidia-smi.
+type xmlBackend struct {
+	mu   sync.Mutex
+	root *xmlNode // the latest output, nil until it's next needed
+	err  error
+}
+
+// smiXML is the XML backend, or nil when using the CSV queries.
+var smiXML *xmlBackend
+
+// invalidate discards the latest output, so the next query reads it afresh.
+// It's called at the start of each scan.
+func (b *xmlBackend) invalidate() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.root, b.err = nil, nil
+}
+
+// snapshot returns the latest output, running nvidia-smi if it's needed. A
+// failure is kept until the next scan, rather than retried by every query.
+func (b *xmlBackend) snapshot() (*xmlNode, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.root != nil || b.err != nil {
+		return b.root, b.err
+	}
+
+	out, err := execSMI("-q", "-x")
+	if err != nil {
+		b.err = err
+		return nil, err
+	}
+	root := &xmlNode{}
+	if err := xml.Unmarshal(out, root); err != nil {
+		b.err = fmt.Errorf("failed to parse nvidia-smi XML: %v", err)
+		return nil, b.err
+	}
+	b.root = root
+	return root, nil
+}
+
+// capabilities returns the query fields the XML backend can answer.
+func (b *xmlBackend) capabilities() *smiCapabilities {
+	caps := &smiCapabilities{computeApps: map[string]bool{"gpu_uuid": true}, gpu: map[string]bool{"index": true}}
+	for field := range xmlProcessFields {
+		caps.computeApps[field] = true
+	}
+	for field := range xmlGPUFields {
+		caps.gpu[field] = true
+	}
+	for field := range xmlComputedGPUFields {
+		caps.gpu[field] = true
+	}
+	return caps
+}
+
+// query answers a --query-gpu or --query-compute-apps call made with
+// --format=csv,noheader,nounits with the output nvidia-smi would give,
+// reporting false for any other call.
+func (b *xmlBackend) query(args []string) ([]byte, bool, error) {
+	if len(args) != 2 || args[1] != "--format=csv,noheader,nounits" {
+		return nil, false, nil
+	}
+	var fields []string
+	var rows func(root *xmlNode, fields []string) ([][]string, error)
+	if spec, ok := strings.CutPrefix(args[0], "--query-gpu="); ok {
+		fields, rows = strings.Split(spec, ","), xmlGPURows
+	} else if spec, ok := strings.CutPrefix(args[0], "--query-compute-apps="); ok {
+		fields, rows = strings.Split(spec, ","), xmlProcessRows
+	} else {
+		return nil, false, nil
+	}
+
+	root, err := b.snapshot()
+	if err != nil {
+		return nil, true, err
+	}
+	records, err := rows(root, fields)
+	if err != nil {
+		return nil, true, err
+	}
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.WriteAll(records)
+	return out.Bytes(), true, w.Error()
+}
+
+// xmlGPURows renders a --query-gpu query. GPUs are listed in index order, the
+// order nvidia-smi outputs them in.
+func xmlGPURows(root *xmlNode, fields []string) ([][]string, error) {
+	var records [][]string
+	for index, gpu := range root.children("gpu") {
+		record := make([]string, len(fields))
+		for i, field := range fields {
+			switch {
+			case field == "index":
+				record[i] = strconv.Itoa(index)
+			case xmlComputedGPUFields[field] != nil:
+				record[i] = xmlComputedGPUFields[field](gpu)
+			case xmlGPUFields[field] != nil:
+				record[i] = xmlValue(gpu.text(xmlGPUFields[field]...))
+			default:
+				return nil, fmt.Errorf("field %s isn't available with -backend xml", field)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// xmlProcessRows renders a --query-compute-apps query, leaving out graphics
+// only processes as nvidia-smi does.
+func xmlProcessRows(root *xmlNode, fields []string) ([][]string, error) {
+	var records [][]string
+	for _, gpu := range root.children("gpu") {
+		for _, process := range gpu.child("processes").children("process_info") {
+			if kind := process.text("type"); kind != "" && !strings.Contains(kind, "C") {
+				continue
+			}
+			record := make([]string, len(fields))
+			for i, field := range fields {
+				switch path, ok := xmlProcessFields[field]; {
+				case field == "gpu_uuid":
+					record[i] = gpu.text("uuid")
+				case ok:
+					record[i] = xmlValue(process.text(path))
+				default:
+					return nil, fmt.Errorf("field %s isn't available with -backend xml", field)
+				}
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// takeSnapshot records the GPU state and a process's memory map to a new
+// directory under dir, named after the PID and time, returning its path. This
+// preserves what's needed to investigate a suspected leak after the process is
+// gone.
+func takeSnapshot(dir string, pid int, now time.Time) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s", pid, now.Format("20060102T150405")))
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return "", err
+	}
+
+	out, err := runSMI("-q")
+	if err != nil {
+		return path, fmt.Errorf("failed to dump GPU state: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "nvidia-smi.txt"), out, 0640); err != nil {
+		return path, err
+	}
+
+	// smaps_rollup summarises smaps and is much smaller, but needs Linux 4.14+
+	smaps, err := os.ReadFile(procPath(pid, "smaps_rollup"))
+	if err != nil {
+		if smaps, err = os.ReadFile(procPath(pid, "smaps")); err != nil {
+			return path, fmt.Errorf("failed to read memory map: %v", err)
+		}
+	}
+	return path, os.WriteFile(filepath.Join(path, "smaps.txt"), smaps, 0640)
+}
+
+// pruneSnapshots removes the oldest snapshots under dir until their total size
+// is no more than maxBytes.
+func pruneSnapshots(dir string, maxBytes int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type snapshot struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var snapshots []snapshot
+	var total int64
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s := snapshot{path: filepath.Join(dir, entry.Name())}
+		filepath.WalkDir(s.path, func(_ string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					s.size += info.Size()
+				}
+			}
+			return nil
+		})
+		if info, err := entry.Info(); err == nil {
+			s.modTime = info.ModTime()
+		}
+		snapshots = append(snapshots, s)
+		total += s.size
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].modTime.Before(snapshots[j].modTime) })
+	for _, s := range snapshots {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.RemoveAll(s.path); err != nil {
+			return err
+		}
+		total -= s.size
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stateFileSchema is the version of the -stateFile format, increased whenever
+// a field is changed or removed rather than just added.
+const stateFileSchema = 1
+
+// recentActionsKept is how many of the latest events -stateFile includes.
+const recentActionsKept = 50
+
+// lastState is nvidler's state as of the latest scan, written to -stateFile for
+// dashboards and scripts that can't or shouldn't query the API.
+type lastState struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Time          time.Time       `json:"time"`
+	Hostname      string          `json:"hostname"`
+	Degraded      bool            `json:"degraded"` // only warning after failed scans
+	GPUs          []gpuUsage      `json:"gpus"`
+	GPUError      string          `json:"gpuError,omitempty"` // why the GPUs couldn't be queried
+	Processes     []processMemory `json:"processes"`
+	RecentActions []event         `json:"recentActions"` // oldest first
+}
+
+// gpuUsage is a GPU's utilization as of the latest scan.
+type gpuUsage struct {
+	Index             int     `json:"index"`
+	UUID              string  `json:"uuid"`
+	Utilization       float64 `json:"utilization"`       // percent of time a kernel was running
+	MemoryUtilization float64 `json:"memoryUtilization"` // percent of time memory was read or written
+	MemoryUsedMB      int     `json:"memoryUsedMB"`
+	MemoryTotalMB     int     `json:"memoryTotalMB"`
+}
+
+var gpuUsageFields = []queryField{
+	{Name: "index", Field: "index"},
+	{Name: "utilization", Field: "utilization.gpu"},
+	{Name: "memory_utilization", Field: "utilization.memory"},
+	{Name: "memory_used", Field: "memory.used"},
+	{Name: "memory_total", Field: "memory.total"},
+}
+
+// queryGPUUsage returns the utilization of every GPU. Readings a GPU doesn't
+// report are left as 0.
+func queryGPUUsage() ([]gpuUsage, error) {
+	values, err := queryGPUFields(gpuUsageFields)
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]gpuUsage, 0, len(values))
+	for uuid, v := range values {
+		usage = append(usage, gpuUsage{
+			Index:             int(v["index"]),
+			UUID:              uuid,
+			Utilization:       v["utilization"],
+			MemoryUtilization: v["memory_utilization"],
+			MemoryUsedMB:      int(v["memory_used"]),
+			MemoryTotalMB:     int(v["memory_total"]),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Index < usage[j].Index })
+	return usage, nil
+}
+
+// recentEvents is a sink keeping the latest events for -stateFile.
+type recentEvents struct {
+	mu     sync.Mutex
+	events []event
+}
+
+func (r *recentEvents) send(e event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	if len(r.events) > recentActionsKept {
+		r.events = append([]event(nil), r.events[len(r.events)-recentActionsKept:]...)
+	}
+	return nil
+}
+
+func (r *recentEvents) list() []event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]event{}, r.events...)
+}
+
+// restorePeaks seeds the memory peaks from the processes in -stateFile, written
+// before nvidler last stopped, so a restart doesn't forget how much memory the
+// processes still running used.
+func (m *monitor) restorePeaks() {
+	data, err := os.ReadFile(m.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var state lastState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err == nil && state.SchemaVersion != stateFileSchema {
+		err = fmt.Errorf("schema version %d, want %d", state.SchemaVersion, stateFileSchema)
+	}
+	if err != nil {
+		m.logger.Printf("Failed to read the peak memory use of processes from -stateFile %s: %v\n", m.cfg.StateFile, err)
+		return
+	}
+	if restored := m.peaks.restore(state.Processes, processStartTime); restored > 0 {
+		m.logger.Printf("Restored the peak memory use of %d processes from -stateFile %s.\n", restored, m.cfg.StateFile)
+	}
+}
+
+// writeState writes the state as of the latest scan to -stateFile.
+func (m *monitor) writeState() {
+	state := lastState{
+		SchemaVersion: stateFileSchema,
+		Time:          m.clock.Now(),
+		Degraded:      m.failSafe.Degraded,
+		Processes:     m.peaks.list(),
+		RecentActions: m.recent.list(),
+	}
+	state.Hostname, _ = os.Hostname()
+	var err error
+	if state.GPUs, err = queryGPUUsage(); err != nil {
+		state.GPUError = err.Error()
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = replaceFile(m.cfg.StateFile, append(data, '\n'))
+	}
+	if err != nil {
+		m.logger.Printf("Failed to write -stateFile %s: %v\n", m.cfg.StateFile, err)
+	}
+}
+
+// replaceFile atomically replaces a file's contents, by writing them to a
+// temporary file in the same directory and renaming it over the file, so
+// readers see either the old contents or the new, never a partial write.
+func replaceFile(path string, data []byte) error {
+	return replaceFileMode(path, data, 0644)
+}
+
+// replaceFileMode is replaceFile leaving the new contents with the given
+// permissions, which they have before they're in place.
+func replaceFileMode(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
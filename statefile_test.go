@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReplaceFileIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	old, updated := bytes.Repeat([]byte("a"), 1<<20), bytes.Repeat([]byte("b"), 1<<20)
+	if err := replaceFile(path, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader racing the replacements only ever sees one version whole
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("reading while it was replaced: %v", err)
+				return
+			}
+			if !bytes.Equal(data, old) && !bytes.Equal(data, updated) {
+				t.Errorf("read a partial write of %d bytes", len(data))
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		contents := old
+		if i%2 == 0 {
+			contents = updated
+		}
+		if err := replaceFile(path, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// A reader that opened the file before it was replaced keeps the old version
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := replaceFile(path, []byte("replaced\n")); err != nil {
+		t.Fatal(err)
+	}
+	var before bytes.Buffer
+	if _, err := before.ReadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before.Bytes(), old) {
+		t.Errorf("open file changed to %d bytes when replaced, want the old contents", before.Len())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("directory has %s, want only state.json with no temporary files left", strings.Join(names, ", "))
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Errorf("replaced file mode = %v, want 0644", info.Mode().Perm())
+	}
+}
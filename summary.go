@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tally accumulates the actions taken over a period of time.
+type tally struct {
+	Warnings    int
+	Terminated  int
+	IdleSeconds float64 // idle time held by processes when terminated, weighted by their share of the GPU
+	Leaked      int     // warnings and terminations for leaked CUDA contexts
+	ByUser      map[string]int
+	ByContainer map[string]int
+}
+
+func newTally() tally {
+	return tally{ByUser: make(map[string]int), ByContainer: make(map[string]int)}
+}
+
+// summary tracks actions for the current reporting window as well as over the
+// lifetime of the monitor.
+type summary struct {
+	clock       clock
+	windowStart time.Time
+	window      tally
+	lifetime    tally
+	telemetry   tally // since the last -telemetryEndpoint report
+}
+
+func newSummary(clk clock) *summary {
+	return &summary{clock: clk, windowStart: clk.Now(), window: newTally(), lifetime: newTally(), telemetry: newTally()}
+}
+
+// recordWarning counts a warning issued for an idle process.
+func (s *summary) recordWarning(user, container string) {
+	for _, t := range []*tally{&s.window, &s.lifetime, &s.telemetry} {
+		t.Warnings++
+		t.addOffender(user, container)
+	}
+}
+
+// recordTermination counts a process terminated after being idle for idle,
+// holding share of its GPU. On a shared GPU only the process's share of the
+// idle time was wasted.
+func (s *summary) recordTermination(user, container string, idle time.Duration, share float64) {
+	if share <= 0 || share > 1 {
+		share = 1
+	}
+	for _, t := range []*tally{&s.window, &s.lifetime, &s.telemetry} {
+		t.Terminated++
+		t.IdleSeconds += idle.Seconds() * share
+		t.addOffender(user, container)
+	}
+}
+
+// recordLeakedContext counts a warning or termination as being for a leaked
+// CUDA context.
+func (s *summary) recordLeakedContext() {
+	for _, t := range []*tally{&s.window, &s.lifetime, &s.telemetry} {
+		t.Leaked++
+	}
+}
+
+func (t *tally) addOffender(user, container string) {
+	if user != "" {
+		t.ByUser[user]++
+	}
+	if container != "" {
+		t.ByContainer[container]++
+	}
+}
+
+// due reports whether a digest should be emitted for the given interval.
+func (s *summary) due(interval time.Duration) bool {
+	return interval > 0 && s.clock.Now().Sub(s.windowStart) >= interval
+}
+
+// report emits a digest of the current window and lifetime totals, then starts
+// a new window.
+func (s *summary) report(events *notifier) {
+	window := s.clock.Now().Sub(s.windowStart).Round(time.Second)
+	events.emit(event{
+		Action:  actionSummary,
+		Message: fmt.Sprintf("SUMMARY: In the last %s: %s. Lifetime: %s.", window, s.window.describe(), s.lifetime.describe()),
+	})
+
+	s.window = newTally()
+	s.windowStart = s.clock.Now()
+}
+
+// takeTelemetry returns the actions tallied since the last -telemetryEndpoint
+// report, and starts tallying again.
+func (s *summary) takeTelemetry() tally {
+	t := s.telemetry
+	s.telemetry = newTally()
+	return t
+}
+
+func (t tally) describe() string {
+	return fmt.Sprintf("%d warnings issued, %d processes terminated, %d of them for leaked CUDA contexts, %.2f idle GPU-hours reclaimed, top users: %s, top containers: %s",
+		t.Warnings, t.Terminated, t.Leaked, t.IdleSeconds/3600, topOffenders(t.ByUser, 3), topOffenders(t.ByContainer, 3))
+}
+
+// topOffenders formats the n keys with the highest counts, most frequent first.
+func topOffenders(counts map[string]int, n int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s (%d)", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
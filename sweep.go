@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Outcomes of terminating a process, in termination reports.
+const (
+	outcomeSent         = "sent"         // signalled, evicted, cancelled or stopped
+	outcomeEscalated    = "escalated"    // sent a later rung of -signalLadder
+	outcomeNotPermitted = "notPermitted" // nvidler wasn't permitted to signal it
+	outcomeAlreadyGone  = "alreadyGone"  // it exited before it could be signalled
+	outcomeFailed       = "failed"       // any other failure
+
+	// Outcomes of checking on the next scan that a process is gone
+	outcomeGone         = "gone"
+	outcomeStillRunning = "stillRunning"
+)
+
+// outcomeOrder is the order outcomes are counted in a report's message.
+var outcomeOrder = []string{outcomeSent, outcomeEscalated, outcomeNotPermitted, outcomeAlreadyGone, outcomeFailed, outcomeGone, outcomeStillRunning}
+
+// killError is a failure to signal a process, with its outcome.
+type killError struct {
+	outcome string
+	message string
+}
+
+func (e *killError) Error() string {
+	return e.message
+}
+
+// killOutcome is what became of one process a scan set out to terminate.
+type killOutcome struct {
+	PID       int    `json:"pid"`
+	Process   string `json:"process"`
+	Container string `json:"container,omitempty"`
+	GPU       string `json:"gpu,omitempty"`
+	Outcome   string `json:"outcome"`
+	Error     string `json:"error,omitempty"`
+}
+
+// sweepReport is the consolidated record of a scan's terminations, and of
+// whether those of the scan before took effect.
+type sweepReport struct {
+	Terminations []killOutcome `json:"terminations,omitempty"`
+	Verified     []killOutcome `json:"verified,omitempty"`
+}
+
+// pendingKill is a process signalled on the last scan, to check it's gone.
+type pendingKill struct {
+	outcome   killOutcome
+	startTime time.Time
+}
+
+// recordKill records the outcome of terminating a process in the scan's
+// report, returning it. err is whatever terminating it returned.
+func (m *monitor) recordKill(state *scanState, c candidate, err error) string {
+	o := killOutcome{PID: c.PID, Process: c.Name, Container: c.Container, GPU: c.GPUUUID, Outcome: outcomeSent}
+	var kerr *killError
+	switch {
+	case errors.As(err, &kerr):
+		o.Outcome, o.Error = kerr.outcome, err.Error()
+	case err != nil:
+		o.Outcome, o.Error = outcomeFailed, err.Error()
+	case m.ladderProgress[c.PID] != nil && m.ladderProgress[c.PID].next > 1:
+		o.Outcome = outcomeEscalated
+	}
+	state.sweep.Terminations = append(state.sweep.Terminations, o)
+	if o.Outcome == outcomeSent || o.Outcome == outcomeEscalated {
+		m.unverified[c.PID] = pendingKill{outcome: o, startTime: c.StartTime}
+	}
+	return o.Outcome
+}
+
+// verifyKills checks that each process signalled on the last scan is gone,
+// logging whether it is unless that's left to the report. A process whose PID has been reused since, going by
+// its start time, is gone too.
+func (m *monitor) verifyKills(state *scanState) {
+	for pid, pending := range m.unverified {
+		o := pending.outcome
+		o.Outcome, o.Error = outcomeGone, ""
+		if _, err := os.Stat(procPath(pid, "stat")); err == nil {
+			if start, err := processStartTime(pid); err != nil || pending.startTime.IsZero() || start.Equal(pending.startTime) {
+				o.Outcome = outcomeStillRunning
+			}
+		}
+		switch {
+		case m.cfg.BatchTerminations:
+			// Left to the report
+		case o.Outcome == outcomeGone:
+			m.logger.Printf("Verified: PID %d (%s) is gone since it was terminated.\n", pid, o.Process)
+		default:
+			m.logger.Printf("Verification failed: PID %d (%s) is still running a scan after it was terminated.\n", pid, o.Process)
+		}
+		state.sweep.Verified = append(state.sweep.Verified, o)
+		delete(m.unverified, pid)
+	}
+}
+
+// emitKill emits the event for an attempt to terminate a process, which with
+// -batchTerminations only the scan's report is logged for.
+func (m *monitor) emitKill(e event) {
+	e.batched = m.cfg.BatchTerminations
+	m.events.emit(e)
+}
+
+// reportSweep emits a scan's terminations, and the verification of the last
+// scan's, as a single report event, if there were any.
+func (m *monitor) reportSweep(state *scanState) {
+	report := state.sweep
+	if len(report.Terminations) == 0 && len(report.Verified) == 0 {
+		return
+	}
+	var parts []string
+	if n := len(report.Terminations); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d terminated this scan (%s)", n, countOutcomes(report.Terminations)))
+	}
+	if n := len(report.Verified); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d terminated last scan checked (%s)", n, countOutcomes(report.Verified)))
+	}
+	message := fmt.Sprintf("TERMINATION REPORT: %s.", strings.Join(parts, ", "))
+
+	// With -batchTerminations nothing else is logged about the processes, so
+	// they're named
+	if m.cfg.BatchTerminations {
+		if len(report.Terminations) > 0 {
+			message += " Terminated: " + listOutcomes(report.Terminations) + "."
+		}
+		if len(report.Verified) > 0 {
+			message += " Checked: " + listOutcomes(report.Verified) + "."
+		}
+	}
+	m.events.emit(event{
+		Action:  actionReport,
+		Message: message,
+		Report:  &report,
+	})
+}
+
+// listOutcomes lists each process with its outcome.
+func listOutcomes(outcomes []killOutcome) string {
+	var parts []string
+	for _, o := range outcomes {
+		parts = append(parts, fmt.Sprintf("PID %d (%s) %s", o.PID, o.Process, o.Outcome))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// countOutcomes describes how many of the outcomes there were of each kind.
+func countOutcomes(outcomes []killOutcome) string {
+	counts := make(map[string]int)
+	for _, o := range outcomes {
+		counts[o.Outcome]++
+	}
+	var parts []string
+	for _, outcome := range outcomeOrder {
+		if counts[outcome] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[outcome], outcome))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
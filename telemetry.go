@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// telemetrySchema is the version of the -telemetryEndpoint payload, increased
+// whenever a field is changed or removed rather than just added.
+const telemetrySchema = 1
+
+// telemetryBackoff is how long a failed report waits before it's sent again at
+// first, doubling with each failure up to telemetryMaxBackoff.
+const (
+	telemetryBackoff    = 30 * time.Second
+	telemetryMaxBackoff = time.Hour
+)
+
+// telemetryReport is the anonymized summary sent to -telemetryEndpoint. It has
+// no hostnames, users, containers, processes or GPU UUIDs, unless
+// -telemetryIdentify adds the hostname and the actions taken by user.
+type telemetryReport struct {
+	SchemaVersion     int            `json:"schemaVersion"`
+	PeriodStart       time.Time      `json:"periodStart"`
+	PeriodEnd         time.Time      `json:"periodEnd"`
+	GPUs              int            `json:"gpus"`
+	WarningOnly       bool           `json:"warningOnly"`
+	Warnings          int            `json:"warnings"`
+	Terminations      int            `json:"terminations"`
+	ReclaimedGPUHours float64        `json:"reclaimedGPUHours"`
+	Hostname          string         `json:"hostname,omitempty"`      // with -telemetryIdentify
+	ActionsByUser     map[string]int `json:"actionsByUser,omitempty"` // warnings and terminations, with -telemetryIdentify
+}
+
+// merge folds a later report into one that hasn't been sent yet, so counts
+// aren't lost while the endpoint is unreachable.
+func (r *telemetryReport) merge(later telemetryReport) {
+	r.PeriodEnd = later.PeriodEnd
+	r.GPUs = later.GPUs
+	r.WarningOnly = later.WarningOnly
+	r.Warnings += later.Warnings
+	r.Terminations += later.Terminations
+	r.ReclaimedGPUHours += later.ReclaimedGPUHours
+	r.Hostname = later.Hostname
+	for user, n := range later.ActionsByUser {
+		if r.ActionsByUser == nil {
+			r.ActionsByUser = make(map[string]int)
+		}
+		r.ActionsByUser[user] += n
+	}
+}
+
+// telemetry sends a report to -telemetryEndpoint every -telemetryInterval. It's
+// sent from its own goroutine, retrying with backoff, so an unreachable or slow
+// endpoint never holds up scanning.
+type telemetry struct {
+	clock       clock
+	logger      *log.Logger
+	client      *http.Client
+	endpoint    string
+	windowStart time.Time
+
+	mu     sync.Mutex
+	queued *telemetryReport // the report waiting to be sent, if any
+	wake   chan struct{}
+}
+
+func newTelemetry(endpoint string, clk clock, logger *log.Logger) *telemetry {
+	t := &telemetry{
+		clock:       clk,
+		logger:      logger,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		endpoint:    endpoint,
+		windowStart: clk.Now(),
+		wake:        make(chan struct{}, 1),
+	}
+	go t.deliver()
+	return t
+}
+
+// due reports whether a report should be sent for the given interval.
+func (t *telemetry) due(interval time.Duration) bool {
+	return interval > 0 && t.clock.Now().Sub(t.windowStart) >= interval
+}
+
+// reportTelemetry builds the report for the current window from the actions
+// tallied since the last, and queues it to be sent.
+func (m *monitor) reportTelemetry() {
+	t := m.telemetry
+	now := m.clock.Now()
+	tally := m.stats.takeTelemetry()
+	r := telemetryReport{
+		SchemaVersion:     telemetrySchema,
+		PeriodStart:       t.windowStart,
+		PeriodEnd:         now,
+		WarningOnly:       m.cfg.WarningOnly,
+		Warnings:          tally.Warnings,
+		Terminations:      tally.Terminated,
+		ReclaimedGPUHours: tally.IdleSeconds / 3600,
+	}
+	if gpus, err := queryGPUs(); err == nil {
+		r.GPUs = len(gpus)
+	}
+	if m.cfg.TelemetryIdentify {
+		r.Hostname, _ = os.Hostname()
+		r.ActionsByUser = tally.ByUser
+	}
+	t.windowStart = now
+	t.queue(r)
+}
+
+// queue hands a report to the sending goroutine without waiting, merging it
+// into any report still waiting to be sent.
+func (t *telemetry) queue(r telemetryReport) {
+	t.mu.Lock()
+	if t.queued != nil {
+		t.queued.merge(r)
+	} else {
+		t.queued = &r
+	}
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued reports until nvidler exits. A report that fails to be
+// sent is retried with exponential backoff, taking in any reports queued in
+// the meantime when it is.
+func (t *telemetry) deliver() {
+	var pending *telemetryReport
+	backoff := telemetryBackoff
+	for {
+		if pending == nil {
+			<-t.wake
+		}
+		t.mu.Lock()
+		if t.queued != nil {
+			if pending == nil {
+				pending = t.queued
+			} else {
+				pending.merge(*t.queued)
+			}
+			t.queued = nil
+		}
+		t.mu.Unlock()
+		if pending == nil {
+			continue
+		}
+
+		err := t.send(*pending)
+		if err == nil {
+			pending = nil
+			backoff = telemetryBackoff
+			continue
+		}
+		t.logger.Printf("Failed to send telemetry to %s, retrying in %v: %v\n", redactedURL(t.endpoint), backoff, err)
+		t.clock.Sleep(backoff)
+		backoff = min(2*backoff, telemetryMaxBackoff)
+	}
+}
+
+func (t *telemetry) send(r telemetryReport) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("telemetry endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// redactedURL returns a URL with any password removed, for logging.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[invalid URL]"
+	}
+	return u.Redacted()
+}
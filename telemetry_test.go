@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// telemetryPayload scans a node with one process warned about and one
+// terminated, sends a -telemetryEndpoint report and returns the payload
+// received.
+func telemetryPayload(t *testing.T, identify bool) []byte {
+	t.Helper()
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer server.Close()
+
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0")
+	cfg := e.config()
+	cfg.TelemetryIdentify = identify
+	m := e.monitor(cfg)
+	m.telemetry = newTelemetry(server.URL, e.clock, log.New(io.Discard, "", 0))
+
+	m.scan()
+	cfg.WarningOnly = false
+	if err := m.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 2048", "1002, 0")
+	e.clock.Sleep(time.Hour)
+	m.scan()
+	m.reportTelemetry()
+
+	select {
+	case payload := <-received:
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("no telemetry report was sent")
+		return nil
+	}
+}
+
+func TestTelemetryPayload(t *testing.T) {
+	payload := telemetryPayload(t, false)
+	var report map[string]interface{}
+	if err := json.Unmarshal(payload, &report); err != nil {
+		t.Fatalf("payload %s: %v", payload, err)
+	}
+
+	// Exactly the documented fields are sent, with nothing identifying
+	var fields []string
+	for field := range report {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	if want := []string{"gpus", "periodEnd", "periodStart", "reclaimedGPUHours", "schemaVersion", "terminations", "warningOnly", "warnings"}; !equalStrings(fields, want) {
+		t.Errorf("payload fields = %v, want %v", fields, want)
+	}
+	for field, want := range map[string]interface{}{
+		"schemaVersion": float64(telemetrySchema),
+		"gpus":          float64(1),
+		"warningOnly":   false,
+		"warnings":      float64(1),
+		"terminations":  float64(1),
+		"periodStart":   testEpoch.Format(time.RFC3339),
+		"periodEnd":     testEpoch.Add(time.Hour).Format(time.RFC3339),
+	} {
+		if report[field] != want {
+			t.Errorf("%s = %v, want %v", field, report[field], want)
+		}
+	}
+	if hours, _ := report["reclaimedGPUHours"].(float64); hours <= 0 {
+		t.Errorf("reclaimedGPUHours = %v, want the terminated process's idle time", report["reclaimedGPUHours"])
+	}
+	hostname, _ := os.Hostname()
+	for _, identifying := range []string{hostname, "python", "1001", "1002", testGPU, "root"} {
+		if strings.Contains(string(payload), identifying) {
+			t.Errorf("payload contains %q: %s", identifying, payload)
+		}
+	}
+}
+
+func TestTelemetryPayloadIdentified(t *testing.T) {
+	var report telemetryReport
+	if err := json.Unmarshal(telemetryPayload(t, true), &report); err != nil {
+		t.Fatal(err)
+	}
+	if hostname, _ := os.Hostname(); report.Hostname != hostname {
+		t.Errorf("hostname = %q, want %q with -telemetryIdentify", report.Hostname, hostname)
+	}
+	if got := report.ActionsByUser["root"]; got != 2 {
+		t.Errorf("actionsByUser = %v, want 2 for root, who owns the processes, with -telemetryIdentify", report.ActionsByUser)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// gpuTemperature is the latest temperature reading for a GPU.
+type gpuTemperature struct {
+	Index       int        `json:"index"`
+	UUID        string     `json:"uuid"`
+	Temperature int        `json:"temperature"`
+	OverSince   *time.Time `json:"overSince,omitempty"` // when it went over -tempThreshold
+
+	alerted bool
+}
+
+// thermalMonitor watches GPU temperatures, alerting when a GPU stays above a
+// threshold rather than on every brief spike.
+type thermalMonitor struct {
+	clock clock
+	temps map[string]*gpuTemperature // by GPU UUID
+}
+
+func newThermalMonitor(clk clock) *thermalMonitor {
+	return &thermalMonitor{clock: clk, temps: make(map[string]*gpuTemperature)}
+}
+
+// check reads the GPU temperatures. A GPU going over threshold is logged, and
+// raises a critical alert once it has stayed over for sustain.
+func (t *thermalMonitor) check(events *notifier, threshold int, sustain time.Duration) {
+	logger := events.logger
+
+	out, err := runSMI("--query-gpu=index,uuid,temperature.gpu", "--format=csv,noheader,nounits")
+	if err != nil {
+		logger.Printf("Failed to query GPU temperatures: %v\n", err)
+		return
+	}
+	records, err := parseSMICSV(out, 3)
+	if err != nil {
+		logger.Printf("Failed to parse GPU temperatures: %v\n", err)
+		return
+	}
+
+	now := t.clock.Now()
+	for _, record := range records {
+		index, err := strconv.Atoi(record[0])
+		if err != nil {
+			continue
+		}
+		temperature, err := strconv.Atoi(record[2])
+		if err != nil {
+			// The temperature isn't available for this GPU
+			continue
+		}
+		uuid := record[1]
+
+		gpu, ok := t.temps[uuid]
+		if !ok {
+			gpu = &gpuTemperature{Index: index, UUID: uuid}
+			t.temps[uuid] = gpu
+		}
+		gpu.Temperature = temperature
+
+		switch {
+		case temperature > threshold && gpu.OverSince == nil:
+			gpu.OverSince = &now
+			logger.Printf("GPU %d (%s) is at %d°C, above -tempThreshold of %d°C.\n", index, uuid, temperature, threshold)
+		case temperature > threshold && !gpu.alerted && now.Sub(*gpu.OverSince) >= sustain:
+			gpu.alerted = true
+			events.emit(event{
+				Action:  actionCritical,
+				Message: fmt.Sprintf("CRITICAL: GPU %d (%s) has been above %d°C for %v, currently %d°C.", index, uuid, threshold, now.Sub(*gpu.OverSince).Truncate(time.Second), temperature),
+				GPU:     uuid,
+			})
+		case temperature <= threshold && gpu.OverSince != nil:
+			logger.Printf("GPU %d (%s) is back down to %d°C after %v above -tempThreshold.\n", index, uuid, temperature, now.Sub(*gpu.OverSince).Truncate(time.Second))
+			gpu.OverSince = nil
+			gpu.alerted = false
+		}
+	}
+}
+
+// overheated reports whether any GPU has been over the threshold for long
+// enough to raise an alert.
+func (t *thermalMonitor) overheated() bool {
+	for _, gpu := range t.temps {
+		if gpu.alerted {
+			return true
+		}
+	}
+	return false
+}
+
+// readings returns the latest temperature of each GPU in index order.
+func (t *thermalMonitor) readings() []gpuTemperature {
+	readings := make([]gpuTemperature, 0, len(t.temps))
+	for _, gpu := range t.temps {
+		readings = append(readings, *gpu)
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Index < readings[j].Index })
+	return readings
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// processTTY returns the device path of a process's controlling terminal, or
+// an empty string if it has none.
+func processTTY(pid int) (string, error) {
+	fields, err := readStat(pid)
+	if err != nil {
+		return "", err
+	}
+	ttyNr, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return "", err
+	}
+	if ttyNr == 0 {
+		return "", nil
+	}
+
+	// The device number packs the major number into bits 8-15 and the minor
+	// number into bits 0-7 and 20-31
+	major := (ttyNr >> 8) & 0xfff
+	minor := (ttyNr & 0xff) | ((ttyNr >> 12) & 0xfff00)
+	switch {
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("/dev/pts/%d", (major-136)*256+minor), nil
+	case major == 4 && minor < 64:
+		return fmt.Sprintf("/dev/tty%d", minor), nil
+	case major == 4:
+		return fmt.Sprintf("/dev/ttyS%d", minor-64), nil
+	}
+	return "", fmt.Errorf("unrecognised terminal device %d:%d", major, minor)
+}
+
+// ttyLastInput returns when a terminal last received input. The kernel updates
+// a terminal's access time as it's read from, which is also how w(1) works out
+// how long a user has been idle.
+func ttyLastInput(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no access time available for %s", path)
+	}
+	return time.Unix(stat.Atim.Sec, stat.Atim.Nsec), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ownerTerminals returns the terminals a process's owner is logged in on, as
+// listed by who(1), along with the process's own controlling terminal, which
+// covers sessions such as tmux panes that aren't recorded as logins.
+func ownerTerminals(c candidate) []string {
+	seen := make(map[string]bool)
+	if tty, err := processTTY(c.PID); err == nil && tty != "" {
+		seen[tty] = true
+	}
+	if c.Owner != "" {
+		if out, err := exec.Command("who").Output(); err == nil {
+			for _, line := range strings.Split(string(out), "\n") {
+				fields := strings.Fields(line)
+				// X displays such as :0 are listed too, but aren't terminals
+				if len(fields) < 2 || fields[0] != c.Owner || strings.HasPrefix(fields[1], ":") {
+					continue
+				}
+				seen["/dev/"+fields[1]] = true
+			}
+		}
+	}
+
+	ttys := make([]string, 0, len(seen))
+	for tty := range seen {
+		ttys = append(ttys, tty)
+	}
+	sort.Strings(ttys)
+	return ttys
+}
+
+// writeTerminal writes a message to a terminal the way wall(1) does. It's
+// opened non-blocking so a terminal with its output stopped can't hold up the
+// scan.
+func writeTerminal(path, message string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(message)
+	return err
+}
+
+// wallNotice gives a process's owner -wallNotify seconds of notice on their
+// terminals before it's terminated, reporting whether it's due to be
+// terminated yet. The notice is written when the process is first due for
+// termination, and it's terminated on the first scan after the notice period.
+// If the owner can't be reached on any terminal, there's no one to wait for
+// and it's terminated straight away.
+func (m *monitor) wallNotice(c candidate) bool {
+	if m.cfg.WallNotify <= 0 {
+		return true
+	}
+	notice := time.Duration(m.cfg.WallNotify) * time.Second
+	if sent, ok := m.wallNotices[c.PID]; ok {
+		return m.clock.Now().Sub(sent) >= notice
+	}
+
+	message := fmt.Sprintf("\r\n\a*** Message from nvidler on %s at %s ***\r\n\r\nYour process %d (%s) on GPU %s %s. It will be terminated in %d seconds to free the GPU unless it becomes active again.\r\n\r\n",
+		hostname(), m.clock.Now().Format("15:04"), c.PID, c.Name, c.GPUUUID, m.idleDescription(c), m.cfg.WallNotify)
+	var delivered, failed []string
+	for _, tty := range ownerTerminals(c) {
+		if err := writeTerminal(tty, message); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", tty, err))
+			continue
+		}
+		delivered = append(delivered, tty)
+	}
+	if len(failed) > 0 {
+		m.logger.Printf("Failed to notify the owner of PID %d on some terminals: %s\n", c.PID, strings.Join(failed, "; "))
+	}
+	if len(delivered) == 0 {
+		m.logger.Printf("PID %d: no notice delivered, %s isn't logged in on any terminal, terminating it without waiting.\n", c.PID, c.Owner)
+		return true
+	}
+
+	m.wallNotices[c.PID] = m.clock.Now()
+	m.logger.Printf("PID %d: notified %s on %s, terminating it in %d seconds unless it becomes active again.\n", c.PID, c.Owner, strings.Join(delivered, ", "), m.cfg.WallNotify)
+	return false
+}
+
+// withdrawWallNotices forgets the notices given for processes no longer due
+// for termination, so they're given notice afresh if they become due again.
+func (m *monitor) withdrawWallNotices(terminate map[int]bool) {
+	for pid := range m.wallNotices {
+		if terminate[pid] {
+			continue
+		}
+		if _, err := os.Stat(procPath(pid, "stat")); err == nil {
+			m.logger.Printf("PID %d is no longer due for termination, withdrawing its -wallNotify notice.\n", pid)
+		}
+		delete(m.wallNotices, pid)
+	}
+}
+
+// hostname returns the host's name for messages, or "this host" if it can't
+// be found.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "this host"
+	}
+	return name
+}
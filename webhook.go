@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+)
+
+// webhookTemplates are the built-in payload templates, selectable by name with
+// -webhookTemplate.
+var webhookTemplates = map[string]string{
+	"generic": `{{json .}}`,
+	"slack": `{
+  "text": {{json .Message}},
+  "blocks": [
+    {
+      "type": "section",
+      "text": {"type": "mrkdwn", "text": {{json (printf "*nvidler %s on %s*\n%s" .Action hostname .Message)}}}
+    }
+  ]
+}`,
+}
+
+// webhookFuncs are available to payload templates, e.g. {{json .Message}} to
+// safely embed a value in a JSON payload.
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"hostname": func() string {
+		host, _ := os.Hostname()
+		return host
+	},
+}
+
+// webhookQueueSize is how many events are held while the webhook is slow or
+// unreachable.
+const webhookQueueSize = 1000
+
+// webhookSink POSTs events to a URL as JSON, rendered with a text/template that
+// has access to the event's fields. Events are queued and posted one at a time
+// in the background, in the order they were emitted, so a slow or unreachable
+// webhook never holds up a scan.
+type webhookSink struct {
+	url    string
+	tmpl   *template.Template
+	client *http.Client
+	batch  bool // with -batchTerminations
+
+	queue  chan event
+	done   chan struct{} // closed once the queue has been drained after flush
+	logger *log.Logger
+}
+
+// newWebhookSink creates a webhook sink using either a built-in template by
+// name or a template file. The template is checked by rendering a sample event,
+// which must produce valid JSON.
+func newWebhookSink(url, templateSpec string) (*webhookSink, error) {
+	text, ok := webhookTemplates[templateSpec]
+	if !ok {
+		data, err := os.ReadFile(templateSpec)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a built-in template nor a readable file: %v", templateSpec, err)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := template.New("webhook").Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &webhookSink{url: url, tmpl: tmpl, client: &http.Client{Timeout: 10 * time.Second}}
+	sample := event{
+		Time:      time.Now(),
+		Action:    actionTerminate,
+		Message:   "Terminated: Process 1234 (python) in Docker container example has been idle for more than 300 seconds.",
+		PID:       1234,
+		Process:   "python",
+		Container: "example",
+		User:      "example",
+		GPU:       "GPU-00000000-0000-0000-0000-000000000000",
+		Details:   map[string]string{"cmdline": "python train.py"},
+	}
+	payload, err := sink.render(sample)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("template doesn't produce valid JSON, got: %s", payload)
+	}
+	return sink, nil
+}
+
+func (w *webhookSink) render(e event) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := w.tmpl.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// start begins posting queued events, logging any that fail.
+func (w *webhookSink) start(logger *log.Logger) {
+	w.queue = make(chan event, webhookQueueSize)
+	w.done = make(chan struct{})
+	w.logger = logger
+	go w.run()
+}
+
+func (w *webhookSink) send(e event) error {
+	// Terminations are sent either one at a time or together in each scan's
+	// report, not both
+	if e.batched || !w.batch && e.Action == actionReport {
+		return nil
+	}
+	select {
+	case w.queue <- e:
+		return nil
+	default:
+		return errors.New("webhook queue is full, dropping the event")
+	}
+}
+
+// run posts queued events until the queue is closed by flush.
+func (w *webhookSink) run() {
+	defer close(w.done)
+	for e := range w.queue {
+		if err := w.post(e); err != nil {
+			w.logger.Printf("Failed to deliver %s event to the webhook: %v\n", e.Action, err)
+		}
+	}
+}
+
+// flush posts any events still queued and stops, for when nvidler is about to
+// exit. Nothing can be sent afterwards.
+func (w *webhookSink) flush() {
+	close(w.queue)
+	<-w.done
+}
+
+// post renders an event and POSTs it to the webhook.
+func (w *webhookSink) post(e event) error {
+	payload, err := w.render(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookSendDoesNotWaitForDelivery(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		var e event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Errorf("payload %q: %v", body, err)
+		}
+		received <- e
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	sink, err := newWebhookSink(srv.URL, "generic")
+	if err != nil {
+		t.Fatalf("newWebhookSink: %v", err)
+	}
+	var logs syncBuffer
+	sink.start(log.New(&logs, "", 0))
+
+	sent := make(chan struct{})
+	go func() {
+		for _, pid := range []int{1, 2, 3} {
+			if err := sink.send(event{Action: actionWarn, PID: pid}); err != nil {
+				t.Errorf("send: %v", err)
+			}
+		}
+		// With -batchTerminations off, reports aren't sent
+		sink.send(event{Action: actionReport})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked on a webhook that hasn't answered")
+	}
+
+	release <- struct{}{}
+	release <- struct{}{}
+	release <- struct{}{}
+	sink.flush()
+	close(received)
+	var pids []int
+	for e := range received {
+		pids = append(pids, e.PID)
+	}
+	if len(pids) != 3 || pids[0] != 1 || pids[1] != 2 || pids[2] != 3 {
+		t.Fatalf("webhook received PIDs %v, want [1 2 3] in order", pids)
+	}
+	if logs.String() != "" {
+		t.Errorf("logged %q, want no delivery failures", logs.String())
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	// Not started, so nothing drains the queue
+	sink, err := newWebhookSink("http://127.0.0.1:0", "generic")
+	if err != nil {
+		t.Fatalf("newWebhookSink: %v", err)
+	}
+	sink.queue = make(chan event, 1)
+	if err := sink.send(event{Action: actionWarn}); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	if err := sink.send(event{Action: actionWarn}); err == nil {
+		t.Fatal("send to a full queue succeeded, want an error")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// whatIfEntry is a process that would be acted on at a candidate threshold.
+type whatIfEntry struct {
+	PID         int    `json:"pid"`
+	Process     string `json:"process"`
+	User        string `json:"user,omitempty"`
+	Container   string `json:"container,omitempty"`
+	Job         string `json:"job,omitempty"`
+	GPU         string `json:"gpu"`
+	UsedMemory  int    `json:"usedMemory"`
+	IdleSeconds int64  `json:"idleSeconds"`
+	Action      string `json:"action"` // warn, terminate or quarantine
+	Category    string `json:"category,omitempty"`
+}
+
+// whatIfResult is the set of processes that would be acted on at one
+// candidate threshold.
+type whatIfResult struct {
+	ThresholdSeconds int           `json:"thresholdSeconds"`
+	MemoryMB         int           `json:"memoryMB"` // held by the processes that would be terminated or quarantined
+	Processes        []whatIfEntry `json:"processes"`
+}
+
+// parseThresholds parses a list of candidate idle thresholds in seconds, as
+// given to -whatIf, returning them in order.
+func parseThresholds(spec string) ([]int, error) {
+	var thresholds []int
+	for _, item := range splitList(spec) {
+		n, err := strconv.Atoi(item)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid threshold %q, expected a number of seconds above 0", item)
+		}
+		thresholds = append(thresholds, n)
+	}
+	if len(thresholds) == 0 {
+		return nil, fmt.Errorf("no thresholds given")
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+// startPreview begins evaluating the current GPU processes as a scan would,
+// for -preview, -whatIf or their API endpoints, without changing what later
+// scans do: the evaluation isn't counted towards -whitelist usage, -idlePolicy
+// utilization windows or -requireFreshAttribution, doesn't take in
+// -gpuDisableMarkerDir changes, and isn't recorded in the black box. The
+// function returned ends the preview.
+func (m *monitor) startPreview() func() {
+	quiet := m.quiet.clone()
+	m.previewing = true
+	blackBox.pause(true)
+	return func() {
+		*m.quiet = *quiet
+		m.previewing = false
+		blackBox.pause(false)
+	}
+}
+
+// whatIf works out which of the current GPU processes would be acted on at
+// each of the candidate thresholds, in place of the idle threshold in effect,
+// for choosing a threshold from live data. Each threshold is evaluated the
+// same way as a scan, with every other setting as it is, but nothing is acted
+// on, the evaluations aren't logged and later scans are unaffected.
+func (m *monitor) whatIf(thresholds []int) ([]whatIfResult, error) {
+	defer m.startPreview()()
+	if smiXML != nil {
+		smiXML.invalidate()
+	}
+	_, processes, err := queryComputeApps(m.extraFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query GPU processes: %v", err)
+	}
+	if m.cfg.Pmon {
+		m.addPmonValues(processes)
+	}
+	defer func() { m.thresholdOverride = 0 }()
+
+	results := make([]whatIfResult, 0, len(thresholds))
+	for _, threshold := range thresholds {
+		m.thresholdOverride = time.Duration(threshold) * time.Second
+		state := m.newScanState(processes)
+		state.logger = log.New(io.Discard, "", 0)
+
+		var candidates []candidate
+		for _, process := range processes {
+			if c, ok := m.evaluate(process, state); ok && !c.Drain {
+				candidates = append(candidates, c)
+			}
+		}
+		terminate := map[int]bool{}
+		if !m.cfg.WarningOnly && len(candidates) > 0 {
+			terminate = planReclaim(candidates, m.reclaimTargets, m.cfg.ReclaimOrder, state.gpus, state.logger)
+		}
+
+		result := whatIfResult{ThresholdSeconds: threshold, Processes: []whatIfEntry{}}
+		for _, c := range candidates {
+			e := whatIfEntry{
+				PID:         c.PID,
+				Process:     c.Name,
+				User:        c.Owner,
+				Container:   c.Container,
+				Job:         c.Job,
+				GPU:         c.GPUUUID,
+				UsedMemory:  c.UsedMemory,
+				IdleSeconds: int64(c.IdleTime / time.Second),
+				Action:      actionWarn,
+				Category:    c.category(),
+			}
+			if terminate[c.PID] {
+				e.Action = actionTerminate
+				if m.cfg.QuarantineAction != "" {
+					e.Action = actionQuarantine
+				}
+				result.MemoryMB += c.UsedMemory
+			}
+			result.Processes = append(result.Processes, e)
+		}
+		sort.Slice(result.Processes, func(i, j int) bool { return result.Processes[i].IdleSeconds > result.Processes[j].IdleSeconds })
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// writeWhatIfTable writes the processes acted on at each threshold as a human
+// readable table.
+func writeWhatIfTable(w io.Writer, results []whatIfResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "THRESHOLD\tACTION\tPID\tPROCESS\tUSER\tCONTAINER\tJOB\tGPU\tMEMORY\tIDLE")
+	for _, r := range results {
+		threshold := (time.Duration(r.ThresholdSeconds) * time.Second).String()
+		if len(r.Processes) == 0 {
+			fmt.Fprintf(tw, "%s\tnone\t-\t-\t-\t-\t-\t-\t-\t-\n", threshold)
+			continue
+		}
+		for _, e := range r.Processes {
+			action := e.Action
+			if e.Category != "" {
+				action += " (" + e.Category + ")"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%d MB\t%s\n",
+				threshold, action, e.PID, e.Process, orDash(e.User), orDash(e.Container), orDash(e.Job), e.GPU, e.UsedMemory, time.Duration(e.IdleSeconds)*time.Second)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreviewsLeaveScansUnaffected(t *testing.T) {
+	e := newTestEnv(t)
+	e.addProcess(fakeProcess{PID: 1001, PPID: 1, Comm: "python", Start: testEpoch.Add(-time.Hour)})
+	e.addProcess(fakeProcess{PID: 1002, PPID: 1, Comm: "notebook", Start: testEpoch.Add(-time.Hour)})
+	e.gpuProcesses("1001, 0", "1002, 0")
+	e.smi("--query-gpu=uuid,utilization.gpu", testGPU+", 2\n")
+	markers := filepath.Join(e.dir, "markers")
+	if err := os.MkdirAll(markers, 0755); err != nil {
+		t.Fatal(err)
+	}
+	e.write(filepath.Join(markers, "3"), "")
+	recorder := blackBox
+	blackBox = newDiagRecorder(5, t.TempDir(), 1, e.clock, log.New(io.Discard, "", 0))
+	t.Cleanup(func() { blackBox = recorder })
+	blackBox.begin()
+
+	cfg := e.config()
+	cfg.WarningOnly = false
+	cfg.TargetWorkloads = []string{"python", "notebook"}
+	cfg.Whitelist = []string{"notebook"}
+	cfg.ExtraQueryFields = "util=gpu:utilization.gpu"
+	cfg.IdlePolicy = `{"utilizationBelow": 5, "utilizationField": "util", "utilizationWindow": 60}`
+	cfg.GPUDisableMarkerDir = markers
+	m := e.monitor(cfg, newFakeDocker(t).daemon())
+
+	if _, err := m.preview(); err != nil {
+		t.Fatalf("preview: %v", err)
+	}
+	if _, err := m.whatIf([]int{60, 600}); err != nil {
+		t.Fatalf("whatIf: %v", err)
+	}
+	if len(m.whitelistUsage.matches) != 0 {
+		t.Errorf("-whitelist usage after previews = %v, want nothing counted", m.whitelistUsage.matches)
+	}
+	if len(m.quiet.since) != 0 {
+		t.Errorf("utilization windows after previews = %v, want none started", m.quiet.since)
+	}
+	if m.disabledGPUs != nil || strings.Contains(e.log.String(), "disabled by a marker") {
+		t.Errorf("disabled GPUs after previews = %v, want the marker left for the next scan to take in:\n%s", m.disabledGPUs, e.log.String())
+	}
+	if !m.containersListed.IsZero() {
+		t.Errorf("containers last listed at %v by previews, want never", m.containersListed)
+	}
+	if commands := blackBox.cycles[0].Commands; len(commands) != 0 {
+		t.Errorf("black box recorded %d nvidia-smi runs from previews, want none", len(commands))
+	}
+
+	// The utilization window starts with the first scan, not the previews
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	if got := e.signals(); got != nil {
+		t.Fatalf("signalled %v on the first scan after previews, want the utilization window only starting then", got)
+	}
+	if m.disabledGPUs == nil || !strings.Contains(e.log.String(), "GPU 3 disabled by a marker") {
+		t.Errorf("the scan didn't take in the marker:\n%s", e.log.String())
+	}
+	e.clock.Sleep(time.Minute)
+	m.scan()
+	if got, want := e.signals(), []string{"-s TERM 1001"}; !equalStrings(got, want) {
+		t.Fatalf("signals once the window passed = %v, want %v", got, want)
+	}
+}
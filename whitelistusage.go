@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// whitelistUsage counts how many times each -whitelist entry has matched a
+// process or container, so entries that never match, most likely because of a
+// wrong name, can be pointed out.
+type whitelistUsage struct {
+	clock      clock
+	started    time.Time
+	lastWarned time.Time
+	matches    map[string]int
+}
+
+func newWhitelistUsage(clk clock) *whitelistUsage {
+	return &whitelistUsage{clock: clk, started: clk.Now(), lastWarned: clk.Now(), matches: make(map[string]int)}
+}
+
+// record counts the entries matching a process's name or executable, its
+// container or its container's Compose project/service.
+func (w *whitelistUsage) record(entries []string, name, exe, container, compose string) {
+	for _, entry := range entries {
+		if matched, _ := matchProcess([]string{entry}, name, exe); matched != "" || (container != "" && entry == container) || (compose != "" && entry == compose) {
+			w.matches[entry]++
+		}
+	}
+}
+
+// counts returns the number of matches of each entry.
+func (w *whitelistUsage) counts(entries []string) map[string]int {
+	counts := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		counts[entry] = w.matches[entry]
+	}
+	return counts
+}
+
+// warnUnused logs the entries that have never matched, once every interval.
+func (w *whitelistUsage) warnUnused(entries []string, interval time.Duration, logger *log.Logger) {
+	now := w.clock.Now()
+	if interval <= 0 || now.Sub(w.lastWarned) < interval {
+		return
+	}
+	w.lastWarned = now
+
+	var unused []string
+	for _, entry := range entries {
+		if w.matches[entry] == 0 {
+			unused = append(unused, entry)
+		}
+	}
+	if len(unused) > 0 {
+		logger.Printf("WARNING: -whitelist entries %s haven't matched any process or container in %v, check they're spelled correctly.\n", strings.Join(unused, ", "), now.Sub(w.started).Round(time.Second))
+	}
+}